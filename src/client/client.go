@@ -3,25 +3,31 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
 	"runtime"
 	"sync"
+	"syscall"
 	"time"
 
+	"pineapple/src/config"
 	"pineapple/src/genericsmrproto"
+	"pineapple/src/history"
 	"pineapple/src/poisson"
+	"pineapple/src/replycheck"
 	"pineapple/src/state"
 	"pineapple/src/zipfian"
 
 	"golang.org/x/sync/semaphore"
 )
 
-var leaderAddr *string = flag.String("laddr", "10.10.1.2", "Leader address. Defaults to 10.10.1.2")
+var leaderAddr *string = flag.String("laddr", "", "Leader address. Optional: without it RMWs go to the server, which redirects them to the leader.")
 var leaderPort *int = flag.Int("lport", 7070, "Leader port.")
 var serverAddr *string = flag.String("saddr", "", "Server address.")
 var serverPort *int = flag.Int("sport", 7070, "Server port.")
@@ -44,6 +50,11 @@ var singleClusterTest = flag.Bool("singleClusterTest", true, "True if clients ru
 var rampDown *int = flag.Int("rampDown", 5, "Length of the cool-down period after statistics are measured (in seconds).")
 var rampUp *int = flag.Int("rampUp", 5, "Length of the warm-up period before statistics are measured (in seconds).")
 var timeout *int = flag.Int("timeout", 180, "Length of the timeout used when running the client")
+var percentReadMsgs = flag.Float64("readmsgs", 0, "A float between 0 and 1 that corresponds to the percentage of reads that should be sent as READ messages instead of GET proposals.")
+var percentProposeAndRead = flag.Float64("par", 0, "A float between 0 and 1 that corresponds to the percentage of writes and RMWs that should be sent as PROPOSE_AND_READ, which also returns the value of the next key.")
+var rmwOp = flag.String("rmwop", "rmw", "RMW operator: rmw (increment), faa, cas, swap, max, min or cset.")
+var configFile = flag.String("config", "", "Cluster config file. Replaces -saddr, -sport, -laddr and -lport: the client talks to replica -serverID, and sends RMWs to the preferred leader.")
+var historyFile = flag.String("history", "", "Log every request and reply to this file, for lincheck. It is written out when the client is interrupted or terminated.")
 
 // Information about the latency of an operation
 type response struct {
@@ -61,11 +72,49 @@ type outstandingRequestInfo struct {
 	sema       *semaphore.Weighted // Controls number of outstanding operations
 	startTimes map[int32]time.Time // The time at which operations were sent out
 	operation  map[int32]state.Operation
+	commands   map[int32]state.Command // The command issued by each operation
+	msgTypes   map[int32]uint8         // The message type each operation was sent as
+	checker    *replycheck.Checker     // Checks replies against those seen before
+	client     int                     // Index of the client thread, in the history
+	leader     *leaderConn             // Where RMWs and PROPOSE_AND_READs go
+}
+
+// The connection of a client thread to the leader. It is opened with -laddr, or once a
+// replica answers NOT_LEADER, and written to by the thread's writer and readers.
+type leaderConn struct {
+	sync.Mutex
+	id     int            // replica id, -1 if unknown
+	conn   net.Conn       // nil while RMWs go to the server
+	writer *bufio.Writer  // nil while RMWs go to the server
+	sent   map[int32]bool // requests sent on conn that were not answered yet
 }
 
 // An outstandingRequestInfo per client thread
 var orInfos []*outstandingRequestInfo
 
+// The RMW operation selected with -rmwop
+var rmwOperation state.Operation
+
+// Where requests and replies are logged with -history
+var historyLog *history.Logger
+
+// Preferred leader from the config file, -1 without one
+var leaderID = -1
+
+// Takes the addresses of replica -serverID and of the preferred leader from the config file
+func applyConfig() {
+	cluster, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *serverID < 0 || *serverID >= len(cluster.Replicas) {
+		log.Fatalf("-serverID must be a replica id from %s, 0 to %d\n", *configFile, len(cluster.Replicas)-1)
+	}
+	leaderID = cluster.Leaders[0]
+	*serverAddr, *serverPort, _ = config.SplitAddr(cluster.Replicas[*serverID].Client)
+	*leaderAddr, *leaderPort, _ = config.SplitAddr(cluster.Replicas[leaderID].Client)
+}
+
 func main() {
 	flag.Parse()
 
@@ -74,6 +123,20 @@ func main() {
 	if *conflicts > 100 {
 		log.Fatalf("Conflicts percentage must be between 0 and 100.\n")
 	}
+	rmwOperation = parseRMWOp(*rmwOp)
+	if *configFile != "" {
+		applyConfig()
+	}
+
+	if *historyFile != "" {
+		var err error
+		if historyLog, err = history.NewLogger(*historyFile); err != nil {
+			log.Fatal(err)
+		}
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go closeHistory(interrupt)
+	}
 
 	orInfos = make([]*outstandingRequestInfo, *T)
 
@@ -91,30 +154,29 @@ func main() {
 		}
 
 		reader := bufio.NewReader(server)
+		if _, err := genericsmrproto.Handshake(server, reader, genericsmrproto.NewHello(genericsmrproto.ROLE_CLIENT, -1)); err != nil {
+			log.Fatalf("Replica %s:%d refused the connection: %v\n", *serverAddr, *serverPort, err)
+		}
 		writer := bufio.NewWriter(server)
 
 		orInfo := &outstandingRequestInfo{
 			sync.Mutex{},
 			semaphore.NewWeighted(*outstandingReqs),
 			make(map[int32]time.Time, *outstandingReqs),
-			make(map[int32]state.Operation, *outstandingReqs)}
-
-		if *serverID != 0 && *percentRMWs != 0 { // not already connected to leader
-			leader, err := net.Dial("tcp", fmt.Sprintf("%s:%d", *leaderAddr, *leaderPort))
-			if err != nil {
-				log.Fatalf("Error connecting to replica %s:%d\n", *leaderAddr, *leaderPort)
+			make(map[int32]state.Operation, *outstandingReqs),
+			make(map[int32]state.Command, *outstandingReqs),
+			make(map[int32]uint8, *outstandingReqs),
+			replycheck.New(),
+			i,
+			&leaderConn{id: -1}}
+
+		if *leaderAddr != "" && *serverID != leaderID && (*percentRMWs != 0 || *percentProposeAndRead != 0) { // not already connected to leader
+			if err := connectLeader(orInfo, fmt.Sprintf("%s:%d", *leaderAddr, *leaderPort), leaderID, readings); err != nil {
+				log.Fatal(err)
 			}
-
-			lReader := bufio.NewReader(leader)
-			lWriter := bufio.NewWriter(leader)
-
-			go simulatedClientWriter(writer, lWriter /* leader writer*/, orInfo, *serverID)
-			go simulatedClientReader(lReader, orInfo, readings, *serverID)
-			go simulatedClientReader(reader, orInfo, readings, *serverID)
-		} else {
-			go simulatedClientWriter(writer, nil /* leader writer*/, orInfo, *serverID)
-			go simulatedClientReader(reader, orInfo, readings, *serverID)
 		}
+		go simulatedClientWriter(writer, orInfo)
+		go simulatedClientReader(reader, orInfo, readings, *serverID)
 
 		orInfos[i] = orInfo
 	}
@@ -125,7 +187,74 @@ func main() {
 	}
 }
 
-func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, orInfo *outstandingRequestInfo, serverID int) {
+// Opens the connection of a client thread to the leader, and reads the replies that come
+// back on it. Must be called with orInfo.leader locked.
+func connectLeader(orInfo *outstandingRequestInfo, addr string, id int, readings chan *response) error {
+	leader, err := net.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot connect to replica %s: %v", addr, err)
+	}
+	lReader := bufio.NewReader(leader)
+	if _, err := genericsmrproto.Handshake(leader, lReader, genericsmrproto.NewHello(genericsmrproto.ROLE_CLIENT, -1)); err != nil {
+		leader.Close()
+		return fmt.Errorf("replica %s refused the connection: %v", addr, err)
+	}
+	if orInfo.leader.conn != nil {
+		// stops the reader of the previous leader, whose replies are lost with it
+		orInfo.leader.conn.Close()
+		failSent(orInfo)
+	}
+	orInfo.leader.id = id
+	orInfo.leader.conn = leader
+	orInfo.leader.writer = bufio.NewWriter(leader)
+	orInfo.leader.sent = make(map[int32]bool)
+	go simulatedClientReader(lReader, orInfo, readings, *serverID)
+	return nil
+}
+
+// Gives up on the requests sent to a leader whose connection is closed. They may or may
+// not have taken effect. Must be called with orInfo.leader locked.
+func failSent(orInfo *outstandingRequestInfo) {
+	for id := range orInfo.leader.sent {
+		orInfo.Lock()
+		answered := !orInfo.forget(id)
+		orInfo.Unlock()
+		if answered {
+			continue
+		}
+		log.Println("Request failed:", id)
+		logReturn(orInfo, &genericsmrproto.ProposeReplyTS{CommandId: id}, genericsmrproto.PROPOSE_REPLY, false)
+		orInfo.sema.Release(1)
+	}
+}
+
+// Sends a request that a replica answered with NOT_LEADER again, to the leader it named,
+// where RMWs go from then on. Returns false if the leader is unknown or unreachable.
+func redirect(orInfo *outstandingRequestInfo, notLeader *genericsmrproto.NotLeader, readings chan *response) bool {
+	if notLeader.LeaderId < 0 {
+		return false
+	}
+	orInfo.leader.Lock()
+	defer orInfo.leader.Unlock()
+	delete(orInfo.leader.sent, notLeader.CommandId) // sent again below
+	if orInfo.leader.writer == nil || orInfo.leader.id != int(notLeader.LeaderId) {
+		if err := connectLeader(orInfo, string(notLeader.LeaderAddr), int(notLeader.LeaderId), readings); err != nil {
+			log.Println(err)
+			return false
+		}
+		log.Printf("Redirected to replica %d at %s for RMWs\n", notLeader.LeaderId, notLeader.LeaderAddr)
+	}
+
+	orInfo.Lock()
+	args := genericsmrproto.Propose{CommandId: notLeader.CommandId, Command: orInfo.commands[notLeader.CommandId]}
+	msgType := orInfo.msgTypes[notLeader.CommandId]
+	orInfo.Unlock()
+	orInfo.leader.sent[notLeader.CommandId] = true
+	sendRequest(orInfo.leader.writer, msgType, &args)
+	return true
+}
+
+func simulatedClientWriter(writer *bufio.Writer, orInfo *outstandingRequestInfo) {
 	args := genericsmrproto.Propose{
 		CommandId: 0,
 		Command:   state.Command{Op: state.PUT, K: 0, V: 1},
@@ -141,6 +270,7 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, orIn
 
 	for id := int32(0); ; id++ {
 		args.CommandId = id
+		args.Command.V = state.Value(id + 1)
 
 		// Determine key
 		if *conflicts >= 0 {
@@ -165,7 +295,8 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, orIn
 					//args.Command.Op = state.PUT_BLIND
 				}
 			} else if *percentRMWs > 0 {
-				args.Command.Op = state.RMW // RMW operation
+				args.Command.Op = rmwOperation // RMW operation
+				args.Command.E = expectedValue(orInfo, args.Command.K)
 			}
 		} else {
 			args.Command.Op = state.GET // read operation
@@ -188,47 +319,77 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, orIn
 			}
 		}
 
+		// recorded before sending, so that the reply can always be checked
+		orInfo.Lock()
+		orInfo.operation[id] = args.Command.Op
+		msgType := requestType(args.Command.Op, opRand)
+		orInfo.commands[id] = args.Command
+		orInfo.msgTypes[id] = msgType
+		orInfo.Unlock()
+		if historyLog != nil {
+			historyLog.Invoke(orInfo.client, id, args.Command)
+		}
+
 		before := time.Now()
-		if args.Command.Op == state.RMW && serverID != 0 { // send RMWs to leader
-			otherWriter.WriteByte(genericsmrproto.PROPOSE)
-			args.Marshal(otherWriter)
-			otherWriter.Flush()
+		if state.IsRMW(args.Command.Op) || msgType == genericsmrproto.PROPOSE_AND_READ {
+			// send RMWs and PROPOSE_AND_READs to leader, once we know it
+			orInfo.leader.Lock()
+			if orInfo.leader.writer != nil {
+				orInfo.leader.sent[id] = true
+				sendRequest(orInfo.leader.writer, msgType, &args)
+			} else {
+				sendRequest(writer, msgType, &args)
+			}
+			orInfo.leader.Unlock()
 		} else {
-			writer.WriteByte(genericsmrproto.PROPOSE)
-			args.Marshal(writer)
-			writer.Flush()
+			sendRequest(writer, msgType, &args)
 		}
 
 		orInfo.Lock()
-		orInfo.operation[id] = args.Command.Op
 		orInfo.startTimes[id] = before
 		orInfo.Unlock()
 	}
 }
 
 func simulatedClientReader(reader *bufio.Reader, orInfo *outstandingRequestInfo, readings chan *response, leader int) {
-	var reply genericsmrproto.ProposeReplyTS
-
 	for {
-		if err := reply.Unmarshal(reader); err != nil || reply.OK == 0 {
-			if err != nil {
-				log.Println("Error during unmarshaling:", err)
-			} else if reply.OK == 0 {
-				log.Println("reply.OK is 0")
-			}
-			log.Println(reply.OK)
-			log.Println(reply.CommandId)
+		msgType, reply, notLeader, err := genericsmrproto.ReadClientReplyOrRedirect(reader)
+		if errors.Is(err, net.ErrClosed) {
+			return // a redirect replaced this leader connection
+		}
+		if err != nil {
+			log.Println("Error during unmarshaling:", err)
 			break
 		}
+		if notLeader != nil && redirect(orInfo, notLeader, readings) {
+			continue
+		}
+		orInfo.leader.Lock()
+		delete(orInfo.leader.sent, reply.CommandId)
+		orInfo.leader.Unlock()
 
 		after := time.Now()
-		orInfo.sema.Release(1)
-
 		orInfo.Lock()
 		before := orInfo.startTimes[reply.CommandId]
 		operation := orInfo.operation[reply.CommandId]
-		delete(orInfo.startTimes, reply.CommandId)
+		cmd := orInfo.commands[reply.CommandId]
+		if !orInfo.forget(reply.CommandId) {
+			orInfo.Unlock()
+			continue // already given up on with the connection it was sent on
+		}
+		ok := reply.OK == genericsmrproto.REPLY_OK
+		if ok && msgType != genericsmrproto.PROPOSE_AND_READ_REPLY {
+			// the value of a PROPOSE_AND_READ belongs to another key and has no tag to check
+			orInfo.checker.Check(cmd, reply, before, after)
+		}
 		orInfo.Unlock()
+		logReturn(orInfo, reply, msgType, ok)
+		orInfo.sema.Release(1)
+		if !ok {
+			// the replica gave up on the request, move on to the next one
+			logFailure(reply)
+			continue
+		}
 
 		rtt := (after.Sub(before)).Seconds() * 1000
 		//commitToExec := float64(reply.Timestamp) / 1e6
@@ -244,6 +405,103 @@ func simulatedClientReader(reader *bufio.Reader, orInfo *outstandingRequestInfo,
 	}
 }
 
+// Sends args as a message of type msgType. PROPOSE_AND_READ also reads the key after
+// the one args writes, and READ only uses the key.
+func sendRequest(writer *bufio.Writer, msgType uint8, args *genericsmrproto.Propose) {
+	switch msgType {
+	case genericsmrproto.READ:
+		read := genericsmrproto.Read{CommandId: args.CommandId, Key: args.Command.K}
+		genericsmrproto.WriteFrame(writer, msgType, &read, false)
+	case genericsmrproto.PROPOSE_AND_READ:
+		pr := genericsmrproto.ProposeAndRead{CommandId: args.CommandId, Command: args.Command, Key: args.Command.K + 1}
+		genericsmrproto.WriteFrame(writer, msgType, &pr, false)
+	default:
+		genericsmrproto.WriteFrame(writer, msgType, args, false)
+	}
+	writer.Flush()
+}
+
+// Picks the message type for a command according to -readmsgs and -par
+func requestType(op state.Operation, r *rand.Rand) uint8 {
+	if op == state.GET {
+		if r.Float64() < *percentReadMsgs {
+			return genericsmrproto.READ
+		}
+	} else if r.Float64() < *percentProposeAndRead {
+		return genericsmrproto.PROPOSE_AND_READ
+	}
+	return genericsmrproto.PROPOSE
+}
+
+// Forgets an outstanding request once it is answered. Returns false if it was already.
+// Must be called with orInfo locked.
+func (orInfo *outstandingRequestInfo) forget(id int32) bool {
+	if _, present := orInfo.commands[id]; !present {
+		return false
+	}
+	delete(orInfo.startTimes, id)
+	delete(orInfo.operation, id)
+	delete(orInfo.commands, id)
+	delete(orInfo.msgTypes, id)
+	return true
+}
+
+// Logs a reply to the history, if there is one. The value in a PROPOSE_AND_READ reply is
+// that of another key.
+func logReturn(orInfo *outstandingRequestInfo, reply *genericsmrproto.ProposeReplyTS, msgType uint8, ok bool) {
+	if historyLog != nil {
+		historyLog.Return(orInfo.client, reply.CommandId, ok, msgType != genericsmrproto.PROPOSE_AND_READ_REPLY,
+			reply.Value, reply.Previous, reply.TagTimestamp, reply.TagID, reply.TagRMWCount)
+	}
+}
+
+// Logs a request the replica gave up on, and whether it may still take effect
+func logFailure(reply *genericsmrproto.ProposeReplyTS) {
+	if reply.OK == genericsmrproto.REPLY_UNKNOWN {
+		log.Println("Request outcome unknown:", reply.CommandId)
+	} else {
+		log.Println("Request failed:", reply.CommandId)
+	}
+}
+
+// Writes out the history when the client is stopped
+func closeHistory(interrupt chan os.Signal) {
+	<-interrupt
+	if err := historyLog.Close(); err != nil {
+		log.Println("Error writing the history:", err)
+	}
+	os.Exit(0)
+}
+
+// Maps the -rmwop flag to the RMW operation sent to the replicas
+func parseRMWOp(name string) state.Operation {
+	switch name {
+	case "rmw":
+		return state.RMW
+	case "faa":
+		return state.FETCH_ADD
+	case "cas":
+		return state.COMPARE_SWAP
+	case "swap":
+		return state.SWAP
+	case "max":
+		return state.FETCH_MAX
+	case "min":
+		return state.FETCH_MIN
+	case "cset":
+		return state.COND_SET
+	}
+	log.Fatalf("Unknown RMW operator %s\n", name)
+	return state.NONE
+}
+
+// The expected value of a compare-and-swap is the last value this thread observed for the key
+func expectedValue(orInfo *outstandingRequestInfo, key state.Key) state.Value {
+	orInfo.Lock()
+	defer orInfo.Unlock()
+	return orInfo.checker.Latest(key)
+}
+
 func printer(readings chan *response) {
 	lattputFile, err := os.Create("lattput.txt")
 	if err != nil {
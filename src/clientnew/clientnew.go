@@ -9,19 +9,24 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
 	"runtime"
 	"sync"
+	"syscall"
 	"time"
 
+	"pineapple/src/config"
 	"pineapple/src/genericsmrproto"
+	"pineapple/src/history"
 	"pineapple/src/poisson"
+	"pineapple/src/replycheck"
 	"pineapple/src/state"
 	"pineapple/src/zipfian"
 
 	"golang.org/x/sync/semaphore"
 )
 
-var leaderAddr *string = flag.String("laddr", "10.10.1.2", "Leader address. Defaults to 10.10.1.2")
+var leaderAddr *string = flag.String("laddr", "", "Leader address. Optional: without it RMWs go to the server, which redirects them to the leader.")
 var leaderPort *int = flag.Int("lport", 7070, "Leader port.")
 var serverAddr *string = flag.String("saddr", "", "Server address.")
 var serverPort *int = flag.Int("sport", 7070, "Server port.")
@@ -43,6 +48,11 @@ var singleClusterTest = flag.Bool("singleClusterTest", true, "True if clients ru
 var rampDown *int = flag.Int("rampDown", 5, "Length of the cool-down period after statistics are measured (in seconds).")
 var rampUp *int = flag.Int("rampUp", 5, "Length of the warm-up period before statistics are measured (in seconds).")
 var timeout *int = flag.Int("timeout", 180, "Length of the timeout used when running the client")
+var percentReadMsgs = flag.Float64("readmsgs", 0, "A float between 0 and 1 that corresponds to the percentage of reads that should be sent as READ messages instead of GET proposals.")
+var percentProposeAndRead = flag.Float64("par", 0, "A float between 0 and 1 that corresponds to the percentage of writes and RMWs that should be sent as PROPOSE_AND_READ, which also returns the value of the next key.")
+var rmwOp = flag.String("rmwop", "rmw", "RMW operator: rmw (increment), faa, cas, swap, max, min or cset.")
+var configFile = flag.String("config", "", "Cluster config file. Replaces -saddr, -sport, -laddr and -lport: the client talks to replica -serverID, and sends RMWs to the preferred leader.")
+var historyFile = flag.String("history", "", "Log every request and reply to this file, for lincheck. It is written out when the client is interrupted or terminated.")
 
 // Information about the latency of an operation
 type response struct {
@@ -60,14 +70,26 @@ type outstandingRequestInfo struct {
 	sema        *semaphore.Weighted // Controls number of outstanding operations
 	startTimes  map[int32]time.Time // The time at which operations were sent out
 	operation   map[int32]state.Operation
-	tasBatch    map[int32]int32     // tasBatch id of the request
-	maxLat      map[int32][]float64 // max latency of the tail at scale requests
-	tasRecevied map[int32]int       // how many of the tas requests have been received
+	tasBatch    map[int32]int32         // tasBatch id of the request
+	maxLat      map[int32][]float64     // max latency of the tail at scale requests
+	tasRecevied map[int32]int           // how many of the tas requests have been received
+	commands    map[int32]state.Command // The command issued by each operation
+	checker     *replycheck.Checker     // Checks replies against those seen before
+	client      int                     // Index of the client thread, in the history
 }
 
 // An outstandingRequestInfo per client thread
 var orInfos []*outstandingRequestInfo
 
+// The RMW operation selected with -rmwop
+var rmwOperation state.Operation
+
+// Where requests and replies are logged with -history
+var historyLog *history.Logger
+
+// Preferred leader from the config file, -1 without one
+var leaderID = -1
+
 func Max(a float64, b float64) float64 {
 	if a > b {
 		return a
@@ -76,6 +98,20 @@ func Max(a float64, b float64) float64 {
 	}
 }
 
+// Takes the addresses of replica -serverID and of the preferred leader from the config file
+func applyConfig() {
+	cluster, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *serverID < 0 || *serverID >= len(cluster.Replicas) {
+		log.Fatalf("-serverID must be a replica id from %s, 0 to %d\n", *configFile, len(cluster.Replicas)-1)
+	}
+	leaderID = cluster.Leaders[0]
+	*serverAddr, *serverPort, _ = config.SplitAddr(cluster.Replicas[*serverID].Client)
+	*leaderAddr, *leaderPort, _ = config.SplitAddr(cluster.Replicas[leaderID].Client)
+}
+
 func main() {
 	flag.Parse()
 
@@ -84,6 +120,20 @@ func main() {
 	if *conflicts > 100 {
 		log.Fatalf("Conflicts percentage must be between 0 and 100.\n")
 	}
+	rmwOperation = parseRMWOp(*rmwOp)
+	if *configFile != "" {
+		applyConfig()
+	}
+
+	if *historyFile != "" {
+		var err error
+		if historyLog, err = history.NewLogger(*historyFile); err != nil {
+			log.Fatal(err)
+		}
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go closeHistory(interrupt)
+	}
 
 	orInfos = make([]*outstandingRequestInfo, *T)
 
@@ -101,6 +151,9 @@ func main() {
 		}
 
 		reader := bufio.NewReader(server)
+		if _, err := genericsmrproto.Handshake(server, reader, genericsmrproto.NewHello(genericsmrproto.ROLE_CLIENT, -1)); err != nil {
+			log.Fatalf("Replica %s:%d refused the connection: %v\n", *serverAddr, *serverPort, err)
+		}
 		writer := bufio.NewWriter(server)
 
 		// TODO: init maps
@@ -113,22 +166,20 @@ func main() {
 			make(map[int32]int32),
 			make(map[int32][]float64),
 			make(map[int32]int),
+			make(map[int32]state.Command, *outstandingReqs),
+			replycheck.New(),
+			i,
 		}
 
-		if *serverID != 0 && *percentRMWs != 0 { // not already connected to leader
-			leader, err := net.Dial("tcp", fmt.Sprintf("%s:%d", *leaderAddr, *leaderPort))
+		if *leaderAddr != "" && *serverID != leaderID && (*percentRMWs != 0 || *percentProposeAndRead != 0) { // not already connected to leader
+			leader, err := dialLeader(fmt.Sprintf("%s:%d", *leaderAddr, *leaderPort))
 			if err != nil {
-				log.Fatalf("Error connecting to replica %s:%d\n", *leaderAddr, *leaderPort)
+				log.Fatal(err)
 			}
-
-			lReader := bufio.NewReader(leader)
-			lWriter := bufio.NewWriter(leader)
-
-			go simulatedClientWriter(writer, lWriter, /* leader writer*/
-				reader, lReader /* leader reader */, orInfo, readings, *serverID)
+			go simulatedClientWriter(writer, reader, leader, orInfo, readings, *serverID)
 		} else {
-			go simulatedClientWriter(writer, nil, /* leader writer*/
-				reader, nil /* leader reader */, orInfo, readings, *serverID)
+			// RMWs go to the server until it redirects them
+			go simulatedClientWriter(writer, reader, nil, orInfo, readings, *serverID)
 		}
 
 		//waitTime := startTime.Intn(3)
@@ -143,8 +194,31 @@ func main() {
 	}
 }
 
-func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, reader *bufio.Reader,
-	otherReader *bufio.Reader, orInfo *outstandingRequestInfo, readings chan *response, serverID int) {
+// The connection of a client thread to the leader
+type leaderConn struct {
+	conn   net.Conn
+	writer *bufio.Writer
+	reader *bufio.Reader
+}
+
+// Connects to the leader, for RMWs and PROPOSE_AND_READs
+func dialLeader(addr string) (*leaderConn, error) {
+	leader, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to replica %s: %v", addr, err)
+	}
+	lReader := bufio.NewReader(leader)
+	if _, err := genericsmrproto.Handshake(leader, lReader, genericsmrproto.NewHello(genericsmrproto.ROLE_CLIENT, -1)); err != nil {
+		leader.Close()
+		return nil, fmt.Errorf("replica %s refused the connection: %v", addr, err)
+	}
+	return &leaderConn{leader, bufio.NewWriter(leader), lReader}, nil
+}
+
+// Sends requests and reads their replies. RMWs and PROPOSE_AND_READs go to leader, nil
+// until a replica names it.
+func simulatedClientWriter(writer *bufio.Writer, reader *bufio.Reader, leader *leaderConn,
+	orInfo *outstandingRequestInfo, readings chan *response, serverID int) {
 	args := genericsmrproto.Propose{
 		CommandId: 0,
 		Command:   state.Command{Op: state.PUT, K: 0, V: 1},
@@ -168,6 +242,7 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, read
 		for i := 0; i < coalescedOps; i++ {
 			id += int32(i)
 			args.CommandId = id
+			args.Command.V = state.Value(id + 1)
 
 			// Determine key
 			if *conflicts >= 0 {
@@ -192,7 +267,8 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, read
 						//args.Command.Op = state.PUT_BLIND
 					}
 				} else if *percentRMWs > 0 {
-					args.Command.Op = state.RMW // RMW operation
+					args.Command.Op = rmwOperation // RMW operation
+					args.Command.E = expectedValue(orInfo, args.Command.K)
 				}
 			} else {
 				args.Command.Op = state.GET // read operation
@@ -215,62 +291,89 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, read
 				}
 			}
 
+			msgType := requestType(args.Command.Op, opRand)
+
+			if historyLog != nil {
+				historyLog.Invoke(orInfo.client, id, args.Command)
+			}
 			before := time.Now()
-			useLeader := args.Command.Op == state.RMW && serverID != 0
-			if useLeader { // send RMWs to leader
-				otherWriter.WriteByte(genericsmrproto.PROPOSE)
-				args.Marshal(otherWriter)
-				otherWriter.Flush()
+			useLeader := (state.IsRMW(args.Command.Op) || msgType == genericsmrproto.PROPOSE_AND_READ) && leader != nil
+			if useLeader { // send RMWs and PROPOSE_AND_READs to leader
+				sendRequest(leader.writer, msgType, &args)
 				//} else if args.Command.Op == state.GET && serverID == 0 { // send leader's reads to VA
 				//	otherWriter.WriteByte(genericsmrproto.PROPOSE)
 				//	args.Marshal(otherWriter)
 				//	otherWriter.Flush()
 				//}
 			} else {
-				writer.WriteByte(genericsmrproto.PROPOSE)
-				args.Marshal(writer)
-				writer.Flush()
+				sendRequest(writer, msgType, &args)
 			}
 
 			orInfo.Lock()
 			orInfo.operation[id] = args.Command.Op
 			orInfo.startTimes[id] = before
 			orInfo.tasBatch[id] = tasBatch
+			orInfo.commands[id] = args.Command
 			orInfo.Unlock()
 
 			//
 			// reader logic
 			//
-			var reply genericsmrproto.ProposeReplyTS
-
 			for {
+				var replyType uint8
+				var reply *genericsmrproto.ProposeReplyTS
+				var notLeader *genericsmrproto.NotLeader
 				var err error
 				if useLeader { // read response from leader
-					err = reply.Unmarshal(otherReader)
+					replyType, reply, notLeader, err = genericsmrproto.ReadClientReplyOrRedirect(leader.reader)
 				} else {
-					err = reply.Unmarshal(reader)
+					replyType, reply, notLeader, err = genericsmrproto.ReadClientReplyOrRedirect(reader)
 				}
-				if err != nil || reply.OK == 0 {
-					if err != nil {
-						log.Println("Error during unmarshaling:", err)
-					} else if reply.OK == 0 {
-						log.Println("reply.OK is 0")
+				if err != nil {
+					log.Println("Error during unmarshaling:", err)
+					break
+				}
+				if notLeader != nil && notLeader.LeaderId >= 0 {
+					// send it again to the leader, and the RMWs after it too
+					newLeader, err := dialLeader(string(notLeader.LeaderAddr))
+					if err == nil {
+						log.Printf("Redirected to replica %d at %s for RMWs\n", notLeader.LeaderId, notLeader.LeaderAddr)
+						if leader != nil {
+							leader.conn.Close()
+						}
+						leader = newLeader
+						useLeader = true
+						sendRequest(leader.writer, msgType, &args)
+						continue
 					}
-					log.Println(reply.OK)
-					log.Println(reply.CommandId)
+					log.Println(err)
+				}
+				if reply.OK != genericsmrproto.REPLY_OK {
+					// the replica gave up on the request, move on to the next one
+					logFailure(reply)
+					logReturn(orInfo, reply, replyType, false)
+					orInfo.sema.Release(1)
+					orInfo.Lock()
+					orInfo.forget(reply.CommandId)
+					orInfo.Unlock()
 					break
 				}
 
 				after := time.Now()
+				logReturn(orInfo, reply, replyType, true)
 				orInfo.sema.Release(1)
 
 				orInfo.Lock()
 				start := orInfo.startTimes[reply.CommandId]
 				operation := orInfo.operation[reply.CommandId]
 				rtt := (after.Sub(start)).Seconds() * 1000
-				delete(orInfo.startTimes, reply.CommandId)
+				if replyType != genericsmrproto.PROPOSE_AND_READ_REPLY {
+					// the value of a PROPOSE_AND_READ belongs to another key and has no tag to check
+					orInfo.checker.Check(orInfo.commands[reply.CommandId], reply, start, after)
+				}
 
 				tasID := orInfo.tasBatch[reply.CommandId]
+				orInfo.forget(reply.CommandId)
 				orInfo.tasRecevied[tasID]++ // keep track of how many sub-requests have been received
 				tasReceived := orInfo.tasRecevied[tasID]
 				if len(orInfo.maxLat[tasID]) == 0 {
@@ -286,7 +389,10 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, read
 					orInfo.maxLat[tasID][2] = Max(orInfo.maxLat[tasID][2], rtt) // third element is largest rmw lat
 				}
 				maxLat := orInfo.maxLat[tasID]
-
+				if tasReceived == *tailAtScale || *tailAtScale == -1 {
+					delete(orInfo.maxLat, tasID)
+					delete(orInfo.tasRecevied, tasID)
+				}
 				orInfo.Unlock()
 
 				//commitToExec := float64(reply.Timestamp) / 1e6
@@ -339,6 +445,98 @@ func simulatedClientWriter(writer *bufio.Writer, otherWriter *bufio.Writer, read
 	}
 }
 
+// Sends args as a message of type msgType. PROPOSE_AND_READ also reads the key after
+// the one args writes, and READ only uses the key.
+func sendRequest(writer *bufio.Writer, msgType uint8, args *genericsmrproto.Propose) {
+	switch msgType {
+	case genericsmrproto.READ:
+		read := genericsmrproto.Read{CommandId: args.CommandId, Key: args.Command.K}
+		genericsmrproto.WriteFrame(writer, msgType, &read, false)
+	case genericsmrproto.PROPOSE_AND_READ:
+		pr := genericsmrproto.ProposeAndRead{CommandId: args.CommandId, Command: args.Command, Key: args.Command.K + 1}
+		genericsmrproto.WriteFrame(writer, msgType, &pr, false)
+	default:
+		genericsmrproto.WriteFrame(writer, msgType, args, false)
+	}
+	writer.Flush()
+}
+
+// Picks the message type for a command according to -readmsgs and -par
+func requestType(op state.Operation, r *rand.Rand) uint8 {
+	if op == state.GET {
+		if r.Float64() < *percentReadMsgs {
+			return genericsmrproto.READ
+		}
+	} else if r.Float64() < *percentProposeAndRead {
+		return genericsmrproto.PROPOSE_AND_READ
+	}
+	return genericsmrproto.PROPOSE
+}
+
+// Forgets a request once it is answered. Must be called with orInfo locked.
+func (orInfo *outstandingRequestInfo) forget(id int32) {
+	delete(orInfo.startTimes, id)
+	delete(orInfo.operation, id)
+	delete(orInfo.tasBatch, id)
+	delete(orInfo.commands, id)
+}
+
+// Logs a reply to the history, if there is one. The value in a PROPOSE_AND_READ reply is
+// that of another key.
+func logReturn(orInfo *outstandingRequestInfo, reply *genericsmrproto.ProposeReplyTS, msgType uint8, ok bool) {
+	if historyLog != nil {
+		historyLog.Return(orInfo.client, reply.CommandId, ok, msgType != genericsmrproto.PROPOSE_AND_READ_REPLY,
+			reply.Value, reply.Previous, reply.TagTimestamp, reply.TagID, reply.TagRMWCount)
+	}
+}
+
+// Logs a request the replica gave up on, and whether it may still take effect
+func logFailure(reply *genericsmrproto.ProposeReplyTS) {
+	if reply.OK == genericsmrproto.REPLY_UNKNOWN {
+		log.Println("Request outcome unknown:", reply.CommandId)
+	} else {
+		log.Println("Request failed:", reply.CommandId)
+	}
+}
+
+// Writes out the history when the client is stopped
+func closeHistory(interrupt chan os.Signal) {
+	<-interrupt
+	if err := historyLog.Close(); err != nil {
+		log.Println("Error writing the history:", err)
+	}
+	os.Exit(0)
+}
+
+// Maps the -rmwop flag to the RMW operation sent to the replicas
+func parseRMWOp(name string) state.Operation {
+	switch name {
+	case "rmw":
+		return state.RMW
+	case "faa":
+		return state.FETCH_ADD
+	case "cas":
+		return state.COMPARE_SWAP
+	case "swap":
+		return state.SWAP
+	case "max":
+		return state.FETCH_MAX
+	case "min":
+		return state.FETCH_MIN
+	case "cset":
+		return state.COND_SET
+	}
+	log.Fatalf("Unknown RMW operator %s\n", name)
+	return state.NONE
+}
+
+// The expected value of a compare-and-swap is the last value this thread observed for the key
+func expectedValue(orInfo *outstandingRequestInfo, key state.Key) state.Value {
+	orInfo.Lock()
+	defer orInfo.Unlock()
+	return orInfo.checker.Latest(key)
+}
+
 func printer(readings chan *response) {
 	lattputFile, err := os.Create("lattput.txt")
 	if err != nil {
@@ -0,0 +1,226 @@
+// Package config reads the description of a cluster that the master, the servers and the
+// clients share, instead of each being told where the others are with flags:
+//
+//	{
+//	  "master": "10.10.1.1:7087",
+//	  "leaders": [0, 1],
+//	  "replicas": [
+//	    {"id": 0, "name": "california", "region": "us-west", "peer": "10.10.1.1:7070"},
+//	    {"id": 1, "name": "virginia", "region": "us-east", "peer": "10.10.1.2:7070",
+//	     "client": "10.10.1.2:7080", "admin": "10.10.1.2:9070"}
+//	  ],
+//	  "options": {"timeout": "200ms", "durable": true}
+//	}
+//
+// A replica's client address defaults to its peer address, and its admin (net/rpc)
+// address to its peer port + 1000. The leaders are tried in order, and default to every
+// replica by id. Options left out keep the servers' defaults.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Most replicas a cluster can have, since ballots keep the id of the replica that owns
+// them in 4 bits
+const MAX_REPLICAS = 16
+
+type Cluster struct {
+	Master   string    `json:"master"`
+	Leaders  []int     `json:"leaders"` // replica ids, most preferred leader first
+	Replicas []Replica `json:"replicas"`
+	Options  Options   `json:"options"`
+}
+
+type Replica struct {
+	Id     int    `json:"id"`
+	Name   string `json:"name"`
+	Region string `json:"region"`
+	Peer   string `json:"peer"`   // where the other replicas connect
+	Client string `json:"client"` // where clients connect
+	Admin  string `json:"admin"`  // where the master and tools make RPCs
+}
+
+// Protocol options, as the server flags of the same name
+type Options struct {
+	Exec      bool     `json:"exec"`
+	Dreply    bool     `json:"dreply"`
+	Durable   bool     `json:"durable"`
+	Timeout   Duration `json:"timeout"`
+	Retries   int      `json:"retries"`
+	Flush     bool     `json:"flush"`
+	Snapshot  Duration `json:"snapshot"`
+	Transport string   `json:"transport"`
+	SockDir   string   `json:"sockdir"`
+	Crc       bool     `json:"crc"`
+}
+
+// Server defaults
+func DefaultOptions() Options {
+	return Options{false, true, false, Duration(100 * time.Millisecond), 5, true,
+		Duration(30 * time.Second), "tcp", os.TempDir(), false}
+}
+
+// A time.Duration written as a string, like "100ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"100ms\", not %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Reads and checks a cluster file. Errors say which file and which replica they are about.
+func Load(path string) (*Cluster, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{Options: DefaultOptions()}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Fills in the defaults and checks that the cluster makes sense
+func (c *Cluster) validate() error {
+	if _, _, err := SplitAddr(c.Master); err != nil {
+		return fmt.Errorf("master: %v", err)
+	}
+	if len(c.Replicas) == 0 {
+		return fmt.Errorf("no replicas")
+	}
+	if len(c.Replicas) > MAX_REPLICAS {
+		return fmt.Errorf("%d replicas, but ballots only have room for %d replica ids", len(c.Replicas), MAX_REPLICAS)
+	}
+
+	sort.SliceStable(c.Replicas, func(i, j int) bool { return c.Replicas[i].Id < c.Replicas[j].Id })
+	owner := map[string]string{c.Master: "the master"}
+	for i := range c.Replicas {
+		r := &c.Replicas[i]
+		if r.Id != i {
+			if i > 0 && r.Id == c.Replicas[i-1].Id {
+				return fmt.Errorf("two replicas have id %d", r.Id)
+			}
+			return fmt.Errorf("replica ids must be 0 to %d, but there is no replica %d", len(c.Replicas)-1, i)
+		}
+		host, port, err := SplitAddr(r.Peer)
+		if err != nil {
+			return fmt.Errorf("replica %d: peer: %v", r.Id, err)
+		}
+		if r.Client == "" {
+			r.Client = r.Peer
+		} else if _, _, err := SplitAddr(r.Client); err != nil {
+			return fmt.Errorf("replica %d: client: %v", r.Id, err)
+		}
+		if r.Admin == "" {
+			if port+1000 > 65535 {
+				return fmt.Errorf("replica %d: peer port %d + 1000 is too large for the admin port, give an admin address", r.Id, port)
+			}
+			r.Admin = net.JoinHostPort(host, strconv.Itoa(port+1000))
+		} else if _, _, err := SplitAddr(r.Admin); err != nil {
+			return fmt.Errorf("replica %d: admin: %v", r.Id, err)
+		}
+
+		who := fmt.Sprintf("replica %d", r.Id)
+		for _, a := range []string{r.Peer, r.Client, r.Admin} {
+			if o, taken := owner[a]; taken && o != who {
+				return fmt.Errorf("%s and %s both use %s", o, who, a)
+			}
+			owner[a] = who
+		}
+		if r.Admin == r.Peer || r.Admin == r.Client {
+			return fmt.Errorf("replica %d: the admin address %s must differ from the peer and client ones", r.Id, r.Admin)
+		}
+	}
+
+	if len(c.Leaders) == 0 {
+		for i := range c.Replicas {
+			c.Leaders = append(c.Leaders, i)
+		}
+	}
+	seen := make(map[int]bool)
+	for _, id := range c.Leaders {
+		if id < 0 || id >= len(c.Replicas) {
+			return fmt.Errorf("leaders: there is no replica %d", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("leaders: replica %d is listed twice", id)
+		}
+		seen[id] = true
+	}
+
+	o := &c.Options
+	if o.Transport != "tcp" && o.Transport != "unix" {
+		return fmt.Errorf("options: transport must be tcp or unix, not %q", o.Transport)
+	}
+	if o.Timeout < Duration(time.Millisecond) {
+		return fmt.Errorf("options: timeout must be at least 1ms")
+	}
+	if o.Retries < 0 {
+		return fmt.Errorf("options: retries cannot be negative")
+	}
+	if o.Snapshot != 0 && o.Snapshot < Duration(time.Second) {
+		return fmt.Errorf("options: snapshot must be 0 (no snapshots) or at least 1s")
+	}
+	return nil
+}
+
+// The replica whose peer address is addr
+func (c *Cluster) Find(addr string) (*Replica, bool) {
+	for i := range c.Replicas {
+		if c.Replicas[i].Peer == addr {
+			return &c.Replicas[i], true
+		}
+	}
+	return nil, false
+}
+
+// Peer addresses by replica id, as the master hands them out
+func (c *Cluster) PeerAddrs() []string {
+	addrs := make([]string, len(c.Replicas))
+	for i, r := range c.Replicas {
+		addrs[i] = r.Peer
+	}
+	return addrs
+}
+
+// Splits a host:port address, insisting on both
+func SplitAddr(addr string) (string, int, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("%q is not a host:port address", addr)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, fmt.Errorf("%q has no valid port", addr)
+	}
+	if host == "" {
+		return "", 0, fmt.Errorf("%q has no host", addr)
+	}
+	return host, port, nil
+}
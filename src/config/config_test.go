@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func load(t *testing.T, text string) (*Cluster, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cluster.json")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestLoad(t *testing.T) {
+	c, err := load(t, `{
+		"master": "10.10.1.1:7087",
+		"replicas": [
+			{"id": 1, "name": "virginia", "peer": "10.10.1.2:7070", "client": "10.10.1.2:7080", "admin": "10.10.1.2:9070"},
+			{"id": 0, "name": "california", "region": "us-west", "peer": "10.10.1.1:7070"}
+		],
+		"options": {"timeout": "200ms", "durable": true}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Replica{
+		{0, "california", "us-west", "10.10.1.1:7070", "10.10.1.1:7070", "10.10.1.1:8070"},
+		{1, "virginia", "", "10.10.1.2:7070", "10.10.1.2:7080", "10.10.1.2:9070"},
+	}
+	if !reflect.DeepEqual(c.Replicas, want) {
+		t.Errorf("replicas %+v, want %+v", c.Replicas, want)
+	}
+	if !reflect.DeepEqual(c.Leaders, []int{0, 1}) {
+		t.Errorf("leaders %v, want every replica", c.Leaders)
+	}
+	o := DefaultOptions()
+	o.Timeout, o.Durable = Duration(200*time.Millisecond), true
+	if c.Options != o {
+		t.Errorf("options %+v, want %+v", c.Options, o)
+	}
+	if r, ok := c.Find("10.10.1.2:7070"); !ok || r.Id != 1 {
+		t.Errorf("Find = %+v, %v", r, ok)
+	}
+	if !reflect.DeepEqual(c.PeerAddrs(), []string{"10.10.1.1:7070", "10.10.1.2:7070"}) {
+		t.Errorf("PeerAddrs = %v", c.PeerAddrs())
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	const replicas = `"replicas": [{"id": 0, "peer": "h0:7070"}, {"id": 1, "peer": "h1:7070"}]`
+	var many []string
+	for i := 0; i <= MAX_REPLICAS; i++ {
+		many = append(many, fmt.Sprintf(`{"id": %d, "peer": "h%d:7070"}`, i, i))
+	}
+	for _, c := range []struct{ text, err string }{
+		{`{"master": "m:7087", "replicas": []}`, "no replicas"},
+		{`{"master": "m:7087", "replicas": [` + strings.Join(many, ", ") + `]}`, "room for 16 replica ids"},
+		{`{"master": "m", ` + replicas + `}`, "master"},
+		{`{"master": "m:7087", "replicas": [{"id": 0, "peer": "h0:7070"}, {"id": 0, "peer": "h1:7070"}]}`, "two replicas have id 0"},
+		{`{"master": "m:7087", "replicas": [{"id": 0, "peer": "h0:7070"}, {"id": 2, "peer": "h1:7070"}]}`, "no replica 1"},
+		{`{"master": "m:7087", "replicas": [{"id": 0, "peer": "h0:70700"}]}`, "replica 0: peer"},
+		{`{"master": "m:7087", "replicas": [{"id": 0, "peer": "h0:7070", "client": ":7080"}]}`, "replica 0: client"},
+		{`{"master": "m:7087", "replicas": [{"id": 0, "peer": "h0:65000"}]}`, "too large for the admin port"},
+		{`{"master": "m:7087", "replicas": [{"id": 0, "peer": "h0:7070"}, {"id": 1, "peer": "h0:7070"}]}`, "replica 0 and replica 1 both use h0:7070"},
+		{`{"master": "h0:7070", "replicas": [{"id": 0, "peer": "h0:7070"}]}`, "the master and replica 0"},
+		{`{"master": "m:7087", "replicas": [{"id": 0, "peer": "h0:7070", "admin": "h0:7070"}]}`, "must differ"},
+		{`{"master": "m:7087", "leaders": [2], ` + replicas + `}`, "no replica 2"},
+		{`{"master": "m:7087", "leaders": [1, 1], ` + replicas + `}`, "listed twice"},
+		{`{"master": "m:7087", "options": {"transport": "udp"}, ` + replicas + `}`, "tcp or unix"},
+		{`{"master": "m:7087", "options": {"timeout": "500us"}, ` + replicas + `}`, "at least 1ms"},
+		{`{"master": "m:7087", "options": {"timeout": 100}, ` + replicas + `}`, "durations are strings"},
+		{`{"master": "m:7087", "options": {"snapshot": "10ms"}, ` + replicas + `}`, "at least 1s"},
+		{`{"master": "m:7087", "options": {"retries": -1}, ` + replicas + `}`, "retries"},
+		{`{"master": "m:7087", "replica": [], ` + replicas + `}`, "unknown field"},
+	} {
+		_, err := load(t, c.text)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %v, want one about %q", c.text, err, c.err)
+		}
+	}
+}
+
+func TestSplitAddr(t *testing.T) {
+	if host, port, err := SplitAddr("[::1]:7070"); err != nil || host != "::1" || port != 7070 {
+		t.Errorf("SplitAddr = %q, %d, %v", host, port, err)
+	}
+	for _, addr := range []string{"", "h", "h:", ":7070", "h:0", "h:x", "h:65536"} {
+		if _, _, err := SplitAddr(addr); err == nil {
+			t.Errorf("SplitAddr(%q) succeeded", addr)
+		}
+	}
+}
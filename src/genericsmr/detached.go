@@ -0,0 +1,39 @@
+package genericsmr
+
+import (
+	"bytes"
+	"time"
+
+	"pineapple/src/genericsmrproto"
+)
+
+// Where a replica gets the time from. The simulator swaps in a virtual clock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// Cuts the replica off the network so that a driver can run it by hand, as the simulator
+// does: it never connects to peers, every peer counts as alive, frames meant for a peer
+// go to send, and frames from peers come in through Deliver.
+func (r *Replica) Detach(clock Clock, send func(peerId int32, frame []byte)) {
+	r.Clock = clock
+	r.detachedSend = send
+	for i := range r.Alive {
+		r.Alive[i].Store(int32(i) != r.Id)
+	}
+}
+
+// Hands a frame from a peer to the protocol, as if it came over the peer's connection
+func (r *Replica) Deliver(peerId int32, frame []byte) error {
+	msgType, body, err := genericsmrproto.ReadFrame(bytes.NewReader(frame), nil)
+	if err != nil {
+		return err
+	}
+	return r.dispatchFrame(int(peerId), msgType, body)
+}
@@ -0,0 +1,431 @@
+package genericsmr
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"pineapple/src/genericsmrproto"
+)
+
+// What happens to the messages sent from one replica to another. Latencies are drawn per
+// message, but a link never reorders them, as TCP would not.
+type LinkFaults struct {
+	Latency      time.Duration // one-way delay
+	Jitter       time.Duration // spread of the delay, see Distribution
+	Distribution string        // "uniform" in Latency±Jitter (the default), "normal" around Latency, or "pareto" above Latency
+	Loss         float64       // probability that a message is dropped
+	Partitioned  bool          // drop every message
+	Bandwidth    int64         // bytes per second, 0 for no cap
+}
+
+// Draws the delay of one message
+func (lf *LinkFaults) delay(r *rand.Rand) time.Duration {
+	d := lf.Latency
+	switch lf.Distribution {
+	case "normal":
+		d += time.Duration(r.NormFloat64() * float64(lf.Jitter))
+	case "pareto":
+		// shape 2: at least Latency+Jitter, Latency+2*Jitter on average, with a long tail
+		d += time.Duration(float64(lf.Jitter) / math.Sqrt(1-r.Float64()))
+	default:
+		if lf.Jitter > 0 {
+			d += time.Duration(r.Int63n(int64(2*lf.Jitter)+1)) - lf.Jitter
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+type link struct {
+	from string
+	to   string
+}
+
+// The faults of every link, keyed by the replicas' addresses. "*" stands for any replica.
+// A Faults is shared by the transport and the HTTP handler that changes it at runtime.
+type Faults struct {
+	mu    sync.Mutex
+	links map[link]LinkFaults
+	rand  *rand.Rand
+}
+
+func NewFaults() *Faults {
+	return &Faults{links: make(map[link]LinkFaults), rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (f *Faults) Set(from string, to string, lf LinkFaults) {
+	f.mu.Lock()
+	f.links[link{from, to}] = lf
+	f.mu.Unlock()
+}
+
+// The faults of a link, most specific entry first
+func (f *Faults) Get(from string, to string) LinkFaults {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.get(from, to)
+}
+
+func (f *Faults) get(from string, to string) LinkFaults {
+	for _, l := range []link{{from, to}, {from, "*"}, {"*", to}, {"*", "*"}} {
+		if lf, present := f.links[l]; present {
+			return lf
+		}
+	}
+	return LinkFaults{}
+}
+
+// On-disk and HTTP form of the fault table:
+// {"links": [{"from": "10.10.1.1:7070", "to": "*", "latency": "40ms", "both": true}, ...]}
+type faultsJSON struct {
+	Links []linkJSON `json:"links"`
+}
+
+type linkJSON struct {
+	From         string  `json:"from"`
+	To           string  `json:"to"`
+	Both         bool    `json:"both,omitempty"` // also the link from To to From
+	Latency      string  `json:"latency,omitempty"`
+	Jitter       string  `json:"jitter,omitempty"`
+	Distribution string  `json:"distribution,omitempty"`
+	Loss         float64 `json:"loss,omitempty"`
+	Partitioned  bool    `json:"partitioned,omitempty"`
+	Bandwidth    int64   `json:"bandwidth,omitempty"`
+}
+
+// Replaces the whole table with the one read from r
+func (f *Faults) Load(r io.Reader) error {
+	var table faultsJSON
+	if err := json.NewDecoder(r).Decode(&table); err != nil {
+		return err
+	}
+	links := make(map[link]LinkFaults)
+	for _, lj := range table.Links {
+		lf := LinkFaults{Distribution: lj.Distribution, Loss: lj.Loss, Partitioned: lj.Partitioned, Bandwidth: lj.Bandwidth}
+		var err error
+		if lj.Latency != "" {
+			if lf.Latency, err = time.ParseDuration(lj.Latency); err != nil {
+				return err
+			}
+		}
+		if lj.Jitter != "" {
+			if lf.Jitter, err = time.ParseDuration(lj.Jitter); err != nil {
+				return err
+			}
+		}
+		links[link{lj.From, lj.To}] = lf
+		if lj.Both {
+			links[link{lj.To, lj.From}] = lf
+		}
+	}
+
+	f.mu.Lock()
+	f.links = links
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *Faults) dump(w io.Writer) error {
+	table := faultsJSON{Links: []linkJSON{}}
+	f.mu.Lock()
+	for l, lf := range f.links {
+		table.Links = append(table.Links, linkJSON{From: l.from, To: l.to, Latency: lf.Latency.String(),
+			Jitter: lf.Jitter.String(), Distribution: lf.Distribution, Loss: lf.Loss, Partitioned: lf.Partitioned,
+			Bandwidth: lf.Bandwidth})
+	}
+	f.mu.Unlock()
+	sort.Slice(table.Links, func(i, j int) bool {
+		a, b := table.Links[i], table.Links[j]
+		return a.From < b.From || (a.From == b.From && a.To < b.To)
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&table)
+}
+
+// Control endpoint:
+//
+//	GET    /faults       the table as JSON
+//	PUT    /faults       replace the table with the JSON in the body
+//	DELETE /faults       clear every fault
+//	POST   /faults/link?from=A&to=B[&both=true][&latency=80ms][&jitter=5ms][&distribution=normal]
+//	                     [&loss=0.01][&partitioned=true][&bandwidth=125000]
+//	                     change the given fields of one link, keeping the others
+func (f *Faults) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/faults" && req.Method == http.MethodGet:
+	case req.URL.Path == "/faults" && req.Method == http.MethodPut:
+		if err := f.Load(req.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case req.URL.Path == "/faults" && req.Method == http.MethodDelete:
+		f.mu.Lock()
+		f.links = make(map[link]LinkFaults)
+		f.mu.Unlock()
+	case req.URL.Path == "/faults/link" && req.Method == http.MethodPost:
+		if err := f.updateLink(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "unknown request", http.StatusNotFound)
+		return
+	}
+	f.dump(w)
+}
+
+func (f *Faults) updateLink(req *http.Request) error {
+	q := req.URL.Query()
+	from, to := q.Get("from"), q.Get("to")
+	if from == "" || to == "" {
+		return fmt.Errorf("from and to are required")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lf, present := f.links[link{from, to}]
+	if !present {
+		lf = f.get(from, to)
+	}
+	var err error
+	for name, values := range q {
+		v := values[0]
+		switch name {
+		case "from", "to", "both":
+		case "latency":
+			lf.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			lf.Jitter, err = time.ParseDuration(v)
+		case "distribution":
+			lf.Distribution = v
+		case "loss":
+			lf.Loss, err = strconv.ParseFloat(v, 64)
+		case "partitioned":
+			lf.Partitioned, err = strconv.ParseBool(v)
+		case "bandwidth":
+			lf.Bandwidth, err = strconv.ParseInt(v, 10, 64)
+		default:
+			err = fmt.Errorf("unknown field %q", name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	f.links[link{from, to}] = lf
+	if both, _ := strconv.ParseBool(q.Get("both")); both {
+		f.links[link{to, from}] = lf
+	}
+	return nil
+}
+
+// Decides when a message of size bytes sent now on a link arrives, or that it never does
+func (f *Faults) schedule(l link, size int, exempt bool, freeAt *time.Time, lastAt *time.Time) (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lf := f.get(l.from, l.to)
+	if !exempt && (lf.Partitioned || (lf.Loss > 0 && f.rand.Float64() < lf.Loss)) {
+		return time.Time{}, false
+	}
+
+	sent := time.Now()
+	if lf.Bandwidth > 0 {
+		if freeAt.After(sent) {
+			sent = *freeAt
+		}
+		sent = sent.Add(time.Duration(int64(size) * int64(time.Second) / lf.Bandwidth))
+		*freeAt = sent
+	}
+	at := sent.Add(lf.delay(f.rand))
+	if at.Before(*lastAt) {
+		at = *lastAt // a stream keeps its order
+	}
+	*lastAt = at
+	return at, true
+}
+
+// Wraps the transport of a replica whose own address is local. Faults are applied on the
+// connections the replica dials, in both directions, so each link between two replicas is
+// handled once, by the one with the higher id. Hellos are delayed but never dropped.
+type FaultTransport struct {
+	Inner  Transport
+	Local  string
+	Faults *Faults
+}
+
+func NewFaultTransport(inner Transport, local string, faults *Faults) *FaultTransport {
+	return &FaultTransport{inner, local, faults}
+}
+
+func (t *FaultTransport) Listen(addr string) (net.Listener, error) {
+	return t.Inner.Listen(addr)
+}
+
+func (t *FaultTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.Inner.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &faultConn{Conn: conn, faults: t.Faults, out: link{t.Local, addr}, in: link{addr, t.Local}, received: newMemPipe()}
+	c.outLine = newDelayLine(func(b []byte) error {
+		_, err := conn.Write(b)
+		return err
+	}, func() {})
+	c.inLine = newDelayLine(func(b []byte) error {
+		_, err := c.received.write(b)
+		return err
+	}, c.received.close)
+	go c.readLoop()
+	return c, nil
+}
+
+// A connection whose frames go through a delay line each way
+type faultConn struct {
+	net.Conn
+	faults   *Faults
+	out      link
+	in       link
+	outLine  *delayLine
+	inLine   *delayLine
+	received *memPipe // frames from the peer that have arrived
+
+	mu     sync.Mutex
+	outBuf []byte // written bytes that do not make a whole frame yet
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	return c.received.read(b)
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outBuf = append(c.outBuf, b...)
+	c.outBuf = c.outLine.sendFrames(c.faults, c.out, c.outBuf, false)
+	return len(b), nil
+}
+
+func (c *faultConn) Close() error {
+	err := c.Conn.Close()
+	c.outLine.close()
+	c.inLine.close()
+	c.received.close()
+	return err
+}
+
+func (c *faultConn) readLoop() {
+	buf := make([]byte, 64*1024)
+	var pending []byte
+	for {
+		n, err := c.Conn.Read(buf)
+		pending = c.inLine.sendFrames(c.faults, c.in, append(pending, buf[:n]...), false)
+		if err != nil {
+			c.inLine.sendFrames(c.faults, c.in, pending, true)
+			c.inLine.close()
+			return
+		}
+	}
+}
+
+// Messages in flight on one direction of a link, written to sink in order once due
+type delayLine struct {
+	mu      sync.Mutex
+	ready   *sync.Cond
+	queue   []delayed
+	closed  bool
+	freeAt  time.Time // when the last message has been sent, under a bandwidth cap
+	lastAt  time.Time // when the last message arrives
+	sink    func([]byte) error
+	drained func()
+}
+
+type delayed struct {
+	data []byte
+	at   time.Time
+}
+
+func newDelayLine(sink func([]byte) error, drained func()) *delayLine {
+	l := &delayLine{sink: sink, drained: drained}
+	l.ready = sync.NewCond(&l.mu)
+	go l.run()
+	return l
+}
+
+// Schedules the whole frames at the start of buf and returns what is left of it. Bytes
+// that are not framed are passed on unharmed, and so is the rest of buf when flush is set.
+func (l *delayLine) sendFrames(faults *Faults, lk link, buf []byte, flush bool) []byte {
+	for len(buf) > 0 {
+		size := len(buf)
+		exempt := true
+		if len(buf) >= 2 && binary.LittleEndian.Uint16(buf) == genericsmrproto.FRAME_MAGIC {
+			if len(buf) < genericsmrproto.FRAME_HEADER_SIZE {
+				if !flush {
+					return buf
+				}
+			} else {
+				size = genericsmrproto.FRAME_HEADER_SIZE + int(binary.LittleEndian.Uint32(buf[5:9]))
+				if size > len(buf) {
+					if !flush {
+						return buf
+					}
+					size = len(buf)
+				}
+				exempt = buf[4] == genericsmrproto.HELLO
+			}
+		} else if len(buf) < 2 && !flush {
+			return buf
+		}
+
+		frame := append([]byte(nil), buf[:size]...)
+		buf = buf[size:]
+		l.mu.Lock()
+		if at, delivered := faults.schedule(lk, size, exempt, &l.freeAt, &l.lastAt); delivered {
+			l.queue = append(l.queue, delayed{frame, at})
+			l.ready.Broadcast()
+		}
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+func (l *delayLine) close() {
+	l.mu.Lock()
+	l.closed = true
+	l.ready.Broadcast()
+	l.mu.Unlock()
+}
+
+func (l *delayLine) run() {
+	for {
+		l.mu.Lock()
+		for len(l.queue) == 0 && !l.closed {
+			l.ready.Wait()
+		}
+		if len(l.queue) == 0 {
+			l.mu.Unlock()
+			l.drained()
+			return
+		}
+		next := l.queue[0]
+		l.queue = l.queue[1:]
+		l.mu.Unlock()
+
+		time.Sleep(time.Until(next.at))
+		if l.sink(next.data) != nil {
+			l.drained()
+			return
+		}
+	}
+}
@@ -2,18 +2,19 @@ package genericsmr
 
 import (
 	"bufio"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"pineapple/src/rdtsc"
 
 	"pineapple/src/fastrpc"
 	"pineapple/src/genericsmrproto"
+	"pineapple/src/stablestore"
 	"pineapple/src/state"
 )
 
@@ -26,7 +27,19 @@ type RPCPair struct {
 
 type Propose struct {
 	*genericsmrproto.Propose
-	Reply *bufio.Writer
+	Reply     *ReplyWriter
+	ReplyType uint8     // PROPOSE_REPLY, or the reply a READ / PROPOSE_AND_READ turned into a proposal expects
+	ReadKey   state.Key // key whose value a PROPOSE_AND_READ returns
+}
+
+type Read struct {
+	*genericsmrproto.Read
+	Reply *ReplyWriter
+}
+
+type ProposeAndRead struct {
+	*genericsmrproto.ProposeAndRead
+	Reply *ReplyWriter
 }
 
 type Beacon struct {
@@ -34,20 +47,31 @@ type Beacon struct {
 	Timestamp uint64
 }
 
+// Sent on PeerEventChan when a peer connection comes up or breaks
+type PeerEvent struct {
+	Peer  int32
+	Alive bool
+}
+
 type Replica struct {
-	N            int        // total number of replicas
-	Id           int32      // the ID of the current replica
-	PeerAddrList []string   // array with the IP:port address of every replica
-	Peers        []net.Conn // cache of connections to all other replicas
-	PeerReaders  []*bufio.Reader
-	PeerWriters  []*bufio.Writer
-	Alive        []bool // connection status
-	Listener     net.Listener
+	N              int        // total number of replicas
+	Id             int32      // the ID of the current replica
+	PeerAddrList   []string   // array with the IP:port address of every replica
+	ClientAddrList []string   // where clients reach every replica, see NewReplica
+	Peers          []net.Conn // cache of connections to all other replicas
+	PeerReaders    []*bufio.Reader
+	peerSenders    []*peerSender // writing side of every peer connection
+	Alive          []atomic.Bool // connection status, set by the connection goroutines
+	Listener       net.Listener
+	Transport      Transport // carries peer and client connections
+	Clock          Clock     // where the replica gets the time from
 
 	State *state.State
 
-	ProposeChan chan *Propose // channel for client proposals
-	BeaconChan  chan *Beacon  // channel for beacons from peer replicas
+	ProposeChan        chan *Propose        // channel for client proposals
+	ReadChan           chan *Read           // channel for client reads
+	ProposeAndReadChan chan *ProposeAndRead // channel for client proposals that also read a key
+	BeaconChan         chan *Beacon         // channel for beacons from peer replicas
 
 	Shutdown bool
 
@@ -55,8 +79,10 @@ type Replica struct {
 	Dreply bool // reply to client after command has been executed?
 	Beacon bool // send beacons to detect how fast are the other replicas?
 
-	Durable     bool     // log to a stable store?
-	StableStore *os.File // file support for the persistent log
+	Checksum bool // protect outgoing frames with a CRC?
+
+	Durable     bool             // log to a stable store?
+	StableStore *stablestore.Log // file support for the persistent log
 
 	PreferredPeerOrder []int32 // replicas in the preferred order of communication
 
@@ -66,37 +92,70 @@ type Replica struct {
 	Ewma []float64
 
 	OnClientConnect chan bool
+
+	PeerEventChan chan PeerEvent // peer up/down notifications for the protocol
+
+	peerLock      sync.Mutex // guards swapping peer connections
+	listenToPeers bool
+	joined        []bool    // peers that connected at least once
+	pendingPeers  int       // peers that never connected yet
+	peersReady    chan bool // closed once every peer connected
+	peerDropped   []uint64  // messages dropped on a full peer queue
+
+	detachedSend func(peerId int32, frame []byte) // takes every frame for a peer once detached, see Detach
 }
 
-func NewReplica(id int, peerAddrList []string, exec bool, dreply bool) *Replica {
+// Clients connect to the peer addresses, unless clientAddrList gives others
+func NewReplica(id int, peerAddrList []string, clientAddrList []string, exec bool, dreply bool, durable bool, checksum bool, transport Transport) *Replica {
+	if clientAddrList == nil {
+		clientAddrList = peerAddrList
+	}
 	r := &Replica{
 		len(peerAddrList),
 		int32(id),
 		peerAddrList,
+		clientAddrList,
 		make([]net.Conn, len(peerAddrList)),
 		make([]*bufio.Reader, len(peerAddrList)),
-		make([]*bufio.Writer, len(peerAddrList)),
-		make([]bool, len(peerAddrList)),
+		make([]*peerSender, len(peerAddrList)),
+		make([]atomic.Bool, len(peerAddrList)),
 		nil,
+		transport,
+		systemClock{},
 		state.InitState(),
 		make(chan *Propose, CHAN_BUFFER_SIZE),
+		make(chan *Read, CHAN_BUFFER_SIZE),
+		make(chan *ProposeAndRead, CHAN_BUFFER_SIZE),
 		make(chan *Beacon, CHAN_BUFFER_SIZE),
 		false,
 		exec,
 		dreply,
 		false,
+		checksum,
 		false,
 		nil,
 		make([]int32, len(peerAddrList)),
 		make(map[uint8]*RPCPair),
 		genericsmrproto.GENERIC_SMR_BEACON_REPLY + 1,
 		make([]float64, len(peerAddrList)),
-		make(chan bool, 500000)}
+		make(chan bool, 500000),
+		make(chan PeerEvent, CHAN_BUFFER_SIZE),
+		sync.Mutex{},
+		false,
+		make([]bool, len(peerAddrList)),
+		len(peerAddrList) - 1,
+		make(chan bool),
+		make([]uint64, len(peerAddrList)),
+		nil}
 
-	var err error
+	if r.pendingPeers == 0 {
+		close(r.peersReady)
+	}
 
-	if r.StableStore, err = os.Create(fmt.Sprintf("stable-store-replica%d", r.Id)); err != nil {
-		log.Fatal(err)
+	if durable {
+		if err := r.OpenStableStore(fmt.Sprintf("stable-store-replica%d", r.Id)); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	for i := 0; i < r.N; i++ {
@@ -107,6 +166,18 @@ func NewReplica(id int, peerAddrList []string, exec bool, dreply bool) *Replica
 	return r
 }
 
+// Opens the stable store kept in files named after base and makes the replica durable.
+// Reopened without truncating, so that the protocol can replay it.
+func (r *Replica) OpenStableStore(base string) error {
+	store, err := stablestore.Open(base)
+	if err != nil {
+		return err
+	}
+	r.StableStore = store
+	r.Durable = true
+	return nil
+}
+
 /* Client API */
 
 func (r *Replica) Ping(args *genericsmrproto.PingArgs, reply *genericsmrproto.PingReply) error {
@@ -117,205 +188,313 @@ func (r *Replica) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *gene
 	return nil
 }
 
+func (r *Replica) StepDown(args *genericsmrproto.StepDownArgs, reply *genericsmrproto.StepDownReply) error {
+	return nil
+}
+
 /* ============= */
 
 func (r *Replica) ConnectToPeers() {
-	var b [4]byte
-	bs := b[:4]
-	done := make(chan bool)
+	r.connectToPeers(true)
+}
 
-	go r.waitForPeerConnections(done)
+func (r *Replica) ConnectToPeersNoListeners() {
+	r.connectToPeers(false)
+}
 
-	//connect to peers
-	for i := 0; i < int(r.Id); i++ {
-		for done := false; !done; {
-			if conn, err := net.Dial("tcp", r.PeerAddrList[i]); err == nil {
-				r.Peers[i] = conn
-				done = true
-			} else {
-				time.Sleep(1e9)
-			}
-		}
-		binary.LittleEndian.PutUint32(bs, uint32(r.Id))
-		if _, err := r.Peers[i].Write(bs); err != nil {
-			fmt.Println("Write id error:", err)
-			continue
+// Dials every lower-id replica and waits until all peers are connected.
+// Higher-id replicas dial us; their connections come in through acceptConnections,
+// which also hands client connections to clientListener.
+func (r *Replica) connectToPeers(listen bool) {
+	var err error
+
+	r.listenToPeers = listen
+	if r.Listener, err = r.Transport.Listen(r.PeerAddrList[r.Id]); err != nil {
+		log.Fatal("Listen error:", err)
+	}
+	go r.acceptConnections(r.Listener, false)
+	if r.ClientAddrList[r.Id] != r.PeerAddrList[r.Id] {
+		if err := r.ListenForClients(r.ClientAddrList[r.Id]); err != nil {
+			log.Fatal("Listen error:", err)
 		}
-		r.Alive[i] = true
-		r.PeerReaders[i] = bufio.NewReader(r.Peers[i])
-		r.PeerWriters[i] = bufio.NewWriter(r.Peers[i])
 	}
-	<-done
-	log.Printf("Replica id: %d. Done connecting to peers\n", r.Id)
 
-	for rid, reader := range r.PeerReaders {
-		if int32(rid) == r.Id {
-			continue
+	//connect to peers
+	for i := int32(0); i < r.Id; i++ {
+		for !r.dialPeer(i) {
+			time.Sleep(1e9)
 		}
-		go r.replicaListener(rid, reader)
 	}
+	<-r.peersReady
+	log.Printf("Replica id: %d. Done connecting to peers\n", r.Id)
 }
 
-func (r *Replica) ConnectToPeersNoListeners() {
-	var b [4]byte
-	bs := b[:4]
-	done := make(chan bool)
+// Opens a connection to a peer and exchanges hellos with it
+func (r *Replica) dialPeer(peerId int32) bool {
+	conn, err := r.Transport.Dial(r.PeerAddrList[peerId])
+	if err != nil {
+		return false
+	}
 
-	go r.waitForPeerConnections(done)
+	reader := bufio.NewReader(conn)
+	hello, err := genericsmrproto.Handshake(conn, reader, genericsmrproto.NewHello(genericsmrproto.ROLE_REPLICA, r.Id))
+	if err == nil && (hello.Role != genericsmrproto.ROLE_REPLICA || hello.Id != peerId) {
+		err = fmt.Errorf("answered as role %d, id %d", hello.Role, hello.Id)
+	}
+	if err != nil {
+		log.Printf("Replica %d refused connection to peer %d: %v\n", r.Id, peerId, err)
+		conn.Close()
+		return false
+	}
 
-	//connect to peers
-	for i := 0; i < int(r.Id); i++ {
-		for done := false; !done; {
-			if conn, err := net.Dial("tcp", r.PeerAddrList[i]); err == nil {
-				r.Peers[i] = conn
-				done = true
-			} else {
-				time.Sleep(1e9)
-			}
-		}
-		binary.LittleEndian.PutUint32(bs, uint32(r.Id))
-		if _, err := r.Peers[i].Write(bs); err != nil {
-			fmt.Println("Write id error:", err)
-			continue
+	r.addPeer(peerId, conn, reader)
+	return true
+}
+
+// Keeps dialing a lower-id peer whose connection broke, until it is back
+func (r *Replica) redialPeer(peerId int32) {
+	for !r.Shutdown && !r.dialPeer(peerId) {
+		time.Sleep(1e9)
+	}
+}
+
+// Installs a (new) connection to a peer, replacing the one a restarted peer left behind
+func (r *Replica) addPeer(peerId int32, conn net.Conn, reader *bufio.Reader) {
+	r.peerLock.Lock()
+	if old := r.Peers[peerId]; old != nil && old != conn {
+		old.Close()
+	}
+	if old := r.peerSenders[peerId]; old != nil {
+		old.stop()
+	}
+	sender := newPeerSender(peerId, conn, &r.peerDropped[peerId])
+	r.Peers[peerId] = conn
+	r.PeerReaders[peerId] = reader
+	r.peerSenders[peerId] = sender
+	r.Alive[peerId].Store(true)
+	if !r.joined[peerId] {
+		r.joined[peerId] = true
+		r.pendingPeers--
+		if r.pendingPeers == 0 {
+			close(r.peersReady)
 		}
-		r.Alive[i] = true
-		r.PeerReaders[i] = bufio.NewReader(r.Peers[i])
-		r.PeerWriters[i] = bufio.NewWriter(r.Peers[i])
 	}
-	<-done
-	log.Printf("Replica id: %d. Done connecting to peers\n", r.Id)
+	r.peerLock.Unlock()
+
+	go r.runPeerSender(sender)
+	if r.listenToPeers {
+		go r.replicaListener(int(peerId), conn, reader)
+	}
+	r.notifyPeer(peerId, true)
 }
 
-/* Peer (replica) connections dispatcher */
-func (r *Replica) waitForPeerConnections(done chan bool) {
-	var b [4]byte
-	bs := b[:4]
+// Marks a peer dead if conn is still its current connection
+func (r *Replica) peerDown(peerId int32, conn net.Conn) {
+	r.peerLock.Lock()
+	if r.Peers[peerId] != conn || !r.Alive[peerId].Load() {
+		// already replaced by a newer connection, or already down
+		r.peerLock.Unlock()
+		return
+	}
+	r.Alive[peerId].Store(false)
+	r.peerSenders[peerId].stop()
+	r.peerSenders[peerId] = nil
+	conn.Close()
+	r.peerLock.Unlock()
+
+	log.Printf("Replica %d lost connection to peer %d\n", r.Id, peerId)
+	r.notifyPeer(peerId, false)
+
+	// lower-id peers are ours to dial, higher-id peers dial us when they come back
+	if peerId < r.Id {
+		go r.redialPeer(peerId)
+	}
+}
 
-	r.Listener, _ = net.Listen("tcp", r.PeerAddrList[r.Id])
-	for i := r.Id + 1; i < int32(r.N); i++ {
-		conn, err := r.Listener.Accept()
-		if err != nil {
-			fmt.Println("Accept error:", err)
-			continue
-		}
-		if _, err := io.ReadFull(conn, bs); err != nil {
-			fmt.Println("Connection establish error:", err)
-			continue
-		}
-		id := int32(binary.LittleEndian.Uint32(bs))
-		r.Peers[id] = conn
-		r.PeerReaders[id] = bufio.NewReader(conn)
-		r.PeerWriters[id] = bufio.NewWriter(conn)
-		r.Alive[id] = true
+func (r *Replica) notifyPeer(peerId int32, alive bool) {
+	select {
+	case r.PeerEventChan <- PeerEvent{peerId, alive}:
+	default:
+		// nobody is listening for peer events
 	}
+}
 
-	done <- true
+// Also accepts clients on addr, for replicas that serve clients on another address or
+// network than their peers. Clients can still connect on the peer address.
+func (r *Replica) ListenForClients(addr string) error {
+	l, err := r.Transport.Listen(addr)
+	if err != nil {
+		return err
+	}
+	go r.acceptConnections(l, true)
+	return nil
 }
 
-/* Client connections dispatcher */
-func (r *Replica) WaitForClientConnections() {
+/* Peer and client connections dispatcher */
+func (r *Replica) acceptConnections(l net.Listener, clientsOnly bool) {
 	for !r.Shutdown {
-		conn, err := r.Listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			log.Println("Accept error:", err)
 			continue
 		}
-		go r.clientListener(conn)
+		go r.handleConnection(conn, clientsOnly)
+	}
+}
+
+// Peers and clients both open with a hello saying who they are
+func (r *Replica) handleConnection(conn net.Conn, clientsOnly bool) {
+	reader := bufio.NewReader(conn)
+	hello, err := genericsmrproto.Handshake(conn, reader, genericsmrproto.NewHello(genericsmrproto.ROLE_REPLICA, r.Id))
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("Replica %d refused connection from %s: %v\n", r.Id, conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
 
-		r.OnClientConnect <- true
+	if hello.Role == genericsmrproto.ROLE_REPLICA {
+		if clientsOnly {
+			log.Printf("Replica %d refused replica %d on its client address\n", r.Id, hello.Id)
+			conn.Close()
+			return
+		}
+		if hello.Id < 0 || hello.Id >= int32(r.N) || hello.Id == r.Id {
+			log.Println("Connection from unknown replica", hello.Id)
+			conn.Close()
+			return
+		}
+		r.addPeer(hello.Id, conn, reader)
+		return
 	}
+
+	r.OnClientConnect <- true
+	r.clientListener(conn, reader)
 }
 
-func (r *Replica) replicaListener(rid int, reader *bufio.Reader) {
+// Reads the frames a peer sends. A frame that cannot be used is logged and skipped; the
+// connection is only given up when the stream itself is broken.
+func (r *Replica) replicaListener(rid int, conn net.Conn, reader *bufio.Reader) {
 	var msgType uint8
+	var body []byte
+	var buf []byte
 	var err error = nil
-	var gbeacon genericsmrproto.Beacon
-	var gbeaconReply genericsmrproto.BeaconReply
+	from := fmt.Sprintf("peer %d", rid)
 
 	for err == nil && !r.Shutdown {
-
-		if msgType, err = reader.ReadByte(); err != nil {
-			break
+		if msgType, body, err = genericsmrproto.ReadFrame(reader, buf); err == nil {
+			buf = body
+			err = r.dispatchFrame(rid, msgType, body)
 		}
+		err = r.skipFrame(from, msgType, err)
+	}
 
-		switch uint8(msgType) {
+	if err != nil && !r.Shutdown {
+		if err != io.EOF {
+			log.Printf("Replica %d closing connection to %s: %v\n", r.Id, from, err)
+		}
+		r.peerDown(int32(rid), conn)
+	}
+}
 
-		case genericsmrproto.GENERIC_SMR_BEACON:
-			if err = gbeacon.Unmarshal(reader); err != nil {
-				break
-			}
-			beacon := &Beacon{int32(rid), gbeacon.Timestamp}
-			r.BeaconChan <- beacon
-			break
+// Decodes a frame from a peer and hands it to whoever handles its type
+func (r *Replica) dispatchFrame(rid int, msgType uint8, body []byte) error {
+	switch uint8(msgType) {
 
-		case genericsmrproto.GENERIC_SMR_BEACON_REPLY:
-			if err = gbeaconReply.Unmarshal(reader); err != nil {
-				break
-			}
-			//TODO: UPDATE STUFF
-			r.Ewma[rid] = 0.99*r.Ewma[rid] + 0.01*float64(rdtsc.Cputicks()-gbeaconReply.Timestamp)
-			log.Println("Ewma: ", r.Ewma)
-			break
+	case genericsmrproto.GENERIC_SMR_BEACON:
+		var gbeacon genericsmrproto.Beacon
+		if err := genericsmrproto.Decode(body, &gbeacon); err != nil {
+			return err
+		}
+		beacon := &Beacon{int32(rid), gbeacon.Timestamp}
+		r.BeaconChan <- beacon
 
-		default:
-			if rpair, present := r.rpcTable[msgType]; present {
-				obj := rpair.Obj.New()
-				if err = obj.Unmarshal(reader); err != nil {
-					break
-				}
-				rpair.Chan <- obj
-			} else {
-				log.Println("Error: received unknown message type")
+	case genericsmrproto.GENERIC_SMR_BEACON_REPLY:
+		var gbeaconReply genericsmrproto.BeaconReply
+		if err := genericsmrproto.Decode(body, &gbeaconReply); err != nil {
+			return err
+		}
+		//TODO: UPDATE STUFF
+		r.Ewma[rid] = 0.99*r.Ewma[rid] + 0.01*float64(rdtsc.Cputicks()-gbeaconReply.Timestamp)
+		log.Println("Ewma: ", r.Ewma)
+
+	default:
+		if rpair, present := r.rpcTable[msgType]; present {
+			obj := rpair.Obj.New()
+			if err := genericsmrproto.Decode(body, obj); err != nil {
+				return err
 			}
+			rpair.Chan <- obj
+		} else {
+			log.Printf("Replica %d skipped unknown message type %d from peer %d\n", r.Id, msgType, rid)
 		}
 	}
+	return nil
 }
 
 // Puts commands / proposal received from client into the channels.
-func (r *Replica) clientListener(conn net.Conn) {
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-	var msgType byte //:= make([]byte, 1)
-	// log.Println("Message type, ", msgType)
+func (r *Replica) clientListener(conn net.Conn, reader *bufio.Reader) {
+	writer := NewReplyWriter(conn, r.Checksum)
+	defer conn.Close()
+	defer writer.Close()
+	var msgType uint8
+	var body []byte
 	var err error
+	from := fmt.Sprintf("client %s", conn.RemoteAddr())
 	for !r.Shutdown && err == nil {
 
-		if msgType, err = reader.ReadByte(); err != nil {
-			break
+		if msgType, body, err = genericsmrproto.ReadFrame(reader, nil); err != nil {
+			err = r.skipFrame(from, msgType, err)
+			continue
 		}
 
 		switch uint8(msgType) {
 
 		case genericsmrproto.PROPOSE:
 			prop := new(genericsmrproto.Propose)
-			if err = prop.Unmarshal(reader); err != nil {
+			if err = genericsmrproto.Decode(body, prop); err != nil {
 				break
 			}
-			r.ProposeChan <- &Propose{prop, writer}
+			r.ProposeChan <- &Propose{prop, writer, genericsmrproto.PROPOSE_REPLY, 0}
 			break
 
 		case genericsmrproto.READ:
 			read := new(genericsmrproto.Read)
-			if err = read.Unmarshal(reader); err != nil {
+			if err = genericsmrproto.Decode(body, read); err != nil {
 				break
 			}
-			//r.ReadChan <- read
+			r.ReadChan <- &Read{read, writer}
 			break
 
 		case genericsmrproto.PROPOSE_AND_READ:
 			pr := new(genericsmrproto.ProposeAndRead)
-			if err = pr.Unmarshal(reader); err != nil {
+			if err = genericsmrproto.Decode(body, pr); err != nil {
 				break
 			}
-			//r.ProposeAndReadChan <- pr
+			r.ProposeAndReadChan <- &ProposeAndRead{pr, writer}
 			break
+
+		default:
+			log.Printf("Replica %d skipped unknown message type %d from %s\n", r.Id, msgType, from)
 		}
+		err = r.skipFrame(from, msgType, err)
 	}
 	if err != nil && err != io.EOF {
 		log.Println("Error when reading from client connection:", err)
 	}
 }
 
+// Logs and clears an error that only cost the current frame, see genericsmrproto.Skippable.
+// Any other error means the stream is broken.
+func (r *Replica) skipFrame(from string, msgType uint8, err error) error {
+	if !genericsmrproto.Skippable(err) {
+		return err
+	}
+	log.Printf("Replica %d skipped message type %d from %s: %v\n", r.Id, msgType, from, err)
+	return nil
+}
+
 func (r *Replica) RegisterRPC(msgObj fastrpc.Serializable, notify chan fastrpc.Serializable) uint8 {
 	code := r.rpcCode
 	r.rpcCode++
@@ -323,49 +502,47 @@ func (r *Replica) RegisterRPC(msgObj fastrpc.Serializable, notify chan fastrpc.S
 	return code
 }
 
+// Queues a message for a peer, to be flushed as soon as the peer's queue drains.
+// msg is marshalled before SendMsg returns, so the caller may reuse it.
 func (r *Replica) SendMsg(peerId int32, code uint8, msg fastrpc.Serializable) {
-	w := r.PeerWriters[peerId]
-	w.WriteByte(code)
-	msg.Marshal(w)
-	w.Flush()
+	r.queueMsg(peerId, code, msg, true)
 }
 
+// Like SendMsg, but the message may wait for a later flush, at most FLUSH_INTERVAL
 func (r *Replica) SendMsgNoFlush(peerId int32, code uint8, msg fastrpc.Serializable) {
-	w := r.PeerWriters[peerId]
-	w.WriteByte(code)
-	msg.Marshal(w)
+	r.queueMsg(peerId, code, msg, false)
+}
+
+// Client replies are framed with their type, since READ, PROPOSE and PROPOSE_AND_READ
+// replies share the connection. Safe to call from any goroutine, see ReplyWriter.
+func (r *Replica) ReplyPropose(reply *genericsmrproto.ProposeReply, w *ReplyWriter) {
+	w.Write(genericsmrproto.PROPOSE_REPLY, reply)
+}
+
+func (r *Replica) ReplyProposeTS(reply *genericsmrproto.ProposeReplyTS, w *ReplyWriter) {
+	w.Write(genericsmrproto.PROPOSE_REPLY, reply)
+}
+
+func (r *Replica) ReplyRead(reply *genericsmrproto.ReadReply, w *ReplyWriter) {
+	w.Write(genericsmrproto.READ_REPLY, reply)
 }
 
-func (r *Replica) ReplyPropose(reply *genericsmrproto.ProposeReply, w *bufio.Writer) {
-	//r.clientMutex.Lock()
-	//defer r.clientMutex.Unlock()
-	//w.WriteByte(genericsmrproto.PROPOSE_REPLY)
-	reply.Marshal(w)
-	w.Flush()
+func (r *Replica) ReplyProposeAndRead(reply *genericsmrproto.ProposeAndReadReply, w *ReplyWriter) {
+	w.Write(genericsmrproto.PROPOSE_AND_READ_REPLY, reply)
 }
 
-func (r *Replica) ReplyProposeTS(reply *genericsmrproto.ProposeReplyTS, w *bufio.Writer) {
-	//r.clientMutex.Lock()
-	//defer r.clientMutex.Unlock()
-	//w.WriteByte(genericsmrproto.PROPOSE_REPLY)
-	reply.Marshal(w)
-	w.Flush()
+func (r *Replica) ReplyNotLeader(reply *genericsmrproto.NotLeader, w *ReplyWriter) {
+	w.Write(genericsmrproto.NOT_LEADER, reply)
 }
 
 func (r *Replica) SendBeacon(peerId int32) {
-	w := r.PeerWriters[peerId]
-	w.WriteByte(genericsmrproto.GENERIC_SMR_BEACON)
 	beacon := &genericsmrproto.Beacon{rdtsc.Cputicks()}
-	beacon.Marshal(w)
-	w.Flush()
+	r.queueMsg(peerId, genericsmrproto.GENERIC_SMR_BEACON, beacon, true)
 }
 
 func (r *Replica) ReplyBeacon(beacon *Beacon) {
-	w := r.PeerWriters[beacon.Rid]
-	w.WriteByte(genericsmrproto.GENERIC_SMR_BEACON_REPLY)
 	rb := &genericsmrproto.BeaconReply{beacon.Timestamp}
-	rb.Marshal(w)
-	w.Flush()
+	r.queueMsg(beacon.Rid, genericsmrproto.GENERIC_SMR_BEACON_REPLY, rb, true)
 }
 
 // updates the preferred order in which to communicate with peers according to a preferred quorum
@@ -0,0 +1,158 @@
+package genericsmr
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var errConnRefused = errors.New("connection refused")
+
+// In-process transport: connections are pairs of buffered pipes, so a whole cluster and
+// its clients can run in one process without opening any port. Replicas and clients of
+// the same cluster must share one MemTransport.
+type MemTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+func NewMemTransport() *MemTransport {
+	return &MemTransport{listeners: make(map[string]*memListener)}
+}
+
+func (t *MemTransport) Listen(addr string) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, present := t.listeners[addr]; present {
+		return nil, errors.New("address already in use")
+	}
+	l := &memListener{t, memAddr(addr), make(chan net.Conn, 16), make(chan bool), sync.Once{}}
+	t.listeners[addr] = l
+	return l, nil
+}
+
+func (t *MemTransport) Dial(addr string) (net.Conn, error) {
+	t.mu.Lock()
+	l := t.listeners[addr]
+	t.mu.Unlock()
+	if l == nil {
+		return nil, errConnRefused
+	}
+
+	toServer, toClient := newMemPipe(), newMemPipe()
+	client := &memConn{toClient, toServer, memAddr("client"), l.addr}
+	server := &memConn{toServer, toClient, l.addr, memAddr("client")}
+	select {
+	case l.accepted <- server:
+		return client, nil
+	case <-l.done:
+		return nil, errConnRefused
+	}
+}
+
+type memListener struct {
+	transport *MemTransport
+	addr      memAddr
+	accepted  chan net.Conn
+	done      chan bool
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, string(l.addr))
+		l.transport.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+// One direction of a connection. Writes never block; the buffer grows instead, like a
+// socket buffer that never fills.
+type memPipe struct {
+	mu     sync.Mutex
+	ready  *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newMemPipe() *memPipe {
+	p := &memPipe{}
+	p.ready = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *memPipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.buf.Len() == 0 && !p.closed {
+		p.ready.Wait()
+	}
+	if p.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return p.buf.Read(b)
+}
+
+func (p *memPipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	p.buf.Write(b)
+	p.ready.Broadcast()
+	return len(b), nil
+}
+
+func (p *memPipe) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.ready.Broadcast()
+	p.mu.Unlock()
+}
+
+// Deadlines are not supported; nothing in genericsmr sets them
+type memConn struct {
+	in     *memPipe
+	out    *memPipe
+	local  memAddr
+	remote memAddr
+}
+
+func (c *memConn) Read(b []byte) (int, error)  { return c.in.read(b) }
+func (c *memConn) Write(b []byte) (int, error) { return c.out.write(b) }
+
+func (c *memConn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr                { return c.local }
+func (c *memConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
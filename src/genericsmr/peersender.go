@@ -0,0 +1,112 @@
+package genericsmr
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"pineapple/src/genericsmrproto"
+)
+
+// Frames waiting to be written to a peer, see enqueue for what happens when it is full
+const PEER_QUEUE_SIZE = 8192
+
+// Longest a frame sent with SendMsgNoFlush waits in the buffer
+const FLUSH_INTERVAL = 2 * time.Millisecond
+
+type frame struct {
+	data  []byte
+	flush bool // flush as soon as the queue drains
+}
+
+// Owns the writing side of one peer connection. Callers marshal messages into frames
+// on their own goroutine and queue them; the sender writes them in order and flushes
+// once it runs out of queued frames, so a burst goes out in a few large writes.
+type peerSender struct {
+	peerId  int32
+	conn    net.Conn
+	writer  *bufio.Writer
+	queue   chan frame
+	done    chan bool
+	dropped *uint64 // frames dropped on a full queue, over every connection to the peer
+}
+
+func newPeerSender(peerId int32, conn net.Conn, dropped *uint64) *peerSender {
+	return &peerSender{peerId, conn, bufio.NewWriter(conn), make(chan frame, PEER_QUEUE_SIZE), make(chan bool), dropped}
+}
+
+func (r *Replica) runPeerSender(s *peerSender) {
+	ticker := time.NewTicker(FLUSH_INTERVAL)
+	defer ticker.Stop()
+	pending := false // a flushing frame was written since the last flush
+
+	for {
+		select {
+		case f := <-s.queue:
+			if _, err := s.writer.Write(f.data); err != nil {
+				r.peerDown(s.peerId, s.conn)
+				return
+			}
+			pending = pending || f.flush
+			if !pending || len(s.queue) > 0 {
+				continue
+			}
+		case <-ticker.C:
+			if s.writer.Buffered() == 0 {
+				continue
+			}
+		case <-s.done:
+			return
+		}
+
+		if err := s.writer.Flush(); err != nil {
+			r.peerDown(s.peerId, s.conn)
+			return
+		}
+		pending = false
+	}
+}
+
+func (s *peerSender) stop() {
+	close(s.done)
+}
+
+// Queues a frame without ever blocking the caller. A full queue means the peer or the
+// network cannot keep up; the frame is dropped and counted, and the protocol's resends
+// make up for it.
+func (s *peerSender) enqueue(f frame) {
+	select {
+	case s.queue <- f:
+	default:
+		if dropped := atomic.AddUint64(s.dropped, 1); dropped&(dropped-1) == 0 {
+			// log at powers of two so a stuck peer does not flood the log
+			log.Printf("Queue to peer %d is full, %d messages dropped so far\n", s.peerId, dropped)
+		}
+	}
+}
+
+func (r *Replica) sender(peerId int32) *peerSender {
+	r.peerLock.Lock()
+	defer r.peerLock.Unlock()
+	return r.peerSenders[peerId]
+}
+
+func (r *Replica) queueMsg(peerId int32, code uint8, msg interface{ Marshal(io.Writer) }, flush bool) {
+	if r.detachedSend != nil {
+		r.detachedSend(peerId, genericsmrproto.EncodeFrame(code, msg, r.Checksum))
+		return
+	}
+	s := r.sender(peerId)
+	if s == nil {
+		return // never connected
+	}
+	s.enqueue(frame{genericsmrproto.EncodeFrame(code, msg, r.Checksum), flush})
+}
+
+// Number of messages to a peer dropped because its queue was full
+func (r *Replica) PeerBackpressure(peerId int32) uint64 {
+	return atomic.LoadUint64(&r.peerDropped[peerId])
+}
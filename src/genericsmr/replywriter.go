@@ -0,0 +1,85 @@
+package genericsmr
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"pineapple/src/genericsmrproto"
+)
+
+// Replies waiting to be written to a client
+const CLIENT_QUEUE_SIZE = 16384
+
+// Writing side of a client connection. Replies, ABD and RMW alike, come from the
+// protocol loop, which must not wait on a slow client, so each one is marshalled by its
+// caller and queued; a single goroutine writes them in queue order and flushes whenever
+// the queue drains. A client that lets its queue fill up is disconnected.
+type ReplyWriter struct {
+	conn      net.Conn
+	writer    *bufio.Writer
+	queue     chan []byte
+	done      chan bool
+	closeOnce sync.Once
+	checksum  bool
+	sink      func(reply []byte) // takes the replies instead of conn, see NewReplySink
+}
+
+func NewReplyWriter(conn net.Conn, checksum bool) *ReplyWriter {
+	w := &ReplyWriter{conn: conn, writer: bufio.NewWriter(conn), queue: make(chan []byte, CLIENT_QUEUE_SIZE), done: make(chan bool), checksum: checksum}
+	go w.run()
+	return w
+}
+
+// A writer that hands every framed reply to sink as soon as it is written, on the
+// caller's goroutine. Lets a driver such as the simulator collect replies in order.
+func NewReplySink(sink func(reply []byte)) *ReplyWriter {
+	return &ReplyWriter{done: make(chan bool), sink: sink}
+}
+
+func (w *ReplyWriter) run() {
+	for {
+		select {
+		case reply := <-w.queue:
+			if _, err := w.writer.Write(reply); err != nil {
+				w.Close()
+				return
+			}
+			if len(w.queue) > 0 {
+				continue
+			}
+			if err := w.writer.Flush(); err != nil {
+				w.Close()
+				return
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Queues a reply, framed with its type, without ever blocking. If the connection is gone
+// the reply is discarded. If the queue is full the client is not reading its replies, so
+// the reply is dropped and the connection closed: the client sees it fail instead of
+// waiting on a reply that never comes.
+func (w *ReplyWriter) Write(code uint8, msg interface{ Marshal(io.Writer) }) {
+	if w.sink != nil {
+		w.sink(genericsmrproto.EncodeFrame(code, msg, w.checksum))
+		return
+	}
+	select {
+	case w.queue <- genericsmrproto.EncodeFrame(code, msg, w.checksum):
+	case <-w.done:
+	default:
+		log.Printf("Reply queue to client %v is full, closing the connection\n", w.conn.RemoteAddr())
+		w.Close()
+		w.conn.Close()
+	}
+}
+
+// Stops the writer; replies queued after this are discarded
+func (w *ReplyWriter) Close() {
+	w.closeOnce.Do(func() { close(w.done) })
+}
@@ -0,0 +1,41 @@
+package genericsmr
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"pineapple/src/genericsmrproto"
+)
+
+// A client that stops reading gets disconnected, and the replica never waits on it
+func TestReplyWriterSlowClient(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	w := NewReplyWriter(server, false)
+
+	wrote := make(chan bool)
+	go func() {
+		for i := 0; i < 2*CLIENT_QUEUE_SIZE; i++ {
+			w.Write(genericsmrproto.PROPOSE_REPLY, &genericsmrproto.ProposeReplyTS{CommandId: int32(i)})
+		}
+		close(wrote)
+	}()
+	select {
+	case <-wrote:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Write blocked on a client that does not read")
+	}
+
+	// whatever was written before the drop, the connection ends
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 4096)
+	for {
+		if _, err := client.Read(buf); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("connection left open")
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package genericsmr
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// How a replica reaches its peers and how clients reach it. Addresses are the entries
+// of PeerAddrList; each transport decides what they mean.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// Maps the name given on the command line to a transport. Unix sockets live in dir.
+func NewTransport(name string, dir string) (Transport, error) {
+	switch name {
+	case "tcp":
+		return TCPTransport{}, nil
+	case "unix":
+		return UnixTransport{dir}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
+
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (TCPTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+// Unix-domain sockets named after the address, for replicas sharing a host
+type UnixTransport struct {
+	Dir string
+}
+
+func (t UnixTransport) path(addr string) string {
+	return filepath.Join(t.Dir, "pineapple-"+addr+".sock")
+}
+
+func (t UnixTransport) Listen(addr string) (net.Listener, error) {
+	// a replica that crashed leaves its socket behind
+	os.Remove(t.path(addr))
+	return net.Listen("unix", t.path(addr))
+}
+
+func (t UnixTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("unix", t.path(addr))
+}
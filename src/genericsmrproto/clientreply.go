@@ -0,0 +1,45 @@
+package genericsmrproto
+
+import (
+	"fmt"
+	"io"
+
+	"pineapple/src/state"
+)
+
+// Reads the frame of one client reply. Every reply type is returned as a ProposeReplyTS:
+// READ replies carry a tag like ABD replies do, while PROPOSE_AND_READ replies only carry
+// the value read. A NOT_LEADER reply comes back as a failed one.
+func ReadClientReply(reader io.Reader) (uint8, *ProposeReplyTS, error) {
+	code, reply, _, err := ReadClientReplyOrRedirect(reader)
+	return code, reply, err
+}
+
+// Like ReadClientReply, but also returns the NotLeader of a NOT_LEADER reply, so the
+// request can be sent again to the leader.
+func ReadClientReplyOrRedirect(reader io.Reader) (uint8, *ProposeReplyTS, *NotLeader, error) {
+	code, body, err := ReadFrame(reader, nil)
+	if err != nil {
+		return code, nil, nil, err
+	}
+
+	switch code {
+	case PROPOSE_REPLY:
+		reply := new(ProposeReplyTS)
+		return code, reply, nil, Decode(body, reply)
+	case READ_REPLY:
+		var read ReadReply
+		err := Decode(body, &read)
+		return code, &ProposeReplyTS{OK: read.OK, CommandId: read.CommandId, Value: read.Value,
+			TagTimestamp: read.TagTimestamp, TagID: read.TagID, TagRMWCount: read.TagRMWCount}, nil, err
+	case PROPOSE_AND_READ_REPLY:
+		var pr ProposeAndReadReply
+		err := Decode(body, &pr)
+		return code, &ProposeReplyTS{OK: pr.OK, CommandId: pr.CommandId, Value: pr.Value}, nil, err
+	case NOT_LEADER:
+		nl := new(NotLeader)
+		err := Decode(body, nl)
+		return code, &ProposeReplyTS{OK: 0, CommandId: nl.CommandId, Value: state.NIL}, nl, err
+	}
+	return code, nil, nil, fmt.Errorf("unknown reply type %d", code)
+}
@@ -0,0 +1,149 @@
+package genericsmrproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Every message on a replica or client connection travels in a frame:
+// [magic 2][version 1][flags 1][type 1][body length 4][body crc32c 4][body]
+// The length keeps the stream in sync past frames the receiver cannot use.
+const FRAME_HEADER_SIZE = 13
+
+const FRAME_MAGIC uint16 = 0x5041 // "PA"
+
+// Wire versions this build speaks
+const (
+	WIRE_VERSION     uint8 = 3 // 2: tags carry an RMW count, 3: CommitUpTo carries the state machine
+	MIN_WIRE_VERSION uint8 = 3
+)
+
+// Frame flags
+const FLAG_CRC uint8 = 1 // the crc field covers the body
+
+// Largest body accepted; anything longer is taken for a corrupt header
+const MAX_FRAME_SIZE = 64 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// The stream cannot be read any further and the connection should be closed
+var (
+	ErrBadMagic      = errors.New("bad frame magic")
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+// Only the current frame is lost; the next one can still be read
+var (
+	ErrChecksum  = errors.New("frame checksum mismatch")
+	ErrVersion   = errors.New("unsupported frame version")
+	ErrMalformed = errors.New("malformed frame body")
+)
+
+// Can the connection go on after this error from ReadFrame or Decode
+func Skippable(err error) bool {
+	return err == ErrChecksum || err == ErrVersion || err == ErrMalformed
+}
+
+// Marshals msg into a frame of type code
+func EncodeFrame(code uint8, msg interface{ Marshal(io.Writer) }, checksum bool) []byte {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, FRAME_HEADER_SIZE))
+	msg.Marshal(&buf)
+	b := buf.Bytes()
+
+	binary.LittleEndian.PutUint16(b[0:2], FRAME_MAGIC)
+	b[2] = WIRE_VERSION
+	b[4] = code
+	binary.LittleEndian.PutUint32(b[5:9], uint32(len(b)-FRAME_HEADER_SIZE))
+	if checksum {
+		b[3] = FLAG_CRC
+		binary.LittleEndian.PutUint32(b[9:13], crc32.Checksum(b[FRAME_HEADER_SIZE:], crcTable))
+	}
+	return b
+}
+
+func WriteFrame(w io.Writer, code uint8, msg interface{ Marshal(io.Writer) }, checksum bool) error {
+	_, err := w.Write(EncodeFrame(code, msg, checksum))
+	return err
+}
+
+// Reads the next frame, returning its type and body. The body is read into buf when it
+// fits, so it is only valid until the next call with the same buf.
+func ReadFrame(r io.Reader, buf []byte) (uint8, []byte, error) {
+	var h [FRAME_HEADER_SIZE]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	if binary.LittleEndian.Uint16(h[0:2]) != FRAME_MAGIC {
+		return 0, nil, ErrBadMagic
+	}
+	size := binary.LittleEndian.Uint32(h[5:9])
+	if size > MAX_FRAME_SIZE {
+		return 0, nil, ErrFrameTooLarge
+	}
+
+	body := buf
+	if cap(body) < int(size) {
+		body = make([]byte, size)
+	}
+	body = body[:size]
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+
+	// hellos are read whatever their version, so that Handshake can report it
+	if h[4] != HELLO && (h[2] < MIN_WIRE_VERSION || h[2] > WIRE_VERSION) {
+		return h[4], nil, ErrVersion
+	}
+	if h[3]&FLAG_CRC != 0 && crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(h[9:13]) {
+		return h[4], nil, ErrChecksum
+	}
+	return h[4], body, nil
+}
+
+// Unmarshals a frame body into msg, which must use all of it
+func Decode(body []byte, msg interface{ Unmarshal(io.Reader) error }) error {
+	r := bytes.NewReader(body)
+	if err := msg.Unmarshal(r); err != nil || r.Len() != 0 {
+		return ErrMalformed
+	}
+	return nil
+}
+
+func NewHello(role uint8, id int32) *Hello {
+	return &Hello{WIRE_VERSION, MIN_WIRE_VERSION, role, id}
+}
+
+// Sends our Hello and reads the other side's. Both sides send theirs before checking,
+// so when the versions do not overlap each of them can tell the other one's version.
+func Handshake(w io.Writer, r io.Reader, hello *Hello) (*Hello, error) {
+	if err := WriteFrame(w, HELLO, hello, false); err != nil {
+		return nil, err
+	}
+
+	code, body, err := ReadFrame(r, nil)
+	if err == ErrBadMagic {
+		return nil, errors.New("not speaking the framed wire protocol (version 0?)")
+	} else if err != nil {
+		return nil, err
+	}
+	if code != HELLO {
+		return nil, fmt.Errorf("expected a hello, got message type %d", code)
+	}
+	other := new(Hello)
+	if err := Decode(body, other); err != nil {
+		return nil, err
+	}
+	if other.Version < MIN_WIRE_VERSION || other.MinVersion > WIRE_VERSION {
+		return other, fmt.Errorf("speaks wire versions %d-%d, we speak %d-%d",
+			other.MinVersion, other.Version, MIN_WIRE_VERSION, WIRE_VERSION)
+	}
+	return other, nil
+}
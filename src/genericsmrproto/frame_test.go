@@ -0,0 +1,116 @@
+package genericsmrproto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"pineapple/src/state"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, checksum := range []bool{false, true} {
+		var buf bytes.Buffer
+		sent := &Propose{CommandId: 7, Command: state.Command{Op: state.PUT, K: 3, V: 42}, Timestamp: 99}
+		if err := WriteFrame(&buf, PROPOSE, sent, checksum); err != nil {
+			t.Fatal(err)
+		}
+
+		code, body, err := ReadFrame(&buf, nil)
+		if err != nil || code != PROPOSE {
+			t.Fatalf("crc %v: ReadFrame = type %d, %v", checksum, code, err)
+		}
+		got := new(Propose)
+		if err := Decode(body, got); err != nil {
+			t.Fatal(err)
+		}
+		if *got != *sent {
+			t.Errorf("crc %v: got %+v, sent %+v", checksum, *got, *sent)
+		}
+	}
+}
+
+// A flipped body bit is caught with a CRC, and only costs that frame
+func TestFrameChecksum(t *testing.T) {
+	bad := EncodeFrame(READ, &Read{CommandId: 1, Key: 5}, true)
+	bad[len(bad)-1] ^= 1
+	stream := bytes.NewReader(append(bad, EncodeFrame(READ, &Read{CommandId: 2, Key: 6}, true)...))
+
+	code, _, err := ReadFrame(stream, nil)
+	if err != ErrChecksum || code != READ {
+		t.Fatalf("corrupt frame: type %d, %v; want %d, %v", code, err, READ, ErrChecksum)
+	}
+	if !Skippable(err) {
+		t.Error("a checksum mismatch should only cost one frame")
+	}
+	_, body, err := ReadFrame(stream, nil)
+	if err != nil {
+		t.Fatalf("frame after the corrupt one: %v", err)
+	}
+	var read Read
+	if err := Decode(body, &read); err != nil || read.CommandId != 2 {
+		t.Errorf("frame after the corrupt one = %+v, %v", read, err)
+	}
+
+	// without the flag the crc field is not checked
+	unchecked := EncodeFrame(READ, &Read{CommandId: 1, Key: 5}, false)
+	unchecked[len(unchecked)-1] ^= 1
+	if _, _, err := ReadFrame(bytes.NewReader(unchecked), nil); err != nil {
+		t.Errorf("frame without a crc: %v", err)
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	frame := func() []byte { return EncodeFrame(READ, &Read{CommandId: 1, Key: 5}, false) }
+
+	magic := frame()
+	magic[0] ^= 0xff
+	if _, _, err := ReadFrame(bytes.NewReader(magic), nil); err != ErrBadMagic || Skippable(err) {
+		t.Errorf("bad magic: %v", err)
+	}
+
+	version := frame()
+	version[2] = WIRE_VERSION + 1
+	if _, _, err := ReadFrame(bytes.NewReader(version), nil); err != ErrVersion || !Skippable(err) {
+		t.Errorf("newer version: %v", err)
+	}
+
+	large := frame()
+	large[8] = 0xff // length above MAX_FRAME_SIZE
+	if _, _, err := ReadFrame(bytes.NewReader(large), nil); err != ErrFrameTooLarge || Skippable(err) {
+		t.Errorf("huge length: %v", err)
+	}
+
+	torn := frame()
+	if _, _, err := ReadFrame(bytes.NewReader(torn[:len(torn)-1]), nil); err != io.ErrUnexpectedEOF {
+		t.Errorf("torn body: %v", err)
+	}
+
+	// a body with bytes left over is not the message it claims to be
+	_, body, _ := ReadFrame(bytes.NewReader(frame()), nil)
+	if err := Decode(append(body, 0), new(Read)); err != ErrMalformed {
+		t.Errorf("trailing bytes: %v", err)
+	}
+	if err := Decode(body[:3], new(Read)); err != ErrMalformed {
+		t.Errorf("short body: %v", err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	var toServer, toClient bytes.Buffer
+	WriteFrame(&toClient, HELLO, NewHello(ROLE_REPLICA, 2), false)
+	other, err := Handshake(&toServer, &toClient, NewHello(ROLE_CLIENT, -1))
+	if err != nil || other.Role != ROLE_REPLICA || other.Id != 2 {
+		t.Fatalf("Handshake = %+v, %v", other, err)
+	}
+	if code, _, err := ReadFrame(&toServer, nil); err != nil || code != HELLO {
+		t.Errorf("sent type %d, %v; want a hello", code, err)
+	}
+
+	// a peer that only speaks older versions is told apart from a corrupt stream
+	toClient.Reset()
+	WriteFrame(&toClient, HELLO, &Hello{MIN_WIRE_VERSION - 1, MIN_WIRE_VERSION - 1, ROLE_REPLICA, 2}, false)
+	if _, err := Handshake(io.Discard, &toClient, NewHello(ROLE_CLIENT, -1)); err == nil {
+		t.Error("handshake with a peer speaking only older versions succeeded")
+	}
+}
@@ -15,6 +15,34 @@ const (
 	GENERIC_SMR_BEACON_REPLY
 )
 
+// First frame each side of a connection sends, see Handshake.
+// Lets peers and clients share one listening port.
+const HELLO uint8 = 0xFF
+
+// Reply of a replica that is not the leader to a request only the leader takes, such
+// as an RMW. Says where to send it instead.
+const NOT_LEADER uint8 = 0xFE
+
+// What the OK field of a client reply says about the request
+const (
+	REPLY_FAILED uint8 = iota // it did not take effect
+	REPLY_OK
+	REPLY_UNKNOWN // the replica gave up on it, but it may still take effect
+)
+
+// Who sent a Hello
+const (
+	ROLE_REPLICA uint8 = iota
+	ROLE_CLIENT
+)
+
+type Hello struct {
+	Version    uint8 // newest wire version the sender speaks
+	MinVersion uint8 // oldest wire version the sender speaks
+	Role       uint8
+	Id         int32 // replica id, -1 for clients
+}
+
 type Propose struct {
 	CommandId int32
 	Command   state.Command
@@ -27,10 +55,20 @@ type ProposeReply struct {
 }
 
 type ProposeReplyTS struct {
-	OK        uint8
-	CommandId int32
-	Value     state.Value
-	Timestamp int64
+	OK           uint8
+	CommandId    int32
+	Value        state.Value
+	Timestamp    int64
+	TagTimestamp int64 // tag of the returned value
+	TagID        int32
+	TagRMWCount  int32
+	Previous     state.Value // value of the key before an RMW was applied
+}
+
+type NotLeader struct {
+	CommandId  int32
+	LeaderId   int32  // -1 if the replica does not know the leader
+	LeaderAddr []byte // host:port clients reach the leader at
 }
 
 type Read struct {
@@ -39,8 +77,12 @@ type Read struct {
 }
 
 type ReadReply struct {
-	CommandId int32
-	Value     state.Value
+	OK           uint8
+	CommandId    int32
+	Value        state.Value
+	TagTimestamp int64 // tag of the returned value
+	TagID        int32
+	TagRMWCount  int32
 }
 
 type ProposeAndRead struct {
@@ -52,7 +94,7 @@ type ProposeAndRead struct {
 type ProposeAndReadReply struct {
 	OK        uint8
 	CommandId int32
-	Value     state.Value
+	Value     state.Value // value of Key when the command was applied
 }
 
 // handling stalls and failures
@@ -77,3 +119,9 @@ type BeTheLeaderArgs struct {
 
 type BeTheLeaderReply struct {
 }
+
+type StepDownArgs struct {
+}
+
+type StepDownReply struct {
+}
@@ -1,10 +1,17 @@
 package genericsmrproto
 
 import (
+	"bufio"
+	"encoding/binary"
 	"io"
 	"sync"
 )
 
+type byteReader interface {
+	io.Reader
+	ReadByte() (c byte, err error)
+}
+
 func (t *Propose) BinarySize() (nbytes int, sizeKnown bool) {
 	return 0, false
 }
@@ -483,27 +490,57 @@ func (p *ReadReplyCache) Put(t *ReadReply) {
 	p.mu.Unlock()
 }
 func (t *ReadReply) Marshal(wire io.Writer) {
-	var b [4]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:4]
+	bs = b[:5]
+	bs[0] = byte(t.OK)
 	tmp32 := t.CommandId
-	bs[0] = byte(tmp32)
-	bs[1] = byte(tmp32 >> 8)
-	bs[2] = byte(tmp32 >> 16)
-	bs[3] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32 >> 16)
+	bs[4] = byte(tmp32 >> 24)
 	wire.Write(bs)
 	t.Value.Marshal(wire)
+	bs = b[:16]
+	tmp64 := t.TagTimestamp
+	bs[0] = byte(tmp64)
+	bs[1] = byte(tmp64 >> 8)
+	bs[2] = byte(tmp64 >> 16)
+	bs[3] = byte(tmp64 >> 24)
+	bs[4] = byte(tmp64 >> 32)
+	bs[5] = byte(tmp64 >> 40)
+	bs[6] = byte(tmp64 >> 48)
+	bs[7] = byte(tmp64 >> 56)
+	tmp32 = t.TagID
+	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 8)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 24)
+	tmp32 = t.TagRMWCount
+	bs[12] = byte(tmp32)
+	bs[13] = byte(tmp32 >> 8)
+	bs[14] = byte(tmp32 >> 16)
+	bs[15] = byte(tmp32 >> 24)
+	wire.Write(bs)
 }
 
 func (t *ReadReply) Unmarshal(wire io.Reader) error {
-	var b [4]byte
+	var b [16]byte
 	var bs []byte
-	bs = b[:4]
-	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+	bs = b[:5]
+	if _, err := io.ReadAtLeast(wire, bs, 5); err != nil {
 		return err
 	}
-	t.CommandId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.OK = uint8(bs[0])
+	t.CommandId = int32((uint32(bs[1]) | (uint32(bs[2]) << 8) | (uint32(bs[3]) << 16) | (uint32(bs[4]) << 24)))
 	t.Value.Unmarshal(wire)
+	bs = b[:16]
+	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
+		return err
+	}
+	t.TagTimestamp = int64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
+	t.TagID = int32((uint32(bs[8]) | (uint32(bs[9]) << 8) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 24)))
+	t.TagRMWCount = int32((uint32(bs[12]) | (uint32(bs[13]) << 8) | (uint32(bs[14]) << 16) | (uint32(bs[15]) << 24)))
 	return nil
 }
 
@@ -699,7 +736,7 @@ func (p *ProposeReplyTSCache) Put(t *ProposeReplyTS) {
 	p.mu.Unlock()
 }
 func (t *ProposeReplyTS) Marshal(wire io.Writer) {
-	var b [8]byte
+	var b [24]byte
 	var bs []byte
 	bs = b[:5]
 	bs[0] = byte(t.OK)
@@ -710,7 +747,7 @@ func (t *ProposeReplyTS) Marshal(wire io.Writer) {
 	bs[4] = byte(tmp32 >> 24)
 	wire.Write(bs)
 	t.Value.Marshal(wire)
-	bs = b[:8]
+	bs = b[:24]
 	tmp64 := t.Timestamp
 	bs[0] = byte(tmp64)
 	bs[1] = byte(tmp64 >> 8)
@@ -720,11 +757,31 @@ func (t *ProposeReplyTS) Marshal(wire io.Writer) {
 	bs[5] = byte(tmp64 >> 40)
 	bs[6] = byte(tmp64 >> 48)
 	bs[7] = byte(tmp64 >> 56)
+	tmp64 = t.TagTimestamp
+	bs[8] = byte(tmp64)
+	bs[9] = byte(tmp64 >> 8)
+	bs[10] = byte(tmp64 >> 16)
+	bs[11] = byte(tmp64 >> 24)
+	bs[12] = byte(tmp64 >> 32)
+	bs[13] = byte(tmp64 >> 40)
+	bs[14] = byte(tmp64 >> 48)
+	bs[15] = byte(tmp64 >> 56)
+	tmp32 = t.TagID
+	bs[16] = byte(tmp32)
+	bs[17] = byte(tmp32 >> 8)
+	bs[18] = byte(tmp32 >> 16)
+	bs[19] = byte(tmp32 >> 24)
+	tmp32 = t.TagRMWCount
+	bs[20] = byte(tmp32)
+	bs[21] = byte(tmp32 >> 8)
+	bs[22] = byte(tmp32 >> 16)
+	bs[23] = byte(tmp32 >> 24)
 	wire.Write(bs)
+	t.Previous.Marshal(wire)
 }
 
 func (t *ProposeReplyTS) Unmarshal(wire io.Reader) error {
-	var b [8]byte
+	var b [24]byte
 	var bs []byte
 	bs = b[:5]
 	if _, err := io.ReadAtLeast(wire, bs, 5); err != nil {
@@ -733,10 +790,169 @@ func (t *ProposeReplyTS) Unmarshal(wire io.Reader) error {
 	t.OK = uint8(bs[0])
 	t.CommandId = int32((uint32(bs[1]) | (uint32(bs[2]) << 8) | (uint32(bs[3]) << 16) | (uint32(bs[4]) << 24)))
 	t.Value.Unmarshal(wire)
+	bs = b[:24]
+	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
+		return err
+	}
+	t.Timestamp = int64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
+	t.TagTimestamp = int64((uint64(bs[8]) | (uint64(bs[9]) << 8) | (uint64(bs[10]) << 16) | (uint64(bs[11]) << 24) | (uint64(bs[12]) << 32) | (uint64(bs[13]) << 40) | (uint64(bs[14]) << 48) | (uint64(bs[15]) << 56)))
+	t.TagID = int32((uint32(bs[16]) | (uint32(bs[17]) << 8) | (uint32(bs[18]) << 16) | (uint32(bs[19]) << 24)))
+	t.TagRMWCount = int32((uint32(bs[20]) | (uint32(bs[21]) << 8) | (uint32(bs[22]) << 16) | (uint32(bs[23]) << 24)))
+	t.Previous.Unmarshal(wire)
+	return nil
+}
+
+func (t *Hello) BinarySize() (nbytes int, sizeKnown bool) {
+	return 7, true
+}
+
+type HelloCache struct {
+	mu    sync.Mutex
+	cache []*Hello
+}
+
+func NewHelloCache() *HelloCache {
+	c := &HelloCache{}
+	c.cache = make([]*Hello, 0)
+	return c
+}
+
+func (p *HelloCache) Get() *Hello {
+	var t *Hello
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &Hello{}
+	}
+	return t
+}
+
+func (p *HelloCache) Put(t *Hello) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+
+func (t *Hello) Marshal(wire io.Writer) {
+	var b [7]byte
+	var bs []byte
+	bs = b[:7]
+	bs[0] = byte(t.Version)
+	bs[1] = byte(t.MinVersion)
+	bs[2] = byte(t.Role)
+	tmp32 := t.Id
+	bs[3] = byte(tmp32)
+	bs[4] = byte(tmp32 >> 8)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 24)
+	wire.Write(bs)
+}
+
+func (t *Hello) Unmarshal(wire io.Reader) error {
+	var b [7]byte
+	var bs []byte
+	bs = b[:7]
+	if _, err := io.ReadAtLeast(wire, bs, 7); err != nil {
+		return err
+	}
+	t.Version = uint8(bs[0])
+	t.MinVersion = uint8(bs[1])
+	t.Role = uint8(bs[2])
+	t.Id = int32((uint32(bs[3]) | (uint32(bs[4]) << 8) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 24)))
+	return nil
+}
+
+func (t *NotLeader) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type NotLeaderCache struct {
+	mu    sync.Mutex
+	cache []*NotLeader
+}
+
+func NewNotLeaderCache() *NotLeaderCache {
+	c := &NotLeaderCache{}
+	c.cache = make([]*NotLeader, 0)
+	return c
+}
+
+func (p *NotLeaderCache) Get() *NotLeader {
+	var t *NotLeader
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &NotLeader{}
+	}
+	return t
+}
+
+func (p *NotLeaderCache) Put(t *NotLeader) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+
+func (t *NotLeader) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.CommandId
+	bs[0] = byte(tmp32)
+	bs[1] = byte(tmp32 >> 8)
+	bs[2] = byte(tmp32 >> 16)
+	bs[3] = byte(tmp32 >> 24)
+	tmp32 = t.LeaderId
+	bs[4] = byte(tmp32)
+	bs[5] = byte(tmp32 >> 8)
+	bs[6] = byte(tmp32 >> 16)
+	bs[7] = byte(tmp32 >> 24)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.LeaderAddr))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:1]
+		bs[0] = byte(t.LeaderAddr[i])
+		wire.Write(bs)
+	}
+}
+
+func (t *NotLeader) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [10]byte
+	var bs []byte
 	bs = b[:8]
 	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
 		return err
 	}
-	t.Timestamp = int64((uint64(bs[0]) | (uint64(bs[1]) << 8) | (uint64(bs[2]) << 16) | (uint64(bs[3]) << 24) | (uint64(bs[4]) << 32) | (uint64(bs[5]) << 40) | (uint64(bs[6]) << 48) | (uint64(bs[7]) << 56)))
+	t.CommandId = int32((uint32(bs[0]) | (uint32(bs[1]) << 8) | (uint32(bs[2]) << 16) | (uint32(bs[3]) << 24)))
+	t.LeaderId = int32((uint32(bs[4]) | (uint32(bs[5]) << 8) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 24)))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.LeaderAddr = make([]byte, alen1)
+	for i := int64(0); i < alen1; i++ {
+		bs = b[:1]
+		if _, err := io.ReadAtLeast(wire, bs, 1); err != nil {
+			return err
+		}
+		t.LeaderAddr[i] = byte(bs[0])
+	}
 	return nil
 }
@@ -0,0 +1,378 @@
+package history
+
+import (
+	"sort"
+
+	"pineapple/src/state"
+)
+
+// Linearizability checking in the style of Wing & Gong, with Lowe's memoization (as in
+// Porcupine). Each key is a register checked on its own, which is enough since
+// linearizability is compositional. A key starts out holding state.NIL.
+
+// Outcome for one key
+type KeyResult struct {
+	Key          state.Key
+	Ops          int
+	Linearizable bool
+	// A short stretch of the key's history that is not linearizable either, see Shrink.
+	// Only set when the key is not linearizable.
+	Counterexample []*Op
+}
+
+// Checks every key of a history, in key order
+func Check(ops []*Op) []KeyResult {
+	byKey := make(map[state.Key][]*Op)
+	for _, op := range ops {
+		if op.Command.Op == state.GET && !op.Done() {
+			continue // a read that never returned tells nothing
+		}
+		byKey[op.Command.K] = append(byKey[op.Command.K], op)
+	}
+	keys := make([]state.Key, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	results := make([]KeyResult, 0, len(keys))
+	for _, k := range keys {
+		res := KeyResult{Key: k, Ops: len(byKey[k]), Linearizable: Linearizable(byKey[k])}
+		if !res.Linearizable {
+			res.Counterexample = Shrink(byKey[k])
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// Contents of the register. A history cut from the middle of a longer one starts out with
+// a value that is not known until an operation reveals it, and may not know whether the
+// key was ever written even then.
+type register struct {
+	known   bool
+	value   state.Value
+	written writtenness // only meaningful if known
+}
+
+// Whether the key of a register was ever written, which conditional RMWs depend on
+type writtenness uint8
+
+const (
+	maybeWritten writtenness = iota
+	neverWritten
+	wasWritten
+)
+
+// The value of a register that starts out empty
+var initialRegister = register{true, state.NIL, neverWritten}
+
+// Applies op to the register. ok is false if the reply could not have come from it.
+func step(reg register, op *Op) (next register, ok bool) {
+	if op.relaxed == anyEffect {
+		return register{}, true
+	}
+	observed := op.Done() && op.Observed && op.relaxed != unchecked
+	switch op.Command.Op {
+	case state.GET:
+		if !observed {
+			return reg, true
+		}
+		if reg.known {
+			return reg, reg.value == op.Value
+		}
+		next = register{true, op.Value, maybeWritten}
+		if op.Value != state.NIL {
+			next.written = wasWritten
+		}
+		return next, true
+	case state.PUT:
+		return register{true, op.Command.V, wasWritten}, !observed || op.Value == op.Command.V
+	}
+	if !state.IsRMW(op.Command.Op) {
+		return reg, false
+	}
+	if !reg.known {
+		if !observed {
+			return reg, true
+		}
+		return register{true, op.Value, wasWritten}, op.Command.Yields(op.Previous, op.Value)
+	}
+
+	v, _ := op.Command.Modify(reg.value, reg.written == wasWritten)
+	if reg.written == maybeWritten {
+		// only NIL leaves it open; the RMW gives one of two values
+		if other, _ := op.Command.Modify(reg.value, true); other != v {
+			if !observed {
+				return register{}, true
+			}
+			if op.Value == other {
+				v = other
+			}
+		}
+	}
+	if observed && (op.Previous != reg.value || op.Value != v) {
+		return reg, false
+	}
+	return register{true, v, wasWritten}, true
+}
+
+// How much of an op Shrink leaves out
+type relaxation uint8
+
+const (
+	checked   relaxation = iota
+	unchecked            // takes effect, but its reply is not checked
+	anyEffect            // may leave any value in the register
+)
+
+func (op *Op) relax(r relaxation) *Op {
+	c := *op
+	c.relaxed = r
+	return &c
+}
+
+// An invocation or a return in the timeline of a key
+type entry struct {
+	op     int
+	isCall bool
+	time   int64
+	match  *entry // return of a call
+	prev   *entry
+	next   *entry
+}
+
+// Builds the timeline of ops as a list after a sentinel. An op that returns at the same
+// time another is invoked counts as concurrent with it.
+func timeline(ops []*Op) *entry {
+	entries := make([]*entry, 0, 2*len(ops))
+	for i, op := range ops {
+		call := &entry{op: i, isCall: true, time: op.Invoke}
+		ret := &entry{op: i, time: op.Return}
+		call.match = ret
+		entries = append(entries, call, ret)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		return entries[i].isCall && !entries[j].isCall
+	})
+
+	head := &entry{op: -1}
+	last := head
+	for _, e := range entries {
+		last.next = e
+		e.prev = last
+		last = e
+	}
+	return head
+}
+
+// Takes a call and its return out of the list
+func lift(call *entry) {
+	call.prev.next = call.next
+	if call.next != nil {
+		call.next.prev = call.prev
+	}
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// Puts back what lift took out
+func unlift(call *entry) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	if call.next != nil {
+		call.next.prev = call
+	}
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h = (h ^ w) * 1099511628211
+	}
+	return h
+}
+
+func (b bitset) equal(c bitset) bool {
+	for i := range b {
+		if b[i] != c[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type configuration struct {
+	linearized bitset
+	value      register
+}
+
+// Is there an order of ops, consistent with real time, in which every reply is right
+func Linearizable(ops []*Op) bool {
+	return linearizable(ops, initialRegister)
+}
+
+func linearizable(ops []*Op, value register) bool {
+	head := timeline(ops)
+	linearized := make(bitset, (len(ops)+63)/64)
+	cache := make(map[uint64][]configuration)
+	type frame struct {
+		call  *entry
+		value register
+	}
+	var stack []frame
+
+	seen := func(b bitset, v register) bool {
+		h := b.hash() ^ uint64(v.value)*0x9e3779b97f4a7c15
+		if v.known {
+			h = ^h
+		}
+		for _, c := range cache[h] {
+			if c.value == v && c.linearized.equal(b) {
+				return true
+			}
+		}
+		cache[h] = append(cache[h], configuration{append(bitset(nil), b...), v})
+		return false
+	}
+
+	e := head.next
+	for head.next != nil {
+		if e.isCall {
+			if next, ok := step(value, ops[e.op]); ok {
+				linearized.set(e.op)
+				if !seen(linearized, next) {
+					stack = append(stack, frame{e, value})
+					value = next
+					lift(e)
+					e = head.next
+					continue
+				}
+				linearized.clear(e.op)
+			}
+			e = e.next
+		} else {
+			// the op that returns here must come before the ops after it, try another order
+			if len(stack) == 0 {
+				return false
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			value = top.value
+			linearized.clear(top.call.op)
+			unlift(top.call)
+			e = top.call.next
+		}
+	}
+	return true
+}
+
+// Largest stretch of history Shrink tries to drop reads from, one check per read
+const shrinkReadsLimit = 2000
+
+// Cuts a history that is not linearizable down to a short stretch that is not either.
+// Only the ops of the stretch have their replies checked. Ops that overlap its end keep
+// their effect, since they may have been linearized inside it, and ops that overlap its
+// start may have left the register holding anything. Every op outside the stretch can
+// be linearized after it or before those overlapping its start, so any linearization of
+// the whole history would also be one of the stretch: a stretch that fails is a real
+// counterexample. Shrink looks for the shortest failing stretch from the start, then the
+// latest start that still fails, then drops the reads that are not needed to fail.
+func Shrink(ops []*Op) []*Op {
+	sorted := append([]*Op(nil), ops...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Invoke < sorted[j].Invoke })
+	n := len(sorted)
+
+	window := func(lo int, hi int, skip map[int]bool) ([]*Op, register) {
+		var w []*Op
+		initial := initialRegister
+		if lo > 0 {
+			initial = register{}
+			for _, op := range sorted[:lo] {
+				if op.Return >= sorted[lo].Invoke && op.Command.Op != state.GET {
+					w = append(w, op.relax(anyEffect))
+				}
+			}
+		}
+		end := int64(-1 << 63)
+		for i := lo; i < hi; i++ {
+			if skip[i] {
+				continue
+			}
+			w = append(w, sorted[i])
+			if sorted[i].Done() && sorted[i].Return > end {
+				end = sorted[i].Return
+			}
+		}
+		for _, op := range sorted[hi:] {
+			if op.Invoke > end {
+				break
+			}
+			if op.Command.Op != state.GET {
+				w = append(w, op.relax(unchecked))
+			}
+		}
+		return w, initial
+	}
+	fails := func(lo int, hi int, skip map[int]bool) bool {
+		w, initial := window(lo, hi, skip)
+		return !linearizable(w, initial)
+	}
+
+	// shortest failing stretch from the start; failing usually keeps failing as it grows
+	hi := 1
+	for hi < n && !fails(0, hi, nil) {
+		hi *= 2
+	}
+	if hi > n {
+		hi = n
+	}
+	from := hi/2 + 1
+	if shorter := from + sort.Search(hi-from, func(i int) bool { return fails(0, from+i, nil) }); shorter < hi && fails(0, shorter, nil) {
+		hi = shorter
+	}
+
+	// latest start that still fails
+	lo := 0
+	d := 1
+	for ; d < hi && !fails(hi-d, hi, nil); d *= 2 {
+	}
+	if d < hi {
+		lo = hi - d
+		from := hi - d/2 - 1
+		if later := from - sort.Search(d/2, func(m int) bool { return fails(from-m, hi, nil) }); later > lo && fails(later, hi, nil) {
+			lo = later
+		}
+	}
+
+	skip := make(map[int]bool)
+	if hi-lo <= shrinkReadsLimit {
+		for i := hi - 1; i >= lo; i-- {
+			if sorted[i].Command.Op != state.GET {
+				continue
+			}
+			skip[i] = true
+			if !fails(lo, hi, skip) {
+				delete(skip, i)
+			}
+		}
+	}
+	w, _ := window(lo, hi, skip)
+	sort.SliceStable(w, func(i, j int) bool { return w[i].Invoke < w[j].Invoke })
+	return w
+}
@@ -0,0 +1,103 @@
+package history
+
+import (
+	"strings"
+	"testing"
+
+	"pineapple/src/state"
+)
+
+// A request of client 0 on key 1 that returned value, or Pending for no reply
+func op(cmd state.Command, invoke int64, ret int64, previous state.Value, value state.Value) *Op {
+	cmd.K = 1
+	return &Op{Command: cmd, Invoke: invoke, Return: ret, Observed: true, Value: value, Previous: previous}
+}
+
+func put(v state.Value, invoke int64, ret int64) *Op {
+	return op(state.Command{Op: state.PUT, V: v}, invoke, ret, 0, v)
+}
+
+func get(invoke int64, ret int64, value state.Value) *Op {
+	return op(state.Command{Op: state.GET}, invoke, ret, 0, value)
+}
+
+func TestLinearizable(t *testing.T) {
+	faa := state.Command{Op: state.FETCH_ADD, V: 1}
+	condSet := state.Command{Op: state.COND_SET, V: 7}
+	for _, c := range []struct {
+		name string
+		ops  []*Op
+		want bool
+	}{
+		{"empty", nil, true},
+		{"read of an empty key", []*Op{get(0, 1, state.NIL)}, true},
+		{"sequential", []*Op{put(5, 0, 1), get(2, 3, 5), put(6, 4, 5), get(6, 7, 6)}, true},
+		{"stale read", []*Op{put(5, 0, 1), put(6, 2, 3), get(4, 5, 5)}, false},
+		{"concurrent writes in either order", []*Op{put(5, 0, 10), put(6, 1, 9), get(11, 12, 5)}, true},
+		{"new then old value", []*Op{put(5, 0, 10), put(6, 0, 10), get(1, 2, 6), get(3, 4, 5), get(5, 6, 6)}, false},
+		{"write without a reply", []*Op{put(5, 0, Pending), get(1, 2, 5), get(3, 4, 5)}, true},
+		{"write without a reply, read back and lost", []*Op{put(5, 0, Pending), get(1, 2, 5), get(3, 4, state.NIL)}, false},
+		{"fetch-and-add", []*Op{put(5, 0, 1), op(faa, 2, 3, 5, 6), op(faa, 2, 4, 6, 7), get(5, 6, 7)}, true},
+		{"fetch-and-add applied twice", []*Op{put(5, 0, 1), op(faa, 2, 3, 5, 6), op(faa, 4, 5, 5, 6)}, false},
+		{"COND_SET on an empty key", []*Op{op(condSet, 0, 1, state.NIL, 7)}, true},
+		{"COND_SET on a key written with NIL", []*Op{put(state.NIL, 0, 1), op(condSet, 2, 3, state.NIL, state.NIL)}, true},
+		{"COND_SET sets a key written with NIL", []*Op{put(state.NIL, 0, 1), op(condSet, 2, 3, state.NIL, 7)}, false},
+		{"COND_SET leaves an empty key", []*Op{op(condSet, 0, 1, state.NIL, state.NIL)}, false},
+	} {
+		if got := Linearizable(c.ops); got != c.want {
+			t.Errorf("%s: Linearizable = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// Keys are checked on their own, and a counterexample is only given for the keys that fail
+func TestCheck(t *testing.T) {
+	other := put(5, 0, 1)
+	other.Command.K = 2
+	pendingRead := get(0, Pending, 0)
+	pendingRead.Command.K = 3
+	results := Check([]*Op{put(5, 0, 1), put(6, 2, 3), get(4, 5, 5), other, pendingRead})
+	if len(results) != 2 {
+		t.Fatalf("Check returned %d keys, want 2 without the key only a pending read touched", len(results))
+	}
+	if r := results[0]; r.Key != 1 || r.Ops != 3 || r.Linearizable || len(r.Counterexample) == 0 {
+		t.Errorf("key 1: %+v", r)
+	}
+	if r := results[1]; r.Key != 2 || !r.Linearizable || r.Counterexample != nil {
+		t.Errorf("key 2: %+v", r)
+	}
+}
+
+// A stale read after a long good history shrinks to the writes and read around it
+func TestShrink(t *testing.T) {
+	var ops []*Op
+	at := int64(0)
+	for v := state.Value(1); v <= 200; v++ {
+		ops = append(ops, put(v, at, at+1), get(at+2, at+3, v))
+		at += 4
+	}
+	stale := get(at, at+1, 150)
+	ops = append(ops, stale)
+	for v := state.Value(201); v <= 300; v++ {
+		at += 4
+		ops = append(ops, put(v, at, at+1))
+	}
+	if Linearizable(ops) {
+		t.Fatal("a history with a stale read is linearizable")
+	}
+
+	shrunk := Shrink(ops)
+	if len(shrunk) > 3 {
+		var lines []string
+		for _, op := range shrunk {
+			lines = append(lines, op.Format(0))
+		}
+		t.Errorf("shrunk to %d ops:\n%s", len(shrunk), strings.Join(lines, "\n"))
+	}
+	if shrunk[len(shrunk)-1] != stale {
+		t.Errorf("the stale read is not the last op of the counterexample")
+	}
+	if linearizable(shrunk, register{}) {
+		t.Error("the counterexample is linearizable")
+	}
+}
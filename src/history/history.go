@@ -0,0 +1,215 @@
+// Package history records what clients asked the replicas and what they answered, and
+// checks that the answers are linearizable.
+//
+// A history file holds one line per event, written in the order the events happened:
+//
+//	i <client> <id> <op> <key> <v> <e> <time>
+//	r <client> <id> <ok> <observed> <value> <previous> <tag timestamp> <tag id> <tag rmw count> <time>
+//
+// An invocation is logged before the request is sent, and a return once the reply is
+// read, with times in nanoseconds. A request without a return, or whose reply was not OK,
+// may or may not have taken effect. observed is 0 when the reply's value is not about the
+// request's key (the reply to a PROPOSE_AND_READ).
+package history
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"pineapple/src/state"
+)
+
+// Return time of requests that never got an OK reply
+const Pending = math.MaxInt64
+
+// One client request and its reply
+type Op struct {
+	Source   string // file the request was read from
+	Client   int
+	Id       int32
+	Command  state.Command
+	Invoke   int64 // ns
+	Return   int64 // ns, Pending if there was no OK reply
+	Observed bool  // Value and Previous are about Command.K
+	Value    state.Value
+	Previous state.Value // value an RMW was applied to
+
+	TagTimestamp int64
+	TagID        int32
+	TagRMWCount  int32
+
+	relaxed relaxation // set on the ops of a counterexample that are only partly checked
+}
+
+func (op *Op) Done() bool {
+	return op.Return != Pending
+}
+
+// Writes a history file. Safe to use from several goroutines.
+type Logger struct {
+	sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func NewLogger(path string) (*Logger, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{file: f, writer: bufio.NewWriter(f)}, nil
+}
+
+// Must be called before the request is sent
+func (l *Logger) Invoke(client int, id int32, cmd state.Command) {
+	l.Lock()
+	fmt.Fprintf(l.writer, "i %d %d %d %d %d %d %d\n", client, id, cmd.Op, cmd.K, cmd.V, cmd.E, time.Now().UnixNano())
+	l.Unlock()
+}
+
+func (l *Logger) Return(client int, id int32, ok bool, observed bool, value state.Value, previous state.Value,
+	tagTimestamp int64, tagID int32, tagRMWCount int32) {
+	l.Lock()
+	fmt.Fprintf(l.writer, "r %d %d %d %d %d %d %d %d %d %d\n", client, id, flag(ok), flag(observed), value, previous,
+		tagTimestamp, tagID, tagRMWCount, time.Now().UnixNano())
+	l.Unlock()
+}
+
+func (l *Logger) Flush() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.writer.Flush()
+}
+
+func (l *Logger) Close() error {
+	if err := l.Flush(); err != nil {
+		return err
+	}
+	return l.file.Close()
+}
+
+// Describes op for a report, with times in ms since start
+func (op *Op) Format(start int64) string {
+	ms := func(t int64) string {
+		return fmt.Sprintf("%.3fms", float64(t-start)/1e6)
+	}
+	ret := "no reply"
+	if op.Done() {
+		ret = ms(op.Return)
+	}
+
+	cmd := OpName(op.Command.Op)
+	switch op.Command.Op {
+	case state.GET:
+	case state.COMPARE_SWAP:
+		cmd += fmt.Sprintf("(%d, %d)", op.Command.E, op.Command.V)
+	default:
+		cmd += fmt.Sprintf("(%d)", op.Command.V)
+	}
+
+	result := "?"
+	if op.Done() && op.Observed {
+		result = fmt.Sprintf("%d, tag (%d, %d, %d)", op.Value, op.TagTimestamp, op.TagID, op.TagRMWCount)
+		if state.IsRMW(op.Command.Op) {
+			result = fmt.Sprintf("%d -> %s", op.Previous, result)
+		}
+	} else if op.Done() {
+		result = "ok"
+	}
+
+	switch op.relaxed {
+	case unchecked:
+		result += " (reply not checked)"
+	case anyEffect:
+		result += " (may have left any value)"
+	}
+
+	source := ""
+	if op.Source != "" {
+		source = op.Source + " "
+	}
+	return fmt.Sprintf("[%s, %s] %sclient %d request %d: %s = %s", ms(op.Invoke), ret, source, op.Client, op.Id, cmd, result)
+}
+
+func flag(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Reads a history file. Requests come back in the order they were invoked.
+func Load(r io.Reader, source string) ([]*Op, error) {
+	var ops []*Op
+	byId := make(map[[2]int64]*Op)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		var client, ok, observed int
+		var id int32
+		var at int64
+		switch text[0] {
+		case 'i':
+			op := &Op{Source: source, Return: Pending}
+			if _, err := fmt.Sscanf(text, "i %d %d %d %d %d %d %d", &client, &id, &op.Command.Op, &op.Command.K,
+				&op.Command.V, &op.Command.E, &at); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", source, line, err)
+			}
+			op.Client, op.Id, op.Invoke = client, id, at
+			ops = append(ops, op)
+			byId[[2]int64{int64(client), int64(id)}] = op
+		case 'r':
+			var ret Op
+			if _, err := fmt.Sscanf(text, "r %d %d %d %d %d %d %d %d %d %d", &client, &id, &ok, &observed, &ret.Value,
+				&ret.Previous, &ret.TagTimestamp, &ret.TagID, &ret.TagRMWCount, &at); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", source, line, err)
+			}
+			op := byId[[2]int64{int64(client), int64(id)}]
+			if op == nil {
+				return nil, fmt.Errorf("%s:%d: reply to request %d of client %d, which was never sent", source, line, id, client)
+			}
+			if ok == 0 || op.Done() {
+				continue // failed, or a duplicate reply
+			}
+			op.Return, op.Observed, op.Value, op.Previous = at, observed != 0, ret.Value, ret.Previous
+			op.TagTimestamp, op.TagID, op.TagRMWCount = ret.TagTimestamp, ret.TagID, ret.TagRMWCount
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown event %q", source, line, text[0])
+		}
+	}
+	return ops, scanner.Err()
+}
+
+// Short name of an operation, for reports
+func OpName(op state.Operation) string {
+	switch op {
+	case state.PUT:
+		return "PUT"
+	case state.GET:
+		return "GET"
+	case state.RMW:
+		return "INC"
+	case state.FETCH_ADD:
+		return "FAA"
+	case state.COMPARE_SWAP:
+		return "CAS"
+	case state.SWAP:
+		return "SWAP"
+	case state.FETCH_MAX:
+		return "MAX"
+	case state.FETCH_MIN:
+		return "MIN"
+	case state.COND_SET:
+		return "CSET"
+	}
+	return fmt.Sprintf("op%d", op)
+}
@@ -0,0 +1,40 @@
+package history
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"pineapple/src/state"
+)
+
+func TestLoad(t *testing.T) {
+	text := strings.Join([]string{
+		"# a comment",
+		fmt.Sprintf("i 0 1 %d 4 9 0 100", state.PUT),
+		fmt.Sprintf("i 1 1 %d 4 0 0 110", state.GET),
+		"r 1 1 0 1 0 0 0 0 0 115", // failed
+		"r 0 1 1 1 9 0 3 0 0 120",
+		"r 0 1 1 1 9 0 3 0 0 125", // duplicate
+	}, "\n")
+	ops, err := Load(strings.NewReader(text), "h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 || ops[0].Client != 0 || ops[1].Client != 1 {
+		t.Fatalf("loaded %+v", ops)
+	}
+	if w := ops[0]; w.Return != 120 || !w.Observed || w.Value != 9 || w.TagTimestamp != 3 || w.Command.K != 4 {
+		t.Errorf("write %+v", *w)
+	}
+	if ops[1].Done() {
+		t.Errorf("a read with a failed reply returned at %d", ops[1].Return)
+	}
+
+	if _, err := Load(strings.NewReader("r 0 1 1 1 9 0 3 0 0 120"), "h"); err == nil {
+		t.Error("loaded a reply to a request that was never sent")
+	}
+	if _, err := Load(strings.NewReader("x 0"), "h"); err == nil || !strings.HasPrefix(err.Error(), "h:1:") {
+		t.Errorf("unknown event: %v", err)
+	}
+}
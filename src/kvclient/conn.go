@@ -0,0 +1,148 @@
+package kvclient
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+
+	"pineapple/src/genericsmrproto"
+)
+
+// One connection of the pool, dialed when first used and again after it breaks. Replies
+// are matched to requests by CommandId, which is unique per connection.
+type conn struct {
+	client  *Client
+	replica int
+
+	mu      sync.Mutex // guards everything below
+	c       net.Conn   // nil until dialed, and after it broke
+	writer  *bufio.Writer
+	pending map[int32]*Future
+	nextId  int32
+	closed  bool
+}
+
+// Sends the request of f, unless the connection cannot be opened
+func (cn *conn) send(f *Future) error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if cn.closed {
+		f.complete(Result{}, ErrClosed)
+		return nil
+	}
+	select {
+	case <-f.done:
+		return nil // timed out while waiting for the connection
+	default:
+	}
+	if cn.c == nil {
+		if err := cn.dial(); err != nil {
+			return err
+		}
+	}
+
+	id := cn.nextId
+	cn.nextId++
+	f.mu.Lock()
+	f.conn, f.id = cn, id
+	f.mu.Unlock()
+	cn.pending[id] = f
+	propose := genericsmrproto.Propose{CommandId: id, Command: f.cmd}
+	genericsmrproto.WriteFrame(cn.writer, genericsmrproto.PROPOSE, &propose, cn.client.opts.Checksum)
+	if err := cn.writer.Flush(); err != nil {
+		cn.broke(cn.c, fmt.Errorf("kvclient: replica %d: %v", cn.replica, err))
+	}
+	return nil
+}
+
+// Must be called with cn.mu held
+func (cn *conn) dial() error {
+	addr := cn.client.addrs[cn.replica]
+	c, err := cn.client.opts.Transport.Dial(addr)
+	if err != nil {
+		return fmt.Errorf("kvclient: cannot connect to replica %d at %s: %v", cn.replica, addr, err)
+	}
+	reader := bufio.NewReader(c)
+	if _, err := genericsmrproto.Handshake(c, reader, genericsmrproto.NewHello(genericsmrproto.ROLE_CLIENT, -1)); err != nil {
+		c.Close()
+		return fmt.Errorf("kvclient: replica %d at %s refused the connection: %v", cn.replica, addr, err)
+	}
+	cn.c = c
+	cn.writer = bufio.NewWriter(c)
+	cn.pending = make(map[int32]*Future)
+	go cn.readReplies(c, reader)
+	return nil
+}
+
+func (cn *conn) readReplies(c net.Conn, reader *bufio.Reader) {
+	for {
+		_, reply, notLeader, err := genericsmrproto.ReadClientReplyOrRedirect(reader)
+		if err != nil && !genericsmrproto.Skippable(err) {
+			cn.mu.Lock()
+			cn.broke(c, fmt.Errorf("kvclient: replica %d: %v", cn.replica, err))
+			cn.mu.Unlock()
+			return
+		}
+		if err != nil {
+			continue
+		}
+
+		var f *Future
+		cn.mu.Lock()
+		if cn.c == c {
+			f = cn.pending[reply.CommandId]
+			delete(cn.pending, reply.CommandId)
+		}
+		cn.mu.Unlock()
+		if f == nil {
+			continue // cancelled
+		}
+		if notLeader != nil {
+			cn.client.redirect(f, notLeader)
+			continue
+		}
+		switch reply.OK {
+		case genericsmrproto.REPLY_OK:
+		case genericsmrproto.REPLY_UNKNOWN:
+			f.complete(Result{}, ErrUnknown)
+			continue
+		default:
+			f.complete(Result{}, ErrFailed)
+			continue
+		}
+		f.complete(Result{reply.Value, reply.Previous, reply.TagTimestamp, reply.TagID, reply.TagRMWCount}, nil)
+	}
+}
+
+// Fails the requests in flight on c, if it is still the current connection. Whether they
+// took effect is unknown. Must be called with cn.mu held.
+func (cn *conn) broke(c net.Conn, err error) {
+	if cn.c != c {
+		return
+	}
+	c.Close()
+	cn.c = nil
+	for _, f := range cn.pending {
+		f.complete(Result{}, err)
+	}
+	cn.pending = nil
+}
+
+// Stops waiting for the reply to request id
+func (cn *conn) forget(f *Future, id int32) {
+	cn.mu.Lock()
+	if cn.pending[id] == f {
+		delete(cn.pending, id)
+	}
+	cn.mu.Unlock()
+}
+
+func (cn *conn) close(err error) {
+	cn.mu.Lock()
+	cn.closed = true
+	if cn.c != nil {
+		cn.broke(cn.c, err)
+	}
+	cn.mu.Unlock()
+}
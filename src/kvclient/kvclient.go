@@ -0,0 +1,338 @@
+// Package kvclient lets programs use a Pineapple cluster as a key-value store.
+//
+//	c, err := kvclient.Dial(kvclient.Options{Master: "10.10.1.1:7087"})
+//	...
+//	res, err := c.Put(ctx, 7, 42)
+//	res, err = c.RMW(ctx, state.FETCH_ADD, 7, 1, state.NIL) // res.Previous is 42, res.Value 43
+//
+// GETs and PUTs go to any replica, spread over the connections of a pool, while RMWs go
+// to the leader the master reports, or the one a replica redirects them to. Every call
+// can be made asynchronous with Do, and is bounded by its context, or by Options.Timeout
+// when the context has no deadline.
+//
+// A key that was never written holds state.NIL, so Delete writes state.NIL.
+package kvclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pineapple/src/config"
+	"pineapple/src/genericsmr"
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/masterproto"
+	"pineapple/src/state"
+)
+
+// The replicas could not carry out a request, which did not take effect
+var ErrFailed = errors.New("kvclient: request failed")
+
+// The replicas gave up on a request, which may or may not have taken effect. Retrying one
+// that is not idempotent, like a FETCH_ADD, may apply it twice.
+var ErrUnknown = errors.New("kvclient: request outcome unknown")
+
+// The client was closed
+var ErrClosed = errors.New("kvclient: client closed")
+
+type Options struct {
+	Master    string               // master address, for the replica list and the leader
+	Cluster   *config.Cluster      // cluster config, instead of asking the master for the replicas
+	Replicas  []int                // replicas GETs and PUTs go to, all of them if empty
+	Conns     int                  // connections per replica, 1 if 0
+	Timeout   time.Duration        // deadline of requests whose context has none, 5s if 0
+	Transport genericsmr.Transport // how to reach the replicas, TCP if nil
+	Checksum  bool                 // send requests with a CRC
+}
+
+// What the replicas answered
+type Result struct {
+	Value        state.Value // value of the key after the request
+	Previous     state.Value // value an RMW was applied to
+	TagTimestamp int64       // tag of Value
+	TagID        int32
+	TagRMWCount  int32
+}
+
+type Client struct {
+	opts     Options
+	addrs    []string // client address of every replica
+	pool     [][]*conn
+	replicas []int  // replicas GETs and PUTs go to
+	next     uint32 // round robin over replicas and connections
+
+	leader     int32 // replica RMWs go to
+	refreshing int32 // 1 while the leader is being looked up
+	closed     int32
+}
+
+// Connects to a cluster. Connections to the replicas are opened on first use.
+func Dial(opts Options) (*Client, error) {
+	if opts.Conns <= 0 {
+		opts.Conns = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.Transport == nil {
+		opts.Transport = genericsmr.TCPTransport{}
+	}
+
+	c := &Client{opts: opts}
+	if opts.Cluster != nil {
+		for _, r := range opts.Cluster.Replicas {
+			c.addrs = append(c.addrs, r.Client)
+		}
+		c.leader = int32(opts.Cluster.Leaders[0])
+		if c.opts.Master == "" {
+			c.opts.Master = opts.Cluster.Master
+		}
+	} else if opts.Master != "" {
+		var err error
+		if c.addrs, err = c.replicaList(); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, errors.New("kvclient: no master or cluster config to find the replicas with")
+	}
+
+	for _, r := range opts.Replicas {
+		if r < 0 || r >= len(c.addrs) {
+			return nil, fmt.Errorf("kvclient: there is no replica %d", r)
+		}
+	}
+	c.replicas = opts.Replicas
+	if len(c.replicas) == 0 {
+		for r := range c.addrs {
+			c.replicas = append(c.replicas, r)
+		}
+	}
+
+	c.pool = make([][]*conn, len(c.addrs))
+	for r := range c.pool {
+		c.pool[r] = make([]*conn, opts.Conns)
+		for i := range c.pool[r] {
+			c.pool[r][i] = &conn{client: c, replica: r}
+		}
+	}
+
+	if leader, err := c.askLeader(); err == nil {
+		c.leader = int32(leader)
+	} else if opts.Cluster == nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Replica addresses from the master, which are also where clients connect
+func (c *Client) replicaList() ([]string, error) {
+	mcli, err := rpc.DialHTTP("tcp", c.opts.Master)
+	if err != nil {
+		return nil, fmt.Errorf("kvclient: cannot reach the master: %v", err)
+	}
+	defer mcli.Close()
+	var reply masterproto.GetReplicaListReply
+	if err := mcli.Call("Master.GetReplicaList", new(masterproto.GetReplicaListArgs), &reply); err != nil {
+		return nil, fmt.Errorf("kvclient: cannot get the replica list: %v", err)
+	}
+	if !reply.Ready {
+		return nil, errors.New("kvclient: not every replica has registered with the master yet")
+	}
+	return reply.ReplicaList, nil
+}
+
+func (c *Client) askLeader() (int, error) {
+	if c.opts.Master == "" {
+		return 0, errors.New("kvclient: no master to ask for the leader")
+	}
+	mcli, err := rpc.DialHTTP("tcp", c.opts.Master)
+	if err != nil {
+		return 0, fmt.Errorf("kvclient: cannot reach the master: %v", err)
+	}
+	defer mcli.Close()
+	var reply masterproto.GetLeaderReply
+	if err := mcli.Call("Master.GetLeader", new(masterproto.GetLeaderArgs), &reply); err != nil {
+		return 0, fmt.Errorf("kvclient: cannot get the leader: %v", err)
+	}
+	if reply.LeaderId < 0 || reply.LeaderId >= len(c.addrs) {
+		return 0, fmt.Errorf("kvclient: the master named replica %d leader, out of %d", reply.LeaderId, len(c.addrs))
+	}
+	return reply.LeaderId, nil
+}
+
+// Asks the master for the leader again, in the background, after an RMW failed
+func (c *Client) refreshLeader() {
+	if !atomic.CompareAndSwapInt32(&c.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.refreshing, 0)
+		if leader, err := c.askLeader(); err == nil {
+			atomic.StoreInt32(&c.leader, int32(leader))
+		}
+	}()
+}
+
+// Replica RMWs are sent to
+func (c *Client) Leader() int {
+	return int(atomic.LoadInt32(&c.leader))
+}
+
+// Closes every connection. Requests in flight fail with ErrClosed.
+func (c *Client) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	for _, conns := range c.pool {
+		for _, cn := range conns {
+			cn.close(ErrClosed)
+		}
+	}
+	return nil
+}
+
+func (c *Client) Get(ctx context.Context, key state.Key) (Result, error) {
+	return c.Do(ctx, state.Command{Op: state.GET, K: key}).Wait()
+}
+
+func (c *Client) Put(ctx context.Context, key state.Key, value state.Value) (Result, error) {
+	return c.Do(ctx, state.Command{Op: state.PUT, K: key, V: value}).Wait()
+}
+
+// Applies an RMW operator, like state.FETCH_ADD, with argument v and, for
+// state.COMPARE_SWAP, expected value e
+func (c *Client) RMW(ctx context.Context, op state.Operation, key state.Key, v state.Value, e state.Value) (Result, error) {
+	if !state.IsRMW(op) {
+		return Result{}, fmt.Errorf("kvclient: operation %d is not an RMW", op)
+	}
+	return c.Do(ctx, state.Command{Op: op, K: key, V: v, E: e}).Wait()
+}
+
+func (c *Client) Delete(ctx context.Context, key state.Key) (Result, error) {
+	return c.Do(ctx, state.Command{Op: state.PUT, K: key, V: state.NIL}).Wait()
+}
+
+// Sends a command without waiting for its reply. Requests that overlap in time may be
+// applied in any order.
+func (c *Client) Do(ctx context.Context, cmd state.Command) *Future {
+	f := newFuture(cmd)
+	if atomic.LoadInt32(&c.closed) == 1 {
+		f.complete(Result{}, ErrClosed)
+		return f
+	}
+
+	cancel := func() {}
+	if _, has := ctx.Deadline(); !has {
+		ctx, cancel = context.WithTimeout(ctx, c.opts.Timeout)
+	}
+
+	n := atomic.AddUint32(&c.next, 1)
+	replica := c.replicas[int(n)%len(c.replicas)]
+	if state.IsRMW(cmd.Op) {
+		replica = c.Leader()
+	}
+	slot := int(n/uint32(len(c.replicas))) % c.opts.Conns
+	f.slot = slot
+	// connecting may take a while, and must not hold up the caller or the deadline
+	go func() {
+		for tried := 1; ; tried++ {
+			err := c.pool[replica][slot].send(f)
+			if err == nil {
+				return
+			}
+			if state.IsRMW(cmd.Op) || tried >= len(c.replicas) {
+				f.complete(Result{}, err)
+				return
+			}
+			// the request was never sent, another replica can take it
+			replica = c.replicas[(int(n)+tried)%len(c.replicas)]
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.complete(Result{}, ctx.Err())
+			f.forget()
+		case <-f.done:
+		}
+		cancel()
+		if state.IsRMW(cmd.Op) && f.err != nil && f.err != ErrClosed {
+			// the leader may have changed
+			c.refreshLeader()
+		}
+	}()
+	return f
+}
+
+// Sends an RMW again to the replica a NOT_LEADER reply named, giving up once it has gone
+// around every replica
+func (c *Client) redirect(f *Future, notLeader *genericsmrproto.NotLeader) {
+	leader := int(notLeader.LeaderId)
+	f.mu.Lock()
+	f.redirects++
+	redirects := f.redirects
+	f.mu.Unlock()
+	if leader < 0 || leader >= len(c.addrs) || redirects > len(c.addrs) {
+		f.complete(Result{}, ErrFailed)
+		return
+	}
+	atomic.StoreInt32(&c.leader, int32(leader))
+	go func() {
+		if err := c.pool[leader][f.slot].send(f); err != nil {
+			f.complete(Result{}, err)
+		}
+	}()
+}
+
+// A request in flight
+type Future struct {
+	cmd    state.Command
+	done   chan struct{}
+	once   sync.Once
+	result Result
+	err    error
+
+	slot int // connection of the pool it goes on
+
+	mu        sync.Mutex
+	conn      *conn // where the request was sent
+	id        int32 // its CommandId there
+	redirects int   // NOT_LEADER replies so far
+}
+
+func newFuture(cmd state.Command) *Future {
+	return &Future{cmd: cmd, done: make(chan struct{})}
+}
+
+// Closed once the request completed
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Waits for the request to complete
+func (f *Future) Wait() (Result, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+// Stops waiting for the reply, if the request was sent
+func (f *Future) forget() {
+	f.mu.Lock()
+	cn, id := f.conn, f.id
+	f.mu.Unlock()
+	if cn != nil {
+		cn.forget(f, id)
+	}
+}
+
+func (f *Future) complete(res Result, err error) {
+	f.once.Do(func() {
+		f.result, f.err = res, err
+		close(f.done)
+	})
+}
@@ -0,0 +1,194 @@
+package kvclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"pineapple/src/config"
+	"pineapple/src/genericsmr"
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/state"
+)
+
+// Answers a request the way a replica would, with the frame of a PROPOSE_REPLY or a
+// NOT_LEADER, or not at all if it returns nil
+type answer func(replica int, p *genericsmrproto.Propose) []byte
+
+// Starts a replica on transport that answers every request of every connection with answer
+func fakeReplica(t *testing.T, transport *genericsmr.MemTransport, id int, answer answer) string {
+	addr := fmt.Sprintf("fake%d", id)
+	l, err := transport.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				reader := bufio.NewReader(c)
+				if _, err := genericsmrproto.Handshake(c, reader, genericsmrproto.NewHello(genericsmrproto.ROLE_REPLICA, int32(id))); err != nil {
+					return
+				}
+				for {
+					code, body, err := genericsmrproto.ReadFrame(reader, nil)
+					if err != nil {
+						return
+					}
+					p := new(genericsmrproto.Propose)
+					if code != genericsmrproto.PROPOSE || genericsmrproto.Decode(body, p) != nil {
+						t.Errorf("replica %d got a message of type %d", id, code)
+						return
+					}
+					if reply := answer(id, p); reply != nil {
+						c.Write(reply)
+					}
+				}
+			}()
+		}
+	}()
+	return addr
+}
+
+// A client of fake replicas, the first of which it takes for the leader
+func dialFakes(t *testing.T, replicas int, answer answer) *Client {
+	transport := genericsmr.NewMemTransport()
+	cluster := &config.Cluster{Leaders: []int{0}}
+	for i := 0; i < replicas; i++ {
+		cluster.Replicas = append(cluster.Replicas, config.Replica{Id: i, Client: fakeReplica(t, transport, i, answer)})
+	}
+	c, err := Dial(Options{Cluster: cluster, Transport: transport, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func ok(p *genericsmrproto.Propose, value state.Value) []byte {
+	return genericsmrproto.EncodeFrame(genericsmrproto.PROPOSE_REPLY, &genericsmrproto.ProposeReplyTS{OK: genericsmrproto.REPLY_OK,
+		CommandId: p.CommandId, Value: value, TagTimestamp: 3, TagID: 1, Previous: 40}, false)
+}
+
+func notOK(p *genericsmrproto.Propose, status uint8) []byte {
+	return genericsmrproto.EncodeFrame(genericsmrproto.PROPOSE_REPLY, &genericsmrproto.ProposeReplyTS{OK: status, CommandId: p.CommandId}, false)
+}
+
+func redirect(p *genericsmrproto.Propose, leader int32) []byte {
+	return genericsmrproto.EncodeFrame(genericsmrproto.NOT_LEADER, &genericsmrproto.NotLeader{CommandId: p.CommandId, LeaderId: leader}, false)
+}
+
+func TestReplies(t *testing.T) {
+	c := dialFakes(t, 2, func(replica int, p *genericsmrproto.Propose) []byte {
+		switch p.Command.V {
+		case 1:
+			return notOK(p, genericsmrproto.REPLY_UNKNOWN)
+		case 2:
+			return notOK(p, genericsmrproto.REPLY_FAILED)
+		case 3:
+			return nil
+		}
+		return ok(p, p.Command.V+state.Value(p.Command.K))
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ { // every replica and connection
+		if res, err := c.Get(ctx, 5); err != nil || res != (Result{5, 40, 3, 1, 0}) {
+			t.Errorf("Get = %+v, %v", res, err)
+		}
+	}
+	if _, err := c.Put(ctx, 0, 1); err != ErrUnknown {
+		t.Errorf("a request the replica gave up on: %v, want ErrUnknown", err)
+	}
+	if _, err := c.Put(ctx, 0, 2); err != ErrFailed {
+		t.Errorf("a request that failed: %v, want ErrFailed", err)
+	}
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Put(short, 0, 3); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("a request without a reply: %v, want its deadline exceeded", err)
+	}
+	if _, err := c.Put(ctx, 0, 4); err != nil {
+		t.Errorf("a request after one that timed out: %v", err)
+	}
+
+	if _, err := c.RMW(ctx, state.PUT, 0, 1, 0); err == nil {
+		t.Error("RMW took a PUT")
+	}
+	f := c.Do(ctx, state.Command{Op: state.PUT, K: 0, V: 3})
+	c.Close()
+	if _, err := f.Wait(); err != ErrClosed {
+		t.Errorf("a request in flight at Close: %v, want ErrClosed", err)
+	}
+	if _, err := c.Get(ctx, 0); err != ErrClosed {
+		t.Errorf("Get after Close: %v, want ErrClosed", err)
+	}
+}
+
+// RMWs follow NOT_LEADER replies, and the client sends later ones straight to the new leader
+func TestRedirect(t *testing.T) {
+	redirected := make(chan int, 10)
+	c := dialFakes(t, 3, func(replica int, p *genericsmrproto.Propose) []byte {
+		if replica == 2 || !state.IsRMW(p.Command.Op) {
+			return ok(p, 41)
+		}
+		redirected <- replica
+		return redirect(p, int32(replica+1))
+	})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		res, err := c.RMW(ctx, state.FETCH_ADD, 7, 1, state.NIL)
+		if err != nil || res.Previous != 40 || res.Value != 41 {
+			t.Fatalf("RMW = %+v, %v", res, err)
+		}
+	}
+	if c.Leader() != 2 {
+		t.Errorf("leader %d after the redirects, want 2", c.Leader())
+	}
+	if len(redirected) != 2 {
+		t.Errorf("%d redirects, want only those of the first RMW", len(redirected))
+	}
+}
+
+// Replicas that keep redirecting to each other, or to no one, fail the request
+func TestRedirectLoop(t *testing.T) {
+	for _, next := range []func(int) int32{
+		func(replica int) int32 { return int32(1 - replica) },
+		func(int) int32 { return -1 },
+	} {
+		c := dialFakes(t, 2, func(replica int, p *genericsmrproto.Propose) []byte {
+			return redirect(p, next(replica))
+		})
+		if _, err := c.RMW(context.Background(), state.SWAP, 7, 1, state.NIL); err != ErrFailed {
+			t.Errorf("RMW redirected in a loop: %v, want ErrFailed", err)
+		}
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	if _, err := Dial(Options{}); err == nil {
+		t.Error("Dial without a master or cluster succeeded")
+	}
+	cluster := &config.Cluster{Leaders: []int{0}, Replicas: []config.Replica{{Id: 0, Client: "nowhere"}}}
+	if _, err := Dial(Options{Cluster: cluster, Replicas: []int{1}}); err == nil {
+		t.Error("Dial with a replica not in the cluster succeeded")
+	}
+
+	// a replica that cannot be reached fails only the requests sent to it
+	c, err := Dial(Options{Cluster: cluster, Transport: genericsmr.NewMemTransport()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Get(context.Background(), 1); err == nil || err == ErrClosed {
+		t.Errorf("Get from a replica that is not there: %v", err)
+	}
+}
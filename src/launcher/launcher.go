@@ -0,0 +1,314 @@
+package main
+
+// Runs a whole cluster on one machine: a master and N servers on free localhost ports,
+// then a client workload against it. Every process runs in its own directory of the run
+// directory, where its log, stable store and metrics files end up. Everything is torn
+// down when the clients exit, or on an interrupt.
+//
+//	launcher [flags] [-- client flags...]
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/masterproto"
+)
+
+var numNodes = flag.Int("N", 3, "Number of replicas.")
+var addr = flag.String("addr", "127.0.0.1", "Address the master and servers listen on.")
+var binDir = flag.String("bin", "", "Directory of the master, server and client binaries. Defaults to the launcher's own directory.")
+var runDir = flag.String("dir", "", "Run directory. Defaults to runs/<start time>.")
+var serverArgs = flag.String("serverargs", "", "Extra flags for every server, separated by spaces.")
+var clientName = flag.String("client", "client", "Workload binary: client, clientnew or stress. Empty to only start the cluster and wait for an interrupt.")
+var numClients = flag.Int("clients", 1, "Client processes. Client i talks to replica i mod N, except stress, which needs the leader for RMWs.")
+var duration = flag.Int("duration", 0, "Seconds after which the clients are stopped, 0 to let them finish.")
+var startTimeout = flag.Int("starttimeout", 30, "Seconds to wait for the cluster to be ready.")
+
+// A process started by the launcher
+type process struct {
+	name   string
+	cmd    *exec.Cmd
+	exited chan struct{} // closed once it has exited
+	err    error         // why it exited, once it has
+}
+
+// Everything started so far, stopped in reverse order
+var processes []*process
+var processesLock sync.Mutex
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.Ltime)
+
+	bin := *binDir
+	if bin == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatal(err)
+		}
+		bin = filepath.Dir(exe)
+	}
+	for _, name := range []string{"master", "server", *clientName} {
+		if name == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(bin, name)); err != nil {
+			log.Fatalf("No %s binary in %s, build it with go build -o %s ./src/%s\n", name, bin, bin, name)
+		}
+	}
+
+	dir := *runDir
+	if dir == "" {
+		dir = filepath.Join("runs", time.Now().Format("2006-01-02T15-04-05"))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Run directory %s\n", dir)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		log.Println("Interrupted, stopping the cluster")
+		stopAll()
+		os.Exit(1)
+	}()
+
+	ports := freePorts(*numNodes + 1)
+	masterPort := ports[0]
+	start(dir, "master", filepath.Join(bin, "master"), "-maddr", *addr, "-mport", fmt.Sprint(masterPort), "-N", fmt.Sprint(*numNodes))
+
+	// replica ids go by registration order, so give each server a head start
+	serverDirs := make(map[string]string)
+	for i := 0; i < *numNodes; i++ {
+		args := []string{"-maddr", *addr, "-mport", fmt.Sprint(masterPort), "-addr", *addr, "-port", fmt.Sprint(ports[i+1])}
+		args = append(args, strings.Fields(*serverArgs)...)
+		name := fmt.Sprintf("server-%d", i)
+		start(dir, name, filepath.Join(bin, "server"), args...)
+		serverDirs[fmt.Sprintf("%s:%d", *addr, ports[i+1])] = name
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	replicas, leader, err := waitForCluster(fmt.Sprintf("%s:%d", *addr, masterPort), time.Duration(*startTimeout)*time.Second)
+	if err != nil {
+		stopAll()
+		log.Fatal(err)
+	}
+	writeClusterFile(dir, masterPort, replicas, serverDirs, leader)
+	log.Printf("Cluster ready: %s, leader is replica %d\n", strings.Join(replicas, " "), leader)
+
+	if *clientName == "" {
+		log.Println("Waiting for an interrupt")
+		select {}
+	}
+
+	clients := make([]*process, *numClients)
+	for i := range clients {
+		clients[i] = start(dir, fmt.Sprintf("client-%d", i), filepath.Join(bin, *clientName),
+			clientArgs(i%len(replicas), replicas, leader)...)
+	}
+
+	var deadline <-chan time.Time
+	if *duration > 0 {
+		deadline = time.After(time.Duration(*duration) * time.Second)
+	}
+	failed := 0
+	for _, c := range clients {
+		select {
+		case <-c.exited:
+		case <-deadline:
+			log.Println("Time is up, stopping the clients")
+			for _, other := range clients {
+				other.cmd.Process.Signal(syscall.SIGTERM)
+			}
+			deadline = nil
+			<-c.exited
+		}
+		if c.err != nil {
+			log.Printf("%s: %v\n", c.name, c.err)
+			failed++
+		}
+	}
+
+	stopAll()
+	log.Printf("Done, logs and metrics are in %s\n", dir)
+	if failed > 0 {
+		log.Fatalf("%d of %d clients failed\n", failed, len(clients))
+	}
+}
+
+// Flags pointing a workload at replica id. They come first, so the flags after -- win.
+func clientArgs(id int, replicas []string, leader int) []string {
+	host, port, _ := net.SplitHostPort(replicas[id])
+	lhost, lport, _ := net.SplitHostPort(replicas[leader])
+	var args []string
+	switch *clientName {
+	case "stress":
+		args = []string{"-saddr", lhost, "-sport", lport}
+	default:
+		args = []string{"-saddr", host, "-sport", port, "-serverID", fmt.Sprint(id), "-laddr", lhost, "-lport", lport}
+	}
+	return append(args, flag.Args()...)
+}
+
+// Starts name in its own directory of dir, with its output in name.log there
+func start(dir string, name string, path string, args ...string) *process {
+	wd := filepath.Join(dir, name)
+	if err := os.MkdirAll(wd, 0755); err != nil {
+		log.Fatal(err)
+	}
+	out, err := os.Create(filepath.Join(wd, name+".log"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cmd := exec.Command(abs, args...)
+	cmd.Dir = wd
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		stopAll()
+		log.Fatalf("Error starting %s: %v\n", name, err)
+	}
+	p := &process{name, cmd, make(chan struct{}), nil}
+	go func() {
+		p.err = cmd.Wait()
+		out.Close()
+		close(p.exited)
+	}()
+
+	processesLock.Lock()
+	processes = append(processes, p)
+	processesLock.Unlock()
+	log.Printf("Started %s (pid %d): %s %s\n", name, cmd.Process.Pid, filepath.Base(path), strings.Join(args, " "))
+	return p
+}
+
+// Sends every process still running a SIGTERM, and a SIGKILL if it has not exited in 5s
+func stopAll() {
+	processesLock.Lock()
+	defer processesLock.Unlock()
+	for i := len(processes) - 1; i >= 0; i-- {
+		p := processes[i]
+		p.cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-p.exited:
+		case <-time.After(5 * time.Second):
+			log.Printf("%s did not exit, killing it\n", p.name)
+			p.cmd.Process.Kill()
+		}
+	}
+	processes = nil
+}
+
+// Picks n ports p that are free along with p+1000, the servers' RPC port
+func freePorts(n int) []int {
+	var ports []int
+	var listeners []net.Listener
+	for len(ports) < n {
+		l, err := net.Listen("tcp", *addr+":0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		port := l.Addr().(*net.TCPAddr).Port
+		if port+1000 > 65535 {
+			continue
+		}
+		rl, err := net.Listen("tcp", fmt.Sprintf("%s:%d", *addr, port+1000))
+		if err != nil {
+			continue
+		}
+		listeners = append(listeners, rl)
+		ports = append(ports, port)
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	return ports
+}
+
+// Waits until every replica has registered with the master and answers pings on its RPC
+// port, then returns the replicas' addresses and the leader's id
+func waitForCluster(masterAddr string, timeout time.Duration) ([]string, int, error) {
+	deadline := time.Now().Add(timeout)
+	var mcli *rpc.Client
+	var list masterproto.GetReplicaListReply
+	for {
+		if time.Now().After(deadline) {
+			return nil, 0, fmt.Errorf("cluster not ready after %v, see the logs", timeout)
+		}
+		var err error
+		if mcli == nil {
+			mcli, err = rpc.DialHTTP("tcp", masterAddr)
+		}
+		if err == nil {
+			err = mcli.Call("Master.GetReplicaList", new(masterproto.GetReplicaListArgs), &list)
+		}
+		if err == nil && list.Ready {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for i, replica := range list.ReplicaList {
+		host, port, err := net.SplitHostPort(replica)
+		if err != nil {
+			return nil, 0, err
+		}
+		var rpcPort int
+		fmt.Sscan(port, &rpcPort)
+		rpcAddr := fmt.Sprintf("%s:%d", host, rpcPort+1000)
+		for {
+			if time.Now().After(deadline) {
+				return nil, 0, fmt.Errorf("replica %d (%s) does not answer pings on %s", i, replica, rpcAddr)
+			}
+			if rcli, err := rpc.DialHTTP("tcp", rpcAddr); err == nil {
+				err = rcli.Call("Replica.Ping", new(genericsmrproto.PingArgs), new(genericsmrproto.PingReply))
+				rcli.Close()
+				if err == nil {
+					break
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	var leader masterproto.GetLeaderReply
+	if err := mcli.Call("Master.GetLeader", new(masterproto.GetLeaderArgs), &leader); err != nil {
+		return nil, 0, err
+	}
+	mcli.Close()
+	return list.ReplicaList, leader.LeaderId, nil
+}
+
+// Records which replica is where, for whoever reads the run directory later
+func writeClusterFile(dir string, masterPort int, replicas []string, serverDirs map[string]string, leader int) {
+	f, err := os.Create(filepath.Join(dir, "cluster.txt"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "master %s:%d\n", *addr, masterPort)
+	for id, replica := range replicas {
+		fmt.Fprintf(f, "replica %d %s %s\n", id, replica, serverDirs[replica])
+	}
+	fmt.Fprintf(f, "leader %d\n", leader)
+}
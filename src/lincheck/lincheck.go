@@ -0,0 +1,74 @@
+package main
+
+// Checks that the histories logged by clients run with -history are linearizable, key by
+// key. Give it the files of every client that ran against the cluster at the same time;
+// their clocks must be in sync. For each key that is not linearizable it prints a small
+// history that is not either.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"pineapple/src/history"
+)
+
+var verbose = flag.Bool("v", false, "Print every key, not just the ones that fail.")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-v] history-file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var ops []*history.Op
+	for _, path := range flag.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileOps, err := history.Load(f, path)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		ops = append(ops, fileOps...)
+	}
+
+	start := int64(history.Pending)
+	for _, op := range ops {
+		if op.Invoke < start {
+			start = op.Invoke
+		}
+	}
+
+	began := time.Now()
+	results := history.Check(ops)
+	failed := 0
+	for _, res := range results {
+		if res.Linearizable {
+			if *verbose {
+				fmt.Printf("key %d: %d operations, linearizable\n", res.Key, res.Ops)
+			}
+			continue
+		}
+		failed++
+		fmt.Printf("key %d: %d operations, NOT linearizable; counterexample of %d operations:\n",
+			res.Key, res.Ops, len(res.Counterexample))
+		for _, op := range res.Counterexample {
+			fmt.Println("   ", op.Format(start))
+		}
+	}
+	fmt.Printf("%d operations on %d keys checked in %v: %d keys not linearizable\n",
+		len(ops), len(results), time.Since(began).Round(time.Millisecond), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
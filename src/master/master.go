@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"pineapple/src/config"
 	"pineapple/src/genericsmrproto"
 	"pineapple/src/masterproto"
 )
@@ -17,6 +18,10 @@ import (
 var masterAddr *string = flag.String("maddr", "10.10.1.1", "Master address. Defaults to 10.10.1.1.")
 var masterPort *int = flag.Int("mport", 7087, "Master port.  Defaults to 7087.")
 var numNodes *int = flag.Int("N", 3, "Number of replicas. Defaults to 3.")
+var configFile = flag.String("config", "", "Cluster config file. Replaces -maddr, -mport and -N, and gives replicas their ids by address instead of in the order they register.")
+
+// How long the master waits for a leader it replaces to step down
+const STEP_DOWN_TIMEOUT = time.Second
 
 type Master struct {
 	N        int
@@ -27,11 +32,33 @@ type Master struct {
 	nodes    []*rpc.Client
 	leader   []bool
 	alive    []bool
+	cluster  *config.Cluster // nil without -config
+	leaders  []int           // replica ids in the order they are asked to lead
+
+	registered map[int]bool // replicas that registered, with -config
 }
 
 func main() {
 	flag.Parse()
 
+	var cluster *config.Cluster
+	leaders := make([]int, *numNodes)
+	for i := range leaders {
+		leaders[i] = i
+	}
+	if *configFile != "" {
+		var err error
+		if cluster, err = config.Load(*configFile); err != nil {
+			log.Fatal(err)
+		}
+		*masterAddr, *masterPort, _ = config.SplitAddr(cluster.Master)
+		*numNodes = len(cluster.Replicas)
+		leaders = cluster.Leaders
+	}
+	if *numNodes > config.MAX_REPLICAS {
+		log.Fatalf("%d replicas, but ballots only have room for %d replica ids\n", *numNodes, config.MAX_REPLICAS)
+	}
+
 	log.Printf("Master starting on port %d\n", *masterPort)
 	log.Printf("...waiting for %d replicas\n", *numNodes)
 
@@ -42,7 +69,10 @@ func main() {
 		new(sync.Mutex),
 		make([]*rpc.Client, *numNodes),
 		make([]bool, *numNodes),
-		make([]bool, *numNodes)}
+		make([]bool, *numNodes),
+		cluster,
+		leaders,
+		make(map[int]bool)}
 
 	log.Printf("creating master connected to %d nodes\n", master.N)
 
@@ -76,6 +106,9 @@ func (master *Master) run() {
 	for i := 0; i < master.N; i++ {
 		var err error
 		addr := fmt.Sprintf("%s:%d", master.addrList[i], master.portList[i]+1000)
+		if master.cluster != nil {
+			addr = master.cluster.Replicas[i].Admin
+		}
 		master.nodes[i], err = rpc.DialHTTP("tcp", addr)
 		if err != nil {
 			log.Fatalf("Error connecting to replica %d\n", i)
@@ -83,6 +116,16 @@ func (master *Master) run() {
 		master.leader[i] = false
 	}
 	master.leader[0] = true
+	if preferred := master.leaders[0]; preferred != 0 {
+		// replica 0 starts out leading, hand over to the preferred one
+		master.stepDown(0)
+		err := master.nodes[preferred].Call("Replica.BeTheLeader", new(genericsmrproto.BeTheLeaderArgs), new(genericsmrproto.BeTheLeaderReply))
+		if err == nil {
+			master.leader[0] = false
+			master.leader[preferred] = true
+			log.Printf("Replica %d is the new leader.", preferred)
+		}
+	}
 
 	for true {
 		time.Sleep(3000 * 1000 * 1000)
@@ -93,9 +136,11 @@ func (master *Master) run() {
 				log.Printf("Replica %d has failed to reply\n", i)
 				master.alive[i] = false
 				if master.leader[i] {
-					// need to choose a new leader
+					// need to choose a new leader, and make sure this one stops leading
+					// in case it is only slow
 					new_leader = true
 					master.leader[i] = false
+					master.stepDown(i)
 				}
 			} else {
 				master.alive[i] = true
@@ -104,7 +149,8 @@ func (master *Master) run() {
 		if !new_leader {
 			continue
 		}
-		for i, new_master := range master.nodes {
+		for _, i := range master.leaders {
+			new_master := master.nodes[i]
 			if master.alive[i] {
 				err := new_master.Call("Replica.BeTheLeader", new(genericsmrproto.BeTheLeaderArgs), new(genericsmrproto.BeTheLeaderReply))
 				if err == nil {
@@ -117,11 +163,28 @@ func (master *Master) run() {
 	}
 }
 
+// Asks replica i to stop acting as the leader, giving up after STEP_DOWN_TIMEOUT
+func (master *Master) stepDown(i int) {
+	call := master.nodes[i].Go("Replica.StepDown", new(genericsmrproto.StepDownArgs), new(genericsmrproto.StepDownReply), nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			log.Printf("Replica %d did not step down: %v\n", i, call.Error)
+		}
+	case <-time.After(STEP_DOWN_TIMEOUT):
+		log.Printf("Replica %d did not step down in %v\n", i, STEP_DOWN_TIMEOUT)
+	}
+}
+
 func (master *Master) Register(args *masterproto.RegisterArgs, reply *masterproto.RegisterReply) error {
 
 	master.lock.Lock()
 	defer master.lock.Unlock()
 
+	if master.cluster != nil {
+		return master.registerFromConfig(args, reply)
+	}
+
 	nlen := len(master.nodeList)
 	index := nlen
 
@@ -155,6 +218,36 @@ func (master *Master) Register(args *masterproto.RegisterArgs, reply *masterprot
 	return nil
 }
 
+// Replicas get the id the config gives their address. The node list is complete once all
+// of them registered.
+func (master *Master) registerFromConfig(args *masterproto.RegisterArgs, reply *masterproto.RegisterReply) error {
+	addrPort := fmt.Sprintf("%s:%d", args.Addr, args.Port)
+	replica, known := master.cluster.Find(addrPort)
+	if !known {
+		log.Printf("Refused registration from %s, which is not a replica in %s\n", addrPort, *configFile)
+		return fmt.Errorf("%s is not a replica in %s", addrPort, *configFile)
+	}
+
+	master.registered[replica.Id] = true
+	if len(master.registered) == master.N && len(master.nodeList) < master.N {
+		for _, r := range master.cluster.Replicas {
+			host, port, _ := config.SplitAddr(r.Peer)
+			master.nodeList = append(master.nodeList, r.Peer)
+			master.addrList = append(master.addrList, host)
+			master.portList = append(master.portList, port)
+		}
+	}
+
+	reply.ReplicaId = replica.Id
+	if len(master.nodeList) == master.N {
+		reply.Ready = true
+		reply.NodeList = master.nodeList
+	} else {
+		reply.Ready = false
+	}
+	return nil
+}
+
 func (master *Master) GetLeader(args *masterproto.GetLeaderArgs, reply *masterproto.GetLeaderReply) error {
 	time.Sleep(4 * 1000 * 1000)
 	for i, l := range master.leader {
@@ -0,0 +1,124 @@
+package pineapple
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"pineapple/src/config"
+	"pineapple/src/genericsmr"
+	"pineapple/src/kvclient"
+	"pineapple/src/state"
+)
+
+// Starts an n-replica cluster on its own MemTransport, replica 0 leading, and waits until
+// every replica answers. The replicas run until the test binary exits.
+func startMemCluster(t *testing.T, n int) (*genericsmr.MemTransport, *config.Cluster) {
+	t.Helper()
+	transport := genericsmr.NewMemTransport()
+	cluster := &config.Cluster{Leaders: []int{0}}
+	var addrs []string
+	for i := 0; i < n; i++ {
+		addr := fmt.Sprintf("replica%d", i)
+		addrs = append(addrs, addr)
+		cluster.Replicas = append(cluster.Replicas, config.Replica{Id: i, Peer: addr, Client: addr})
+	}
+	for i := 0; i < n; i++ {
+		NewReplica(i, addrs, nil, true, true, false, 100*time.Millisecond, 5, 0, true, false, transport)
+	}
+
+	// higher replicas dial lower ones, and retry a second later if they were not listening yet
+	for i := 0; i < n; i++ {
+		c := dialMemCluster(t, transport, cluster, []int{i})
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			_, err := c.Get(ctx, 0)
+			cancel()
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("replica %d is not answering: %v", i, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		c.Close()
+	}
+	return transport, cluster
+}
+
+// A client of the cluster sending GETs and PUTs to the given replicas, all if nil
+func dialMemCluster(t *testing.T, transport *genericsmr.MemTransport, cluster *config.Cluster, replicas []int) *kvclient.Client {
+	t.Helper()
+	c, err := kvclient.Dial(kvclient.Options{Cluster: cluster, Replicas: replicas, Transport: transport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestMemClusterKV(t *testing.T) {
+	transport, cluster := startMemCluster(t, 3)
+	c := dialMemCluster(t, transport, cluster, nil)
+	defer c.Close()
+	ctx := context.Background()
+
+	if res, err := c.Get(ctx, 1); err != nil || res.Value != state.NIL {
+		t.Fatalf("GET of a key never written = %d, %v; want NIL", res.Value, err)
+	}
+	if res, err := c.Put(ctx, 1, 42); err != nil || res.Value != 42 {
+		t.Fatalf("PUT 42 = %d, %v", res.Value, err)
+	}
+	// every replica sees the write, whichever of them coordinates the read
+	for r := range cluster.Replicas {
+		rc := dialMemCluster(t, transport, cluster, []int{r})
+		res, err := rc.Get(ctx, 1)
+		rc.Close()
+		if err != nil || res.Value != 42 {
+			t.Fatalf("GET at replica %d = %d, %v; want 42", r, res.Value, err)
+		}
+	}
+
+	res, err := c.RMW(ctx, state.FETCH_ADD, 1, 1, state.NIL)
+	if err != nil || res.Previous != 42 || res.Value != 43 {
+		t.Fatalf("FETCH_ADD(1) of 42 = %d -> %d, %v; want 42 -> 43", res.Previous, res.Value, err)
+	}
+	if res.TagRMWCount != 1 {
+		t.Errorf("FETCH_ADD after a PUT has tag rmw count %d, want 1", res.TagRMWCount)
+	}
+	if res, err := c.Get(ctx, 1); err != nil || res.Value != 43 {
+		t.Fatalf("GET after FETCH_ADD = %d, %v; want 43", res.Value, err)
+	}
+	if res, err := c.RMW(ctx, state.COMPARE_SWAP, 1, 7, 43); err != nil || res.Value != 7 {
+		t.Fatalf("COMPARE_SWAP(43, 7) of 43 = %d, %v; want 7", res.Value, err)
+	}
+	if res, err := c.Delete(ctx, 1); err != nil || res.Value != state.NIL {
+		t.Fatalf("DELETE = %d, %v", res.Value, err)
+	}
+	if res, err := c.Get(ctx, 1); err != nil || res.Value != state.NIL {
+		t.Fatalf("GET after DELETE = %d, %v; want NIL", res.Value, err)
+	}
+}
+
+// COND_SET only sets keys that were never written, whatever value they hold
+func TestMemClusterCondSet(t *testing.T) {
+	transport, cluster := startMemCluster(t, 3)
+	c := dialMemCluster(t, transport, cluster, nil)
+	defer c.Close()
+	ctx := context.Background()
+
+	if res, err := c.RMW(ctx, state.COND_SET, 10, 7, state.NIL); err != nil || res.Value != 7 {
+		t.Fatalf("COND_SET(7) of a key never written = %d, %v; want 7", res.Value, err)
+	}
+	if _, err := c.Put(ctx, 9, 0); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := c.RMW(ctx, state.COND_SET, 9, 7, state.NIL); err != nil || res.Value != 0 {
+		t.Fatalf("COND_SET(7) of a key written with 0 = %d, %v; want 0", res.Value, err)
+	}
+	if res, err := c.Get(ctx, 9); err != nil || res.Value != 0 {
+		t.Fatalf("GET after COND_SET = %d, %v; want 0", res.Value, err)
+	}
+}
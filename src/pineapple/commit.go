@@ -0,0 +1,261 @@
+package pineapple
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+// Most commits resent to a follower per timeout
+const COMMIT_RESEND_BATCH = 1024
+
+// Tells the followers which RMWs committed since the last tick. A follower that accepted
+// a run of them in the same ballot gets a single CommitShort, one that did not answer the
+// RMWSet gets a Commit with the value instead. Commits may be dropped on the way, as
+// peerSender.enqueue explains; followers acknowledge them, and checkCommits resends the
+// ones that were not.
+func (r *Replica) bcastCommits() {
+	if len(r.toCommit) == 0 {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Commit bcast failed:", err)
+		}
+	}()
+	ids := r.toCommit
+	r.toCommit = nil
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q].Load() {
+			continue
+		}
+		if r.commitDeadline[q].IsZero() {
+			r.commitDeadline[q] = r.Clock.Now().Add(r.timeout)
+		}
+		var short *pineappleproto.CommitShort
+		for _, id := range ids {
+			inst := r.pendingRMWs.get(id)
+			if inst == nil {
+				continue
+			}
+			if inst.lb == nil || !inst.lb.acks[q] {
+				r.send(q, r.commitRPC, r.commitMsg(id, inst))
+				continue
+			}
+			if short != nil && short.Instance+short.Count == id && short.Ballot == inst.ballot {
+				short.Count++
+				continue
+			}
+			if short != nil {
+				r.send(q, r.commitShortRPC, short)
+			}
+			short = &pineappleproto.CommitShort{LeaderId: r.Id, Instance: id, Count: 1, Ballot: inst.ballot}
+		}
+		if short != nil {
+			r.send(q, r.commitShortRPC, short)
+		}
+	}
+}
+
+// A Commit carrying the value of a committed instance, or none if it is only known to be
+// chosen somewhere else
+func (r *Replica) commitMsg(id int32, inst *Instance) *pineappleproto.Commit {
+	commit := &pineappleproto.Commit{LeaderId: r.Id, Instance: id, Ballot: inst.ballot,
+		Command: inst.cmds, Payload: inst.payload}
+	if len(inst.cmds) > 0 {
+		commit.Key = int(inst.cmds[0].K)
+	}
+	return commit
+}
+
+// Sends a follower the commits past the end of its committed prefix, at most
+// COMMIT_RESEND_BATCH of them. Instances this replica reclaimed are committed with a
+// single CommitUpTo, as their values are gone. With -exec the follower cannot execute
+// them either, so the CommitUpTo goes up to the last executed instance and carries the
+// state machine as of there.
+func (r *Replica) resendCommits(q int32) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Commit resend failed:", err)
+		}
+	}()
+	from := r.followerDone[q] + 1
+	if first := r.pendingRMWs.first(); from < first {
+		skip := &pineappleproto.CommitUpTo{LeaderId: r.Id, UpTo: first - 1}
+		if r.Exec {
+			skip.UpTo = r.rmwExecutedUpTo
+			skip.State = r.stateCommands()
+		}
+		r.send(q, r.commitUpToRPC, skip)
+		from = skip.UpTo + 1
+	}
+	for i := from; i <= r.rmwDoneUpTo && i < from+COMMIT_RESEND_BATCH; i++ {
+		if inst := r.pendingRMWs.get(i); inst != nil {
+			r.send(q, r.commitRPC, r.commitMsg(i, inst))
+		}
+	}
+}
+
+// The state machine as PUTs in key order, for a follower that skips instances it cannot
+// execute, see resendCommits
+func (r *Replica) stateCommands() []state.Command {
+	cmds := make([]state.Command, 0, len(r.State.Store))
+	for k, v := range r.State.Store {
+		cmds = append(cmds, state.Command{Op: state.PUT, K: k, V: v})
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].K < cmds[j].K })
+	return cmds
+}
+
+// Resends commits to the followers that did not catch up in time
+func (r *Replica) checkCommits(now time.Time) {
+	if !r.IsLeader {
+		return
+	}
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q].Load() || r.commitDeadline[q].IsZero() || now.Before(r.commitDeadline[q]) {
+			continue
+		}
+		if r.followerDone[q] >= r.rmwDoneUpTo {
+			r.commitDeadline[q] = time.Time{} // it caught up since its last acknowledgement
+			continue
+		}
+		r.commitDeadline[q] = now.Add(r.timeout)
+		r.resendCommits(q)
+	}
+}
+
+// Tells the leader how far this replica got, once per tick in which commits arrived. The
+// leader counts this replica among the ones readers find the values at, so the commits
+// must be on disk first.
+func (r *Replica) ackCommits() {
+	if r.ackLeader < 0 {
+		return
+	}
+	if r.ackLeader != r.Id {
+		r.sync()
+		r.send(r.ackLeader, r.commitAckRPC, &pineappleproto.CommitAck{ReplicaID: r.Id, DoneUpTo: r.rmwDoneUpTo})
+	}
+	r.ackLeader = -1
+}
+
+// A follower's committed prefix ends at ack.DoneUpTo. One that moved forward gets another
+// timeout to catch up, one that caught up needs nothing more until the next commit.
+func (r *Replica) handleCommitAck(ack *pineappleproto.CommitAck) {
+	q := ack.ReplicaID
+	if !r.IsLeader || q < 0 || int(q) >= r.N || ack.DoneUpTo <= r.followerDone[q] {
+		return
+	}
+	r.followerDone[q] = ack.DoneUpTo
+	if ack.DoneUpTo >= r.rmwDoneUpTo {
+		r.commitDeadline[q] = time.Time{}
+	} else {
+		r.commitDeadline[q] = r.Clock.Now().Add(r.timeout)
+	}
+	r.executeCommitted()
+}
+
+// End of the committed prefix of the RMW log that a quorum, this replica included, holds
+// in its data. A leader answers an RMW only then: followers apply a value on commit, so
+// before that a read quorum of them could still miss it.
+func (r *Replica) quorumDoneUpTo() int32 {
+	if !r.IsLeader {
+		return r.rmwDoneUpTo
+	}
+	done := make([]int32, 0, r.N)
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id {
+			done = append(done, r.rmwDoneUpTo)
+		} else if r.followerDone[q] < r.rmwDoneUpTo {
+			done = append(done, r.followerDone[q])
+		} else {
+			done = append(done, r.rmwDoneUpTo)
+		}
+	}
+	sort.Slice(done, func(i, j int) bool { return done[i] > done[j] })
+	return done[r.N>>1]
+}
+
+// Forgets what the followers acknowledged to a previous leader, so they are caught up
+// from whatever this replica holds
+func (r *Replica) resetFollowers() {
+	for q := range r.followerDone {
+		r.followerDone[q] = -1
+		r.commitDeadline[q] = time.Time{}
+	}
+}
+
+// The leader committed a value, which this replica may not have seen yet
+func (r *Replica) handleCommit(commit *pineappleproto.Commit) {
+	r.ackLeader = commit.LeaderId
+	if r.pendingRMWs.reclaimed(commit.Instance) {
+		return
+	}
+	inst := r.pendingRMWs.get(commit.Instance)
+	if inst != nil && (inst.lb != nil || inst.status == COMMITTED) {
+		return // our own instance, or known already
+	}
+	if inst == nil {
+		inst = &Instance{rmwId: commit.Instance}
+		r.pendingRMWs.set(commit.Instance, inst)
+		r.learnRMWInstance(commit.Instance)
+	}
+	inst.cmds = commit.Command
+	inst.payload = commit.Payload
+	if commit.Ballot > inst.ballot {
+		inst.ballot = commit.Ballot
+	}
+	r.adoptChosen(inst)
+	inst.status = COMMITTED
+	r.recordInstance(RMW_SPACE, commit.Instance, inst)
+	r.recordCommit(commit.Instance)
+	r.advanceRMWDone()
+}
+
+// The leader committed instances whose value this replica accepted in the same ballot
+func (r *Replica) handleCommitShort(commit *pineappleproto.CommitShort) {
+	r.ackLeader = commit.LeaderId
+	for i := commit.Instance; i < commit.Instance+commit.Count; i++ {
+		inst := r.pendingRMWs.get(i)
+		if inst == nil || inst.lb != nil || inst.status != ACCEPTED || inst.ballot != commit.Ballot {
+			// reclaimed, driven by this replica, or accepted in another ballot since
+			continue
+		}
+		inst.status = COMMITTED
+		r.adoptChosen(inst)
+		r.recordCommit(i)
+	}
+	r.advanceRMWDone()
+}
+
+// The leader reclaimed the instances up to commit.UpTo, so their values are gone. This
+// replica skips over them as if it loaded a snapshot taken there: its data may miss the
+// values of those it did not accept, which the quorums that accepted them hold. With
+// -exec its state machine is replaced by the leader's, which executed them.
+func (r *Replica) handleCommitUpTo(commit *pineappleproto.CommitUpTo) {
+	r.ackLeader = commit.LeaderId
+	if commit.UpTo <= r.rmwDoneUpTo || r.IsLeader {
+		return
+	}
+	log.Printf("Replica %d skipping RMW instances %d to %d, which the leader reclaimed\n",
+		r.Id, r.rmwDoneUpTo+1, commit.UpTo)
+	if r.Exec {
+		st := state.InitState()
+		for i := range commit.State {
+			commit.State[i].Execute(st)
+		}
+		r.State = st
+	}
+	r.learnRMWInstance(commit.UpTo)
+	r.pendingRMWs.reclaimUpTo(commit.UpTo)
+	r.rmwDoneUpTo = commit.UpTo
+	if r.rmwExecutedUpTo < commit.UpTo {
+		r.rmwExecutedUpTo = commit.UpTo
+	}
+	r.advanceRMWDone()
+}
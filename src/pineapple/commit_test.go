@@ -0,0 +1,47 @@
+package pineapple
+
+import (
+	"reflect"
+	"testing"
+
+	"pineapple/src/state"
+)
+
+// With -exec, a follower that comes back after the leader reclaimed the RMWs it missed
+// takes the leader's state machine instead of skipping them
+func TestCommitUpToState(t *testing.T) {
+	c := newManualCluster(t, 3)
+	for _, r := range c.replicas {
+		r.Exec = true
+	}
+	c.down[2] = true
+	c.replicas[0].PeerChanged(2, false)
+	c.replicas[1].PeerChanged(2, false)
+
+	for i, cmd := range []state.Command{
+		{Op: state.FETCH_ADD, K: 1, V: 5},
+		{Op: state.FETCH_ADD, K: 2, V: 7},
+		{Op: state.FETCH_ADD, K: 1, V: 1},
+	} {
+		if reply, notLeader := c.do(0, int32(i), cmd); notLeader != nil || reply.OK != TRUE {
+			t.Fatalf("RMW %d answered with %+v, %+v", i, reply, notLeader)
+		}
+	}
+	c.step()
+	leader := c.replicas[0]
+	if leader.pendingRMWs.first() != 3 {
+		t.Fatalf("leader reclaimed RMWs up to %d, want 2", leader.pendingRMWs.first()-1)
+	}
+
+	c.down[2] = false
+	leader.PeerChanged(2, true)
+	c.deliver()
+	follower := c.replicas[2]
+	if follower.rmwDoneUpTo != 2 || follower.rmwExecutedUpTo != 2 {
+		t.Errorf("follower done up to %d, executed up to %d; want 2", follower.rmwDoneUpTo, follower.rmwExecutedUpTo)
+	}
+	want := map[state.Key]state.Value{1: 6, 2: 7}
+	if !reflect.DeepEqual(leader.State.Store, want) || !reflect.DeepEqual(follower.State.Store, want) {
+		t.Errorf("leader state %v, follower state %v; want %v", leader.State.Store, follower.State.Store, want)
+	}
+}
@@ -0,0 +1,123 @@
+package pineapple
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"pineapple/src/genericsmr"
+	"pineapple/src/pineappleproto"
+)
+
+// Replicas driven by hand, for the simulator. Nothing happens on its own: there are no
+// connections, goroutines or timers, and every call below runs to completion on the
+// caller's goroutine, so the same calls in the same order always do the same thing.
+
+// Builds a replica of an n-replica cluster that only acts when called. Frames for peers
+// go to send; storeBase names the stable store files, "" keeps the replica in memory.
+func NewManualReplica(id int, n int, clock genericsmr.Clock, send func(peerId int32, frame []byte),
+	storeBase string, timeout time.Duration, maxRetries int, snapshotInterval time.Duration) *Replica {
+	peerAddrList := make([]string, n)
+	for i := range peerAddrList {
+		peerAddrList[i] = fmt.Sprintf("replica%d", i)
+	}
+
+	r := newReplica(id, peerAddrList, nil, false, true, false, timeout, maxRetries, snapshotInterval, true, false, nil)
+	r.Detach(clock, send)
+	r.lastSnapshot = clock.Now()
+	r.lastStats = clock.Now()
+	if storeBase != "" {
+		if err := r.OpenStableStore(storeBase); err != nil {
+			log.Fatal(err)
+		}
+		r.recover()
+	}
+
+	if r.Id == 0 {
+		r.startLeading()
+	}
+	return r
+}
+
+// Handles a frame from a peer
+func (r *Replica) Receive(peerId int32, frame []byte) error {
+	if err := r.Deliver(peerId, frame); err != nil {
+		return err
+	}
+	for r.step() {
+	}
+	return nil
+}
+
+// Handles one message waiting in the protocol channels, returns false if there was none.
+// Deliver queues a single message, so there is never a choice to make between channels.
+func (r *Replica) step() bool {
+	select {
+	case get := <-r.getChan:
+		r.handleGet(get.(*pineappleproto.Get))
+	case set := <-r.setChan:
+		r.handleSet(set.(*pineappleproto.Set))
+	case getReply := <-r.getReplyChan:
+		r.handleGetReply(getReply.(*pineappleproto.GetReply))
+	case setReply := <-r.setReplyChan:
+		r.handleSetReply(setReply.(*pineappleproto.SetReply))
+	case rmwGet := <-r.rmwGetChan:
+		r.handleRMWGet(rmwGet.(*pineappleproto.RMWGet))
+	case rmwGetReply := <-r.rmwGetReplyChan:
+		r.handleRMWGetReply(rmwGetReply.(*pineappleproto.RMWGetReply))
+	case rmwSet := <-r.rmwSetChan:
+		r.handleRMWSet(rmwSet.(*pineappleproto.RMWSet))
+	case rmwSetReply := <-r.rmwSetReplyChan:
+		r.handleRMWSetReply(rmwSetReply.(*pineappleproto.RMWSetReply))
+	case prepare := <-r.prepareChan:
+		r.handlePrepare(prepare.(*pineappleproto.Prepare))
+	case prepareReply := <-r.prepareReplyChan:
+		r.handlePrepareReply(prepareReply.(*pineappleproto.PrepareReply))
+	case commit := <-r.commitChan:
+		r.handleCommit(commit.(*pineappleproto.Commit))
+	case commitShort := <-r.commitShortChan:
+		r.handleCommitShort(commitShort.(*pineappleproto.CommitShort))
+	case commitAck := <-r.commitAckChan:
+		r.handleCommitAck(commitAck.(*pineappleproto.CommitAck))
+	case commitUpTo := <-r.commitUpToChan:
+		r.handleCommitUpTo(commitUpTo.(*pineappleproto.CommitUpTo))
+	default:
+		return false
+	}
+	return true
+}
+
+// Handles a client request, whose replies go to propose.Reply
+func (r *Replica) Submit(propose *genericsmr.Propose) {
+	r.handlePropose(propose)
+}
+
+// The work Run does every CLOCK
+func (r *Replica) Tick() {
+	r.onTick()
+}
+
+// Resends phases that waited too long, as Run does every timeout/4
+func (r *Replica) CheckTimeouts() {
+	r.checkTimeouts()
+}
+
+// Tells the replica a peer went down or came back
+func (r *Replica) PeerChanged(peerId int32, alive bool) {
+	r.Alive[peerId].Store(alive)
+	r.handlePeerEvent(genericsmr.PeerEvent{Peer: peerId, Alive: alive})
+}
+
+// Takes over as the leader, as if the master asked
+func (r *Replica) TakeOver() {
+	r.becomeLeader()
+}
+
+// Crashes the replica, which must not be called again. Records the stable store had not
+// flushed are lost, as they would be if the process died.
+func (r *Replica) Stop() {
+	r.Shutdown = true
+	if r.StableStore != nil {
+		r.StableStore.Abandon()
+	}
+}
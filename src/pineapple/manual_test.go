@@ -0,0 +1,169 @@
+package pineapple
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"pineapple/src/genericsmr"
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/state"
+)
+
+// Time only moves when a test says so
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time        { return c.now }
+func (c *testClock) Sleep(d time.Duration) {}
+
+type message struct {
+	from  int32
+	to    int32
+	frame []byte
+}
+
+// Manual replicas wired to each other through a queue the test drains with deliver.
+// Replicas marked down neither send nor receive.
+type manualCluster struct {
+	t        *testing.T
+	clock    *testClock
+	timeout  time.Duration
+	replicas []*Replica
+	down     []bool
+	queue    []message
+}
+
+func newManualCluster(t *testing.T, n int) *manualCluster {
+	c := &manualCluster{t: t, clock: &testClock{time.Unix(1000, 0)}, timeout: 100 * time.Millisecond, down: make([]bool, n)}
+	for i := 0; i < n; i++ {
+		c.replicas = append(c.replicas, c.start(i))
+	}
+	c.deliver()
+	return c
+}
+
+func (c *manualCluster) start(i int) *Replica {
+	return NewManualReplica(i, len(c.down), c.clock, func(to int32, frame []byte) {
+		if !c.down[i] {
+			c.queue = append(c.queue, message{int32(i), to, frame})
+		}
+	}, "", c.timeout, 3, 0)
+}
+
+// Hands out queued messages, and the ones they cause, until there are none left.
+// Returns the messages that went out.
+func (c *manualCluster) deliver() []message {
+	var sent []message
+	for len(c.queue) > 0 {
+		m := c.queue[0]
+		c.queue = c.queue[1:]
+		sent = append(sent, m)
+		if c.down[m.to] {
+			continue
+		}
+		if err := c.replicas[m.to].Receive(m.from, m.frame); err != nil {
+			c.t.Fatalf("replica %d could not read a message from %d: %v", m.to, m.from, err)
+		}
+	}
+	return sent
+}
+
+// Hands out the first n queued messages, and none of the ones they cause
+func (c *manualCluster) deliverFirst(n int) {
+	msgs := c.queue[:n]
+	c.queue = append([]message(nil), c.queue[n:]...)
+	for _, m := range msgs {
+		if c.down[m.to] {
+			continue
+		}
+		if err := c.replicas[m.to].Receive(m.from, m.frame); err != nil {
+			c.t.Fatalf("replica %d could not read a message from %d: %v", m.to, m.from, err)
+		}
+	}
+}
+
+// Moves time on by a quarter of the timeout: every replica ticks and checks its timeouts.
+// Returns the messages that went out.
+func (c *manualCluster) step() []message {
+	c.clock.now = c.clock.now.Add(c.timeout / 4)
+	for i, r := range c.replicas {
+		if !c.down[i] {
+			r.Tick()
+			r.CheckTimeouts()
+		}
+	}
+	return c.deliver()
+}
+
+// Lets time pass
+func (c *manualCluster) wait(d time.Duration) {
+	for end := c.clock.now.Add(d); c.clock.now.Before(end); {
+		c.step()
+	}
+}
+
+// Replies a client got
+type replies struct {
+	frames [][]byte
+}
+
+func (rs *replies) last(t *testing.T) (*genericsmrproto.ProposeReplyTS, *genericsmrproto.NotLeader) {
+	t.Helper()
+	if len(rs.frames) == 0 {
+		t.Fatal("no reply")
+	}
+	_, reply, notLeader, err := genericsmrproto.ReadClientReplyOrRedirect(bytes.NewReader(rs.frames[len(rs.frames)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply, notLeader
+}
+
+// Sends a client request to a replica, without delivering what it sends
+func (c *manualCluster) submit(replica int, id int32, cmd state.Command) *replies {
+	rs := &replies{}
+	c.replicas[replica].Submit(&genericsmr.Propose{
+		Propose:   &genericsmrproto.Propose{CommandId: id, Command: cmd},
+		Reply:     genericsmr.NewReplySink(func(frame []byte) { rs.frames = append(rs.frames, frame) }),
+		ReplyType: genericsmrproto.PROPOSE_REPLY})
+	return rs
+}
+
+// Sends a request and runs the cluster until it is answered, or for a few ticks
+func (c *manualCluster) do(replica int, id int32, cmd state.Command) (*genericsmrproto.ProposeReplyTS, *genericsmrproto.NotLeader) {
+	rs := c.submit(replica, id, cmd)
+	c.deliver()
+	for i := 0; i < 4 && len(rs.frames) == 0; i++ {
+		c.step()
+	}
+	return rs.last(c.t)
+}
+
+// A follower sends RMWs back to the replica whose ballot it promised, and the leader takes them
+func TestRedirectToLeader(t *testing.T) {
+	c := newManualCluster(t, 3)
+	cmd := state.Command{Op: state.FETCH_ADD, K: 1, V: 5}
+
+	reply, notLeader := c.do(2, 1, cmd)
+	if notLeader == nil || notLeader.CommandId != 1 || notLeader.LeaderId != 0 || string(notLeader.LeaderAddr) != "replica0" {
+		t.Fatalf("follower answered an RMW with %+v, %+v; want a redirect to replica 0", reply, notLeader)
+	}
+	if reply, notLeader := c.do(2, 2, state.Command{Op: state.PUT, K: 1, V: 3}); notLeader != nil || reply.OK != TRUE {
+		t.Errorf("follower answered a PUT with %+v, %+v", reply, notLeader)
+	}
+	if reply, notLeader := c.do(0, 1, cmd); notLeader != nil || reply.OK != TRUE || reply.Value != 8 {
+		t.Errorf("leader answered the redirected RMW with %+v, %+v", reply, notLeader)
+	}
+}
+
+// A replica that never heard from a leader says so instead of naming itself
+func TestRedirectUnknownLeader(t *testing.T) {
+	c := newManualCluster(t, 3)
+	c.replicas[0].IsLeader = false
+	_, notLeader := c.do(0, 1, state.Command{Op: state.FETCH_ADD, K: 1, V: 1})
+	if notLeader == nil || notLeader.LeaderId != -1 || len(notLeader.LeaderAddr) != 0 {
+		t.Errorf("got %+v, want a redirect to no one", notLeader)
+	}
+}
@@ -2,7 +2,6 @@ package pineapple
 
 import (
 	"encoding/binary"
-	"io"
 	"log"
 	"time"
 
@@ -42,28 +41,70 @@ type Replica struct {
 	setReplyRPC  uint8
 
 	// Paxos
-	rmwGetChan      chan fastrpc.Serializable
-	rmwGetReplyChan chan fastrpc.Serializable
-	rmwSetChan      chan fastrpc.Serializable
-	rmwSetReplyChan chan fastrpc.Serializable
-	rmwGetRPC       uint8
-	rmwGetReplyRPC  uint8
-	rmwSetRPC       uint8
-	rmwSetReplyRPC  uint8
+	rmwGetChan       chan fastrpc.Serializable
+	rmwGetReplyChan  chan fastrpc.Serializable
+	rmwSetChan       chan fastrpc.Serializable
+	rmwSetReplyChan  chan fastrpc.Serializable
+	prepareChan      chan fastrpc.Serializable
+	prepareReplyChan chan fastrpc.Serializable
+	commitChan       chan fastrpc.Serializable
+	commitShortChan  chan fastrpc.Serializable
+	commitAckChan    chan fastrpc.Serializable
+	commitUpToChan   chan fastrpc.Serializable
+	rmwGetRPC        uint8
+	rmwGetReplyRPC   uint8
+	rmwSetRPC        uint8
+	rmwSetReplyRPC   uint8
+	prepareRPC       uint8
+	prepareReplyRPC  uint8
+	commitRPC        uint8
+	commitShortRPC   uint8
+	commitAckRPC     uint8
+	commitUpToRPC    uint8
 
 	IsLeader bool // does this replica think it is the leader
 	Shutdown bool
 	data     map[int]pineappleproto.Payload
 	// prev // value & carstamp generated by previously executed RMWs
-	instanceSpace []*Instance // the space of all instances (used and not yet used)
-	defaultBallot int32       // default ballot for new instances (0 until a Prepare(ballot, instance->infinity) from a leader)
-	crtInstance   int32       // highest used instance number that this replica knows about
-
-	flush bool
-
-	crtRmwId    int32       // highest id of RMW started
-	rmwDoneUpTo int32       // latest RMW done
-	pendingRMWs []*Instance // ids of RMWs pending
+	instanceSpace *instanceWindow // ABD instances still in flight
+	defaultBallot int32           // default ballot for new instances (0 until a Prepare(ballot, instance->infinity) from a leader)
+	crtInstance   int32           // highest used instance number that this replica knows about
+
+	flush bool // flush peer messages as soon as possible, instead of batching them for up to genericsmr.FLUSH_INTERVAL
+
+	crtRmwId    int32                          // highest id of RMW started
+	rmwDoneUpTo int32                          // end of the committed prefix of the RMW log
+	pendingRMWs *instanceWindow                // RMW log, indexed by RMW id, up to the last executed RMW
+	toCommit    []int32                        // RMWs committed since the followers were last told
+	proposed    map[int]pineappleproto.Payload // newest value RMWs in flight proposed per key, kept out of data until chosen
+
+	ackLeader      int32       // leader whose commits this replica has yet to acknowledge, -1 if none
+	followerDone   []int32     // leader: end of each follower's committed prefix, as last acknowledged
+	commitDeadline []time.Time // leader: when to resend commits to a follower that has not caught up, zero if it has
+
+	leaderChan     chan bool             // BeTheLeader requests from the master
+	stepDownChan   chan chan bool        // StepDown requests from the master, closed once done
+	preparing      bool                  // new leader still recovering the RMW log
+	prepareUpTo    int32                 // last RMW instance covered by the current Prepare round
+	preparePending int                   // RMW instances still waiting on a quorum of Prepare replies
+	deferredRMWs   []*genericsmr.Propose // RMWs received while preparing
+
+	clockChan   chan bool // ticks the main loop every CLOCK
+	timeoutChan chan bool
+	timeout     time.Duration  // how long a phase waits before resending
+	maxRetries  int            // resends before the client gets an error reply
+	abdInFlight map[int32]bool // ABD instances waiting on replies
+	rmwInFlight map[int32]bool // RMW instances waiting on replies
+
+	recovered   bool     // state was rebuilt from the stable store
+	syncWaiters []func() // replies waiting for the next group commit
+
+	snapshotInterval time.Duration // how often a durable replica snapshots its state and drops older log segments
+	lastSnapshot     time.Time
+	compactedUpTo    int32 // RMW instances up to this one were executed and only survive in the snapshot
+
+	rmwExecutedUpTo int32 // last RMW executed, see executeCommitted
+	lastStats       time.Time
 }
 
 type Instance struct {
@@ -73,6 +114,9 @@ type Instance struct {
 	receivedRMW     pineappleproto.Payload
 	receivedData    []*pineappleproto.GetReply
 	receivedRMWData []pineappleproto.Payload
+	payload         pineappleproto.Payload // value-tag pair returned to the client
+	previous        int                    // value of the key before the RMW was applied
+	read            pineappleproto.Payload // PROPOSE_AND_READ: the other key's value-tag pair when the command was applied
 	ballot          int32
 	status          InstanceStatus
 	lb              *LeaderBookkeeping
@@ -90,13 +134,25 @@ type LeaderBookkeeping struct {
 	rmwSetOKs       int
 	rmwGetDone      bool // has rmwGet phase been completed
 	nacks           int
+	maxNackBallot   int32 // highest ballot a NACK reported
 	completed       bool
+	preparing       bool           // waiting on Prepare replies for this instance
+	acks            map[int32]bool // replicas that answered the current phase
+	deadline        time.Time      // resend the current phase to silent replicas after this
+	retries         int
 }
 
-func NewReplica(id int, peerAddrList []string, exec bool, dreply bool) *Replica {
+func NewReplica(id int, peerAddrList []string, clientAddrList []string, exec bool, dreply bool, durable bool, timeout time.Duration, maxRetries int, snapshotInterval time.Duration, flush bool, checksum bool, transport genericsmr.Transport) *Replica {
+	r := newReplica(id, peerAddrList, clientAddrList, exec, dreply, durable, timeout, maxRetries, snapshotInterval, flush, checksum, transport)
+	go r.Run()
+	return r
+}
+
+// Builds a replica without starting it
+func newReplica(id int, peerAddrList []string, clientAddrList []string, exec bool, dreply bool, durable bool, timeout time.Duration, maxRetries int, snapshotInterval time.Duration, flush bool, checksum bool, transport genericsmr.Transport) *Replica {
 	// extends a normal replica
 	r := &Replica{
-		genericsmr.NewReplica(id, peerAddrList, exec, dreply),
+		genericsmr.NewReplica(id, peerAddrList, clientAddrList, exec, dreply, durable, checksum, transport),
 		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
@@ -109,6 +165,18 @@ func NewReplica(id int, peerAddrList []string, exec bool, dreply bool) *Replica
 		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
 		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		make(chan fastrpc.Serializable, CHAN_BUFFER_SIZE),
+		0,
+		0,
+		0,
+		0,
+		0,
+		0,
 		0,
 		0,
 		0,
@@ -117,14 +185,44 @@ func NewReplica(id int, peerAddrList []string, exec bool, dreply bool) *Replica
 		false,
 		false,
 		map[int]pineappleproto.Payload{},
-		make([]*Instance, 20*1024*1024),
+		newInstanceWindow(),
 		0,
 		0,
 
+		flush,
+		0,
+		-1,
+		newInstanceWindow(),
+		nil,
+		map[int]pineappleproto.Payload{},
+
+		-1,
+		make([]int32, len(peerAddrList)),
+		make([]time.Time, len(peerAddrList)),
+
+		make(chan bool, 1),
+		make(chan chan bool),
 		false,
+		-1,
 		0,
+		nil,
+
+		make(chan bool, 1),
+		make(chan bool, 1),
+		timeout,
+		maxRetries,
+		map[int32]bool{},
+		map[int32]bool{},
+
+		false,
+		nil,
+
+		snapshotInterval,
+		time.Now(),
 		-1,
-		make([]*Instance, 20*1024*1024),
+
+		-1,
+		time.Now(),
 	}
 
 	// ABD
@@ -138,60 +236,103 @@ func NewReplica(id int, peerAddrList []string, exec bool, dreply bool) *Replica
 	r.rmwGetReplyRPC = r.RegisterRPC(new(pineappleproto.RMWGetReply), r.rmwGetReplyChan)
 	r.rmwSetRPC = r.RegisterRPC(new(pineappleproto.RMWSet), r.rmwSetChan)
 	r.rmwSetReplyRPC = r.RegisterRPC(new(pineappleproto.RMWSetReply), r.rmwSetReplyChan)
+	r.prepareRPC = r.RegisterRPC(new(pineappleproto.Prepare), r.prepareChan)
+	r.prepareReplyRPC = r.RegisterRPC(new(pineappleproto.PrepareReply), r.prepareReplyChan)
+	r.commitRPC = r.RegisterRPC(new(pineappleproto.Commit), r.commitChan)
+	r.commitShortRPC = r.RegisterRPC(new(pineappleproto.CommitShort), r.commitShortChan)
+	r.commitAckRPC = r.RegisterRPC(new(pineappleproto.CommitAck), r.commitAckChan)
+	r.commitUpToRPC = r.RegisterRPC(new(pineappleproto.CommitUpTo), r.commitUpToChan)
 
-	go r.Run()
+	r.resetFollowers()
+	r.recover()
 
 	return r
 }
 
 // Compare two tags, returning true if the received tag is larger.
-// A tag is larger than another if it has a higher timestamp.
-// If both tags have the same timestamp, the tag with the Paxos leader id is smaller
+// Tags are ordered by timestamp, then by id, then by the RMWs applied on top of them
 func (r *Replica) isLargerTag(currentTag pineappleproto.Tag, receivedTag pineappleproto.Tag) bool {
-	if receivedTag.Timestamp > currentTag.Timestamp {
-		return true
-	} else if receivedTag.Timestamp == currentTag.Timestamp {
-		// tags are identical
-		if currentTag.ID == receivedTag.ID {
-			return false
-		} else if r.IsLeader && currentTag.ID == int(r.Id) {
-			// if the replica is the leader and the tag has its id, prefer the receivedTag
-			return true
-		} else {
-			return currentTag.ID < receivedTag.ID
-		}
+	if receivedTag.Timestamp != currentTag.Timestamp {
+		return receivedTag.Timestamp > currentTag.Timestamp
 	}
-	return false
+	if receivedTag.ID != currentTag.ID {
+		return receivedTag.ID > currentTag.ID
+	}
+	return receivedTag.RMWCount > currentTag.RMWCount
 }
 
-// Reply to client during ABD
+// Reply to client during ABD, after which the instance is no longer needed
 func (r *Replica) replyClient(instance int32) {
-	inst := r.instanceSpace[instance]
+	inst := r.instanceSpace.get(instance)
+	if inst == nil { // already answered
+		return
+	}
+	delete(r.abdInFlight, instance)
 	if inst.lb.clientProposals != nil && r.Dreply && !inst.lb.completed {
-		propreply := &genericsmrproto.ProposeReplyTS{
-			OK:        TRUE,
-			CommandId: inst.lb.clientProposals[0].CommandId,
-			Value:     state.NIL,
-			Timestamp: inst.lb.clientProposals[0].Timestamp}
-		r.ReplyProposeTS(propreply, inst.lb.clientProposals[0].Reply)
+		r.replyPropose(inst)
 		inst.lb.completed = true
 	}
+	r.instanceSpace.reclaim(instance)
+}
+
+// Answers the client of an instance in the form its request expects
+func (r *Replica) replyPropose(inst *Instance) {
+	propose := inst.lb.clientProposals[0]
+	switch propose.ReplyType {
+	case genericsmrproto.READ_REPLY:
+		r.ReplyRead(&genericsmrproto.ReadReply{
+			OK:           TRUE,
+			CommandId:    propose.CommandId,
+			Value:        state.Value(inst.payload.Value),
+			TagTimestamp: int64(inst.payload.Tag.Timestamp),
+			TagID:        int32(inst.payload.Tag.ID),
+			TagRMWCount:  int32(inst.payload.Tag.RMWCount)}, propose.Reply)
+	case genericsmrproto.PROPOSE_AND_READ_REPLY:
+		r.ReplyProposeAndRead(&genericsmrproto.ProposeAndReadReply{
+			OK:        TRUE,
+			CommandId: propose.CommandId,
+			Value:     state.Value(inst.read.Value)}, propose.Reply)
+	default:
+		r.ReplyProposeTS(r.proposeReply(inst), propose.Reply)
+	}
+}
+
+// Builds the client reply carrying the value-tag pair an instance settled on
+func (r *Replica) proposeReply(inst *Instance) *genericsmrproto.ProposeReplyTS {
+	return &genericsmrproto.ProposeReplyTS{
+		OK:           TRUE,
+		CommandId:    inst.lb.clientProposals[0].CommandId,
+		Value:        state.Value(inst.payload.Value),
+		Timestamp:    inst.lb.clientProposals[0].Timestamp,
+		TagTimestamp: int64(inst.payload.Tag.Timestamp),
+		TagID:        int32(inst.payload.Tag.ID),
+		TagRMWCount:  int32(inst.payload.Tag.RMWCount),
+		Previous:     state.Value(inst.previous)}
+}
+
+// Queues a message for a peer
+func (r *Replica) send(peerId int32, code uint8, msg fastrpc.Serializable) {
+	if r.flush {
+		r.SendMsg(peerId, code, msg)
+	} else {
+		r.SendMsgNoFlush(peerId, code, msg)
+	}
 }
 
 func (r *Replica) replyRMWGet(replicaId int32, reply *pineappleproto.RMWGetReply) {
-	r.SendMsg(replicaId, r.rmwGetReplyRPC, reply)
+	r.send(replicaId, r.rmwGetReplyRPC, reply)
 }
 
 func (r *Replica) replyRMWSet(replicaId int32, reply *pineappleproto.RMWSetReply) {
-	r.SendMsg(replicaId, r.rmwSetReplyRPC, reply)
+	r.send(replicaId, r.rmwSetReplyRPC, reply)
 }
 
 func (r *Replica) replyGet(replicaId int32, reply *pineappleproto.GetReply) {
-	r.SendMsg(replicaId, r.getReplyRPC, reply)
+	r.send(replicaId, r.getReplyRPC, reply)
 }
 
 func (r *Replica) replySet(replicaId int32, reply *pineappleproto.SetReply) {
-	r.SendMsg(replicaId, r.setReplyRPC, reply)
+	r.send(replicaId, r.setReplyRPC, reply)
 }
 
 // Get Phase (Coordinator)
@@ -212,6 +353,8 @@ func (r *Replica) bcastGet(instance int32, write bool, key int) {
 
 	args := &pineappleproto.Get{ReplicaID: r.Id, Instance: instance,
 		Write: wr, Key: key, Payload: data}
+	r.startPhase(r.instanceSpace.get(instance).lb)
+
 	replicaCount := r.N - 1
 	q := r.Id
 	// Send to each connected replica
@@ -220,11 +363,11 @@ func (r *Replica) bcastGet(instance int32, write bool, key int) {
 		if q == r.Id {
 			break
 		}
-		if !r.Alive[q] {
+		if !r.Alive[q].Load() {
 			continue
 		}
 
-		r.SendMsg(q, r.getRPC, args)
+		r.send(q, r.getRPC, args)
 	}
 }
 
@@ -233,6 +376,7 @@ func (r *Replica) bcastGet(instance int32, write bool, key int) {
 func (r *Replica) handleGet(get *pineappleproto.Get) {
 	var getReply *pineappleproto.GetReply
 	ok := TRUE
+	adopted := false
 	data, doesExist := r.data[get.Key]
 
 	// Return the most recent data held by storage node only if READ, since payload would be overwritten in write
@@ -240,6 +384,8 @@ func (r *Replica) handleGet(get *pineappleproto.Get) {
 		if !doesExist || r.isLargerTag(data.Tag, get.Payload.Tag) {
 			// Replica has smaller tag, return received value
 			r.data[get.Key] = get.Payload
+			r.recordData(get.Key, get.Payload)
+			adopted = true
 			getReply = &pineappleproto.GetReply{ReplicaID: r.Id, Instance: get.Instance,
 				OK: ok, Write: get.Write, Key: get.Key, Payload: get.Payload,
 			}
@@ -248,28 +394,36 @@ func (r *Replica) handleGet(get *pineappleproto.Get) {
 				OK: ok, Write: get.Write, Key: get.Key, Payload: data,
 			}
 		}
-	} else { // init with empty payload
+	} else { // only the tag is needed, since the value will be overwritten by the writer
 		getReply = &pineappleproto.GetReply{ReplicaID: r.Id, Instance: get.Instance, OK: ok,
-			Write: get.Write, Key: get.Key, Payload: pineappleproto.Payload{},
+			Write: get.Write, Key: get.Key, Payload: pineappleproto.Payload{Tag: data.Tag},
 		}
 	}
 
-	r.replyGet(get.ReplicaID, getReply)
+	if adopted {
+		// the adopted value must be on disk before the coordinator counts this reply
+		r.afterSync(func() { r.replyGet(get.ReplicaID, getReply) })
+	} else {
+		r.replyGet(get.ReplicaID, getReply)
+	}
 }
 
 // Chooses the most recent vt pair after waiting for majority ACKs (or increment timestamp if write)
 func (r *Replica) handleGetReply(getReply *pineappleproto.GetReply) {
-	inst := r.instanceSpace[getReply.Instance]
+	inst := r.instanceSpace.get(getReply.Instance)
 	key := getReply.Key
-	if inst.lb.getDone { // avoid proceeding to set phase several times
+	if inst == nil || inst.lb.getDone { // avoid proceeding to set phase several times
+		return
+	}
+	if !r.ack(inst.lb, getReply.ReplicaID) { // retransmitted Get answered twice
 		return
 	}
 
-	r.instanceSpace[getReply.Instance].receivedData =
-		append(r.instanceSpace[getReply.Instance].receivedData, getReply)
+	r.instanceSpace.get(getReply.Instance).receivedData =
+		append(r.instanceSpace.get(getReply.Instance).receivedData, getReply)
 
-	// update local value to largest received
-	if r.isLargerTag(r.data[key].Tag, getReply.Payload.Tag) {
+	// update local value to largest received; a write query only brings back tags
+	if getReply.Write == FALSE && r.isLargerTag(r.data[key].Tag, getReply.Payload.Tag) {
 		r.data[key] = getReply.Payload
 	}
 
@@ -280,29 +434,40 @@ func (r *Replica) handleGetReply(getReply *pineappleproto.GetReply) {
 		if inst.lb.getOKs+1 > r.N>>1 {
 			identicalCount := 0 // keep track of the count of identical responses
 			ownTag := r.data[key].Tag
-			firstReceivedTag := r.instanceSpace[getReply.Instance].receivedData[0].Payload.Tag
+			firstReceived := r.instanceSpace.get(getReply.Instance).receivedData[0].Payload
+			firstReceivedTag := firstReceived.Tag
 
 			// Check if the quorum has all identical values
-			for _, reply := range r.instanceSpace[getReply.Instance].receivedData {
+			for _, reply := range r.instanceSpace.get(getReply.Instance).receivedData {
 				if reply.Payload.Tag == firstReceivedTag {
 					identicalCount++
 				}
 				if reply.Payload.Tag == ownTag && getReply.Write == 0 {
 					// replica has the biggest tag already, do not send tag in 2nd phase
-					r.instanceSpace[getReply.Instance].lb.hasMaxTag[reply.ReplicaID] = true
+					r.instanceSpace.get(getReply.Instance).lb.hasMaxTag[reply.ReplicaID] = true
 				}
 			}
 			// check if all received messages are >= initial tag
 			if inst.initialTag == firstReceivedTag || r.isLargerTag(inst.initialTag, firstReceivedTag) {
 				identicalCount++
 			}
-			receivedDataCount := len(r.instanceSpace[getReply.Instance].receivedData)
-			r.instanceSpace[getReply.Instance].receivedData = nil // clear slice, no longer needed
-			inst.lb.getDone = true                                // getPhase completed
+			receivedDataCount := len(r.instanceSpace.get(getReply.Instance).receivedData)
+			// the write goes after every value this replica knows of, proposed ones
+			// included, and every tag the quorum holds
+			maxTag := r.newest(key).Tag
+			for _, reply := range r.instanceSpace.get(getReply.Instance).receivedData {
+				if r.isLargerTag(maxTag, reply.Payload.Tag) {
+					maxTag = reply.Payload.Tag
+				}
+			}
+			r.instanceSpace.get(getReply.Instance).receivedData = nil // clear slice, no longer needed
+			inst.lb.getDone = true                                    // getPhase completed
 
 			// Optimized read; don't proceed to set if the quorum (including this node)
-			// all has the latest timestamp
-			if (getReply.Write == 0) && (identicalCount == receivedDataCount+1) {
+			// all has the latest timestamp. The reply carries the value the quorum agreed
+			// on; a newer one that reached this node since still has to be written back.
+			if (getReply.Write == 0) && (identicalCount == receivedDataCount+1) && ownTag == inst.initialTag {
+				inst.payload = firstReceived
 				r.replyClient(getReply.Instance)
 				return
 			}
@@ -313,10 +478,16 @@ func (r *Replica) handleGetReply(getReply *pineappleproto.GetReply) {
 			// If writing, choose a higher unique timestamp (by adjoining replica ID with Timestamp++)
 			if getReply.Write == 1 {
 				write = true
-				newTag := pineappleproto.Tag{Timestamp: r.data[key].Tag.Timestamp + 1, ID: int(r.Id)}
-				r.data[key] = pineappleproto.Payload{Tag: newTag, Value: r.data[key].Value}
+				newTag := pineappleproto.Tag{Timestamp: maxTag.Timestamp + 1, ID: int(r.Id)}
+				r.data[key] = pineappleproto.Payload{Tag: newTag, Value: int(inst.cmds[0].V)}
+			}
+			inst.payload = r.data[key]
+			r.recordInstance(ABD_SPACE, getReply.Instance, inst)
+			if write {
+				// a tag that reached a peer must survive a crash here, or the restarted
+				// replica could pick it again for another value
+				r.sync()
 			}
-			r.sync()
 			r.bcastSet(getReply.Instance, write, key, r.data[key])
 		}
 	}
@@ -338,6 +509,7 @@ func (r *Replica) bcastSet(instance int32, write bool, key int, payload pineappl
 	args := &pineappleproto.Set{ReplicaID: r.Id, Instance: instance, Write: wr,
 		Key: key, Payload: payload,
 	}
+	r.startPhase(r.instanceSpace.get(instance).lb)
 
 	replicaCount := r.N - 1
 	q := r.Id
@@ -348,18 +520,18 @@ func (r *Replica) bcastSet(instance int32, write bool, key int, payload pineappl
 		if q == r.Id {
 			break
 		}
-		if !r.Alive[q] {
+		if !r.Alive[q].Load() {
 			continue
 		}
 
 		if !write {
 			// don't message replicas that already have the largest tag
-			if r.instanceSpace[instance].lb.hasMaxTag[q] {
+			if r.instanceSpace.get(instance).lb.hasMaxTag[q] {
 				continue
 			}
 		}
 
-		r.SendMsg(q, r.setRPC, args)
+		r.send(q, r.setRPC, args)
 	}
 }
 
@@ -371,38 +543,46 @@ func (r *Replica) handleSet(set *pineappleproto.Set) {
 	// Sets received payload if largest tag seen
 	if r.isLargerTag(r.data[set.Key].Tag, set.Payload.Tag) {
 		r.data[set.Key] = set.Payload
+		r.recordData(set.Key, set.Payload)
 	}
 
-	setReply = &pineappleproto.SetReply{Instance: set.Instance}
-	r.replySet(set.ReplicaID, setReply)
+	setReply = &pineappleproto.SetReply{ReplicaID: r.Id, Instance: set.Instance}
+	r.afterSync(func() { r.replySet(set.ReplicaID, setReply) })
 }
 
 // Response handler for Set request on nodes
 func (r *Replica) handleSetReply(setReply *pineappleproto.SetReply) {
-	inst := r.instanceSpace[setReply.Instance]
+	inst := r.instanceSpace.get(setReply.Instance)
+	if inst == nil { // client already answered
+		return
+	}
+	if !r.ack(inst.lb, setReply.ReplicaID) { // retransmitted Set answered twice
+		return
+	}
 	inst.lb.setOKs++
 
 	// Wait for a majority of acknowledgements
 	// Either wait for a quorum or for the number of replicas messages, whichever is smaller
 	if (inst.lb.setOKs+1 > len(inst.lb.hasMaxTag) && len(inst.lb.hasMaxTag) < r.N>>1 && len(inst.lb.hasMaxTag) > 0) ||
 		inst.lb.setOKs+1 > r.N>>1 {
-		r.replyClient(setReply.Instance)
+		// our own copy counts towards the quorum, so it must be on disk too
+		r.afterSync(func() { r.replyClient(setReply.Instance) })
 	}
 }
 
-var pRMWGet pineappleproto.RMWGet
-
 func (r *Replica) bcastRMWGet(instance int32, ballot int32, command []state.Command) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Accept bcast failed:", err)
 		}
 	}()
+	var pRMWGet pineappleproto.RMWGet
 	pRMWGet.LeaderId = r.Id
 	pRMWGet.Instance = instance
 	pRMWGet.Ballot = ballot
 	pRMWGet.Command = command
 	args := &pRMWGet
+	r.startPhase(r.pendingRMWs.get(instance).lb)
 
 	n := r.N - 1
 	q := r.Id
@@ -411,42 +591,51 @@ func (r *Replica) bcastRMWGet(instance int32, ballot int32, command []state.Comm
 		if q == r.Id {
 			break
 		}
-		if !r.Alive[q] {
+		if !r.Alive[q].Load() {
 			continue
 		}
 		sent++
-		r.SendMsg(q, r.rmwGetRPC, args)
+		r.send(q, r.rmwGetRPC, args)
 	}
 }
 
 func (r *Replica) handleRMWGet(rmwGet *pineappleproto.RMWGet) {
-	inst := r.instanceSpace[rmwGet.Instance]
 	key := int(rmwGet.Command[0].K)
+	if r.pendingRMWs.reclaimed(rmwGet.Instance) {
+		// committed and executed long ago; a sender still driving it may have been deposed,
+		// so tell it the ballot in use
+		r.replyRMWGet(rmwGet.LeaderId, &pineappleproto.RMWGetReply{ReplicaID: r.Id, Instance: rmwGet.Instance, OK: FALSE, Ballot: r.defaultBallot, Key: key})
+		return
+	}
+	inst := r.pendingRMWs.get(rmwGet.Instance)
 
 	var rmwGetReply *pineappleproto.RMWGetReply
 
+	if rmwGet.Ballot < r.defaultBallot || (inst != nil && rmwGet.Ballot < inst.ballot) {
+		// message from a deposed leader, tell it about the higher ballot
+		r.replyRMWGet(rmwGet.LeaderId, &pineappleproto.RMWGetReply{ReplicaID: r.Id, Instance: rmwGet.Instance, OK: FALSE, Ballot: r.defaultBallot, Key: key})
+		return
+	}
+	r.adoptBallot(rmwGet.LeaderId, rmwGet.Ballot)
+	r.learnRMWInstance(rmwGet.Instance)
+
 	if inst == nil {
-		if rmwGet.Ballot < r.defaultBallot {
-			panic("outdated ballot received")
-		} else {
-			r.instanceSpace[rmwGet.Instance] = &Instance{
-				cmds:   rmwGet.Command,
-				ballot: rmwGet.Ballot,
-				status: ACCEPTED,
-				lb:     nil,
-			}
-			rmwGetReply = &pineappleproto.RMWGetReply{Instance: rmwGet.Instance, Ballot: r.defaultBallot, Key: key}
-		}
-	} else if rmwGet.Ballot < inst.ballot {
-		panic("outdated ballot received")
+		r.pendingRMWs.set(rmwGet.Instance, &Instance{
+			rmwId:  rmwGet.Instance,
+			cmds:   rmwGet.Command,
+			ballot: rmwGet.Ballot,
+			status: PREPARED,
+			lb:     nil,
+		})
+		rmwGetReply = &pineappleproto.RMWGetReply{ReplicaID: r.Id, Instance: rmwGet.Instance, OK: TRUE, Ballot: r.defaultBallot, Key: key, Payload: r.data[key]}
 	} else {
 		// reordered ACCEPT
-		r.instanceSpace[rmwGet.Instance].cmds = rmwGet.Command
-		if r.instanceSpace[rmwGet.Instance].status != COMMITTED {
-			r.instanceSpace[rmwGet.Instance].status = ACCEPTED
+		inst.cmds = rmwGet.Command
+		if inst.status < PREPARED {
+			inst.status = PREPARED
 		}
 		data := r.data[key]
-		rmwGetReply = &pineappleproto.RMWGetReply{Instance: rmwGet.Instance, Ballot: r.defaultBallot, Key: key, Payload: data}
+		rmwGetReply = &pineappleproto.RMWGetReply{ReplicaID: r.Id, Instance: rmwGet.Instance, OK: TRUE, Ballot: r.defaultBallot, Key: key, Payload: data}
 	}
 
 	r.replyRMWGet(rmwGet.LeaderId, rmwGetReply)
@@ -454,13 +643,20 @@ func (r *Replica) handleRMWGet(rmwGet *pineappleproto.RMWGet) {
 
 // Chooses the most recent vt pair after waiting for majority ACKs (or increment timestamp if write)
 func (r *Replica) handleRMWGetReply(rmwGetReply *pineappleproto.RMWGetReply) {
-	inst := r.instanceSpace[rmwGetReply.Instance]
-	if inst.lb.rmwGetDone { // avoid calling handleRMWSet more than once
+	inst := r.pendingRMWs.get(rmwGetReply.Instance)
+	if inst == nil || inst.lb == nil || inst.lb.rmwGetDone { // avoid calling handleRMWSet more than once
 		return
 	}
 
-	r.instanceSpace[rmwGetReply.Instance].receivedRMWData =
-		append(r.instanceSpace[rmwGetReply.Instance].receivedRMWData, rmwGetReply.Payload)
+	if rmwGetReply.OK == FALSE {
+		r.handleRMWNack(inst, rmwGetReply.Ballot)
+		return
+	}
+	if !r.ack(inst.lb, rmwGetReply.ReplicaID) {
+		return
+	}
+
+	inst.receivedRMWData = append(inst.receivedRMWData, rmwGetReply.Payload)
 
 	inst.lb.rmwGetOKs++
 
@@ -468,44 +664,60 @@ func (r *Replica) handleRMWGetReply(rmwGetReply *pineappleproto.RMWGetReply) {
 		key := rmwGetReply.Key
 
 		// Find the largest received timestamp
-		for _, data := range r.instanceSpace[rmwGetReply.Instance].receivedRMWData {
+		for _, data := range inst.receivedRMWData {
 			if r.isLargerTag(r.data[key].Tag, data.Tag) { // received value has larger tag
-				r.data[key] = rmwGetReply.Payload
+				r.data[key] = data
 			}
 		}
 
-		r.instanceSpace[rmwGetReply.Instance].receivedRMWData = nil // clear slice, no longer needed
-		inst.lb.rmwGetDone = true                                   // rmwGet phase completed
+		inst.receivedRMWData = nil // clear slice, no longer needed
+		inst.lb.rmwGetDone = true  // rmwGet phase completed
+
+		// an RMW still in flight on the key may have proposed a newer value, which this one
+		// must apply to
+		base := r.newest(key)
 
 		inst.lb.nacks = 0
-		// If writing, choose a higher unique timestamp (by adjoining replica ID with Timestamp++)
-		newTag := pineappleproto.Tag{Timestamp: r.data[key].Tag.Timestamp + 1, ID: int(r.Id)}
-		newValue := r.data[key].Value + 1 // TODO: update RMW modify
-		r.data[key] = pineappleproto.Payload{Tag: newTag, Value: newValue}
+		// Run the RMW operator chosen by the client on the freshest value of the quorum. The
+		// result is ordered right after it, before any write concurrent with this RMW.
+		newTag := pineappleproto.Tag{Timestamp: base.Tag.Timestamp, ID: base.Tag.ID, RMWCount: base.Tag.RMWCount + 1}
+		inst.previous = base.Value
+		// a key never written still has the zero tag
+		newValue, ok := inst.cmds[0].Modify(state.Value(inst.previous), base.Tag != pineappleproto.Tag{})
+		if !ok && inst.cmds[0].Op == state.PUT { // PROPOSE_AND_READ of a plain write
+			newValue = inst.cmds[0].V
+		}
+		// readers only see the value once a quorum accepted it
+		inst.payload = pineappleproto.Payload{Tag: newTag, Value: int(newValue)}
+		r.proposed[key] = inst.payload
+		if propose := inst.lb.clientProposals; propose != nil && propose[0].ReplyType == genericsmrproto.PROPOSE_AND_READ_REPLY {
+			inst.read = r.data[int(propose[0].ReadKey)]
+		}
+		inst.status = ACCEPTED
 
-		r.recordInstanceMetadata(r.instanceSpace[rmwGetReply.Instance])
-		r.recordCommands(r.instanceSpace[rmwGetReply.Instance].cmds)
-		r.sync()
+		r.recordInstance(RMW_SPACE, rmwGetReply.Instance, inst)
 
-		r.bcastRMWSet(rmwGetReply.Instance, rmwGetReply.Ballot, key)
+		// accept our own value before asking the others to
+		instance := rmwGetReply.Instance
+		r.afterSync(func() { r.bcastRMWSet(instance, inst.ballot, key) })
 	}
 }
 
-var pRMWSet pineappleproto.RMWSet
-
 func (r *Replica) bcastRMWSet(instance int32, ballot int32, key int) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Println("Accept bcast failed:", err)
 		}
 	}()
+	var pRMWSet pineappleproto.RMWSet
 	pRMWSet.LeaderId = r.Id
 	pRMWSet.Instance = instance
 	pRMWSet.Ballot = ballot
-	pRMWSet.Command = r.instanceSpace[instance].cmds
+	pRMWSet.Command = r.pendingRMWs.get(instance).cmds
 	pRMWSet.Key = key
-	pRMWSet.Payload = r.data[key]
+	pRMWSet.Payload = r.pendingRMWs.get(instance).payload
 	args := &pRMWSet
+	r.startPhase(r.pendingRMWs.get(instance).lb)
 
 	n := r.N - 1
 	q := r.Id
@@ -515,59 +727,79 @@ func (r *Replica) bcastRMWSet(instance int32, ballot int32, key int) {
 		if q == r.Id {
 			break
 		}
-		if !r.Alive[q] {
+		if !r.Alive[q].Load() {
 			continue
 		}
 		sent++
-		r.SendMsg(q, r.rmwSetRPC, args)
+		r.send(q, r.rmwSetRPC, args)
 	}
 }
 
 func (r *Replica) handleRMWSet(rmwSet *pineappleproto.RMWSet) {
-	inst := r.instanceSpace[rmwSet.Instance]
+	if r.pendingRMWs.reclaimed(rmwSet.Instance) {
+		// committed and executed long ago; a sender still driving it may have been deposed,
+		// so tell it the ballot in use
+		r.replyRMWSet(rmwSet.LeaderId, &pineappleproto.RMWSetReply{ReplicaID: r.Id, Instance: rmwSet.Instance, OK: FALSE, Ballot: r.defaultBallot})
+		return
+	}
+	inst := r.pendingRMWs.get(rmwSet.Instance)
 
 	var rmwSetReply *pineappleproto.RMWSetReply
 
+	if rmwSet.Ballot < r.defaultBallot || (inst != nil && rmwSet.Ballot < inst.ballot) {
+		// message from a deposed leader, tell it about the higher ballot
+		r.replyRMWSet(rmwSet.LeaderId, &pineappleproto.RMWSetReply{ReplicaID: r.Id, Instance: rmwSet.Instance, OK: FALSE, Ballot: r.defaultBallot})
+		return
+	}
+	r.adoptBallot(rmwSet.LeaderId, rmwSet.Ballot)
+	r.learnRMWInstance(rmwSet.Instance)
+
 	if inst == nil {
-		if rmwSet.Ballot < r.defaultBallot {
-			panic("outdated ballot received")
-		} else {
-			r.instanceSpace[rmwSet.Instance] = &Instance{
-				cmds:   rmwSet.Command,
-				ballot: rmwSet.Ballot,
-				status: ACCEPTED,
-				lb:     nil,
-			}
-			inst = r.instanceSpace[rmwSet.Instance]
-			rmwSetReply = &pineappleproto.RMWSetReply{Instance: rmwSet.Instance, OK: TRUE, Ballot: r.defaultBallot}
-		}
-	} else if inst.ballot > rmwSet.Ballot {
-		panic("outdated ballot received")
+		r.pendingRMWs.set(rmwSet.Instance, &Instance{
+			rmwId:  rmwSet.Instance,
+			cmds:   rmwSet.Command,
+			ballot: rmwSet.Ballot,
+			status: ACCEPTED,
+			lb:     nil,
+		})
+		inst = r.pendingRMWs.get(rmwSet.Instance)
+		rmwSetReply = &pineappleproto.RMWSetReply{ReplicaID: r.Id, Instance: rmwSet.Instance, OK: TRUE, Ballot: r.defaultBallot}
 	} else if inst.ballot < rmwSet.Ballot {
 		inst.cmds = rmwSet.Command
 		inst.ballot = rmwSet.Ballot
-		inst.status = ACCEPTED
-		rmwSetReply = &pineappleproto.RMWSetReply{Instance: rmwSet.Instance, OK: TRUE, Ballot: r.defaultBallot}
+		if inst.status != COMMITTED { // a new leader re-proposing the chosen value
+			inst.status = ACCEPTED
+		}
+		rmwSetReply = &pineappleproto.RMWSetReply{ReplicaID: r.Id, Instance: rmwSet.Instance, OK: TRUE, Ballot: r.defaultBallot}
 	} else {
 		// reordered ACCEPT
-		r.instanceSpace[rmwSet.Instance].cmds = rmwSet.Command
-		if r.instanceSpace[rmwSet.Instance].status != COMMITTED {
-			r.instanceSpace[rmwSet.Instance].status = ACCEPTED
+		inst.cmds = rmwSet.Command
+		if inst.status != COMMITTED {
+			inst.status = ACCEPTED
 		}
-		rmwSetReply = &pineappleproto.RMWSetReply{Instance: rmwSet.Instance, OK: TRUE, Ballot: r.defaultBallot}
+		rmwSetReply = &pineappleproto.RMWSetReply{ReplicaID: r.Id, Instance: rmwSet.Instance, OK: TRUE, Ballot: r.defaultBallot}
 	}
 	inst.receivedRMW = rmwSet.Payload // store received object in instance space
-	if r.isLargerTag(r.data[rmwSet.Key].Tag, inst.receivedRMW.Tag) {
-		r.data[rmwSet.Key] = inst.receivedRMW
-	}
+	inst.payload = rmwSet.Payload     // reported to a new leader during Prepare
+	// readers only see the value once it is committed, since another leader's may be
+	// chosen instead; the instance record carries the accepted key, tag and value
+	r.recordInstance(RMW_SPACE, rmwSet.Instance, inst)
 
-	r.replyRMWSet(rmwSet.LeaderId, rmwSetReply)
+	r.afterSync(func() { r.replyRMWSet(rmwSet.LeaderId, rmwSetReply) })
 }
 
 // Response handler for Set request on nodes
 func (r *Replica) handleRMWSetReply(rmwSetReply *pineappleproto.RMWSetReply) {
-	inst := r.instanceSpace[rmwSetReply.Instance]
-	if inst.rmwId <= r.rmwDoneUpTo { // quorum of response already received
+	inst := r.pendingRMWs.get(rmwSetReply.Instance)
+	if inst == nil || inst.lb == nil || inst.status == COMMITTED { // quorum of response already received
+		return
+	}
+
+	if rmwSetReply.OK == FALSE {
+		r.handleRMWNack(inst, rmwSetReply.Ballot)
+		return
+	}
+	if !r.ack(inst.lb, rmwSetReply.ReplicaID) {
 		return
 	}
 
@@ -575,44 +807,137 @@ func (r *Replica) handleRMWSetReply(rmwSetReply *pineappleproto.RMWSetReply) {
 
 	// Wait for a majority of acknowledgements
 	if inst.lb.rmwSetOKs+1 > r.N>>1 {
-		r.pendingRMWs[inst.rmwId] = inst
-		r.rmwDoneUpTo++
+		inst.status = COMMITTED
+		r.adoptChosen(inst)
+		r.recordCommit(inst.rmwId)
+		delete(r.rmwInFlight, inst.rmwId)
+		r.toCommit = append(r.toCommit, inst.rmwId)
+		r.advanceRMWDone()
 	}
 
 }
 
-func (r *Replica) executeRMWs() {
-	i := int32(0)
-	for !r.Shutdown {
-		executed := false
-
-		for i <= r.rmwDoneUpTo {
-			inst := r.pendingRMWs[i]
-			if inst.lb.clientProposals != nil && r.Dreply && !inst.lb.completed {
-				propreply := &genericsmrproto.ProposeReplyTS{
-					OK:        TRUE,
-					CommandId: inst.lb.clientProposals[0].CommandId,
-					Value:     state.NIL,
-					Timestamp: inst.lb.clientProposals[0].Timestamp}
-				inst.lb.completed = true
-				r.ReplyProposeTS(propreply, inst.lb.clientProposals[0].Reply)
-			}
-			executed = true
-			i++
+// Newest value-tag pair of a key this replica knows of, counting the values its RMWs in
+// flight proposed
+func (r *Replica) newest(key int) pineappleproto.Payload {
+	data := r.data[key]
+	if proposed, ok := r.proposed[key]; ok && r.isLargerTag(data.Tag, proposed.Tag) {
+		return proposed
+	}
+	return data
+}
+
+// Makes the value an RMW settled on visible to readers, once it is chosen
+func (r *Replica) adoptChosen(inst *Instance) {
+	if len(inst.cmds) == 0 || inst.cmds[0].Op == state.NONE {
+		return
+	}
+	key := int(inst.cmds[0].K)
+	if r.isLargerTag(r.data[key].Tag, inst.payload.Tag) {
+		r.data[key] = inst.payload
+	}
+	if proposed, ok := r.proposed[key]; ok && proposed.Tag == inst.payload.Tag {
+		delete(r.proposed, key) // no newer RMW in flight on the key
+	}
+}
+
+// Moves rmwDoneUpTo over the committed instances right after it, and executes them. An
+// RMW that reaches a quorum before the ones ahead of it in the log waits until they are
+// committed too, so RMWs are executed strictly in log order.
+func (r *Replica) advanceRMWDone() {
+	done := r.rmwDoneUpTo
+	for {
+		inst := r.pendingRMWs.get(done + 1)
+		if inst == nil || inst.status != COMMITTED {
+			break
 		}
+		done++
+	}
+	r.rmwDoneUpTo = done
+	r.executeCommitted()
+}
 
-		if !executed {
-			time.Sleep(CLOCK)
+// Applies the RMWs done since the last call and answers their clients. Runs in the main
+// loop, like everything else that touches the instances.
+func (r *Replica) executeCommitted() {
+	for i := r.rmwExecutedUpTo + 1; i <= r.quorumDoneUpTo(); i++ {
+		inst := r.pendingRMWs.get(i)
+		if inst != nil {
+			r.applyRMW(inst)
+		}
+		// compacted instances were answered before the snapshot
+		if inst != nil && inst.lb != nil && inst.lb.clientProposals != nil && r.Dreply && !inst.lb.completed {
+			inst.lb.completed = true
+			r.replyPropose(inst)
 		}
+		r.rmwExecutedUpTo = i
 	}
 }
 
-func (r *Replica) handlePropose(propose *genericsmr.Propose) {
-	for r.instanceSpace[r.crtInstance] != nil {
-		r.crtInstance++
+// Writes the value a committed RMW settled on to the state machine, with -exec
+func (r *Replica) applyRMW(inst *Instance) {
+	if !r.Exec || len(inst.cmds) == 0 || inst.cmds[0].Op == state.NONE {
+		return // a no-op, or a value only known to be chosen somewhere else
+	}
+	put := state.Command{Op: state.PUT, K: inst.cmds[0].K, V: state.Value(inst.payload.Value)}
+	put.Execute(r.State)
+}
+
+// Replies to a client with OK=genericsmrproto.REPLY_FAILED, or REPLY_UNKNOWN if the
+// request may still take effect
+func (r *Replica) rejectPropose(propose *genericsmr.Propose, outcome uint8) {
+	switch propose.ReplyType {
+	case genericsmrproto.READ_REPLY:
+		r.ReplyRead(&genericsmrproto.ReadReply{OK: outcome, CommandId: propose.CommandId}, propose.Reply)
+	case genericsmrproto.PROPOSE_AND_READ_REPLY:
+		r.ReplyProposeAndRead(&genericsmrproto.ProposeAndReadReply{OK: outcome, CommandId: propose.CommandId}, propose.Reply)
+	default:
+		propreply := &genericsmrproto.ProposeReplyTS{
+			OK:        outcome,
+			CommandId: propose.CommandId,
+			Value:     state.NIL,
+			Timestamp: propose.Timestamp}
+		r.ReplyProposeTS(propreply, propose.Reply)
 	}
+}
 
-	instNo := r.crtInstance
+// Tells a client that sent an RMW here which replica leads, as far as this one knows:
+// the owner of the highest ballot it promised
+func (r *Replica) redirectPropose(propose *genericsmr.Propose) {
+	reply := &genericsmrproto.NotLeader{CommandId: propose.CommandId, LeaderId: -1}
+	if leader := ballotOwner(r.defaultBallot); leader != r.Id {
+		reply.LeaderId = leader
+		reply.LeaderAddr = []byte(r.ClientAddrList[leader])
+	}
+	r.ReplyNotLeader(reply, propose.Reply)
+}
+
+// A READ is an ABD GET answered with a ReadReply
+func (r *Replica) handleRead(read *genericsmr.Read) {
+	r.handlePropose(&genericsmr.Propose{
+		Propose:   &genericsmrproto.Propose{CommandId: read.CommandId, Command: state.Command{Op: state.GET, K: read.Key}},
+		Reply:     read.Reply,
+		ReplyType: genericsmrproto.READ_REPLY})
+}
+
+// A PROPOSE_AND_READ always goes through the RMW log, whatever its operation. The leader
+// reads the other key in the same step that applies the command, so the two are atomic
+// with respect to every other RMW.
+func (r *Replica) handleProposeAndRead(par *genericsmr.ProposeAndRead) {
+	r.handlePropose(&genericsmr.Propose{
+		Propose:   &genericsmrproto.Propose{CommandId: par.CommandId, Command: par.Command},
+		Reply:     par.Reply,
+		ReplyType: genericsmrproto.PROPOSE_AND_READ_REPLY,
+		ReadKey:   par.Key})
+}
+
+func (r *Replica) handlePropose(propose *genericsmr.Propose) {
+	op := propose.Command.Op
+	if op != state.PUT && op != state.GET && !state.IsRMW(op) {
+		// no RMW operator registered for this operation, reject it
+		r.rejectPropose(propose, genericsmrproto.REPLY_FAILED)
+		return
+	}
 
 	cmds := make([]state.Command, 1)
 	proposals := make([]*genericsmr.Propose, 1)
@@ -620,8 +945,44 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 	cmds[0] = propose.Command
 	proposals[0] = propose
 
+	// Use Paxos if operation is not Read / Write
+	if (op != state.PUT && op != state.GET) || propose.ReplyType == genericsmrproto.PROPOSE_AND_READ_REPLY {
+		if !r.IsLeader {
+			r.redirectPropose(propose)
+			return
+		}
+		if r.preparing {
+			// finish recovering the RMW log before taking new RMWs
+			r.deferredRMWs = append(r.deferredRMWs, propose)
+			return
+		}
+		for r.pendingRMWs.get(r.crtRmwId) != nil {
+			r.crtRmwId++
+		}
+		rmwId := r.crtRmwId
+		r.crtRmwId++
+		r.pendingRMWs.set(rmwId, &Instance{
+			rmwId:  rmwId,
+			cmds:   cmds,
+			ballot: r.defaultBallot,
+			status: PREPARING,
+			lb:     &LeaderBookkeeping{clientProposals: proposals, completed: false},
+		})
+		r.rmwInFlight[rmwId] = true
+		r.bcastRMWGet(rmwId, r.defaultBallot, cmds)
+		return
+	}
+
+	for r.instanceSpace.get(r.crtInstance) != nil {
+		r.crtInstance++
+	}
+
+	// ids are never reused, the instance before may already be reclaimed
+	instNo := r.crtInstance
+	r.crtInstance++
+
 	// ABD
-	r.instanceSpace[instNo] = &Instance{
+	r.instanceSpace.set(instNo, &Instance{
 		cmds:   cmds,
 		ballot: 0,
 		status: PREPARING,
@@ -631,107 +992,165 @@ func (r *Replica) handlePropose(propose *genericsmr.Propose) {
 			getDone:         false,
 			completed:       false,
 		},
+	})
+	r.abdInFlight[instNo] = true
+
+	// use ABD
+	// Construct the pineapple payload from proposal data
+	if propose.Command.Op == state.PUT { // write operation
+		r.bcastGet(instNo, true, key)
+	} else if propose.Command.Op == state.GET { // read operation
+		// a key never written has the zero tag and value everywhere
+		r.instanceSpace.get(instNo).initialTag = r.data[key].Tag
+		r.bcastGet(instNo, false, key)
 	}
+}
 
-	// Use Paxos if operation is not Read / Write
-	if propose.Command.Op != state.PUT && propose.Command.Op != state.GET {
-		rmwId := r.crtRmwId
-		r.crtRmwId++
-		r.instanceSpace[instNo] = &Instance{
-			rmwId:  rmwId,
-			cmds:   cmds,
-			ballot: 0,
-			status: PREPARING,
-			lb:     &LeaderBookkeeping{clientProposals: proposals, completed: false},
-		}
-		r.bcastRMWGet(instNo, 0, cmds)
-	} else { // use ABD
-		// Construct the pineapple payload from proposal data
-		if propose.Command.Op == state.PUT { // write operation
-			r.bcastGet(instNo, true, key)
-		} else if propose.Command.Op == state.GET { // read operation
-			data, doesExist := r.data[key]
-			if !doesExist {
-				tag := pineappleproto.Tag{Timestamp: 0, ID: int(r.Id)}
-				r.instanceSpace[instNo].initialTag = tag
-				r.data[key] = pineappleproto.Payload{Tag: tag, Value: 0}
-			} else {
-				r.instanceSpace[instNo].initialTag = data.Tag
-			}
-			r.bcastGet(instNo, false, key)
-		}
+// append an instance, its commands and the value-tag pair it settled on to stable storage
+func (r *Replica) recordInstance(space uint8, instance int32, inst *Instance) {
+	if !r.Durable {
+		return
 	}
+
+	r.appendRecord(RECORD_INSTANCE, encodeInstance(space, instance, inst))
 }
 
-var clockChan chan bool
+// append a value-tag pair this replica adopted to stable storage
+func (r *Replica) recordData(key int, payload pineappleproto.Payload) {
+	if !r.Durable {
+		return
+	}
 
-// append a log entry to stable storage
-func (r *Replica) recordInstanceMetadata(inst *Instance) {
+	var b [40]byte
+	binary.LittleEndian.PutUint64(b[0:8], uint64(key))
+	binary.LittleEndian.PutUint64(b[8:16], uint64(payload.Tag.Timestamp))
+	binary.LittleEndian.PutUint64(b[16:24], uint64(payload.Tag.ID))
+	binary.LittleEndian.PutUint64(b[24:32], uint64(payload.Tag.RMWCount))
+	binary.LittleEndian.PutUint64(b[32:40], uint64(payload.Value))
+	r.appendRecord(RECORD_DATA, b[:])
+}
+
+// append the ballot this replica promised to stable storage
+func (r *Replica) recordBallot() {
 	if !r.Durable {
 		return
 	}
 
-	var b [5]byte
-	binary.LittleEndian.PutUint32(b[0:4], uint32(inst.ballot))
-	b[4] = byte(inst.status)
-	r.StableStore.Write(b[:])
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(r.defaultBallot))
+	r.appendRecord(RECORD_BALLOT, b[:])
+}
+
+// append a record to stable storage. A replica that cannot keep what it promised must not
+// go on answering, so it stops here.
+func (r *Replica) appendRecord(recType uint8, payload []byte) {
+	if err := r.StableStore.Append(recType, payload); err != nil {
+		log.Fatalf("Replica %d cannot write to the stable store: %v\n", r.Id, err)
+	}
 }
 
-// write a sequence of commands to stable storage
-func (r *Replica) recordCommands(cmds []state.Command) {
+// append the id of an RMW that reached a quorum to stable storage
+func (r *Replica) recordCommit(rmwId int32) {
 	if !r.Durable {
 		return
 	}
 
-	if cmds == nil {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(rmwId))
+	r.appendRecord(RECORD_COMMIT, b[:])
+}
+
+// sync with the stable store. The replies waiting on it would promise what may not be on
+// disk, so a failed sync stops the replica instead.
+func (r *Replica) sync() {
+	if !r.Durable {
 		return
 	}
-	for i := 0; i < len(cmds); i++ {
-		cmds[i].Marshal(io.Writer(r.StableStore))
+
+	if err := r.StableStore.Sync(); err != nil {
+		log.Fatalf("Replica %d cannot sync the stable store: %v\n", r.Id, err)
 	}
 }
 
-// sync with the stable store
-func (r *Replica) sync() {
+// Runs f once everything recorded so far is on disk.
+// Without -durable there is nothing to wait for and f runs right away.
+func (r *Replica) afterSync(f func()) {
 	if !r.Durable {
+		f()
 		return
 	}
+	r.syncWaiters = append(r.syncWaiters, f)
+}
 
-	r.StableStore.Sync()
+// Group commit: one sync for all the replies deferred since the last one
+func (r *Replica) groupCommit() {
+	if len(r.syncWaiters) == 0 {
+		return
+	}
+	r.sync()
+	waiters := r.syncWaiters
+	r.syncWaiters = nil
+	for _, f := range waiters {
+		f()
+	}
 }
 
 func (r *Replica) clock() {
 	for !r.Shutdown {
-		time.Sleep(CLOCK)
-		clockChan <- true
+		r.Clock.Sleep(CLOCK)
+		r.clockChan <- true
 	}
 }
 
+// Replica 0 starts as the leader and owns ballot 0
+func (r *Replica) startLeading() {
+	if !r.recovered {
+		r.IsLeader = true
+	} else if ballotOwner(r.defaultBallot) == r.Id {
+		// nobody took over while we were down, finish what we had in flight
+		r.becomeLeader()
+	}
+}
+
+// Periodic work, once every CLOCK
+func (r *Replica) onTick() {
+	r.groupCommit()
+	r.bcastCommits()
+	r.ackCommits()
+	r.reclaimRMWs()
+	r.maybeSnapshot()
+	r.reportMemory()
+}
+
 // Run main processing loop
 func (r *Replica) Run() {
 	r.ConnectToPeers()
 
+	// clients are accepted on the same port as peers, see genericsmr.acceptConnections
 	log.Println("Waiting for client connections")
 
-	go r.WaitForClientConnections()
-
 	if r.Id == 0 {
-		go r.executeRMWs()
+		r.startLeading()
 	}
 
-	clockChan = make(chan bool, 1)
 	go r.clock()
+	go r.timeoutClock()
 
 	// We don't directly access r.ProposeChan, because we want to do pipelining periodically,
 	// so we introduce a channel pointer: onOffProposChan:
 	onOffProposeChan := r.ProposeChan
+	onOffReadChan := r.ReadChan
+	onOffProposeAndReadChan := r.ProposeAndReadChan
 
 	for !r.Shutdown {
 
 		select {
-		case <-clockChan:
+		case <-r.clockChan:
 			// activate the new proposals channel
 			onOffProposeChan = r.ProposeChan
+			onOffReadChan = r.ReadChan
+			onOffProposeAndReadChan = r.ProposeAndReadChan
+			r.onTick()
 			break
 		case setS := <-r.setChan:
 			set := setS.(*pineappleproto.Set)
@@ -760,6 +1179,16 @@ func (r *Replica) Run() {
 			// deactivate the new proposals channel to prioritize the handling of protocol messages
 			onOffProposeChan = nil
 			break
+		case read := <-onOffReadChan:
+			//got a Read from a client
+			r.handleRead(read)
+			onOffReadChan = nil
+			break
+		case par := <-onOffProposeAndReadChan:
+			//got a ProposeAndRead from a client
+			r.handleProposeAndRead(par)
+			onOffProposeAndReadChan = nil
+			break
 		case rmwGetS := <-r.rmwGetChan:
 			rmwGet := rmwGetS.(*pineappleproto.RMWGet)
 			//got an RMWGet message
@@ -780,12 +1209,68 @@ func (r *Replica) Run() {
 			//got an Accept reply
 			r.handleRMWSetReply(rmwSetReply)
 			break
+		case prepareS := <-r.prepareChan:
+			prepare := prepareS.(*pineappleproto.Prepare)
+			//got a Prepare message
+			r.handlePrepare(prepare)
+			break
+		case prepareReplyS := <-r.prepareReplyChan:
+			prepareReply := prepareReplyS.(*pineappleproto.PrepareReply)
+			//got a Prepare reply
+			r.handlePrepareReply(prepareReply)
+			break
+		case commitS := <-r.commitChan:
+			commit := commitS.(*pineappleproto.Commit)
+			//got a Commit message
+			r.handleCommit(commit)
+			break
+		case commitShortS := <-r.commitShortChan:
+			commitShort := commitShortS.(*pineappleproto.CommitShort)
+			//got a CommitShort message
+			r.handleCommitShort(commitShort)
+			break
+		case commitAckS := <-r.commitAckChan:
+			commitAck := commitAckS.(*pineappleproto.CommitAck)
+			//got a CommitAck message
+			r.handleCommitAck(commitAck)
+			break
+		case commitUpToS := <-r.commitUpToChan:
+			commitUpTo := commitUpToS.(*pineappleproto.CommitUpTo)
+			//got a CommitUpTo message
+			r.handleCommitUpTo(commitUpTo)
+			break
+		case <-r.timeoutChan:
+			// resend phases that have been waiting too long
+			r.checkTimeouts()
+			break
+		case event := <-r.PeerEventChan:
+			r.handlePeerEvent(event)
+			break
+		case <-r.leaderChan:
+			// the master asked this replica to take over
+			r.becomeLeader()
+			break
+		case done := <-r.stepDownChan:
+			// the master is about to make another replica the leader
+			if r.IsLeader {
+				r.stepDown()
+			}
+			close(done)
+			break
 		}
 	}
 }
 
 /* RPC to be called by master */
 func (r *Replica) BeTheLeader(args *genericsmrproto.BeTheLeaderArgs, reply *genericsmrproto.BeTheLeaderReply) error {
-	r.IsLeader = true
+	r.leaderChan <- true
+	return nil
+}
+
+// Returns once the replica no longer thinks it is the leader
+func (r *Replica) StepDown(args *genericsmrproto.StepDownArgs, reply *genericsmrproto.StepDownReply) error {
+	done := make(chan bool)
+	r.stepDownChan <- done
+	<-done
 	return nil
 }
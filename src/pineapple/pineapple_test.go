@@ -0,0 +1,110 @@
+package pineapple
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+// An RMW that reaches a quorum before the one ahead of it in the log is neither done
+// nor answered until that one commits too
+func TestRMWsDoneInOrder(t *testing.T) {
+	c := newManualCluster(t, 3)
+	leader := c.replicas[0]
+	first := c.submit(0, 1, state.Command{Op: state.FETCH_ADD, K: 1, V: 5})
+	held := c.queue
+	c.queue = nil
+	second := c.submit(0, 2, state.Command{Op: state.FETCH_ADD, K: 2, V: 7})
+	c.deliver()
+	leader.Tick()
+	c.deliver()
+
+	if inst := leader.pendingRMWs.get(1); inst == nil || inst.status != COMMITTED {
+		t.Fatalf("second RMW is %+v, want it committed", inst)
+	}
+	if leader.rmwDoneUpTo != -1 || len(second.frames) != 0 {
+		t.Fatalf("RMWs done up to %d with the first one still in flight", leader.rmwDoneUpTo)
+	}
+
+	c.queue = held
+	c.deliver()
+	c.step() // the followers acknowledge the commits
+	c.step()
+	if leader.rmwDoneUpTo != 1 {
+		t.Errorf("RMWs done up to %d, want 1", leader.rmwDoneUpTo)
+	}
+	for i, rs := range []*replies{first, second} {
+		if reply, notLeader := rs.last(t); notLeader != nil || reply.OK != TRUE {
+			t.Errorf("RMW %d answered with %+v, %+v", i, reply, notLeader)
+		}
+	}
+}
+
+// Followers keep an accepted RMW value from readers until it is committed, and the leader
+// answers the RMW only once a quorum has it
+func TestRMWVisibleOnCommit(t *testing.T) {
+	c := newManualCluster(t, 3)
+	rs := c.submit(0, 1, state.Command{Op: state.FETCH_ADD, K: 1, V: 5})
+	c.deliver()
+	for q := 1; q < 3; q++ {
+		if inst := c.replicas[q].pendingRMWs.get(0); inst == nil || inst.status != ACCEPTED {
+			t.Fatalf("replica %d holds the RMW as %+v, want it accepted", q, inst)
+		}
+		if data, ok := c.replicas[q].data[1]; ok {
+			t.Errorf("replica %d shows accepted value %+v to readers", q, data)
+		}
+	}
+	if len(rs.frames) != 0 {
+		t.Error("RMW answered before the followers committed it")
+	}
+
+	c.step()
+	for q := 1; q < 3; q++ {
+		if data := c.replicas[q].data[1]; data.Value != 5 {
+			t.Errorf("replica %d holds %+v after the commit, want 5", q, data)
+		}
+	}
+	c.step()
+	if reply, notLeader := rs.last(t); notLeader != nil || reply.OK != TRUE || reply.Value != 5 {
+		t.Errorf("RMW answered with %+v, %+v", reply, notLeader)
+	}
+}
+
+// A replica that reclaimed an RMW instance still tells a deposed leader driving it about
+// the ballot in use
+func TestNackReclaimed(t *testing.T) {
+	c := newManualCluster(t, 3)
+	if reply, notLeader := c.do(0, 1, state.Command{Op: state.FETCH_ADD, K: 1, V: 5}); notLeader != nil || reply.OK != TRUE {
+		t.Fatalf("RMW answered with %+v, %+v", reply, notLeader)
+	}
+	c.step()
+	r := c.replicas[1]
+	if !r.pendingRMWs.reclaimed(0) {
+		t.Fatal("replica 1 did not reclaim the RMW")
+	}
+	r.defaultBallot = 18 // replica 2 took over since
+
+	cmds := []state.Command{{Op: state.FETCH_ADD, K: 1, V: 1}}
+	r.handleRMWGet(&pineappleproto.RMWGet{LeaderId: 0, Instance: 0, Ballot: 0, Command: cmds})
+	r.handleRMWSet(&pineappleproto.RMWSet{LeaderId: 0, Instance: 0, Ballot: 0, Command: cmds, Key: 1})
+	if len(c.queue) != 2 {
+		t.Fatalf("replica 1 sent %d messages, want 2 NACKs", len(c.queue))
+	}
+	getReply, setReply := &pineappleproto.RMWGetReply{}, &pineappleproto.RMWSetReply{}
+	for i, msg := range []interface{ Unmarshal(io.Reader) error }{getReply, setReply} {
+		_, body, err := genericsmrproto.ReadFrame(bytes.NewReader(c.queue[i].frame), nil)
+		if err == nil {
+			err = genericsmrproto.Decode(body, msg)
+		}
+		if err != nil || c.queue[i].to != 0 {
+			t.Fatalf("message %d to %d: %v", i, c.queue[i].to, err)
+		}
+	}
+	if getReply.OK != FALSE || getReply.Ballot != 18 || setReply.OK != FALSE || setReply.Ballot != 18 {
+		t.Errorf("answered with %+v and %+v, want NACKs at ballot 18", getReply, setReply)
+	}
+}
@@ -0,0 +1,395 @@
+package pineapple
+
+import (
+	"log"
+
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+// Ballots are unique per replica: the low 4 bits carry the replica id, which is why a
+// cluster has at most config.MAX_REPLICAS replicas.
+// Ballot 0 belongs to replica 0, the initial leader.
+func (r *Replica) makeUniqueBallot(ballot int32) int32 {
+	return (ballot << 4) | r.Id
+}
+
+func (r *Replica) makeBallotLargerThan(ballot int32) int32 {
+	return r.makeUniqueBallot((ballot >> 4) + 1)
+}
+
+// Records that an RMW instance exists, so a later Prepare reports it
+func (r *Replica) learnRMWInstance(instance int32) {
+	if instance >= r.crtRmwId {
+		r.crtRmwId = instance + 1
+	}
+}
+
+func (r *Replica) replyPrepare(replicaId int32, reply *pineappleproto.PrepareReply) {
+	r.send(replicaId, r.prepareReplyRPC, reply)
+}
+
+// Phase 1: pick a larger ballot and recover every RMW instance that is not known to be done
+func (r *Replica) becomeLeader() {
+	r.IsLeader = true
+	r.proposed = map[int]pineappleproto.Payload{} // finishPrepare puts back those still accepted
+	r.resetFollowers()
+	r.defaultBallot = r.makeBallotLargerThan(r.defaultBallot)
+	r.recordBallot()
+	r.sync()
+	r.preparing = true
+	r.preparePending = 0
+	r.prepareUpTo = r.rmwDoneUpTo
+
+	log.Printf("Replica %d taking over the RMW log with ballot %d\n", r.Id, r.defaultBallot)
+
+	r.extendPrepare(r.crtRmwId)
+	if r.preparePending == 0 {
+		r.endPrepare()
+	}
+}
+
+// Sends a Prepare for every RMW instance after prepareUpTo, up to and including the frontier upTo.
+// The frontier is the first instance this replica knows nothing about.
+func (r *Replica) extendPrepare(upTo int32) {
+	if upTo <= r.prepareUpTo {
+		return
+	}
+
+	// the old frontier came back empty, but instances above it exist
+	if r.prepareUpTo >= 0 {
+		old := r.pendingRMWs.get(r.prepareUpTo)
+		if old != nil && old.lb != nil && !old.lb.preparing && old.status == PREPARING && len(old.cmds) == 0 {
+			r.fillNoOp(old)
+		}
+	}
+
+	for i := r.prepareUpTo + 1; i <= upTo; i++ {
+		inst := r.pendingRMWs.get(i)
+		if inst != nil && inst.status == COMMITTED && i < upTo {
+			continue // learned from a Commit, past a hole the done index stops at
+		}
+		lb := &LeaderBookkeeping{maxRecvBallot: -1, preparing: true, completed: false}
+
+		if inst == nil {
+			inst = &Instance{rmwId: i, status: PREPARING}
+			r.pendingRMWs.set(i, inst)
+		} else {
+			if inst.lb != nil {
+				// keep the clients of RMWs this replica proposed under an earlier ballot
+				lb.clientProposals = inst.lb.clientProposals
+				lb.completed = inst.lb.completed
+			}
+			if inst.status >= ACCEPTED {
+				// our own accepted value counts as one of the replies
+				lb.maxRecvBallot = inst.ballot
+			}
+		}
+		inst.lb = lb
+		r.rmwInFlight[i] = true
+		r.preparePending++
+
+		toInfinity := FALSE
+		if i == upTo {
+			toInfinity = TRUE
+		}
+		r.bcastPrepare(i, r.defaultBallot, toInfinity)
+	}
+
+	r.prepareUpTo = upTo
+	if r.crtRmwId < upTo {
+		r.crtRmwId = upTo
+	}
+}
+
+func (r *Replica) bcastPrepare(instance int32, ballot int32, toInfinity uint8) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Prepare bcast failed:", err)
+		}
+	}()
+	var pPrepare pineappleproto.Prepare
+	pPrepare.LeaderId = r.Id
+	pPrepare.Instance = instance
+	pPrepare.Ballot = ballot
+	pPrepare.ToInfinity = toInfinity
+	args := &pPrepare
+	r.startPhase(r.pendingRMWs.get(instance).lb)
+
+	n := r.N - 1
+	q := r.Id
+	for sent := 0; sent < n; {
+		q = (q + 1) % int32(r.N)
+		if q == r.Id {
+			break
+		}
+		if !r.Alive[q].Load() {
+			continue
+		}
+		sent++
+		r.send(q, r.prepareRPC, args)
+	}
+}
+
+// Promise not to accept lower ballots, and report what was accepted for the instance
+func (r *Replica) handlePrepare(prepare *pineappleproto.Prepare) {
+	inst := r.pendingRMWs.get(prepare.Instance)
+
+	if prepare.Ballot < r.defaultBallot {
+		r.replyPrepare(prepare.LeaderId, &pineappleproto.PrepareReply{ReplicaID: r.Id, Instance: prepare.Instance,
+			OK: FALSE, Ballot: r.defaultBallot, CrtInstance: r.crtRmwId})
+		return
+	}
+
+	if prepare.Ballot > r.defaultBallot {
+		r.defaultBallot = prepare.Ballot
+		r.recordBallot()
+		if r.IsLeader && prepare.LeaderId != r.Id {
+			r.stepDown()
+		}
+	}
+
+	preply := &pineappleproto.PrepareReply{ReplicaID: r.Id, Instance: prepare.Instance,
+		OK: TRUE, Ballot: -1, CrtInstance: r.crtRmwId}
+	if r.pendingRMWs.reclaimed(prepare.Instance) {
+		// the value is gone, but it was chosen and there is nothing to recover
+		preply.Committed = TRUE
+	} else if inst != nil {
+		preply.Command = inst.cmds
+		if inst.status >= ACCEPTED && len(inst.cmds) > 0 {
+			preply.Ballot = inst.ballot
+			preply.Key = int(inst.cmds[0].K)
+			preply.Payload = inst.payload
+		}
+		if inst.status == COMMITTED {
+			// the value is chosen, the leader can take it without a Phase 2
+			preply.Committed = TRUE
+		}
+	}
+
+	// the promise must be on disk before the leader counts it
+	r.afterSync(func() { r.replyPrepare(prepare.LeaderId, preply) })
+}
+
+// Keeps the value accepted in the highest ballot; finishes the instance once a quorum replied
+func (r *Replica) handlePrepareReply(preply *pineappleproto.PrepareReply) {
+	inst := r.pendingRMWs.get(preply.Instance)
+	if !r.preparing || inst == nil || inst.lb == nil || !inst.lb.preparing {
+		return
+	}
+
+	if preply.OK == FALSE {
+		r.handleRMWNack(inst, preply.Ballot)
+		return
+	}
+	if !r.ack(inst.lb, preply.ReplicaID) {
+		return
+	}
+
+	// some replica saw RMW instances this leader never heard of
+	if preply.CrtInstance > r.prepareUpTo {
+		r.extendPrepare(preply.CrtInstance)
+	}
+
+	if preply.Committed == TRUE && len(preply.Command) > 0 {
+		r.commitRecovered(inst, preply)
+		return
+	} else if preply.Committed == TRUE {
+		r.skipCommitted(inst)
+		return
+	}
+
+	if preply.Ballot > inst.lb.maxRecvBallot {
+		inst.lb.maxRecvBallot = preply.Ballot
+		inst.cmds = preply.Command
+		inst.payload = preply.Payload
+		inst.status = ACCEPTED
+	} else if len(inst.cmds) == 0 && len(preply.Command) > 0 {
+		inst.cmds = preply.Command
+	}
+
+	inst.lb.prepareOKs++
+
+	if inst.lb.prepareOKs+1 > r.N>>1 {
+		inst.lb.preparing = false
+		r.finishPrepare(inst)
+
+		r.preparePending--
+		if r.preparePending == 0 {
+			r.endPrepare()
+		}
+	}
+}
+
+// Phase 2 for a recovered instance, at the new ballot
+func (r *Replica) finishPrepare(inst *Instance) {
+	inst.ballot = r.defaultBallot
+
+	if inst.status >= ACCEPTED {
+		// re-propose the value accepted in the highest ballot, which later RMWs on the key
+		// must apply to
+		key := int(inst.cmds[0].K)
+		if proposed, ok := r.proposed[key]; inst.cmds[0].Op != state.NONE && (!ok || r.isLargerTag(proposed.Tag, inst.payload.Tag)) {
+			r.proposed[key] = inst.payload
+		}
+		r.recordInstance(RMW_SPACE, inst.rmwId, inst)
+		r.sync()
+		r.bcastRMWSet(inst.rmwId, inst.ballot, key)
+	} else if len(inst.cmds) > 0 {
+		// nothing was accepted, run the command from scratch
+		r.bcastRMWGet(inst.rmwId, inst.ballot, inst.cmds)
+	} else if inst.rmwId < r.prepareUpTo {
+		// hole below the frontier, nothing can have been chosen here
+		r.fillNoOp(inst)
+	}
+	// an empty frontier is released in endPrepare
+}
+
+// A replica compacted the instance after it was committed, so it needs no Phase 2.
+// Its result is unknown here, so a client still waiting on it is told just that, and
+// whatever this replica accepted for it is dropped rather than reported as chosen.
+func (r *Replica) skipCommitted(inst *Instance) {
+	inst.lb.preparing = false
+	r.failClient(inst, genericsmrproto.REPLY_UNKNOWN)
+	inst.cmds = nil
+	inst.payload = pineappleproto.Payload{}
+	inst.status = COMMITTED
+	r.recordInstance(RMW_SPACE, inst.rmwId, inst)
+	r.recordCommit(inst.rmwId)
+	delete(r.rmwInFlight, inst.rmwId)
+	r.advanceRMWDone()
+
+	r.preparePending--
+	if r.preparePending == 0 {
+		r.endPrepare()
+	}
+}
+
+// A replica learned the value chosen for the instance, so it needs no Phase 2. The value
+// the RMW was applied to is unknown here, so a client still waiting on it does not learn
+// its result, as for skipCommitted.
+func (r *Replica) commitRecovered(inst *Instance, preply *pineappleproto.PrepareReply) {
+	inst.lb.preparing = false
+	r.failClient(inst, genericsmrproto.REPLY_UNKNOWN)
+	inst.cmds = preply.Command
+	inst.ballot = preply.Ballot
+	inst.payload = preply.Payload
+	inst.status = COMMITTED
+	r.adoptChosen(inst)
+	r.recordInstance(RMW_SPACE, inst.rmwId, inst)
+	r.recordCommit(inst.rmwId)
+	delete(r.rmwInFlight, inst.rmwId)
+	// the acks are Prepare replies, so every follower gets the value in a full Commit
+	inst.lb.acks = nil
+	r.toCommit = append(r.toCommit, inst.rmwId)
+	r.advanceRMWDone()
+
+	r.preparePending--
+	if r.preparePending == 0 {
+		r.endPrepare()
+	}
+}
+
+// Fills a hole in the RMW log with a command that does not touch any key
+func (r *Replica) fillNoOp(inst *Instance) {
+	inst.cmds = []state.Command{{Op: state.NONE}}
+	inst.payload = pineappleproto.Payload{}
+	inst.status = ACCEPTED
+	r.recordInstance(RMW_SPACE, inst.rmwId, inst)
+	r.sync()
+	r.bcastRMWSet(inst.rmwId, inst.ballot, 0)
+}
+
+// Every instance up to the frontier is recovered, start taking RMWs again
+func (r *Replica) endPrepare() {
+	if r.prepareUpTo >= 0 {
+		frontier := r.pendingRMWs.get(r.prepareUpTo)
+		if frontier != nil && len(frontier.cmds) == 0 && frontier.status != COMMITTED {
+			r.pendingRMWs.set(r.prepareUpTo, nil)
+			delete(r.rmwInFlight, r.prepareUpTo)
+		}
+	}
+	r.crtRmwId = r.prepareUpTo
+	r.preparing = false
+	log.Printf("Replica %d recovered the RMW log up to instance %d\n", r.Id, r.prepareUpTo)
+
+	deferred := r.deferredRMWs
+	r.deferredRMWs = nil
+	for _, propose := range deferred {
+		r.handlePropose(propose)
+	}
+}
+
+// The replica that picked a ballot
+func ballotOwner(ballot int32) int32 {
+	return ballot & 0xF
+}
+
+// Follow a higher ballot seen in an RMWGet or RMWSet, in case its Prepare was missed
+func (r *Replica) adoptBallot(leaderId int32, ballot int32) {
+	if ballot <= r.defaultBallot {
+		return
+	}
+	r.defaultBallot = ballot
+	r.recordBallot()
+	if r.IsLeader && leaderId != r.Id {
+		r.stepDown()
+	}
+}
+
+// A replica refused an RMW message because it promised a higher ballot.
+// Once a quorum can no longer be reached at our ballot, either step down in favour of
+// the replica that owns the higher ballot, or prepare again with a ballot above it.
+func (r *Replica) handleRMWNack(inst *Instance, ballot int32) {
+	if ballot <= r.defaultBallot {
+		return // stale NACK, we already moved past that ballot
+	}
+
+	inst.lb.nacks++
+	if ballot > inst.lb.maxNackBallot {
+		inst.lb.maxNackBallot = ballot
+	}
+
+	// the leader counts itself, so it needs r.N>>1 acknowledgements from the other r.N-1 replicas
+	if !r.IsLeader || inst.lb.nacks <= r.N-1-r.N>>1 {
+		return
+	}
+
+	if ballotOwner(inst.lb.maxNackBallot) != r.Id {
+		r.defaultBallot = inst.lb.maxNackBallot
+		r.recordBallot()
+		r.stepDown()
+	} else {
+		// our own ballot from before a restart, pick one above it
+		r.defaultBallot = inst.lb.maxNackBallot
+		r.becomeLeader()
+	}
+}
+
+// Another replica took over with a higher ballot, or the master is handing over to one
+func (r *Replica) stepDown() {
+	log.Printf("Replica %d stepping down at ballot %d\n", r.Id, r.defaultBallot)
+	r.IsLeader = false
+	r.preparing = false
+	r.preparePending = 0
+	r.proposed = map[int]pineappleproto.Payload{} // the new leader decides what becomes of them
+
+	// never started, the new leader can take them
+	for _, propose := range r.deferredRMWs {
+		r.redirectPropose(propose)
+	}
+	r.deferredRMWs = nil
+
+	// clients waiting on RMWs this replica no longer drives, which the new leader may
+	// still commit
+	for i := r.rmwDoneUpTo + 1; i < r.crtRmwId; i++ {
+		inst := r.pendingRMWs.get(i)
+		if inst == nil || inst.lb == nil {
+			continue
+		}
+		r.failClient(inst, genericsmrproto.REPLY_UNKNOWN)
+		inst.lb = nil
+	}
+	r.rmwInFlight = map[int32]bool{}
+}
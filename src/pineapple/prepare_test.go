@@ -0,0 +1,47 @@
+package pineapple
+
+import (
+	"testing"
+
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/state"
+)
+
+// A leader that steps down tells the clients of the RMWs it was driving that their
+// outcome is unknown, and sends new ones to the replica that took over
+func TestStepDown(t *testing.T) {
+	c := newManualCluster(t, 3)
+	cmd := state.Command{Op: state.FETCH_ADD, K: 1, V: 5}
+
+	pending := c.submit(0, 1, cmd)
+	c.replicas[0].stepDown()
+	if c.replicas[0].IsLeader {
+		t.Fatal("replica 0 still leads after stepping down")
+	}
+	if reply, notLeader := pending.last(t); notLeader != nil || reply.OK != genericsmrproto.REPLY_UNKNOWN {
+		t.Errorf("RMW in flight answered with %+v, %+v; want its outcome unknown", reply, notLeader)
+	}
+
+	c.replicas[1].TakeOver()
+	c.deliver()
+	if reply, notLeader := c.do(0, 2, cmd); notLeader == nil || notLeader.LeaderId != 1 {
+		t.Errorf("old leader answered an RMW with %+v, %+v; want a redirect to replica 1", reply, notLeader)
+	}
+	if reply, notLeader := c.do(1, 2, cmd); notLeader != nil || reply.OK != TRUE {
+		t.Errorf("new leader answered an RMW with %+v, %+v", reply, notLeader)
+	}
+}
+
+// RMWs deferred while the log was being recovered are redirected, not dropped
+func TestStepDownWhilePreparing(t *testing.T) {
+	c := newManualCluster(t, 3)
+	c.replicas[2].TakeOver()
+	deferred := c.submit(2, 1, state.Command{Op: state.FETCH_ADD, K: 1, V: 5})
+	if len(deferred.frames) != 0 {
+		t.Fatal("RMW answered before the log was recovered")
+	}
+	c.replicas[2].stepDown()
+	if _, notLeader := deferred.last(t); notLeader == nil {
+		t.Error("deferred RMW was not redirected")
+	}
+}
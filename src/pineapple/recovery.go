@@ -0,0 +1,185 @@
+package pineapple
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+// Stable store record types
+const (
+	RECORD_BALLOT   uint8 = iota + 1 // ballot promised by this replica
+	RECORD_INSTANCE                  // instance, its commands and the value-tag pair it settled on
+	RECORD_COMMIT                    // RMW instance acknowledged by a quorum
+	RECORD_DATA                      // value-tag pair adopted for a key
+)
+
+// Instance spaces a RECORD_INSTANCE can belong to
+const (
+	ABD_SPACE uint8 = iota // instanceSpace
+	RMW_SPACE              // pendingRMWs
+)
+
+// [space][instance][ballot][status][tag timestamp][tag id][tag rmw count][value][#cmds][cmds...]
+func encodeInstance(space uint8, instance int32, inst *Instance) []byte {
+	var buf bytes.Buffer
+	var b [8]byte
+
+	buf.WriteByte(space)
+	binary.LittleEndian.PutUint32(b[:4], uint32(instance))
+	buf.Write(b[:4])
+	binary.LittleEndian.PutUint32(b[:4], uint32(inst.ballot))
+	buf.Write(b[:4])
+	buf.WriteByte(byte(inst.status))
+	binary.LittleEndian.PutUint64(b[:], uint64(inst.payload.Tag.Timestamp))
+	buf.Write(b[:])
+	binary.LittleEndian.PutUint64(b[:], uint64(inst.payload.Tag.ID))
+	buf.Write(b[:])
+	binary.LittleEndian.PutUint64(b[:], uint64(inst.payload.Tag.RMWCount))
+	buf.Write(b[:])
+	binary.LittleEndian.PutUint64(b[:], uint64(inst.payload.Value))
+	buf.Write(b[:])
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(inst.cmds)))
+	buf.Write(b[:4])
+	for i := range inst.cmds {
+		inst.cmds[i].Marshal(&buf)
+	}
+	return buf.Bytes()
+}
+
+func decodeInstance(payload []byte) (space uint8, instance int32, inst *Instance, err error) {
+	reader := bytes.NewReader(payload)
+	var h [46]byte
+	if _, err = io.ReadFull(reader, h[:]); err != nil {
+		return
+	}
+	space = h[0]
+	instance = int32(binary.LittleEndian.Uint32(h[1:5]))
+	inst = &Instance{
+		rmwId:  instance,
+		ballot: int32(binary.LittleEndian.Uint32(h[5:9])),
+		status: InstanceStatus(h[9]),
+		payload: pineappleproto.Payload{
+			Tag: pineappleproto.Tag{
+				Timestamp: int(binary.LittleEndian.Uint64(h[10:18])),
+				ID:        int(binary.LittleEndian.Uint64(h[18:26])),
+				RMWCount:  int(binary.LittleEndian.Uint64(h[26:34]))},
+			Value: int(binary.LittleEndian.Uint64(h[34:42]))},
+	}
+	inst.cmds = make([]state.Command, binary.LittleEndian.Uint32(h[42:46]))
+	for i := range inst.cmds {
+		if err = inst.cmds[i].Unmarshal(reader); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Rebuilds data, the instance spaces and the promised ballot from the newest snapshot
+// and the stable store segments written after it. Runs before the replica connects to its peers.
+func (r *Replica) recover() {
+	if !r.Durable {
+		return
+	}
+
+	seq, snapshot, err := r.StableStore.LoadSnapshot()
+	if err != nil {
+		log.Fatal("Loading the snapshot failed:", err)
+	}
+	if snapshot != nil {
+		if err := r.loadSnapshot(snapshot); err != nil {
+			log.Fatal("Loading the snapshot failed:", err)
+		}
+	}
+
+	records := 0
+	err = r.StableStore.Replay(seq, func(recType uint8, payload []byte) error {
+		records++
+		switch recType {
+		case RECORD_BALLOT:
+			if ballot := int32(binary.LittleEndian.Uint32(payload)); ballot > r.defaultBallot {
+				r.defaultBallot = ballot
+			}
+
+		case RECORD_INSTANCE:
+			space, instance, inst, err := decodeInstance(payload)
+			if err != nil {
+				return err
+			}
+			r.recoverInstance(space, instance, inst)
+
+		case RECORD_DATA:
+			key := int(binary.LittleEndian.Uint64(payload[0:8]))
+			r.recoverData(key, pineappleproto.Payload{
+				Tag: pineappleproto.Tag{
+					Timestamp: int(binary.LittleEndian.Uint64(payload[8:16])),
+					ID:        int(binary.LittleEndian.Uint64(payload[16:24])),
+					RMWCount:  int(binary.LittleEndian.Uint64(payload[24:32]))},
+				Value: int(binary.LittleEndian.Uint64(payload[32:40]))})
+
+		case RECORD_COMMIT:
+			if inst := r.pendingRMWs.get(int32(binary.LittleEndian.Uint32(payload))); inst != nil {
+				inst.status = COMMITTED
+				r.recoverChosen(inst)
+			}
+
+		default:
+			log.Printf("Skipping stable store record of unknown type %d\n", recType)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal("Stable store recovery failed:", err)
+	}
+
+	r.instanceSpace.reclaimUpTo(r.crtInstance - 1)
+
+	// RMWs are done up to the first one not known to be committed
+	r.advanceRMWDone()
+
+	r.recovered = snapshot != nil || records > 0
+	if r.recovered {
+		log.Printf("Recovered snapshot %d and %d records: ballot %d, %d ABD instances, RMWs done up to %d of %d\n",
+			seq, records, r.defaultBallot, r.crtInstance, r.rmwDoneUpTo, r.crtRmwId)
+	}
+}
+
+// the freshest value-tag pair wins, as in the protocol
+func (r *Replica) recoverData(key int, payload pineappleproto.Payload) {
+	if data, exists := r.data[key]; !exists || r.isLargerTag(data.Tag, payload.Tag) {
+		r.data[key] = payload
+	}
+}
+
+// The value an instance wrote, once it is chosen. An RMW value that was only accepted
+// may still lose to another leader's, so it stays out of data as it did before the crash.
+func (r *Replica) recoverChosen(inst *Instance) {
+	if len(inst.cmds) > 0 && inst.cmds[0].Op != state.NONE {
+		r.recoverData(int(inst.cmds[0].K), inst.payload)
+	}
+}
+
+func (r *Replica) recoverInstance(space uint8, instance int32, inst *Instance) {
+	if space == ABD_SPACE {
+		// its client is gone, only the key and the instance id matter
+		r.recoverChosen(inst)
+		if instance >= r.crtInstance {
+			r.crtInstance = instance + 1
+		}
+		return
+	}
+
+	// a later record for the same RMW instance supersedes earlier ones
+	if old := r.pendingRMWs.get(instance); old != nil && old.status == COMMITTED {
+		inst.status = COMMITTED
+	}
+	if inst.status == COMMITTED {
+		r.recoverChosen(inst)
+	}
+	r.pendingRMWs.set(instance, inst)
+	r.learnRMWInstance(instance)
+}
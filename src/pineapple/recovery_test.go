@@ -0,0 +1,140 @@
+package pineapple
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pineapple/src/genericsmr"
+	"pineapple/src/pineappleproto"
+	"pineapple/src/stablestore"
+	"pineapple/src/state"
+)
+
+// Just the parts of a replica that the stable store records and recovery use
+func storedReplica(t *testing.T, base string) *Replica {
+	store, err := stablestore.Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Replica{
+		Replica:         &genericsmr.Replica{Durable: true, StableStore: store},
+		data:            map[int]pineappleproto.Payload{},
+		instanceSpace:   newInstanceWindow(),
+		rmwDoneUpTo:     -1,
+		rmwExecutedUpTo: -1,
+		pendingRMWs:     newInstanceWindow(),
+		compactedUpTo:   -1,
+	}
+}
+
+func payload(ts int, id int, value int) pineappleproto.Payload {
+	return pineappleproto.Payload{Tag: pineappleproto.Tag{Timestamp: ts, ID: id}, Value: value}
+}
+
+func TestInstanceRecord(t *testing.T) {
+	inst := &Instance{
+		cmds:    []state.Command{{Op: state.RMW, K: 4, V: 2}},
+		rmwId:   12,
+		ballot:  33,
+		status:  ACCEPTED,
+		payload: payload(5, 2, -7),
+	}
+	space, instance, got, err := decodeInstance(encodeInstance(RMW_SPACE, 12, inst))
+	if err != nil || space != RMW_SPACE || instance != 12 {
+		t.Fatalf("decoded space %d, instance %d, %v", space, instance, err)
+	}
+	if !reflect.DeepEqual(got, inst) {
+		t.Errorf("decoded %+v, encoded %+v", got, inst)
+	}
+
+	if _, _, _, err := decodeInstance(encodeInstance(ABD_SPACE, 1, inst)[:20]); err == nil {
+		t.Error("decoded a truncated record")
+	}
+}
+
+// A restarted replica gets back what it synced, and nothing it did not
+func TestRecover(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "replica1")
+	r := storedReplica(t, store)
+	r.defaultBallot = 17
+	r.recordBallot()
+	r.recordInstance(ABD_SPACE, 0, &Instance{cmds: []state.Command{{Op: state.PUT, K: 3, V: 40}}, payload: payload(4, 0, 40)})
+	r.recordInstance(ABD_SPACE, 1, &Instance{cmds: []state.Command{{Op: state.PUT, K: 3, V: 20}}, payload: payload(2, 0, 20)})
+	r.recordInstance(RMW_SPACE, 0, &Instance{cmds: []state.Command{{Op: state.RMW, K: 5, V: 1}},
+		ballot: 17, status: ACCEPTED, payload: payload(1, 2, 11)})
+	r.recordCommit(0)
+	r.recordData(7, payload(3, 1, 70))
+	r.recordData(7, payload(3, 0, 30)) // same timestamp, lower id
+	r.recordInstance(RMW_SPACE, 1, &Instance{cmds: []state.Command{{Op: state.RMW, K: 6, V: 9}},
+		ballot: 17, status: ACCEPTED, payload: payload(1, 0, 9)})
+	r.sync()
+	// never synced, and the store is dropped without a Close as if the process died
+	r.recordInstance(ABD_SPACE, 2, &Instance{cmds: []state.Command{{Op: state.PUT, K: 8, V: 80}}, payload: payload(1, 1, 80)})
+
+	r = storedReplica(t, store)
+	defer r.StableStore.Close()
+	r.recover()
+	if r.defaultBallot != 17 || !r.recovered {
+		t.Errorf("recovered ballot %d, want 17", r.defaultBallot)
+	}
+	want := map[int]pineappleproto.Payload{
+		3: payload(4, 0, 40), // the newer tag wins
+		5: payload(1, 2, 11),
+		7: payload(3, 1, 70), // key 6 was only accepted
+	}
+	if !reflect.DeepEqual(r.data, want) {
+		t.Errorf("recovered data %v, want %v", r.data, want)
+	}
+	if r.crtInstance != 2 || r.rmwDoneUpTo != 0 || r.crtRmwId != 2 {
+		t.Errorf("recovered %d ABD instances, RMWs done up to %d of %d; want 2, 0 of 2", r.crtInstance, r.rmwDoneUpTo, r.crtRmwId)
+	}
+	if inst := r.pendingRMWs.get(1); inst == nil || inst.status != ACCEPTED {
+		t.Errorf("instance 1 recovered as %+v, want it accepted", inst)
+	}
+}
+
+// A snapshot keeps the data and the RMW instances after the executed prefix, and
+// replaces the log records before it
+func TestSnapshotRecover(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "replica1")
+	r := storedReplica(t, store)
+	r.defaultBallot = 17
+	r.crtInstance = 4
+	r.data[3] = payload(4, 0, 40)
+	r.data[5] = payload(3, 2, 11) // the last committed RMW
+	r.recordData(3, r.data[3])
+	for i, status := range []InstanceStatus{COMMITTED, COMMITTED, ACCEPTED} {
+		inst := &Instance{cmds: []state.Command{{Op: state.RMW, K: 5, V: 1}}, rmwId: int32(i),
+			ballot: 17, status: status, payload: payload(2+i, 2, 10+i)}
+		r.pendingRMWs.set(int32(i), inst)
+		r.learnRMWInstance(int32(i))
+		r.recordInstance(RMW_SPACE, int32(i), inst)
+	}
+	r.rmwExecutedUpTo = 1 // the committed ones were answered
+	r.takeSnapshot()
+	r.recordData(7, payload(1, 1, 70)) // after the snapshot
+	r.sync()
+
+	r = storedReplica(t, store)
+	defer r.StableStore.Close()
+	r.recover()
+	if r.defaultBallot != 17 || r.crtInstance != 4 || r.compactedUpTo != 1 || r.rmwDoneUpTo != 1 || r.crtRmwId != 3 {
+		t.Errorf("recovered ballot %d, %d ABD instances, compacted up to %d, done up to %d of %d; want 17, 4, 1, 1 of 3",
+			r.defaultBallot, r.crtInstance, r.compactedUpTo, r.rmwDoneUpTo, r.crtRmwId)
+	}
+	if !r.pendingRMWs.reclaimed(1) {
+		t.Error("compacted RMW instances are back in the log")
+	}
+	if inst := r.pendingRMWs.get(2); inst == nil || inst.status != ACCEPTED || inst.payload != payload(4, 2, 12) {
+		t.Errorf("instance 2 recovered as %+v", inst)
+	}
+	want := map[int]pineappleproto.Payload{
+		3: payload(4, 0, 40),
+		5: payload(3, 2, 11), // not the accepted instance 2
+		7: payload(1, 1, 70),
+	}
+	if !reflect.DeepEqual(r.data, want) {
+		t.Errorf("recovered data %v, want %v", r.data, want)
+	}
+}
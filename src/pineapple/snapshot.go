@@ -0,0 +1,150 @@
+package pineapple
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+
+	"pineapple/src/pineappleproto"
+)
+
+// Snapshots replace the stable store segments written before them:
+// [ballot][crtInstance][crtRmwId][compactedUpTo][#keys]([key][tag timestamp][tag id][tag rmw count][value])...
+// [#instances]([length][instance record])...
+// compactedUpTo is the end of the executed prefix of the RMW log; the RMW instances after
+// it are kept as RECORD_INSTANCE payloads since they may still have clients to answer, or
+// a new leader may have to recover them.
+const SNAPSHOT_HEADER_SIZE = 20
+
+// Snapshots every snapshotInterval, as long as something was logged since the last one
+func (r *Replica) maybeSnapshot() {
+	if !r.Durable || r.snapshotInterval <= 0 || r.Clock.Now().Sub(r.lastSnapshot) < r.snapshotInterval {
+		return
+	}
+	r.lastSnapshot = r.Clock.Now()
+	if r.StableStore.Size() == 0 {
+		return
+	}
+	r.takeSnapshot()
+}
+
+// Starts a new stable store segment and writes a snapshot of everything logged before it.
+// Runs in the main loop, so the snapshot is consistent with the log.
+func (r *Replica) takeSnapshot() {
+	seq, err := r.StableStore.Rotate()
+	if err != nil {
+		log.Fatal("Stable store rotation failed:", err)
+	}
+
+	// executed RMWs only matter through the keys they wrote
+	if r.rmwExecutedUpTo > r.compactedUpTo {
+		r.compactedUpTo = r.rmwExecutedUpTo
+	}
+
+	snapshot, instances := r.encodeSnapshot()
+	if err := r.StableStore.WriteSnapshot(seq, snapshot); err != nil {
+		// the older segments are still there, so nothing is lost
+		log.Println("Snapshot failed:", err)
+		return
+	}
+	log.Printf("Replica %d snapshot %d: %d keys, %d RMW instances, RMWs compacted up to %d\n",
+		r.Id, seq, len(r.data), instances, r.compactedUpTo)
+}
+
+func (r *Replica) encodeSnapshot() ([]byte, int) {
+	var buf bytes.Buffer
+	var b [8]byte
+
+	binary.LittleEndian.PutUint32(b[:4], uint32(r.defaultBallot))
+	buf.Write(b[:4])
+	binary.LittleEndian.PutUint32(b[:4], uint32(r.crtInstance))
+	buf.Write(b[:4])
+	binary.LittleEndian.PutUint32(b[:4], uint32(r.crtRmwId))
+	buf.Write(b[:4])
+	binary.LittleEndian.PutUint32(b[:4], uint32(r.compactedUpTo))
+	buf.Write(b[:4])
+
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(r.data)))
+	buf.Write(b[:4])
+	for key, payload := range r.data {
+		binary.LittleEndian.PutUint64(b[:], uint64(key))
+		buf.Write(b[:])
+		binary.LittleEndian.PutUint64(b[:], uint64(payload.Tag.Timestamp))
+		buf.Write(b[:])
+		binary.LittleEndian.PutUint64(b[:], uint64(payload.Tag.ID))
+		buf.Write(b[:])
+		binary.LittleEndian.PutUint64(b[:], uint64(payload.Tag.RMWCount))
+		buf.Write(b[:])
+		binary.LittleEndian.PutUint64(b[:], uint64(payload.Value))
+		buf.Write(b[:])
+	}
+
+	var instances bytes.Buffer
+	count := 0
+	for i := r.compactedUpTo + 1; i < r.crtRmwId; i++ {
+		inst := r.pendingRMWs.get(i)
+		if inst == nil {
+			continue
+		}
+		record := encodeInstance(RMW_SPACE, i, inst)
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(record)))
+		instances.Write(b[:4])
+		instances.Write(record)
+		count++
+	}
+	binary.LittleEndian.PutUint32(b[:4], uint32(count))
+	buf.Write(b[:4])
+	buf.Write(instances.Bytes())
+
+	return buf.Bytes(), count
+}
+
+// Restores the state saved by encodeSnapshot
+func (r *Replica) loadSnapshot(snapshot []byte) error {
+	reader := bytes.NewReader(snapshot)
+	var h [SNAPSHOT_HEADER_SIZE]byte
+	if _, err := io.ReadFull(reader, h[:]); err != nil {
+		return err
+	}
+	r.defaultBallot = int32(binary.LittleEndian.Uint32(h[0:4]))
+	r.crtInstance = int32(binary.LittleEndian.Uint32(h[4:8]))
+	r.crtRmwId = int32(binary.LittleEndian.Uint32(h[8:12]))
+	r.compactedUpTo = int32(binary.LittleEndian.Uint32(h[12:16]))
+	r.rmwDoneUpTo = r.compactedUpTo
+	r.rmwExecutedUpTo = r.compactedUpTo
+	r.pendingRMWs.reclaimUpTo(r.compactedUpTo)
+
+	var d [40]byte
+	for keys := binary.LittleEndian.Uint32(h[16:20]); keys > 0; keys-- {
+		if _, err := io.ReadFull(reader, d[:]); err != nil {
+			return err
+		}
+		r.data[int(binary.LittleEndian.Uint64(d[0:8]))] = pineappleproto.Payload{
+			Tag: pineappleproto.Tag{
+				Timestamp: int(binary.LittleEndian.Uint64(d[8:16])),
+				ID:        int(binary.LittleEndian.Uint64(d[16:24])),
+				RMWCount:  int(binary.LittleEndian.Uint64(d[24:32]))},
+			Value: int(binary.LittleEndian.Uint64(d[32:40]))}
+	}
+
+	var n [4]byte
+	if _, err := io.ReadFull(reader, n[:]); err != nil {
+		return err
+	}
+	for count := binary.LittleEndian.Uint32(n[:]); count > 0; count-- {
+		if _, err := io.ReadFull(reader, n[:]); err != nil {
+			return err
+		}
+		record := make([]byte, binary.LittleEndian.Uint32(n[:]))
+		if _, err := io.ReadFull(reader, record); err != nil {
+			return err
+		}
+		space, instance, inst, err := decodeInstance(record)
+		if err != nil {
+			return err
+		}
+		r.recoverInstance(space, instance, inst)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package pineapple
+
+import (
+	"log"
+
+	"pineapple/src/fastrpc"
+	"pineapple/src/genericsmr"
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/pineappleproto"
+	"pineapple/src/state"
+)
+
+func (r *Replica) timeoutClock() {
+	for !r.Shutdown {
+		r.Clock.Sleep(r.timeout / 4)
+		r.timeoutChan <- true
+	}
+}
+
+// Starts a new phase for an instance: forget who replied and re-arm its deadline
+func (r *Replica) startPhase(lb *LeaderBookkeeping) {
+	if lb == nil {
+		return
+	}
+	lb.acks = make(map[int32]bool, r.N)
+	lb.deadline = r.Clock.Now().Add(r.timeout)
+	lb.retries = 0
+}
+
+// Records a reply to the current phase, returns false if the replica already answered it
+func (r *Replica) ack(lb *LeaderBookkeeping, replicaId int32) bool {
+	if lb.acks[replicaId] {
+		return false
+	}
+	lb.acks[replicaId] = true
+	return true
+}
+
+// Sends msg to every connected replica that has not answered the current phase
+func (r *Replica) sendToSilent(lb *LeaderBookkeeping, code uint8, msg fastrpc.Serializable) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("Resend failed:", err)
+		}
+	}()
+	for q := int32(0); q < int32(r.N); q++ {
+		if q == r.Id || !r.Alive[q].Load() || lb.acks[q] {
+			continue
+		}
+		r.send(q, code, msg)
+	}
+}
+
+// Tells the client its request could not complete, and whether it may still take effect
+func (r *Replica) failClient(inst *Instance, outcome uint8) {
+	if inst.lb.clientProposals != nil && !inst.lb.completed {
+		inst.lb.completed = true
+		r.rejectPropose(inst.lb.clientProposals[0], outcome)
+	}
+}
+
+func (r *Replica) checkTimeouts() {
+	now := r.Clock.Now()
+
+	for instance := range r.abdInFlight {
+		inst := r.instanceSpace.get(instance)
+		if inst == nil || inst.lb == nil || inst.lb.completed {
+			delete(r.abdInFlight, instance)
+			continue
+		}
+		if now.Before(inst.lb.deadline) {
+			continue
+		}
+		if inst.lb.retries >= r.maxRetries {
+			log.Printf("ABD instance %d gave up after %d retries\n", instance, inst.lb.retries)
+			outcome := genericsmrproto.REPLY_FAILED
+			if inst.cmds[0].Op == state.PUT && inst.lb.getDone {
+				// replicas may have taken the value, and reads then write it back
+				outcome = genericsmrproto.REPLY_UNKNOWN
+			}
+			r.failClient(inst, outcome)
+			delete(r.abdInFlight, instance)
+			r.instanceSpace.reclaim(instance)
+			continue
+		}
+		inst.lb.retries++
+		inst.lb.deadline = now.Add(r.timeout)
+		r.resendABD(instance, inst)
+	}
+
+	for instance := range r.rmwInFlight {
+		inst := r.pendingRMWs.get(instance)
+		if inst == nil || inst.lb == nil || inst.status == COMMITTED {
+			delete(r.rmwInFlight, instance)
+			continue
+		}
+		if now.Before(inst.lb.deadline) {
+			continue
+		}
+		// the RMW log can't have holes, so keep trying but let the client know it may
+		// still be applied
+		if inst.lb.retries >= r.maxRetries {
+			r.failClient(inst, genericsmrproto.REPLY_UNKNOWN)
+		}
+		inst.lb.retries++
+		inst.lb.deadline = now.Add(r.timeout)
+		r.resendRMW(instance, inst)
+	}
+
+	r.checkCommits(now)
+}
+
+// A reconnected peer missed whatever was sent while it was down, resend it right away
+func (r *Replica) handlePeerEvent(event genericsmr.PeerEvent) {
+	if !event.Alive {
+		return
+	}
+	for instance := range r.abdInFlight {
+		if inst := r.instanceSpace.get(instance); inst != nil && inst.lb != nil && !inst.lb.completed {
+			r.resendABD(instance, inst)
+		}
+	}
+	for instance := range r.rmwInFlight {
+		if inst := r.pendingRMWs.get(instance); inst != nil && inst.lb != nil && inst.status != COMMITTED {
+			r.resendRMW(instance, inst)
+		}
+	}
+	if r.IsLeader && r.followerDone[event.Peer] < r.rmwDoneUpTo {
+		r.resendCommits(event.Peer)
+	}
+}
+
+func (r *Replica) resendABD(instance int32, inst *Instance) {
+	key := int(inst.cmds[0].K)
+	wr := FALSE
+	if inst.cmds[0].Op == state.PUT {
+		wr = TRUE
+	}
+
+	if !inst.lb.getDone {
+		data := pineappleproto.Payload{}
+		if wr == FALSE {
+			data = r.data[key]
+		}
+		r.sendToSilent(inst.lb, r.getRPC, &pineappleproto.Get{ReplicaID: r.Id, Instance: instance,
+			Write: wr, Key: key, Payload: data})
+	} else {
+		// includes replicas skipped because they already had the largest tag
+		r.sendToSilent(inst.lb, r.setRPC, &pineappleproto.Set{ReplicaID: r.Id, Instance: instance,
+			Write: wr, Key: key, Payload: inst.payload})
+	}
+}
+
+func (r *Replica) resendRMW(instance int32, inst *Instance) {
+	if inst.lb.preparing {
+		toInfinity := FALSE
+		if instance == r.prepareUpTo {
+			toInfinity = TRUE
+		}
+		r.sendToSilent(inst.lb, r.prepareRPC, &pineappleproto.Prepare{LeaderId: r.Id, Instance: instance,
+			Ballot: r.defaultBallot, ToInfinity: toInfinity})
+	} else if inst.status >= ACCEPTED {
+		r.sendToSilent(inst.lb, r.rmwSetRPC, &pineappleproto.RMWSet{LeaderId: r.Id, Instance: instance,
+			Ballot: inst.ballot, Command: inst.cmds, Key: int(inst.cmds[0].K), Payload: inst.payload})
+	} else if len(inst.cmds) > 0 {
+		r.sendToSilent(inst.lb, r.rmwGetRPC, &pineappleproto.RMWGet{LeaderId: r.Id, Instance: instance,
+			Ballot: inst.ballot, Command: inst.cmds})
+	}
+	// an empty frontier waits for the rest of the Prepare round
+}
@@ -0,0 +1,137 @@
+package pineapple
+
+import (
+	"testing"
+
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/state"
+)
+
+// Messages of the given type that went out
+func count(sent []message, code uint8) int {
+	n := 0
+	for _, m := range sent {
+		if m.frame[4] == code {
+			n++
+		}
+	}
+	return n
+}
+
+// A phase whose messages were lost is sent again once its timeout passes, not before
+func TestResendOnTimeout(t *testing.T) {
+	c := newManualCluster(t, 3)
+	rs := c.submit(1, 1, state.Command{Op: state.PUT, K: 1, V: 3})
+	c.queue = nil // lost
+
+	c.clock.now = c.clock.now.Add(c.timeout / 2)
+	c.replicas[1].CheckTimeouts()
+	if len(c.queue) != 0 {
+		t.Fatal("resent before the timeout")
+	}
+	c.clock.now = c.clock.now.Add(c.timeout / 2)
+	c.replicas[1].CheckTimeouts()
+	if n := count(c.queue, c.replicas[1].getRPC); n != 2 {
+		t.Fatalf("resent %d Gets after the timeout, want 2", n)
+	}
+	c.deliver()
+	c.step()
+	if reply, notLeader := rs.last(t); notLeader != nil || reply.OK != genericsmrproto.REPLY_OK {
+		t.Errorf("PUT answered with %+v, %+v", reply, notLeader)
+	}
+}
+
+// A read that no replica answers gives up after maxRetries resends, and did not happen
+func TestGiveUpRead(t *testing.T) {
+	c := newManualCluster(t, 3)
+	c.down[1], c.down[2] = true, true
+	rs := c.submit(0, 1, state.Command{Op: state.GET, K: 1})
+	sent := c.deliver()
+	for i := 0; i < 20 && len(rs.frames) == 0; i++ {
+		sent = append(sent, c.step()...)
+	}
+	if reply, _ := rs.last(t); reply == nil || reply.OK != genericsmrproto.REPLY_FAILED {
+		t.Fatalf("GET answered with %+v, want it failed", reply)
+	}
+	if n := count(sent, c.replicas[0].getRPC); n != 2*(1+3) {
+		t.Errorf("sent %d Gets, want the first ones and 3 resends to both peers", n)
+	}
+}
+
+// A write that gave up after its tag was chosen may still be read back, so its client is
+// not told it failed
+func TestGiveUpWrite(t *testing.T) {
+	c := newManualCluster(t, 3)
+	rs := c.submit(0, 1, state.Command{Op: state.PUT, K: 1, V: 3})
+	c.deliverFirst(2) // the Gets, whose replies are queued
+	c.down[1], c.down[2] = true, true
+	if sent := c.deliver(); count(sent, c.replicas[0].setRPC) != 2 {
+		t.Fatal("the write phase did not start")
+	}
+	c.wait(5 * c.timeout)
+	if reply, _ := rs.last(t); reply == nil || reply.OK != genericsmrproto.REPLY_UNKNOWN {
+		t.Errorf("PUT answered with %+v, want its outcome unknown", reply)
+	}
+}
+
+// An RMW that cannot reach a quorum tells its client the outcome is unknown, but stays
+// in the log and commits once the followers are back
+func TestGiveUpRMW(t *testing.T) {
+	c := newManualCluster(t, 3)
+	c.down[1], c.down[2] = true, true
+	rs := c.submit(0, 1, state.Command{Op: state.FETCH_ADD, K: 1, V: 5})
+	c.wait(5 * c.timeout)
+	if reply, _ := rs.last(t); reply == nil || reply.OK != genericsmrproto.REPLY_UNKNOWN {
+		t.Fatalf("RMW answered with %+v, want its outcome unknown", reply)
+	}
+
+	c.down[1], c.down[2] = false, false
+	c.wait(2 * c.timeout)
+	if leader := c.replicas[0]; leader.rmwDoneUpTo != 0 || leader.data[1].Value != 5 {
+		t.Errorf("RMW done up to %d, key 1 holds %+v; want it committed", leader.rmwDoneUpTo, leader.data[1])
+	}
+	if len(rs.frames) != 1 {
+		t.Errorf("client got %d replies, want 1", len(rs.frames))
+	}
+}
+
+// A peer that comes back gets the phases in flight and the commits it missed right away,
+// without waiting for a timeout
+func TestResendOnReconnect(t *testing.T) {
+	c := newManualCluster(t, 3)
+	leader := c.replicas[0]
+	c.down[2] = true
+	leader.PeerChanged(2, false)
+	if reply, notLeader := c.do(0, 1, state.Command{Op: state.FETCH_ADD, K: 1, V: 5}); notLeader != nil || reply.OK != genericsmrproto.REPLY_OK {
+		t.Fatalf("RMW answered with %+v, %+v", reply, notLeader)
+	}
+	put := c.submit(0, 2, state.Command{Op: state.PUT, K: 2, V: 3})
+	rmw := c.submit(0, 3, state.Command{Op: state.FETCH_ADD, K: 1, V: 1})
+	c.queue = nil // lost on the way to replica 1
+
+	c.down[2] = false
+	leader.PeerChanged(2, true)
+	var toPeer []message
+	for _, m := range c.queue {
+		if m.to == 2 {
+			toPeer = append(toPeer, m)
+		}
+	}
+	if count(toPeer, leader.getRPC) != 1 || count(toPeer, leader.rmwGetRPC) != 1 || count(toPeer, leader.commitRPC) != 1 {
+		t.Fatalf("sent %d Gets, %d RMWGets and %d Commits to the reconnected peer, want one of each",
+			count(toPeer, leader.getRPC), count(toPeer, leader.rmwGetRPC), count(toPeer, leader.commitRPC))
+	}
+
+	c.deliver()
+	c.step()
+	c.step()
+	if reply, _ := put.last(t); reply == nil || reply.OK != genericsmrproto.REPLY_OK {
+		t.Errorf("PUT answered with %+v", reply)
+	}
+	if reply, _ := rmw.last(t); reply == nil || reply.OK != genericsmrproto.REPLY_OK || reply.Value != 6 {
+		t.Errorf("RMW answered with %+v", reply)
+	}
+	if done := c.replicas[2].rmwDoneUpTo; done != 1 {
+		t.Errorf("reconnected peer done up to %d, want 1", done)
+	}
+}
@@ -0,0 +1,167 @@
+package pineapple
+
+import (
+	"log"
+	"runtime"
+	"time"
+)
+
+// Initial number of slots in an instance window
+const WINDOW_SIZE = 1024
+
+const MEMORY_REPORT_INTERVAL = 10 * time.Second
+
+// Instance space kept in a ring buffer that only spans the ids from the oldest instance
+// still in use to the newest one, so memory grows with the work in flight.
+// Reclaimed ids are gone for good: get returns nil and set ignores them.
+type instanceWindow struct {
+	base  int32       // lowest id not reclaimed
+	end   int32       // one past the highest id set
+	slots []*Instance // id lives in slots[id % len(slots)], len is a power of two
+	held  int         // instances currently in the window
+}
+
+func newInstanceWindow() *instanceWindow {
+	return &instanceWindow{slots: make([]*Instance, WINDOW_SIZE)}
+}
+
+func (w *instanceWindow) slot(id int32) int {
+	return int(id) & (len(w.slots) - 1)
+}
+
+func (w *instanceWindow) get(id int32) *Instance {
+	if id < w.base || id >= w.end {
+		return nil
+	}
+	return w.slots[w.slot(id)]
+}
+
+func (w *instanceWindow) set(id int32, inst *Instance) {
+	if id < w.base {
+		return
+	}
+	if int(id-w.base) >= len(w.slots) {
+		size := len(w.slots)
+		for int(id-w.base) >= size {
+			size <<= 1
+		}
+		w.resize(size)
+	}
+	// slots outside [base, end) are always empty
+	i := w.slot(id)
+	if id >= w.end {
+		w.end = id + 1
+	}
+	if w.slots[i] == nil && inst != nil {
+		w.held++
+	} else if w.slots[i] != nil && inst == nil {
+		w.held--
+	}
+	w.slots[i] = inst
+}
+
+// Has id been dropped from the window
+func (w *instanceWindow) reclaimed(id int32) bool {
+	return id < w.base
+}
+
+// Drops one instance; the window moves past it once every instance before it is gone too.
+// Only for spaces without holes, where every id below end was handed out.
+func (w *instanceWindow) reclaim(id int32) {
+	if id < w.base || id >= w.end {
+		return
+	}
+	if i := w.slot(id); w.slots[i] != nil {
+		w.slots[i] = nil
+		w.held--
+	}
+	for w.base < w.end && w.slots[w.slot(w.base)] == nil {
+		w.base++
+	}
+	w.shrink()
+}
+
+// Drops every instance up to and including id
+func (w *instanceWindow) reclaimUpTo(id int32) {
+	for ; w.base <= id; w.base++ {
+		if w.base >= w.end {
+			continue
+		}
+		if i := w.slot(w.base); w.slots[i] != nil {
+			w.slots[i] = nil
+			w.held--
+		}
+	}
+	if w.end < w.base {
+		w.end = w.base
+	}
+	w.shrink()
+}
+
+// Gives memory back once the ids in use fit in a quarter of the slots
+func (w *instanceWindow) shrink() {
+	if len(w.slots) > WINDOW_SIZE && int(w.end-w.base) < len(w.slots)/4 {
+		w.resize(len(w.slots) / 2)
+	}
+}
+
+func (w *instanceWindow) resize(size int) {
+	slots := make([]*Instance, size)
+	for id := w.base; id < w.end; id++ {
+		slots[int(id)&(size-1)] = w.slots[w.slot(id)]
+	}
+	w.slots = slots
+}
+
+// Instances held, and slots allocated for them
+func (w *instanceWindow) stats() (int, int) {
+	return w.held, len(w.slots)
+}
+
+// Lowest id not reclaimed
+func (w *instanceWindow) first() int32 {
+	return w.base
+}
+
+// Drops the executed RMWs at the front of the log. They are committed, so a Prepare for
+// one of them is answered with PrepareReply.Committed instead. The leader keeps those a
+// live follower close behind has yet to acknowledge, to resend them with their values.
+func (r *Replica) reclaimRMWs() {
+	executed := r.rmwExecutedUpTo
+	for q := int32(0); r.IsLeader && q < int32(r.N); q++ {
+		done := r.followerDone[q]
+		if q != r.Id && r.Alive[q].Load() && done < executed && executed-done <= COMMIT_RESEND_BATCH {
+			executed = done
+		}
+	}
+	upTo := r.pendingRMWs.first() - 1
+	for upTo < executed {
+		inst := r.pendingRMWs.get(upTo + 1)
+		if inst == nil || inst.status != COMMITTED {
+			break
+		}
+		upTo++
+	}
+	r.pendingRMWs.reclaimUpTo(upTo)
+}
+
+// Logs how much of the instance spaces and the heap is in use, and any backpressure from peers
+func (r *Replica) reportMemory() {
+	if r.Clock.Now().Sub(r.lastStats) < MEMORY_REPORT_INTERVAL {
+		return
+	}
+	r.lastStats = r.Clock.Now()
+
+	abd, abdSlots := r.instanceSpace.stats()
+	rmw, rmwSlots := r.pendingRMWs.stats()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	log.Printf("Replica %d memory: %d ABD instances in %d slots, %d RMW instances in %d slots, %d keys, %d KB heap\n",
+		r.Id, abd, abdSlots, rmw, rmwSlots, len(r.data), mem.HeapAlloc/1024)
+
+	for q := int32(0); q < int32(r.N); q++ {
+		if dropped := r.PeerBackpressure(q); dropped > 0 {
+			log.Printf("Replica %d dropped %d messages to peer %d on a full queue\n", r.Id, dropped, q)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package pineapple
+
+import "testing"
+
+func TestInstanceWindow(t *testing.T) {
+	w := newInstanceWindow()
+	insts := make([]*Instance, 3*WINDOW_SIZE)
+	for id := range insts {
+		insts[id] = &Instance{rmwId: int32(id)}
+		w.set(int32(id), insts[id])
+	}
+	if held, slots := w.stats(); held != len(insts) || slots != 4*WINDOW_SIZE {
+		t.Fatalf("%d instances in %d slots, want %d in %d", held, slots, len(insts), 4*WINDOW_SIZE)
+	}
+	for id := range insts {
+		if w.get(int32(id)) != insts[id] {
+			t.Fatalf("get(%d) after growing is not the instance set there", id)
+		}
+	}
+	if w.get(int32(len(insts))) != nil || w.get(-1) != nil {
+		t.Error("get outside the window returned an instance")
+	}
+
+	// the window only moves once the front is gone
+	w.reclaim(1)
+	if w.first() != 0 || w.get(1) != nil {
+		t.Errorf("reclaim(1) moved the window to %d", w.first())
+	}
+	w.reclaim(0)
+	if w.first() != 2 || !w.reclaimed(1) || w.reclaimed(2) {
+		t.Errorf("reclaim(0) moved the window to %d, want 2", w.first())
+	}
+
+	w.reclaimUpTo(int32(len(insts)) - WINDOW_SIZE/2)
+	if held, slots := w.stats(); held != WINDOW_SIZE/2-1 || slots != 2*WINDOW_SIZE {
+		t.Errorf("%d instances in %d slots after reclaiming, want %d in %d", held, slots, WINDOW_SIZE/2-1, 2*WINDOW_SIZE)
+	}
+	for id := w.first(); id < int32(len(insts)); id++ {
+		if w.get(id) != insts[id] {
+			t.Fatalf("get(%d) after shrinking is not the instance set there", id)
+		}
+	}
+
+	// reclaimed ids stay gone, and reclaiming past the end leaves an empty window there
+	w.set(0, insts[0])
+	if w.get(0) != nil {
+		t.Error("set brought back a reclaimed id")
+	}
+	w.reclaimUpTo(int32(len(insts)) + 10)
+	if held, slots := w.stats(); held != 0 || slots != WINDOW_SIZE || w.first() != int32(len(insts))+11 {
+		t.Errorf("%d instances in %d slots from %d after reclaiming everything", held, slots, w.first())
+	}
+	w.set(w.first(), insts[0])
+	if w.get(w.first()) != insts[0] {
+		t.Error("set after reclaiming everything")
+	}
+}
+
+// Setting nil frees a slot without moving the window
+func TestInstanceWindowSetNil(t *testing.T) {
+	w := newInstanceWindow()
+	w.set(5, &Instance{})
+	w.set(5, nil)
+	if held, _ := w.stats(); held != 0 || w.first() != 0 {
+		t.Errorf("%d held from %d after clearing the only instance", held, w.first())
+	}
+}
@@ -9,9 +9,14 @@ const (
 	ACCEPT_REPLY
 )
 
+// Tags order the values of a key, by Timestamp, then ID, then RMWCount. A write takes
+// the next Timestamp with the id of its coordinator; an RMW keeps the Timestamp and ID of
+// the value it applied to and counts itself in RMWCount, so no write can be ordered
+// between an RMW and the value it read.
 type Tag struct {
 	Timestamp int
 	ID        int
+	RMWCount  int // RMWs applied since the write of Timestamp and ID
 }
 
 type Payload struct {
@@ -45,7 +50,8 @@ type Set struct {
 }
 
 type SetReply struct {
-	Instance int32
+	ReplicaID int32
+	Instance  int32
 }
 
 type Prepare struct {
@@ -56,10 +62,15 @@ type Prepare struct {
 }
 
 type PrepareReply struct {
-	Instance int32
-	OK       uint8
-	Ballot   int32
-	Command  []state.Command
+	ReplicaID   int32
+	Instance    int32
+	OK          uint8
+	Ballot      int32 // ballot the payload was accepted in (-1 if none), or the promised ballot if !OK
+	Command     []state.Command
+	Key         int
+	Payload     Payload
+	CrtInstance int32 // first RMW instance the replica knows nothing about
+	Committed   uint8 // the instance was committed and compacted into a snapshot
 }
 
 type RMWGet struct {
@@ -70,10 +81,12 @@ type RMWGet struct {
 }
 
 type RMWGetReply struct {
-	Instance int32
-	Ballot   int32
-	Key      int
-	Payload  Payload
+	ReplicaID int32
+	Instance  int32
+	OK        uint8
+	Ballot    int32 // promised ballot, higher than the request's if !OK
+	Key       int
+	Payload   Payload
 }
 
 type RMWSet struct {
@@ -86,9 +99,10 @@ type RMWSet struct {
 }
 
 type RMWSetReply struct {
-	Instance int32
-	OK       uint8
-	Ballot   int32
+	ReplicaID int32
+	Instance  int32
+	OK        uint8
+	Ballot    int32 // promised ballot, higher than the request's if !OK
 }
 
 type Commit struct {
@@ -96,11 +110,29 @@ type Commit struct {
 	Instance int32
 	Ballot   int32
 	Command  []state.Command
+	Key      int
+	Payload  Payload // value-tag pair the RMW settled on, for replicas that missed the RMWSet
 }
 
+// Commits Count instances from Instance on, all accepted by the receiver in Ballot
 type CommitShort struct {
 	LeaderId int32
 	Instance int32
 	Count    int32
 	Ballot   int32
 }
+
+// Where a follower's committed prefix of the RMW log ends, so the leader can resend
+// the commits it missed
+type CommitAck struct {
+	ReplicaID int32
+	DoneUpTo  int32
+}
+
+// Commits every instance up to and including UpTo, for those the leader no longer holds
+// the value of
+type CommitUpTo struct {
+	LeaderId int32
+	UpTo     int32
+	State    []state.Command // with -exec, the leader's state machine as of UpTo, as PUTs
+}
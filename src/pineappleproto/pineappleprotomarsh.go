@@ -18,7 +18,7 @@ func (t *Set) New() fastrpc.Serializable {
 	return new(Set)
 }
 func (t *Set) BinarySize() (nbytes int, sizeKnown bool) {
-	return 41, true
+	return 49, true
 }
 
 type SetCache struct {
@@ -51,9 +51,9 @@ func (p *SetCache) Put(t *Set) {
 	p.mu.Unlock()
 }
 func (t *Set) Marshal(wire io.Writer) {
-	var b [41]byte
+	var b [49]byte
 	var bs []byte
-	bs = b[:41]
+	bs = b[:49]
 	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
@@ -92,7 +92,7 @@ func (t *Set) Marshal(wire io.Writer) {
 	bs[30] = byte(tmp64 >> 16)
 	bs[31] = byte(tmp64 >> 8)
 	bs[32] = byte(tmp64)
-	tmp64 = t.Payload.Value
+	tmp64 = t.Payload.Tag.RMWCount
 	bs[33] = byte(tmp64 >> 56)
 	bs[34] = byte(tmp64 >> 48)
 	bs[35] = byte(tmp64 >> 40)
@@ -101,14 +101,23 @@ func (t *Set) Marshal(wire io.Writer) {
 	bs[38] = byte(tmp64 >> 16)
 	bs[39] = byte(tmp64 >> 8)
 	bs[40] = byte(tmp64)
+	tmp64 = t.Payload.Value
+	bs[41] = byte(tmp64 >> 56)
+	bs[42] = byte(tmp64 >> 48)
+	bs[43] = byte(tmp64 >> 40)
+	bs[44] = byte(tmp64 >> 32)
+	bs[45] = byte(tmp64 >> 24)
+	bs[46] = byte(tmp64 >> 16)
+	bs[47] = byte(tmp64 >> 8)
+	bs[48] = byte(tmp64)
 	wire.Write(bs)
 }
 
 func (t *Set) Unmarshal(wire io.Reader) error {
-	var b [41]byte
+	var b [49]byte
 	var bs []byte
-	bs = b[:41]
-	if _, err := io.ReadAtLeast(wire, bs, 41); err != nil {
+	bs = b[:49]
+	if _, err := io.ReadAtLeast(wire, bs, 49); err != nil {
 		return err
 	}
 	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
@@ -117,7 +126,8 @@ func (t *Set) Unmarshal(wire io.Reader) error {
 	t.Key = int(((uint64(bs[9]) << 56) | (uint64(bs[10]) << 48) | (uint64(bs[11]) << 40) | (uint64(bs[12]) << 32) | (uint64(bs[13]) << 24) | (uint64(bs[14]) << 16) | (uint64(bs[15]) << 8) | uint64(bs[16])))
 	t.Payload.Tag.Timestamp = int(((uint64(bs[17]) << 56) | (uint64(bs[18]) << 48) | (uint64(bs[19]) << 40) | (uint64(bs[20]) << 32) | (uint64(bs[21]) << 24) | (uint64(bs[22]) << 16) | (uint64(bs[23]) << 8) | uint64(bs[24])))
 	t.Payload.Tag.ID = int(((uint64(bs[25]) << 56) | (uint64(bs[26]) << 48) | (uint64(bs[27]) << 40) | (uint64(bs[28]) << 32) | (uint64(bs[29]) << 24) | (uint64(bs[30]) << 16) | (uint64(bs[31]) << 8) | uint64(bs[32])))
-	t.Payload.Value = int(((uint64(bs[33]) << 56) | (uint64(bs[34]) << 48) | (uint64(bs[35]) << 40) | (uint64(bs[36]) << 32) | (uint64(bs[37]) << 24) | (uint64(bs[38]) << 16) | (uint64(bs[39]) << 8) | uint64(bs[40])))
+	t.Payload.Tag.RMWCount = int(((uint64(bs[33]) << 56) | (uint64(bs[34]) << 48) | (uint64(bs[35]) << 40) | (uint64(bs[36]) << 32) | (uint64(bs[37]) << 24) | (uint64(bs[38]) << 16) | (uint64(bs[39]) << 8) | uint64(bs[40])))
+	t.Payload.Value = int(((uint64(bs[41]) << 56) | (uint64(bs[42]) << 48) | (uint64(bs[43]) << 40) | (uint64(bs[44]) << 32) | (uint64(bs[45]) << 24) | (uint64(bs[46]) << 16) | (uint64(bs[47]) << 8) | uint64(bs[48])))
 	return nil
 }
 
@@ -125,7 +135,7 @@ func (t *SetReply) New() fastrpc.Serializable {
 	return new(SetReply)
 }
 func (t *SetReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 4, true
+	return 8, true
 }
 
 type SetReplyCache struct {
@@ -158,25 +168,31 @@ func (p *SetReplyCache) Put(t *SetReply) {
 	p.mu.Unlock()
 }
 func (t *SetReply) Marshal(wire io.Writer) {
-	var b [4]byte
+	var b [8]byte
 	var bs []byte
-	bs = b[:4]
-	tmp32 := t.Instance
+	bs = b[:8]
+	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
 	wire.Write(bs)
 }
 
 func (t *SetReply) Unmarshal(wire io.Reader) error {
-	var b [4]byte
+	var b [8]byte
 	var bs []byte
-	bs = b[:4]
-	if _, err := io.ReadAtLeast(wire, bs, 4); err != nil {
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
 		return err
 	}
-	t.Instance = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
 	return nil
 }
 
@@ -217,7 +233,7 @@ func (p *RMWSetCache) Put(t *RMWSet) {
 	p.mu.Unlock()
 }
 func (t *RMWSet) Marshal(wire io.Writer) {
-	var b [32]byte
+	var b [40]byte
 	var bs []byte
 	bs = b[:12]
 	tmp32 := t.LeaderId
@@ -271,7 +287,7 @@ func (t *RMWSet) Marshal(wire io.Writer) {
 	bs[21] = byte(tmp64 >> 16)
 	bs[22] = byte(tmp64 >> 8)
 	bs[23] = byte(tmp64)
-	tmp64 = t.Payload.Value
+	tmp64 = t.Payload.Tag.RMWCount
 	bs[24] = byte(tmp64 >> 56)
 	bs[25] = byte(tmp64 >> 48)
 	bs[26] = byte(tmp64 >> 40)
@@ -280,6 +296,15 @@ func (t *RMWSet) Marshal(wire io.Writer) {
 	bs[29] = byte(tmp64 >> 16)
 	bs[30] = byte(tmp64 >> 8)
 	bs[31] = byte(tmp64)
+	tmp64 = t.Payload.Value
+	bs[32] = byte(tmp64 >> 56)
+	bs[33] = byte(tmp64 >> 48)
+	bs[34] = byte(tmp64 >> 40)
+	bs[35] = byte(tmp64 >> 32)
+	bs[36] = byte(tmp64 >> 24)
+	bs[37] = byte(tmp64 >> 16)
+	bs[38] = byte(tmp64 >> 8)
+	bs[39] = byte(tmp64)
 	wire.Write(bs)
 }
 
@@ -289,7 +314,7 @@ func (t *RMWSet) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [32]byte
+	var b [40]byte
 	var bs []byte
 	bs = b[:12]
 	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
@@ -306,14 +331,15 @@ func (t *RMWSet) Unmarshal(rr io.Reader) error {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Unmarshal(wire)
 	}
-	bs = b[:32]
-	if _, err := io.ReadAtLeast(wire, bs, 32); err != nil {
+	bs = b[:40]
+	if _, err := io.ReadAtLeast(wire, bs, 40); err != nil {
 		return err
 	}
 	t.Key = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
 	t.Payload.Tag.Timestamp = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
 	t.Payload.Tag.ID = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
-	t.Payload.Value = int(((uint64(bs[24]) << 56) | (uint64(bs[25]) << 48) | (uint64(bs[26]) << 40) | (uint64(bs[27]) << 32) | (uint64(bs[28]) << 24) | (uint64(bs[29]) << 16) | (uint64(bs[30]) << 8) | uint64(bs[31])))
+	t.Payload.Tag.RMWCount = int(((uint64(bs[24]) << 56) | (uint64(bs[25]) << 48) | (uint64(bs[26]) << 40) | (uint64(bs[27]) << 32) | (uint64(bs[28]) << 24) | (uint64(bs[29]) << 16) | (uint64(bs[30]) << 8) | uint64(bs[31])))
+	t.Payload.Value = int(((uint64(bs[32]) << 56) | (uint64(bs[33]) << 48) | (uint64(bs[34]) << 40) | (uint64(bs[35]) << 32) | (uint64(bs[36]) << 24) | (uint64(bs[37]) << 16) | (uint64(bs[38]) << 8) | uint64(bs[39])))
 	return nil
 }
 
@@ -398,7 +424,7 @@ func (t *Get) New() fastrpc.Serializable {
 	return new(Get)
 }
 func (t *Get) BinarySize() (nbytes int, sizeKnown bool) {
-	return 41, true
+	return 49, true
 }
 
 type GetCache struct {
@@ -431,9 +457,9 @@ func (p *GetCache) Put(t *Get) {
 	p.mu.Unlock()
 }
 func (t *Get) Marshal(wire io.Writer) {
-	var b [41]byte
+	var b [49]byte
 	var bs []byte
-	bs = b[:41]
+	bs = b[:49]
 	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
@@ -472,7 +498,7 @@ func (t *Get) Marshal(wire io.Writer) {
 	bs[30] = byte(tmp64 >> 16)
 	bs[31] = byte(tmp64 >> 8)
 	bs[32] = byte(tmp64)
-	tmp64 = t.Payload.Value
+	tmp64 = t.Payload.Tag.RMWCount
 	bs[33] = byte(tmp64 >> 56)
 	bs[34] = byte(tmp64 >> 48)
 	bs[35] = byte(tmp64 >> 40)
@@ -481,14 +507,23 @@ func (t *Get) Marshal(wire io.Writer) {
 	bs[38] = byte(tmp64 >> 16)
 	bs[39] = byte(tmp64 >> 8)
 	bs[40] = byte(tmp64)
+	tmp64 = t.Payload.Value
+	bs[41] = byte(tmp64 >> 56)
+	bs[42] = byte(tmp64 >> 48)
+	bs[43] = byte(tmp64 >> 40)
+	bs[44] = byte(tmp64 >> 32)
+	bs[45] = byte(tmp64 >> 24)
+	bs[46] = byte(tmp64 >> 16)
+	bs[47] = byte(tmp64 >> 8)
+	bs[48] = byte(tmp64)
 	wire.Write(bs)
 }
 
 func (t *Get) Unmarshal(wire io.Reader) error {
-	var b [41]byte
+	var b [49]byte
 	var bs []byte
-	bs = b[:41]
-	if _, err := io.ReadAtLeast(wire, bs, 41); err != nil {
+	bs = b[:49]
+	if _, err := io.ReadAtLeast(wire, bs, 49); err != nil {
 		return err
 	}
 	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
@@ -497,7 +532,8 @@ func (t *Get) Unmarshal(wire io.Reader) error {
 	t.Key = int(((uint64(bs[9]) << 56) | (uint64(bs[10]) << 48) | (uint64(bs[11]) << 40) | (uint64(bs[12]) << 32) | (uint64(bs[13]) << 24) | (uint64(bs[14]) << 16) | (uint64(bs[15]) << 8) | uint64(bs[16])))
 	t.Payload.Tag.Timestamp = int(((uint64(bs[17]) << 56) | (uint64(bs[18]) << 48) | (uint64(bs[19]) << 40) | (uint64(bs[20]) << 32) | (uint64(bs[21]) << 24) | (uint64(bs[22]) << 16) | (uint64(bs[23]) << 8) | uint64(bs[24])))
 	t.Payload.Tag.ID = int(((uint64(bs[25]) << 56) | (uint64(bs[26]) << 48) | (uint64(bs[27]) << 40) | (uint64(bs[28]) << 32) | (uint64(bs[29]) << 24) | (uint64(bs[30]) << 16) | (uint64(bs[31]) << 8) | uint64(bs[32])))
-	t.Payload.Value = int(((uint64(bs[33]) << 56) | (uint64(bs[34]) << 48) | (uint64(bs[35]) << 40) | (uint64(bs[36]) << 32) | (uint64(bs[37]) << 24) | (uint64(bs[38]) << 16) | (uint64(bs[39]) << 8) | uint64(bs[40])))
+	t.Payload.Tag.RMWCount = int(((uint64(bs[33]) << 56) | (uint64(bs[34]) << 48) | (uint64(bs[35]) << 40) | (uint64(bs[36]) << 32) | (uint64(bs[37]) << 24) | (uint64(bs[38]) << 16) | (uint64(bs[39]) << 8) | uint64(bs[40])))
+	t.Payload.Value = int(((uint64(bs[41]) << 56) | (uint64(bs[42]) << 48) | (uint64(bs[43]) << 40) | (uint64(bs[44]) << 32) | (uint64(bs[45]) << 24) | (uint64(bs[46]) << 16) | (uint64(bs[47]) << 8) | uint64(bs[48])))
 	return nil
 }
 
@@ -505,7 +541,7 @@ func (t *GetReply) New() fastrpc.Serializable {
 	return new(GetReply)
 }
 func (t *GetReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 42, true
+	return 50, true
 }
 
 type GetReplyCache struct {
@@ -538,9 +574,9 @@ func (p *GetReplyCache) Put(t *GetReply) {
 	p.mu.Unlock()
 }
 func (t *GetReply) Marshal(wire io.Writer) {
-	var b [42]byte
+	var b [50]byte
 	var bs []byte
-	bs = b[:42]
+	bs = b[:50]
 	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
@@ -580,7 +616,7 @@ func (t *GetReply) Marshal(wire io.Writer) {
 	bs[31] = byte(tmp64 >> 16)
 	bs[32] = byte(tmp64 >> 8)
 	bs[33] = byte(tmp64)
-	tmp64 = t.Payload.Value
+	tmp64 = t.Payload.Tag.RMWCount
 	bs[34] = byte(tmp64 >> 56)
 	bs[35] = byte(tmp64 >> 48)
 	bs[36] = byte(tmp64 >> 40)
@@ -589,14 +625,23 @@ func (t *GetReply) Marshal(wire io.Writer) {
 	bs[39] = byte(tmp64 >> 16)
 	bs[40] = byte(tmp64 >> 8)
 	bs[41] = byte(tmp64)
+	tmp64 = t.Payload.Value
+	bs[42] = byte(tmp64 >> 56)
+	bs[43] = byte(tmp64 >> 48)
+	bs[44] = byte(tmp64 >> 40)
+	bs[45] = byte(tmp64 >> 32)
+	bs[46] = byte(tmp64 >> 24)
+	bs[47] = byte(tmp64 >> 16)
+	bs[48] = byte(tmp64 >> 8)
+	bs[49] = byte(tmp64)
 	wire.Write(bs)
 }
 
 func (t *GetReply) Unmarshal(wire io.Reader) error {
-	var b [42]byte
+	var b [50]byte
 	var bs []byte
-	bs = b[:42]
-	if _, err := io.ReadAtLeast(wire, bs, 42); err != nil {
+	bs = b[:50]
+	if _, err := io.ReadAtLeast(wire, bs, 50); err != nil {
 		return err
 	}
 	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
@@ -606,7 +651,8 @@ func (t *GetReply) Unmarshal(wire io.Reader) error {
 	t.Key = int(((uint64(bs[10]) << 56) | (uint64(bs[11]) << 48) | (uint64(bs[12]) << 40) | (uint64(bs[13]) << 32) | (uint64(bs[14]) << 24) | (uint64(bs[15]) << 16) | (uint64(bs[16]) << 8) | uint64(bs[17])))
 	t.Payload.Tag.Timestamp = int(((uint64(bs[18]) << 56) | (uint64(bs[19]) << 48) | (uint64(bs[20]) << 40) | (uint64(bs[21]) << 32) | (uint64(bs[22]) << 24) | (uint64(bs[23]) << 16) | (uint64(bs[24]) << 8) | uint64(bs[25])))
 	t.Payload.Tag.ID = int(((uint64(bs[26]) << 56) | (uint64(bs[27]) << 48) | (uint64(bs[28]) << 40) | (uint64(bs[29]) << 32) | (uint64(bs[30]) << 24) | (uint64(bs[31]) << 16) | (uint64(bs[32]) << 8) | uint64(bs[33])))
-	t.Payload.Value = int(((uint64(bs[34]) << 56) | (uint64(bs[35]) << 48) | (uint64(bs[36]) << 40) | (uint64(bs[37]) << 32) | (uint64(bs[38]) << 24) | (uint64(bs[39]) << 16) | (uint64(bs[40]) << 8) | uint64(bs[41])))
+	t.Payload.Tag.RMWCount = int(((uint64(bs[34]) << 56) | (uint64(bs[35]) << 48) | (uint64(bs[36]) << 40) | (uint64(bs[37]) << 32) | (uint64(bs[38]) << 24) | (uint64(bs[39]) << 16) | (uint64(bs[40]) << 8) | uint64(bs[41])))
+	t.Payload.Value = int(((uint64(bs[42]) << 56) | (uint64(bs[43]) << 48) | (uint64(bs[44]) << 40) | (uint64(bs[45]) << 32) | (uint64(bs[46]) << 24) | (uint64(bs[47]) << 16) | (uint64(bs[48]) << 8) | uint64(bs[49])))
 	return nil
 }
 
@@ -647,20 +693,25 @@ func (p *PrepareReplyCache) Put(t *PrepareReply) {
 	p.mu.Unlock()
 }
 func (t *PrepareReply) Marshal(wire io.Writer) {
-	var b [10]byte
+	var b [45]byte
 	var bs []byte
-	bs = b[:9]
-	tmp32 := t.Instance
+	bs = b[:13]
+	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32)
-	bs[4] = byte(t.OK)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	bs[8] = byte(t.OK)
 	tmp32 = t.Ballot
-	bs[5] = byte(tmp32 >> 24)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 8)
-	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 24)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 8)
+	bs[12] = byte(tmp32)
 	wire.Write(bs)
 	bs = b[:]
 	alen1 := int64(len(t.Command))
@@ -670,6 +721,58 @@ func (t *PrepareReply) Marshal(wire io.Writer) {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Marshal(wire)
 	}
+	tmp64 := t.Key
+	bs[0] = byte(tmp64 >> 56)
+	bs[1] = byte(tmp64 >> 48)
+	bs[2] = byte(tmp64 >> 40)
+	bs[3] = byte(tmp64 >> 32)
+	bs[4] = byte(tmp64 >> 24)
+	bs[5] = byte(tmp64 >> 16)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64)
+	tmp64 = t.Payload.Tag.Timestamp
+	bs[8] = byte(tmp64 >> 56)
+	bs[9] = byte(tmp64 >> 48)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 32)
+	bs[12] = byte(tmp64 >> 24)
+	bs[13] = byte(tmp64 >> 16)
+	bs[14] = byte(tmp64 >> 8)
+	bs[15] = byte(tmp64)
+	tmp64 = t.Payload.Tag.ID
+	bs[16] = byte(tmp64 >> 56)
+	bs[17] = byte(tmp64 >> 48)
+	bs[18] = byte(tmp64 >> 40)
+	bs[19] = byte(tmp64 >> 32)
+	bs[20] = byte(tmp64 >> 24)
+	bs[21] = byte(tmp64 >> 16)
+	bs[22] = byte(tmp64 >> 8)
+	bs[23] = byte(tmp64)
+	tmp64 = t.Payload.Tag.RMWCount
+	bs[24] = byte(tmp64 >> 56)
+	bs[25] = byte(tmp64 >> 48)
+	bs[26] = byte(tmp64 >> 40)
+	bs[27] = byte(tmp64 >> 32)
+	bs[28] = byte(tmp64 >> 24)
+	bs[29] = byte(tmp64 >> 16)
+	bs[30] = byte(tmp64 >> 8)
+	bs[31] = byte(tmp64)
+	tmp64 = t.Payload.Value
+	bs[32] = byte(tmp64 >> 56)
+	bs[33] = byte(tmp64 >> 48)
+	bs[34] = byte(tmp64 >> 40)
+	bs[35] = byte(tmp64 >> 32)
+	bs[36] = byte(tmp64 >> 24)
+	bs[37] = byte(tmp64 >> 16)
+	bs[38] = byte(tmp64 >> 8)
+	bs[39] = byte(tmp64)
+	tmp32 = t.CrtInstance
+	bs[40] = byte(tmp32 >> 24)
+	bs[41] = byte(tmp32 >> 16)
+	bs[42] = byte(tmp32 >> 8)
+	bs[43] = byte(tmp32)
+	bs[44] = byte(t.Committed)
+	wire.Write(bs)
 }
 
 func (t *PrepareReply) Unmarshal(rr io.Reader) error {
@@ -678,15 +781,16 @@ func (t *PrepareReply) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [10]byte
+	var b [45]byte
 	var bs []byte
-	bs = b[:9]
-	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
 		return err
 	}
-	t.Instance = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
-	t.OK = uint8(bs[4])
-	t.Ballot = int32(((uint32(bs[5]) << 24) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 8) | uint32(bs[8])))
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.OK = uint8(bs[8])
+	t.Ballot = int32(((uint32(bs[9]) << 24) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 8) | uint32(bs[12])))
 	alen1, err := binary.ReadVarint(wire)
 	if err != nil {
 		return err
@@ -695,6 +799,17 @@ func (t *PrepareReply) Unmarshal(rr io.Reader) error {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Unmarshal(wire)
 	}
+	bs = b[:45]
+	if _, err := io.ReadAtLeast(wire, bs, 45); err != nil {
+		return err
+	}
+	t.Key = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	t.Payload.Tag.Timestamp = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
+	t.Payload.Tag.ID = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
+	t.Payload.Tag.RMWCount = int(((uint64(bs[24]) << 56) | (uint64(bs[25]) << 48) | (uint64(bs[26]) << 40) | (uint64(bs[27]) << 32) | (uint64(bs[28]) << 24) | (uint64(bs[29]) << 16) | (uint64(bs[30]) << 8) | uint64(bs[31])))
+	t.Payload.Value = int(((uint64(bs[32]) << 56) | (uint64(bs[33]) << 48) | (uint64(bs[34]) << 40) | (uint64(bs[35]) << 32) | (uint64(bs[36]) << 24) | (uint64(bs[37]) << 16) | (uint64(bs[38]) << 8) | uint64(bs[39])))
+	t.CrtInstance = int32(((uint32(bs[40]) << 24) | (uint32(bs[41]) << 16) | (uint32(bs[42]) << 8) | uint32(bs[43])))
+	t.Committed = uint8(bs[44])
 	return nil
 }
 
@@ -702,7 +817,7 @@ func (t *Tag) New() fastrpc.Serializable {
 	return new(Tag)
 }
 func (t *Tag) BinarySize() (nbytes int, sizeKnown bool) {
-	return 16, true
+	return 24, true
 }
 
 type TagCache struct {
@@ -735,9 +850,9 @@ func (p *TagCache) Put(t *Tag) {
 	p.mu.Unlock()
 }
 func (t *Tag) Marshal(wire io.Writer) {
-	var b [16]byte
+	var b [24]byte
 	var bs []byte
-	bs = b[:16]
+	bs = b[:24]
 	tmp64 := t.Timestamp
 	bs[0] = byte(tmp64 >> 56)
 	bs[1] = byte(tmp64 >> 48)
@@ -756,18 +871,28 @@ func (t *Tag) Marshal(wire io.Writer) {
 	bs[13] = byte(tmp64 >> 16)
 	bs[14] = byte(tmp64 >> 8)
 	bs[15] = byte(tmp64)
+	tmp64 = t.RMWCount
+	bs[16] = byte(tmp64 >> 56)
+	bs[17] = byte(tmp64 >> 48)
+	bs[18] = byte(tmp64 >> 40)
+	bs[19] = byte(tmp64 >> 32)
+	bs[20] = byte(tmp64 >> 24)
+	bs[21] = byte(tmp64 >> 16)
+	bs[22] = byte(tmp64 >> 8)
+	bs[23] = byte(tmp64)
 	wire.Write(bs)
 }
 
 func (t *Tag) Unmarshal(wire io.Reader) error {
-	var b [16]byte
+	var b [24]byte
 	var bs []byte
-	bs = b[:16]
-	if _, err := io.ReadAtLeast(wire, bs, 16); err != nil {
+	bs = b[:24]
+	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
 		return err
 	}
 	t.Timestamp = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
 	t.ID = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
+	t.RMWCount = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
 	return nil
 }
 
@@ -881,7 +1006,7 @@ func (p *CommitCache) Put(t *Commit) {
 	p.mu.Unlock()
 }
 func (t *Commit) Marshal(wire io.Writer) {
-	var b [12]byte
+	var b [40]byte
 	var bs []byte
 	bs = b[:12]
 	tmp32 := t.LeaderId
@@ -908,6 +1033,52 @@ func (t *Commit) Marshal(wire io.Writer) {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Marshal(wire)
 	}
+	tmp64 := t.Key
+	bs[0] = byte(tmp64 >> 56)
+	bs[1] = byte(tmp64 >> 48)
+	bs[2] = byte(tmp64 >> 40)
+	bs[3] = byte(tmp64 >> 32)
+	bs[4] = byte(tmp64 >> 24)
+	bs[5] = byte(tmp64 >> 16)
+	bs[6] = byte(tmp64 >> 8)
+	bs[7] = byte(tmp64)
+	tmp64 = t.Payload.Tag.Timestamp
+	bs[8] = byte(tmp64 >> 56)
+	bs[9] = byte(tmp64 >> 48)
+	bs[10] = byte(tmp64 >> 40)
+	bs[11] = byte(tmp64 >> 32)
+	bs[12] = byte(tmp64 >> 24)
+	bs[13] = byte(tmp64 >> 16)
+	bs[14] = byte(tmp64 >> 8)
+	bs[15] = byte(tmp64)
+	tmp64 = t.Payload.Tag.ID
+	bs[16] = byte(tmp64 >> 56)
+	bs[17] = byte(tmp64 >> 48)
+	bs[18] = byte(tmp64 >> 40)
+	bs[19] = byte(tmp64 >> 32)
+	bs[20] = byte(tmp64 >> 24)
+	bs[21] = byte(tmp64 >> 16)
+	bs[22] = byte(tmp64 >> 8)
+	bs[23] = byte(tmp64)
+	tmp64 = t.Payload.Tag.RMWCount
+	bs[24] = byte(tmp64 >> 56)
+	bs[25] = byte(tmp64 >> 48)
+	bs[26] = byte(tmp64 >> 40)
+	bs[27] = byte(tmp64 >> 32)
+	bs[28] = byte(tmp64 >> 24)
+	bs[29] = byte(tmp64 >> 16)
+	bs[30] = byte(tmp64 >> 8)
+	bs[31] = byte(tmp64)
+	tmp64 = t.Payload.Value
+	bs[32] = byte(tmp64 >> 56)
+	bs[33] = byte(tmp64 >> 48)
+	bs[34] = byte(tmp64 >> 40)
+	bs[35] = byte(tmp64 >> 32)
+	bs[36] = byte(tmp64 >> 24)
+	bs[37] = byte(tmp64 >> 16)
+	bs[38] = byte(tmp64 >> 8)
+	bs[39] = byte(tmp64)
+	wire.Write(bs)
 }
 
 func (t *Commit) Unmarshal(rr io.Reader) error {
@@ -916,7 +1087,7 @@ func (t *Commit) Unmarshal(rr io.Reader) error {
 	if wire, ok = rr.(byteReader); !ok {
 		wire = bufio.NewReader(rr)
 	}
-	var b [12]byte
+	var b [40]byte
 	var bs []byte
 	bs = b[:12]
 	if _, err := io.ReadAtLeast(wire, bs, 12); err != nil {
@@ -933,6 +1104,15 @@ func (t *Commit) Unmarshal(rr io.Reader) error {
 	for i := int64(0); i < alen1; i++ {
 		t.Command[i].Unmarshal(wire)
 	}
+	bs = b[:40]
+	if _, err := io.ReadAtLeast(wire, bs, 40); err != nil {
+		return err
+	}
+	t.Key = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
+	t.Payload.Tag.Timestamp = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
+	t.Payload.Tag.ID = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
+	t.Payload.Tag.RMWCount = int(((uint64(bs[24]) << 56) | (uint64(bs[25]) << 48) | (uint64(bs[26]) << 40) | (uint64(bs[27]) << 32) | (uint64(bs[28]) << 24) | (uint64(bs[29]) << 16) | (uint64(bs[30]) << 8) | uint64(bs[31])))
+	t.Payload.Value = int(((uint64(bs[32]) << 56) | (uint64(bs[33]) << 48) | (uint64(bs[34]) << 40) | (uint64(bs[35]) << 32) | (uint64(bs[36]) << 24) | (uint64(bs[37]) << 16) | (uint64(bs[38]) << 8) | uint64(bs[39])))
 	return nil
 }
 
@@ -940,7 +1120,7 @@ func (t *Payload) New() fastrpc.Serializable {
 	return new(Payload)
 }
 func (t *Payload) BinarySize() (nbytes int, sizeKnown bool) {
-	return 24, true
+	return 32, true
 }
 
 type PayloadCache struct {
@@ -973,9 +1153,9 @@ func (p *PayloadCache) Put(t *Payload) {
 	p.mu.Unlock()
 }
 func (t *Payload) Marshal(wire io.Writer) {
-	var b [24]byte
+	var b [32]byte
 	var bs []byte
-	bs = b[:24]
+	bs = b[:32]
 	tmp64 := t.Tag.Timestamp
 	bs[0] = byte(tmp64 >> 56)
 	bs[1] = byte(tmp64 >> 48)
@@ -994,7 +1174,7 @@ func (t *Payload) Marshal(wire io.Writer) {
 	bs[13] = byte(tmp64 >> 16)
 	bs[14] = byte(tmp64 >> 8)
 	bs[15] = byte(tmp64)
-	tmp64 = t.Value
+	tmp64 = t.Tag.RMWCount
 	bs[16] = byte(tmp64 >> 56)
 	bs[17] = byte(tmp64 >> 48)
 	bs[18] = byte(tmp64 >> 40)
@@ -1003,19 +1183,29 @@ func (t *Payload) Marshal(wire io.Writer) {
 	bs[21] = byte(tmp64 >> 16)
 	bs[22] = byte(tmp64 >> 8)
 	bs[23] = byte(tmp64)
+	tmp64 = t.Value
+	bs[24] = byte(tmp64 >> 56)
+	bs[25] = byte(tmp64 >> 48)
+	bs[26] = byte(tmp64 >> 40)
+	bs[27] = byte(tmp64 >> 32)
+	bs[28] = byte(tmp64 >> 24)
+	bs[29] = byte(tmp64 >> 16)
+	bs[30] = byte(tmp64 >> 8)
+	bs[31] = byte(tmp64)
 	wire.Write(bs)
 }
 
 func (t *Payload) Unmarshal(wire io.Reader) error {
-	var b [24]byte
+	var b [32]byte
 	var bs []byte
-	bs = b[:24]
-	if _, err := io.ReadAtLeast(wire, bs, 24); err != nil {
+	bs = b[:32]
+	if _, err := io.ReadAtLeast(wire, bs, 32); err != nil {
 		return err
 	}
 	t.Tag.Timestamp = int(((uint64(bs[0]) << 56) | (uint64(bs[1]) << 48) | (uint64(bs[2]) << 40) | (uint64(bs[3]) << 32) | (uint64(bs[4]) << 24) | (uint64(bs[5]) << 16) | (uint64(bs[6]) << 8) | uint64(bs[7])))
 	t.Tag.ID = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
-	t.Value = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
+	t.Tag.RMWCount = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
+	t.Value = int(((uint64(bs[24]) << 56) | (uint64(bs[25]) << 48) | (uint64(bs[26]) << 40) | (uint64(bs[27]) << 32) | (uint64(bs[28]) << 24) | (uint64(bs[29]) << 16) | (uint64(bs[30]) << 8) | uint64(bs[31])))
 	return nil
 }
 
@@ -1115,7 +1305,7 @@ func (t *RMWGetReply) New() fastrpc.Serializable {
 	return new(RMWGetReply)
 }
 func (t *RMWGetReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 40, true
+	return 53, true
 }
 
 type RMWGetReplyCache struct {
@@ -1148,71 +1338,89 @@ func (p *RMWGetReplyCache) Put(t *RMWGetReply) {
 	p.mu.Unlock()
 }
 func (t *RMWGetReply) Marshal(wire io.Writer) {
-	var b [40]byte
+	var b [53]byte
 	var bs []byte
-	bs = b[:40]
-	tmp32 := t.Instance
+	bs = b[:53]
+	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32)
-	tmp32 = t.Ballot
+	tmp32 = t.Instance
 	bs[4] = byte(tmp32 >> 24)
 	bs[5] = byte(tmp32 >> 16)
 	bs[6] = byte(tmp32 >> 8)
 	bs[7] = byte(tmp32)
+	bs[8] = byte(t.OK)
+	tmp32 = t.Ballot
+	bs[9] = byte(tmp32 >> 24)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 8)
+	bs[12] = byte(tmp32)
 	tmp64 := t.Key
-	bs[8] = byte(tmp64 >> 56)
-	bs[9] = byte(tmp64 >> 48)
-	bs[10] = byte(tmp64 >> 40)
-	bs[11] = byte(tmp64 >> 32)
-	bs[12] = byte(tmp64 >> 24)
-	bs[13] = byte(tmp64 >> 16)
-	bs[14] = byte(tmp64 >> 8)
-	bs[15] = byte(tmp64)
+	bs[13] = byte(tmp64 >> 56)
+	bs[14] = byte(tmp64 >> 48)
+	bs[15] = byte(tmp64 >> 40)
+	bs[16] = byte(tmp64 >> 32)
+	bs[17] = byte(tmp64 >> 24)
+	bs[18] = byte(tmp64 >> 16)
+	bs[19] = byte(tmp64 >> 8)
+	bs[20] = byte(tmp64)
 	tmp64 = t.Payload.Tag.Timestamp
-	bs[16] = byte(tmp64 >> 56)
-	bs[17] = byte(tmp64 >> 48)
-	bs[18] = byte(tmp64 >> 40)
-	bs[19] = byte(tmp64 >> 32)
-	bs[20] = byte(tmp64 >> 24)
-	bs[21] = byte(tmp64 >> 16)
-	bs[22] = byte(tmp64 >> 8)
-	bs[23] = byte(tmp64)
+	bs[21] = byte(tmp64 >> 56)
+	bs[22] = byte(tmp64 >> 48)
+	bs[23] = byte(tmp64 >> 40)
+	bs[24] = byte(tmp64 >> 32)
+	bs[25] = byte(tmp64 >> 24)
+	bs[26] = byte(tmp64 >> 16)
+	bs[27] = byte(tmp64 >> 8)
+	bs[28] = byte(tmp64)
 	tmp64 = t.Payload.Tag.ID
-	bs[24] = byte(tmp64 >> 56)
-	bs[25] = byte(tmp64 >> 48)
-	bs[26] = byte(tmp64 >> 40)
-	bs[27] = byte(tmp64 >> 32)
-	bs[28] = byte(tmp64 >> 24)
-	bs[29] = byte(tmp64 >> 16)
-	bs[30] = byte(tmp64 >> 8)
-	bs[31] = byte(tmp64)
+	bs[29] = byte(tmp64 >> 56)
+	bs[30] = byte(tmp64 >> 48)
+	bs[31] = byte(tmp64 >> 40)
+	bs[32] = byte(tmp64 >> 32)
+	bs[33] = byte(tmp64 >> 24)
+	bs[34] = byte(tmp64 >> 16)
+	bs[35] = byte(tmp64 >> 8)
+	bs[36] = byte(tmp64)
+	tmp64 = t.Payload.Tag.RMWCount
+	bs[37] = byte(tmp64 >> 56)
+	bs[38] = byte(tmp64 >> 48)
+	bs[39] = byte(tmp64 >> 40)
+	bs[40] = byte(tmp64 >> 32)
+	bs[41] = byte(tmp64 >> 24)
+	bs[42] = byte(tmp64 >> 16)
+	bs[43] = byte(tmp64 >> 8)
+	bs[44] = byte(tmp64)
 	tmp64 = t.Payload.Value
-	bs[32] = byte(tmp64 >> 56)
-	bs[33] = byte(tmp64 >> 48)
-	bs[34] = byte(tmp64 >> 40)
-	bs[35] = byte(tmp64 >> 32)
-	bs[36] = byte(tmp64 >> 24)
-	bs[37] = byte(tmp64 >> 16)
-	bs[38] = byte(tmp64 >> 8)
-	bs[39] = byte(tmp64)
+	bs[45] = byte(tmp64 >> 56)
+	bs[46] = byte(tmp64 >> 48)
+	bs[47] = byte(tmp64 >> 40)
+	bs[48] = byte(tmp64 >> 32)
+	bs[49] = byte(tmp64 >> 24)
+	bs[50] = byte(tmp64 >> 16)
+	bs[51] = byte(tmp64 >> 8)
+	bs[52] = byte(tmp64)
 	wire.Write(bs)
 }
 
 func (t *RMWGetReply) Unmarshal(wire io.Reader) error {
-	var b [40]byte
+	var b [53]byte
 	var bs []byte
-	bs = b[:40]
-	if _, err := io.ReadAtLeast(wire, bs, 40); err != nil {
+	bs = b[:53]
+	if _, err := io.ReadAtLeast(wire, bs, 53); err != nil {
 		return err
 	}
-	t.Instance = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
-	t.Ballot = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
-	t.Key = int(((uint64(bs[8]) << 56) | (uint64(bs[9]) << 48) | (uint64(bs[10]) << 40) | (uint64(bs[11]) << 32) | (uint64(bs[12]) << 24) | (uint64(bs[13]) << 16) | (uint64(bs[14]) << 8) | uint64(bs[15])))
-	t.Payload.Tag.Timestamp = int(((uint64(bs[16]) << 56) | (uint64(bs[17]) << 48) | (uint64(bs[18]) << 40) | (uint64(bs[19]) << 32) | (uint64(bs[20]) << 24) | (uint64(bs[21]) << 16) | (uint64(bs[22]) << 8) | uint64(bs[23])))
-	t.Payload.Tag.ID = int(((uint64(bs[24]) << 56) | (uint64(bs[25]) << 48) | (uint64(bs[26]) << 40) | (uint64(bs[27]) << 32) | (uint64(bs[28]) << 24) | (uint64(bs[29]) << 16) | (uint64(bs[30]) << 8) | uint64(bs[31])))
-	t.Payload.Value = int(((uint64(bs[32]) << 56) | (uint64(bs[33]) << 48) | (uint64(bs[34]) << 40) | (uint64(bs[35]) << 32) | (uint64(bs[36]) << 24) | (uint64(bs[37]) << 16) | (uint64(bs[38]) << 8) | uint64(bs[39])))
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.OK = uint8(bs[8])
+	t.Ballot = int32(((uint32(bs[9]) << 24) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 8) | uint32(bs[12])))
+	t.Key = int(((uint64(bs[13]) << 56) | (uint64(bs[14]) << 48) | (uint64(bs[15]) << 40) | (uint64(bs[16]) << 32) | (uint64(bs[17]) << 24) | (uint64(bs[18]) << 16) | (uint64(bs[19]) << 8) | uint64(bs[20])))
+	t.Payload.Tag.Timestamp = int(((uint64(bs[21]) << 56) | (uint64(bs[22]) << 48) | (uint64(bs[23]) << 40) | (uint64(bs[24]) << 32) | (uint64(bs[25]) << 24) | (uint64(bs[26]) << 16) | (uint64(bs[27]) << 8) | uint64(bs[28])))
+	t.Payload.Tag.ID = int(((uint64(bs[29]) << 56) | (uint64(bs[30]) << 48) | (uint64(bs[31]) << 40) | (uint64(bs[32]) << 32) | (uint64(bs[33]) << 24) | (uint64(bs[34]) << 16) | (uint64(bs[35]) << 8) | uint64(bs[36])))
+	t.Payload.Tag.RMWCount = int(((uint64(bs[37]) << 56) | (uint64(bs[38]) << 48) | (uint64(bs[39]) << 40) | (uint64(bs[40]) << 32) | (uint64(bs[41]) << 24) | (uint64(bs[42]) << 16) | (uint64(bs[43]) << 8) | uint64(bs[44])))
+	t.Payload.Value = int(((uint64(bs[45]) << 56) | (uint64(bs[46]) << 48) | (uint64(bs[47]) << 40) | (uint64(bs[48]) << 32) | (uint64(bs[49]) << 24) | (uint64(bs[50]) << 16) | (uint64(bs[51]) << 8) | uint64(bs[52])))
 	return nil
 }
 
@@ -1220,7 +1428,7 @@ func (t *RMWSetReply) New() fastrpc.Serializable {
 	return new(RMWSetReply)
 }
 func (t *RMWSetReply) BinarySize() (nbytes int, sizeKnown bool) {
-	return 9, true
+	return 13, true
 }
 
 type RMWSetReplyCache struct {
@@ -1253,32 +1461,186 @@ func (p *RMWSetReplyCache) Put(t *RMWSetReply) {
 	p.mu.Unlock()
 }
 func (t *RMWSetReply) Marshal(wire io.Writer) {
-	var b [9]byte
+	var b [13]byte
 	var bs []byte
-	bs = b[:9]
-	tmp32 := t.Instance
+	bs = b[:13]
+	tmp32 := t.ReplicaID
 	bs[0] = byte(tmp32 >> 24)
 	bs[1] = byte(tmp32 >> 16)
 	bs[2] = byte(tmp32 >> 8)
 	bs[3] = byte(tmp32)
-	bs[4] = byte(t.OK)
+	tmp32 = t.Instance
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	bs[8] = byte(t.OK)
 	tmp32 = t.Ballot
-	bs[5] = byte(tmp32 >> 24)
-	bs[6] = byte(tmp32 >> 16)
-	bs[7] = byte(tmp32 >> 8)
-	bs[8] = byte(tmp32)
+	bs[9] = byte(tmp32 >> 24)
+	bs[10] = byte(tmp32 >> 16)
+	bs[11] = byte(tmp32 >> 8)
+	bs[12] = byte(tmp32)
 	wire.Write(bs)
 }
 
 func (t *RMWSetReply) Unmarshal(wire io.Reader) error {
-	var b [9]byte
+	var b [13]byte
 	var bs []byte
-	bs = b[:9]
-	if _, err := io.ReadAtLeast(wire, bs, 9); err != nil {
+	bs = b[:13]
+	if _, err := io.ReadAtLeast(wire, bs, 13); err != nil {
 		return err
 	}
-	t.Instance = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
-	t.OK = uint8(bs[4])
-	t.Ballot = int32(((uint32(bs[5]) << 24) | (uint32(bs[6]) << 16) | (uint32(bs[7]) << 8) | uint32(bs[8])))
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.Instance = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	t.OK = uint8(bs[8])
+	t.Ballot = int32(((uint32(bs[9]) << 24) | (uint32(bs[10]) << 16) | (uint32(bs[11]) << 8) | uint32(bs[12])))
+	return nil
+}
+func (t *CommitAck) New() fastrpc.Serializable {
+	return new(CommitAck)
+}
+func (t *CommitAck) BinarySize() (nbytes int, sizeKnown bool) {
+	return 8, true
+}
+
+type CommitAckCache struct {
+	mu    sync.Mutex
+	cache []*CommitAck
+}
+
+func NewCommitAckCache() *CommitAckCache {
+	c := &CommitAckCache{}
+	c.cache = make([]*CommitAck, 0)
+	return c
+}
+func (p *CommitAckCache) Get() *CommitAck {
+	var t *CommitAck
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CommitAck{}
+	}
+	return t
+}
+func (p *CommitAckCache) Put(t *CommitAck) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CommitAck) Marshal(wire io.Writer) {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.ReplicaID
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.DoneUpTo
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+}
+func (t *CommitAck) Unmarshal(wire io.Reader) error {
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.ReplicaID = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.DoneUpTo = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	return nil
+}
+func (t *CommitUpTo) New() fastrpc.Serializable {
+	return new(CommitUpTo)
+}
+func (t *CommitUpTo) BinarySize() (nbytes int, sizeKnown bool) {
+	return 0, false
+}
+
+type CommitUpToCache struct {
+	mu    sync.Mutex
+	cache []*CommitUpTo
+}
+
+func NewCommitUpToCache() *CommitUpToCache {
+	c := &CommitUpToCache{}
+	c.cache = make([]*CommitUpTo, 0)
+	return c
+}
+func (p *CommitUpToCache) Get() *CommitUpTo {
+	var t *CommitUpTo
+	p.mu.Lock()
+	if len(p.cache) > 0 {
+		t = p.cache[len(p.cache)-1]
+		p.cache = p.cache[0:(len(p.cache) - 1)]
+	}
+	p.mu.Unlock()
+	if t == nil {
+		t = &CommitUpTo{}
+	}
+	return t
+}
+func (p *CommitUpToCache) Put(t *CommitUpTo) {
+	p.mu.Lock()
+	p.cache = append(p.cache, t)
+	p.mu.Unlock()
+}
+func (t *CommitUpTo) Marshal(wire io.Writer) {
+	var b [10]byte
+	var bs []byte
+	bs = b[:8]
+	tmp32 := t.LeaderId
+	bs[0] = byte(tmp32 >> 24)
+	bs[1] = byte(tmp32 >> 16)
+	bs[2] = byte(tmp32 >> 8)
+	bs[3] = byte(tmp32)
+	tmp32 = t.UpTo
+	bs[4] = byte(tmp32 >> 24)
+	bs[5] = byte(tmp32 >> 16)
+	bs[6] = byte(tmp32 >> 8)
+	bs[7] = byte(tmp32)
+	wire.Write(bs)
+	bs = b[:]
+	alen1 := int64(len(t.State))
+	if wlen := binary.PutVarint(bs, alen1); wlen >= 0 {
+		wire.Write(b[0:wlen])
+	}
+	for i := int64(0); i < alen1; i++ {
+		t.State[i].Marshal(wire)
+	}
+}
+
+func (t *CommitUpTo) Unmarshal(rr io.Reader) error {
+	var wire byteReader
+	var ok bool
+	if wire, ok = rr.(byteReader); !ok {
+		wire = bufio.NewReader(rr)
+	}
+	var b [8]byte
+	var bs []byte
+	bs = b[:8]
+	if _, err := io.ReadAtLeast(wire, bs, 8); err != nil {
+		return err
+	}
+	t.LeaderId = int32(((uint32(bs[0]) << 24) | (uint32(bs[1]) << 16) | (uint32(bs[2]) << 8) | uint32(bs[3])))
+	t.UpTo = int32(((uint32(bs[4]) << 24) | (uint32(bs[5]) << 16) | (uint32(bs[6]) << 8) | uint32(bs[7])))
+	alen1, err := binary.ReadVarint(wire)
+	if err != nil {
+		return err
+	}
+	t.State = make([]state.Command, alen1)
+	for i := int64(0); i < alen1; i++ {
+		if err := t.State[i].Unmarshal(wire); err != nil {
+			return err
+		}
+	}
 	return nil
 }
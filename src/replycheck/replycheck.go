@@ -0,0 +1,90 @@
+// Package replycheck checks the replies a client thread gets against those it got before:
+// writes must return the value they wrote, RMWs the result of their operator applied to
+// the previous value, and an operation issued after another one completed must not
+// return an older tag.
+package replycheck
+
+import (
+	"log"
+	"time"
+
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/state"
+)
+
+// The tag (version) of a value returned by the replicas
+type Tag struct {
+	Timestamp int64
+	ID        int32
+	RMWCount  int32
+}
+
+// Compare two tags, returning true if a is older than b
+func (a Tag) OlderThan(b Tag) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	if a.ID != b.ID {
+		return a.ID < b.ID
+	}
+	return a.RMWCount < b.RMWCount
+}
+
+// The most recent value-tag pair a client thread has observed for a key
+type observation struct {
+	tag        Tag
+	value      state.Value
+	observedAt time.Time
+}
+
+// Checks the replies of one client thread. Not safe for concurrent use.
+type Checker struct {
+	observed   map[state.Key]*observation // The latest value-tag pair seen per key
+	Mismatches int                        // Replies that failed a value or tag check
+}
+
+func New() *Checker {
+	return &Checker{observed: make(map[state.Key]*observation)}
+}
+
+// Records the value-tag pair returned for cmd, sent at before and answered at after, and
+// checks it against what was observed before
+func (c *Checker) Check(cmd state.Command, reply *genericsmrproto.ProposeReplyTS, before time.Time, after time.Time) {
+	id := reply.CommandId
+	key := cmd.K
+	tag := Tag{reply.TagTimestamp, reply.TagID, reply.TagRMWCount}
+	if cmd.Op == state.PUT && reply.Value != cmd.V {
+		c.Mismatches++
+		log.Printf("Write %d on key %d returned value %d, expected %d\n", id, key, reply.Value, cmd.V)
+	} else if state.IsRMW(cmd.Op) && !cmd.Yields(reply.Previous, reply.Value) {
+		expected, _ := cmd.Modify(reply.Previous, true)
+		c.Mismatches++
+		log.Printf("RMW %d on key %d turned %d into %d, expected %d\n", id, key, reply.Previous, reply.Value, expected)
+	}
+
+	obs, present := c.observed[key]
+	if !present {
+		c.observed[key] = &observation{tag, reply.Value, after}
+		return
+	}
+	if before.After(obs.observedAt) && tag.OlderThan(obs.tag) {
+		c.Mismatches++
+		log.Printf("Operation %d on key %d returned tag %v, older than previously observed %v\n", id, key, tag, obs.tag)
+	} else if tag == obs.tag && reply.Value != obs.value {
+		c.Mismatches++
+		log.Printf("Operation %d on key %d returned value %d for tag %v, previously observed %d\n", id, key, reply.Value, tag, obs.value)
+	}
+	if obs.tag.OlderThan(tag) {
+		obs.tag = tag
+		obs.value = reply.Value
+		obs.observedAt = after
+	}
+}
+
+// Latest value observed for key, state.NIL if none was
+func (c *Checker) Latest(key state.Key) state.Value {
+	if obs, present := c.observed[key]; present {
+		return obs.value
+	}
+	return state.NIL
+}
@@ -14,6 +14,8 @@ import (
 	"syscall"
 	"time"
 
+	"pineapple/src/config"
+	"pineapple/src/genericsmr"
 	"pineapple/src/masterproto"
 	"pineapple/src/pineapple"
 )
@@ -29,6 +31,17 @@ var exec = flag.Bool("exec", false, "Execute commands.")
 var dreply = flag.Bool("dreply", true, "Reply to client only after command has been executed.")
 var beacon = flag.Bool("beacon", false, "Send beacons to other replicas to compare their relative speeds.")
 var durable = flag.Bool("durable", false, "Log to a stable store (i.e., a file in the current dir).")
+var timeout = flag.Int("timeout", 100, "Milliseconds an ABD or Paxos phase waits for replies before resending. Defaults to 100.")
+var retries = flag.Int("retries", 5, "Resends before a client request fails with an error reply. Defaults to 5.")
+var flush = flag.Bool("flush", true, "Flush messages to peers as soon as their queue drains; otherwise batch them for up to 2ms. Defaults to true.")
+var snapshot = flag.Int("snapshot", 30, "Seconds between snapshots of a durable replica, which let it delete older log segments (0 disables them). Defaults to 30.")
+var transport = flag.String("transport", "tcp", "How replicas and clients connect: tcp, or unix for Unix-domain sockets named after each replica's address. Defaults to tcp.")
+var sockDir = flag.String("sockdir", os.TempDir(), "Directory of the Unix-domain sockets.")
+var crc = flag.Bool("crc", false, "Protect every frame sent to peers and clients with a CRC32C checksum. Defaults to false.")
+var faults = flag.Bool("faults", false, "Inject the latency, loss and partitions set at /faults on the RPC port into the links this replica dials. Defaults to false.")
+var configFile = flag.String("config", "", "Cluster config file. Replaces -maddr, -mport, -addr and -port, and sets the options not given as flags.")
+var replicaID = flag.Int("id", -1, "This server's replica id in the -config file.")
+var faultConfig = flag.String("faultconfig", "", "JSON file of link faults to start with (implies -faults).")
 
 func main() {
 	flag.Parse()
@@ -47,19 +60,36 @@ func main() {
 		go catchKill(interrupt)
 	}
 
+	//listen for RPC on a different port (8070 by default)
+	rpcAddr := fmt.Sprintf(":%d", *portnum+1000)
+	var clientAddrs []string
+	if *configFile != "" {
+		rpcAddr, clientAddrs = applyConfig()
+	}
+
+	link, err := genericsmr.NewTransport(*transport, *sockDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *faults || *faultConfig != "" {
+		link = injectFaults(link)
+	}
+
 	log.Printf("Server starting on port %d\n", *portnum)
 
 	replicaId, nodeList := registerWithMaster(fmt.Sprintf("%s:%d", *masterAddr, *masterPort))
+	if *configFile != "" && replicaId != *replicaID {
+		log.Fatalf("The master gave replica id %d to %s:%d, which is replica %d in %s\n", replicaId, *myAddr, *portnum, *replicaID, *configFile)
+	}
 
 	if *doPineapple {
 		log.Println("Starting Pineapple replica...")
-		rep := pineapple.NewReplica(replicaId, nodeList, *exec, *dreply)
+		rep := pineapple.NewReplica(replicaId, nodeList, clientAddrs, *exec, *dreply, *durable, time.Duration(*timeout)*time.Millisecond, *retries, time.Duration(*snapshot)*time.Second, *flush, *crc, link)
 		rpc.Register(rep)
 	}
 
 	rpc.HandleHTTP()
-	//listen for RPC on a different port (8070 by default)
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", *portnum+1000))
+	l, err := net.Listen("tcp", rpcAddr)
 	if err != nil {
 		log.Fatal("listen error:", err)
 	}
@@ -67,6 +97,84 @@ func main() {
 	http.Serve(l, nil)
 }
 
+// Takes this server's addresses and the cluster's options from the config file, except for
+// the options set with flags. Returns where to listen for RPCs, and where clients reach
+// every replica.
+func applyConfig() (string, []string) {
+	cluster, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *replicaID < 0 || *replicaID >= len(cluster.Replicas) {
+		log.Fatalf("-id must be a replica id from %s, 0 to %d\n", *configFile, len(cluster.Replicas)-1)
+	}
+	me := cluster.Replicas[*replicaID]
+
+	*masterAddr, *masterPort, _ = config.SplitAddr(cluster.Master)
+	*myAddr, *portnum, _ = config.SplitAddr(me.Peer)
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	o := cluster.Options
+	if !set["exec"] {
+		*exec = o.Exec
+	}
+	if !set["dreply"] {
+		*dreply = o.Dreply
+	}
+	if !set["durable"] {
+		*durable = o.Durable
+	}
+	if !set["timeout"] {
+		*timeout = int(time.Duration(o.Timeout) / time.Millisecond)
+	}
+	if !set["retries"] {
+		*retries = o.Retries
+	}
+	if !set["flush"] {
+		*flush = o.Flush
+	}
+	if !set["snapshot"] {
+		*snapshot = int(time.Duration(o.Snapshot) / time.Second)
+	}
+	if !set["transport"] {
+		*transport = o.Transport
+	}
+	if !set["sockdir"] {
+		*sockDir = o.SockDir
+	}
+	if !set["crc"] {
+		*crc = o.Crc
+	}
+
+	log.Printf("Replica %d (%s, %s) from %s\n", me.Id, me.Name, me.Region, *configFile)
+	_, adminPort, _ := config.SplitAddr(me.Admin)
+	clientAddrs := make([]string, len(cluster.Replicas))
+	for i, r := range cluster.Replicas {
+		clientAddrs[i] = r.Client
+	}
+	return fmt.Sprintf(":%d", adminPort), clientAddrs
+}
+
+// Wraps link in a fault-injection transport controlled over HTTP
+func injectFaults(link genericsmr.Transport) genericsmr.Transport {
+	table := genericsmr.NewFaults()
+	if *faultConfig != "" {
+		f, err := os.Open(*faultConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = table.Load(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", *faultConfig, err)
+		}
+	}
+	http.Handle("/faults", table)
+	http.Handle("/faults/", table)
+	return genericsmr.NewFaultTransport(link, fmt.Sprintf("%s:%d", *myAddr, *portnum), table)
+}
+
 func registerWithMaster(masterAddr string) (int, []string) {
 	args := &masterproto.RegisterArgs{*myAddr, *portnum}
 	var reply masterproto.RegisterReply
@@ -75,6 +183,9 @@ func registerWithMaster(masterAddr string) (int, []string) {
 		mcli, err := rpc.DialHTTP("tcp", masterAddr)
 		if err == nil {
 			err = mcli.Call("Master.Register", args, &reply)
+			if _, refused := err.(rpc.ServerError); refused {
+				log.Fatal("The master refused to register this replica: ", err)
+			}
 			if err == nil && reply.Ready == true {
 				done = true
 				break
@@ -0,0 +1,77 @@
+package main
+
+// Runs the deterministic simulator over a range of seeds. A run that breaks a check prints
+// its seed; running again with that -seed replays it exactly.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"pineapple/src/simulator"
+)
+
+var defaults = simulator.DefaultConfig()
+
+var seed = flag.Int64("seed", 1, "Seed of the first run.")
+var runs = flag.Int("runs", 1, "Number of runs, with consecutive seeds.")
+var replicas = flag.Int("replicas", defaults.Replicas, "Replicas in the cluster.")
+var clients = flag.Int("clients", defaults.Clients, "Closed-loop clients.")
+var ops = flag.Int("ops", defaults.Ops, "Requests per client.")
+var keys = flag.Int("keys", defaults.Keys, "Number of distinct keys.")
+var writes = flag.Float64("writes", defaults.Writes, "Fraction of requests that are writes.")
+var rmws = flag.Float64("rmws", defaults.RMWs, "Fraction of requests that are RMWs (fetch-and-add). The rest are reads.")
+var minDelay = flag.Duration("mindelay", defaults.MinDelay, "Shortest one-way message delay.")
+var maxDelay = flag.Duration("maxdelay", defaults.MaxDelay, "Longest one-way message delay.")
+var drop = flag.Float64("drop", defaults.Drop, "Probability that a message is lost.")
+var dup = flag.Float64("dup", defaults.Duplicate, "Probability that a message is delivered twice.")
+var kills = flag.Float64("kills", defaults.Kills, "Replica crashes per second of virtual time (0 disables them).")
+var downtime = flag.Duration("downtime", defaults.Downtime, "Average time a crashed replica stays down.")
+var killLeader = flag.Bool("killleader", defaults.KillLeader, "Also crash the leader, which another replica then takes over from.")
+var durable = flag.Bool("durable", defaults.Durable, "Replicas log to a stable store and recover from it after a crash.")
+var verbose = flag.Bool("v", false, "Print every violation, not just the first.")
+var logs = flag.Bool("logs", false, "Show the replicas' log output.")
+
+func main() {
+	flag.Parse()
+	if !*logs {
+		log.SetOutput(io.Discard)
+	}
+
+	cfg := defaults
+	cfg.Replicas, cfg.Clients, cfg.Ops, cfg.Keys = *replicas, *clients, *ops, *keys
+	cfg.Writes, cfg.RMWs = *writes, *rmws
+	cfg.MinDelay, cfg.MaxDelay, cfg.Drop, cfg.Duplicate = *minDelay, *maxDelay, *drop, *dup
+	cfg.Kills, cfg.Downtime, cfg.KillLeader, cfg.Durable = *kills, *downtime, *killLeader, *durable
+
+	failed := 0
+	for i := 0; i < *runs; i++ {
+		cfg.Seed = *seed + int64(i)
+		start := time.Now()
+		res := simulator.Run(cfg)
+		fmt.Printf("seed %d: digest %016x, %v virtual in %v, %d events, %d ok, %d failed, %d timed out, %d crashes, %d violations\n",
+			res.Seed, res.Digest, res.Time, time.Since(start).Round(time.Millisecond), res.Events,
+			res.Completed, res.Failed, res.TimedOut, res.Crashes, len(res.Violations))
+
+		if len(res.Violations) == 0 {
+			continue
+		}
+		failed++
+		shown := res.Violations
+		if !*verbose && len(shown) > 1 {
+			shown = shown[:1]
+		}
+		for _, v := range shown {
+			fmt.Println("   ", v)
+		}
+		fmt.Printf("    replay with -seed %d\n", res.Seed)
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d of %d runs failed\n", failed, *runs)
+		os.Exit(1)
+	}
+}
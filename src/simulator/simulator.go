@@ -0,0 +1,651 @@
+// Package simulator runs a whole Pineapple cluster and its clients in one goroutine, on a
+// virtual clock and a virtual network, so that a run depends only on its seed.
+//
+// Replicas are built with pineapple.NewManualReplica and only act when the simulator
+// calls them. Everything that happens is an event in a queue ordered by virtual time:
+// message deliveries, clock ticks, client requests, crashes and restarts. The network
+// delays, drops and duplicates messages; the fate of each message is drawn from a hash of
+// the seed and the message itself, so it does not depend on the order in which a replica
+// happened to send a batch of messages (Go map iteration order varies between runs).
+package simulator
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"pineapple/src/genericsmr"
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/history"
+	"pineapple/src/pineapple"
+	"pineapple/src/state"
+)
+
+type Config struct {
+	Seed     int64
+	Replicas int
+	Clients  int     // closed-loop clients, each with one request in flight
+	Ops      int     // requests per client
+	Keys     int     // few keys make for many conflicts
+	Writes   float64 // fraction of requests that are PUTs
+	RMWs     float64 // fraction of requests that are RMWs (fetch-and-add), the rest are GETs
+
+	MinDelay  time.Duration // one-way message delay, drawn uniformly between the two
+	MaxDelay  time.Duration
+	Drop      float64 // probability that a message is lost
+	Duplicate float64 // probability that a message is delivered twice
+
+	Kills      float64       // replica crashes per second of virtual time
+	Downtime   time.Duration // average time a crashed replica stays down
+	KillLeader bool          // may crash the leader, which makes the lowest live replica take over
+	Durable    bool          // replicas keep a stable store and recover from it after a crash
+
+	Tick          time.Duration // period of each replica's clock
+	Timeout       time.Duration // phase timeout of the replicas
+	Retries       int
+	ClientTimeout time.Duration // a client gives up on a request after this long
+	MaxTime       time.Duration // virtual time after which the run stops
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Seed:     1,
+		Replicas: 3,
+		Clients:  4,
+		Ops:      200,
+		Keys:     5,
+		Writes:   0.4,
+		RMWs:     0.2,
+
+		MinDelay:  100 * time.Microsecond,
+		MaxDelay:  5 * time.Millisecond,
+		Drop:      0.01,
+		Duplicate: 0.01,
+
+		Kills:    0.5,
+		Downtime: 300 * time.Millisecond,
+		Durable:  true,
+
+		Tick:          time.Millisecond,
+		Timeout:       100 * time.Millisecond,
+		Retries:       5,
+		ClientTimeout: 2 * time.Second,
+		MaxTime:       time.Minute,
+	}
+}
+
+// One client request and what came of it
+type Op struct {
+	Client   int
+	Id       int32
+	Command  state.Command
+	Replica  int32
+	Invoke   time.Duration // virtual time the request was sent
+	Response time.Duration // virtual time the reply arrived
+	Done     bool          // a reply arrived
+	TimedOut bool          // the client moved on without a reply
+	Reply    genericsmrproto.ProposeReplyTS
+}
+
+type Result struct {
+	Seed       int64
+	Time       time.Duration // virtual time the run took
+	Events     int
+	Digest     uint64 // hash of every event handled; equal for every run of a seed
+	Completed  int    // requests answered with OK
+	Failed     int    // requests answered with an error
+	TimedOut   int    // requests never answered
+	Crashes    int
+	Violations []string
+	History    []*Op
+}
+
+// Kinds of events, in the order they are handled when due at the same time
+const (
+	evCrash = iota
+	evRestart
+	evTakeOver
+	evDeliver
+	evReply
+	evTimeouts
+	evTick
+	evRequest
+	evClientTimeout
+)
+
+type event struct {
+	at      time.Duration
+	kind    int
+	replica int32 // destination of a delivery, or the replica the event is about
+	from    int32 // sender of a delivery
+	client  int
+	frame   []byte
+	key     uint64 // orders events that are otherwise alike
+	seq     uint64
+	inc     [2]int // incarnations of the destination and the sender when a message was sent
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	a, b := q[i], q[j]
+	if a.at != b.at {
+		return a.at < b.at
+	}
+	if a.kind != b.kind {
+		return a.kind < b.kind
+	}
+	if a.replica != b.replica {
+		return a.replica < b.replica
+	}
+	if a.from != b.from {
+		return a.from < b.from
+	}
+	if a.client != b.client {
+		return a.client < b.client
+	}
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	return a.seq < b.seq
+}
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+type client struct {
+	id      int
+	nextId  int32
+	pending *Op // request in flight
+	done    int // requests finished
+}
+
+type Simulator struct {
+	cfg   Config
+	rand  *rand.Rand // workload and crashes; drawn in event order
+	now   time.Duration
+	start time.Time
+	queue eventQueue
+	seq   uint64
+
+	replicas    []*pineapple.Replica
+	down        []bool
+	incarnation []int
+	leader      int32
+	storeDir    string
+
+	sent    map[[3]uint64]int // identical frames sent on a link at the current time
+	sentAt  time.Duration
+	clients []*client
+	ops     map[[2]int]*Op // by client and request id
+
+	result Result
+	digest uint64
+}
+
+// Runs one simulation to the end
+func Run(cfg Config) *Result {
+	s := &Simulator{
+		cfg:         cfg,
+		rand:        rand.New(rand.NewSource(cfg.Seed)),
+		start:       time.Unix(0, 0),
+		replicas:    make([]*pineapple.Replica, cfg.Replicas),
+		down:        make([]bool, cfg.Replicas),
+		incarnation: make([]int, cfg.Replicas),
+		sent:        make(map[[3]uint64]int),
+		ops:         make(map[[2]int]*Op),
+		digest:      14695981039346656037,
+	}
+	s.result.Seed = cfg.Seed
+
+	if cfg.Durable {
+		dir, err := os.MkdirTemp("", fmt.Sprintf("pineapple-sim-%d-", cfg.Seed))
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.storeDir = dir
+		defer os.RemoveAll(dir)
+	}
+
+	for i := range s.replicas {
+		s.startReplica(int32(i))
+		s.schedule(&event{at: cfg.Tick, kind: evTick, replica: int32(i)})
+		s.schedule(&event{at: cfg.Timeout / 4, kind: evTimeouts, replica: int32(i)})
+	}
+	for i := 0; i < cfg.Clients; i++ {
+		s.clients = append(s.clients, &client{id: i})
+		s.schedule(&event{kind: evRequest, client: i})
+	}
+	if cfg.Kills > 0 {
+		s.scheduleCrash()
+	}
+
+	for s.queue.Len() > 0 && s.now < cfg.MaxTime && !s.finished() {
+		e := heap.Pop(&s.queue).(*event)
+		s.now = e.at
+		s.record(e)
+		s.handle(e)
+	}
+
+	for _, r := range s.replicas {
+		if r != nil {
+			r.Stop()
+		}
+	}
+	s.result.Time = s.now
+	s.result.Digest = s.digest
+	s.check()
+	s.checkLinearizable()
+	return &s.result
+}
+
+func (s *Simulator) finished() bool {
+	for _, c := range s.clients {
+		if c.done < s.cfg.Ops {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Simulator) schedule(e *event) {
+	s.seq++
+	e.seq = s.seq
+	heap.Push(&s.queue, e)
+}
+
+// Folds an event into the digest of the run
+func (s *Simulator) record(e *event) {
+	s.result.Events++
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d %d %d %d %d %d|", s.digest, e.at, e.kind, e.replica, e.from, e.client)
+	h.Write(e.frame)
+	s.digest = h.Sum64()
+}
+
+func (s *Simulator) handle(e *event) {
+	switch e.kind {
+	case evTick:
+		if r := s.replicas[e.replica]; r != nil {
+			r.Tick()
+		}
+		s.schedule(&event{at: s.now + s.cfg.Tick, kind: evTick, replica: e.replica})
+
+	case evTimeouts:
+		if r := s.replicas[e.replica]; r != nil {
+			r.CheckTimeouts()
+		}
+		s.schedule(&event{at: s.now + s.cfg.Timeout/4, kind: evTimeouts, replica: e.replica})
+
+	case evDeliver:
+		// a crash breaks the connection, and whatever was in flight on it
+		if s.down[e.replica] || s.incarnation[e.replica] != e.inc[0] || s.incarnation[e.from] != e.inc[1] {
+			return
+		}
+		if err := s.replicas[e.replica].Receive(e.from, e.frame); err != nil {
+			s.violation("replica %d could not read a message from %d: %v", e.replica, e.from, err)
+		}
+
+	case evReply:
+		s.reply(s.clients[e.client], e.frame)
+
+	case evRequest:
+		s.request(s.clients[e.client])
+
+	case evClientTimeout:
+		c := s.clients[e.client]
+		if c.pending != nil && c.pending.Id == int32(e.key) {
+			c.pending.TimedOut = true
+			s.next(c)
+		}
+
+	case evCrash:
+		s.crash()
+		s.scheduleCrash()
+
+	case evRestart:
+		s.startReplica(e.replica)
+		for q, r := range s.replicas {
+			if r != nil && int32(q) != e.replica {
+				r.PeerChanged(e.replica, true)
+			}
+		}
+
+	case evTakeOver:
+		if !s.down[e.replica] {
+			s.leader = e.replica
+			s.replicas[e.replica].TakeOver()
+		}
+	}
+}
+
+func (s *Simulator) startReplica(id int32) {
+	store := ""
+	if s.storeDir != "" {
+		store = filepath.Join(s.storeDir, fmt.Sprintf("replica%d", id))
+	}
+	s.incarnation[id]++
+	s.down[id] = false
+	inc := s.incarnation[id]
+	s.replicas[id] = pineapple.NewManualReplica(int(id), s.cfg.Replicas, virtualClock{s},
+		func(to int32, frame []byte) { s.transmit(id, inc, to, frame) },
+		store, s.cfg.Timeout, s.cfg.Retries, 0)
+}
+
+// Decides the fate of a message. The draws come from the message itself, see the package comment.
+func (s *Simulator) transmit(from int32, inc int, to int32, frame []byte) {
+	if inc != s.incarnation[from] || s.down[from] {
+		return
+	}
+	if s.sentAt != s.now {
+		s.sent = make(map[[3]uint64]int)
+		s.sentAt = s.now
+	}
+	h := fnv.New64a()
+	h.Write(frame)
+	sum := h.Sum64()
+	link := [3]uint64{uint64(from), uint64(to), sum}
+	n := s.sent[link]
+	s.sent[link]++
+
+	draw := newSplitMix(uint64(s.cfg.Seed), uint64(s.now), uint64(from)<<32|uint64(to), sum, uint64(n))
+	if draw.float() < s.cfg.Drop {
+		return
+	}
+	copies := 1
+	if draw.float() < s.cfg.Duplicate {
+		copies = 2
+	}
+	for c := 0; c < copies; c++ {
+		delay := s.cfg.MinDelay + time.Duration(draw.next()%uint64(s.cfg.MaxDelay-s.cfg.MinDelay+1))
+		s.schedule(&event{at: s.now + delay, kind: evDeliver, replica: to, from: from, frame: frame,
+			key: sum + uint64(n)<<1 + uint64(c), inc: [2]int{s.incarnation[to], inc}})
+	}
+}
+
+// Crashes a random replica, keeping a majority up
+func (s *Simulator) crash() {
+	var candidates []int32
+	live := 0
+	for i := range s.replicas {
+		if s.down[i] {
+			continue
+		}
+		live++
+		if int32(i) != s.leader || s.cfg.KillLeader {
+			candidates = append(candidates, int32(i))
+		}
+	}
+	if live-1 <= s.cfg.Replicas/2 || len(candidates) == 0 {
+		return
+	}
+
+	victim := candidates[s.rand.Intn(len(candidates))]
+	s.replicas[victim].Stop()
+	s.replicas[victim] = nil
+	s.down[victim] = true
+	s.result.Crashes++
+	for _, r := range s.replicas {
+		if r != nil {
+			r.PeerChanged(victim, false)
+		}
+	}
+
+	downtime := s.cfg.Downtime/2 + time.Duration(s.rand.Int63n(int64(s.cfg.Downtime)+1))
+	s.schedule(&event{at: s.now + downtime, kind: evRestart, replica: victim})
+	if victim == s.leader {
+		for q := range s.replicas {
+			if !s.down[q] {
+				s.schedule(&event{at: s.now + s.cfg.Timeout, kind: evTakeOver, replica: int32(q)})
+				break
+			}
+		}
+	}
+}
+
+func (s *Simulator) scheduleCrash() {
+	gap := time.Duration(s.rand.ExpFloat64() / s.cfg.Kills * float64(time.Second))
+	s.schedule(&event{at: s.now + gap, kind: evCrash})
+}
+
+// Sends a client's next request. RMWs go to the leader, the rest to the client's own replica
+// or, while it is down, the next live one.
+func (s *Simulator) request(c *client) {
+	if c.done >= s.cfg.Ops {
+		return
+	}
+	cmd := state.Command{Op: state.GET, K: state.Key(s.rand.Intn(s.cfg.Keys))}
+	if x := s.rand.Float64(); x < s.cfg.Writes {
+		cmd.Op = state.PUT
+		cmd.V = state.Value(c.id+1)<<32 | state.Value(c.nextId)
+	} else if x < s.cfg.Writes+s.cfg.RMWs {
+		cmd.Op = state.FETCH_ADD
+		cmd.V = 1
+	}
+
+	target := int32(-1)
+	if state.IsRMW(cmd.Op) {
+		if !s.down[s.leader] {
+			target = s.leader
+		}
+	} else {
+		for i := 0; i < s.cfg.Replicas; i++ {
+			if q := (c.id + i) % s.cfg.Replicas; !s.down[q] {
+				target = int32(q)
+				break
+			}
+		}
+	}
+	if target < 0 {
+		// nobody to talk to, try again later
+		s.schedule(&event{at: s.now + s.cfg.Timeout, kind: evRequest, client: c.id})
+		return
+	}
+
+	op := &Op{Client: c.id, Id: c.nextId, Command: cmd, Replica: target, Invoke: s.now}
+	c.nextId++
+	c.pending = op
+	s.ops[[2]int{c.id, int(op.Id)}] = op
+	s.result.History = append(s.result.History, op)
+	s.schedule(&event{at: s.now + s.cfg.ClientTimeout, kind: evClientTimeout, client: c.id, key: uint64(op.Id)})
+
+	id := c.id
+	sink := genericsmr.NewReplySink(func(frame []byte) {
+		// handled as its own event, since a replica may answer several clients in map order
+		s.schedule(&event{at: s.now, kind: evReply, client: id, frame: frame})
+	})
+	s.replicas[target].Submit(&genericsmr.Propose{
+		Propose:   &genericsmrproto.Propose{CommandId: op.Id, Command: cmd},
+		Reply:     sink,
+		ReplyType: genericsmrproto.PROPOSE_REPLY})
+}
+
+func (s *Simulator) reply(c *client, frame []byte) {
+	_, reply, err := genericsmrproto.ReadClientReply(bytes.NewReader(frame))
+	if err != nil {
+		s.violation("client %d could not read a reply: %v", c.id, err)
+		return
+	}
+	op := s.ops[[2]int{c.id, int(reply.CommandId)}]
+	if op == nil {
+		s.violation("client %d got a reply for request %d it never sent", c.id, reply.CommandId)
+		return
+	}
+	if op.Done {
+		if reply.OK == TRUE && op.Reply.OK == TRUE && (reply.Value != op.Reply.Value ||
+			reply.TagTimestamp != op.Reply.TagTimestamp || reply.TagID != op.Reply.TagID || reply.TagRMWCount != op.Reply.TagRMWCount) {
+			s.violation("client %d got two different replies for request %d", c.id, reply.CommandId)
+		}
+		return
+	}
+	op.Done = true
+	op.Response = s.now
+	op.Reply = *reply
+	if c.pending == op {
+		s.next(c)
+	}
+}
+
+func (s *Simulator) next(c *client) {
+	c.pending = nil
+	c.done++
+	s.schedule(&event{at: s.now, kind: evRequest, client: c.id})
+}
+
+const TRUE = uint8(1)
+
+func (s *Simulator) violation(format string, args ...interface{}) {
+	s.result.Violations = append(s.result.Violations, fmt.Sprintf("%v: ", s.now)+fmt.Sprintf(format, args...))
+}
+
+type virtualClock struct {
+	s *Simulator
+}
+
+func (c virtualClock) Now() time.Time { return c.s.start.Add(c.s.now) }
+
+// Manual replicas never sleep
+func (c virtualClock) Sleep(d time.Duration) {}
+
+// Checks what the clients saw: writes return what they wrote, RMWs apply their operator
+// to the value they read, a tag always comes with the same value, and no request sees a
+// tag older than one a request that finished before it started saw.
+func (s *Simulator) check() {
+	byKey := make(map[state.Key][]*Op)
+	for _, op := range s.result.History {
+		switch {
+		case op.Done && op.Reply.OK == TRUE:
+			s.result.Completed++
+			byKey[op.Command.K] = append(byKey[op.Command.K], op)
+		case op.Done:
+			s.result.Failed++
+		default:
+			s.result.TimedOut++
+		}
+	}
+
+	keys := make([]state.Key, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, k := range keys {
+		ops := byKey[k]
+		values := make(map[[3]int64]state.Value)
+		for _, op := range ops {
+			tag := [3]int64{op.Reply.TagTimestamp, int64(op.Reply.TagID), int64(op.Reply.TagRMWCount)}
+			if op.Command.Op == state.PUT && op.Reply.Value != op.Command.V {
+				s.fail(op, "wrote %d but returned %d", op.Command.V, op.Reply.Value)
+			} else if state.IsRMW(op.Command.Op) && !op.Command.Yields(op.Reply.Previous, op.Reply.Value) {
+				expected, _ := op.Command.Modify(op.Reply.Previous, true)
+				s.fail(op, "turned %d into %d, expected %d", op.Reply.Previous, op.Reply.Value, expected)
+			}
+			if v, seen := values[tag]; seen && v != op.Reply.Value {
+				s.fail(op, "returned %d for tag %v, another request returned %d", op.Reply.Value, tag, v)
+			}
+			values[tag] = op.Reply.Value
+		}
+
+		// newest tag among the requests that finished before each request started
+		sort.Slice(ops, func(i, j int) bool { return ops[i].Response < ops[j].Response })
+		started := append([]*Op(nil), ops...)
+		sort.Slice(started, func(i, j int) bool { return started[i].Invoke < started[j].Invoke })
+		var newest *Op
+		j := 0
+		for _, op := range started {
+			for ; j < len(ops) && ops[j].Response < op.Invoke; j++ {
+				if newest == nil || olderTag(newest, ops[j]) {
+					newest = ops[j]
+				}
+			}
+			if newest == nil {
+				continue
+			}
+			if olderTag(op, newest) || (op.Command.Op != state.GET && !olderTag(newest, op)) {
+				s.fail(op, "returned tag (%d, %d, %d), not newer than (%d, %d, %d) of request %d/%d that finished before it started",
+					op.Reply.TagTimestamp, op.Reply.TagID, op.Reply.TagRMWCount,
+					newest.Reply.TagTimestamp, newest.Reply.TagID, newest.Reply.TagRMWCount, newest.Client, newest.Id)
+			}
+		}
+	}
+}
+
+// Runs the linearizability checker over the whole history. Requests without an OK reply
+// may or may not have taken effect.
+func (s *Simulator) checkLinearizable() {
+	ops := make([]*history.Op, 0, len(s.result.History))
+	for _, op := range s.result.History {
+		h := &history.Op{Client: op.Client, Id: op.Id, Command: op.Command, Invoke: int64(op.Invoke), Return: history.Pending}
+		if op.Done && op.Reply.OK == TRUE {
+			h.Return, h.Observed, h.Value, h.Previous = int64(op.Response), true, op.Reply.Value, op.Reply.Previous
+			h.TagTimestamp, h.TagID, h.TagRMWCount = op.Reply.TagTimestamp, op.Reply.TagID, op.Reply.TagRMWCount
+		}
+		ops = append(ops, h)
+	}
+
+	for _, res := range history.Check(ops) {
+		if res.Linearizable {
+			continue
+		}
+		v := fmt.Sprintf("key %d is not linearizable; counterexample of %d of its %d requests:", res.Key, len(res.Counterexample), res.Ops)
+		for _, op := range res.Counterexample {
+			v += "\n        " + op.Format(0)
+		}
+		s.result.Violations = append(s.result.Violations, v)
+	}
+}
+
+func olderTag(a *Op, b *Op) bool {
+	if a.Reply.TagTimestamp != b.Reply.TagTimestamp {
+		return a.Reply.TagTimestamp < b.Reply.TagTimestamp
+	}
+	if a.Reply.TagID != b.Reply.TagID {
+		return a.Reply.TagID < b.Reply.TagID
+	}
+	return a.Reply.TagRMWCount < b.Reply.TagRMWCount
+}
+
+func (s *Simulator) fail(op *Op, format string, args ...interface{}) {
+	s.result.Violations = append(s.result.Violations, fmt.Sprintf("client %d request %d (%v on key %d, %v-%v at replica %d): ",
+		op.Client, op.Id, op.Command.Op, op.Command.K, op.Invoke, op.Response, op.Replica)+fmt.Sprintf(format, args...))
+}
+
+// Small deterministic generator seeded from a few numbers
+type splitMix struct {
+	state uint64
+}
+
+func newSplitMix(seeds ...uint64) *splitMix {
+	m := &splitMix{}
+	for _, x := range seeds {
+		m.state ^= x
+		m.next()
+	}
+	return m
+}
+
+func (m *splitMix) next() uint64 {
+	m.state += 0x9e3779b97f4a7c15
+	z := m.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (m *splitMix) float() float64 {
+	return float64(m.next()>>11) / (1 << 53)
+}
@@ -0,0 +1,58 @@
+package simulator
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard) // the replicas log every step
+	os.Exit(m.Run())
+}
+
+// Seeds that found bugs before, and a few of each kind of run
+func TestSeeds(t *testing.T) {
+	mixed := DefaultConfig()
+	mixed.Replicas, mixed.RMWs, mixed.Writes, mixed.Keys = 5, 0.6, 0.2, 2
+	mixed.Kills, mixed.Drop, mixed.Duplicate = 0, 0, 0
+
+	crashLeader := DefaultConfig()
+	crashLeader.KillLeader, crashLeader.Kills = true, 2
+
+	lossy := DefaultConfig()
+	lossy.Drop, lossy.Duplicate = 0.05, 0.05
+
+	for _, c := range []struct {
+		name  string
+		cfg   Config
+		seeds []int64
+	}{
+		{"defaults", DefaultConfig(), []int64{1, 2, 3}},
+		{"5 replicas, mostly RMWs on 2 keys", mixed, []int64{500, 512, 538, 545}},
+		{"leader crashes", crashLeader, []int64{10, 11}},
+		{"lossy network", lossy, []int64{300, 301}},
+	} {
+		for _, seed := range c.seeds {
+			cfg := c.cfg
+			cfg.Seed = seed
+			res := Run(cfg)
+			if len(res.Violations) > 0 {
+				t.Errorf("%s, seed %d: %d violations, the first:\n%s", c.name, seed, len(res.Violations), res.Violations[0])
+			}
+			if res.Completed == 0 {
+				t.Errorf("%s, seed %d: no request completed", c.name, seed)
+			}
+		}
+	}
+}
+
+// The digest is what makes a failing seed worth reporting
+func TestDeterministic(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Seed = 7
+	if a, b := Run(cfg), Run(cfg); a.Digest != b.Digest || a.Events != b.Events {
+		t.Errorf("two runs of seed 7: digests %016x and %016x, %d and %d events", a.Digest, b.Digest, a.Events, b.Events)
+	}
+}
@@ -0,0 +1,365 @@
+package stablestore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Every record is framed as [type][payload length][crc32 of type and payload][payload].
+// Lengths and checksums are little-endian uint32s.
+const HEADER_SIZE = 9
+
+// Anything longer is treated as a corrupt length field
+const MAX_RECORD_SIZE = 64 * 1024 * 1024
+const MAX_SNAPSHOT_SIZE = 1024 * 1024 * 1024
+
+// Record type of the single record in a snapshot file
+const SNAPSHOT_RECORD uint8 = 0
+
+var ErrCorrupt = errors.New("stablestore: corrupt record")
+
+// Append-only log of typed records, split into numbered segment files <base>.<seq>.log.
+// A snapshot <base>.<seq>.snap stands in for every segment numbered below seq.
+type Log struct {
+	base    string
+	segment uint64 // segment records are appended to
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64 // offset of the end of the last complete record in the segment
+}
+
+func (l *Log) segmentPath(seq uint64) string {
+	return fmt.Sprintf("%s.%d.log", l.base, seq)
+}
+
+func (l *Log) snapshotPath(seq uint64) string {
+	return fmt.Sprintf("%s.%d.snap", l.base, seq)
+}
+
+// Opens (or creates) the newest segment of the log at base without truncating it
+func Open(base string) (*Log, error) {
+	l := &Log{base: base}
+	segments, err := l.list(".log")
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		l.segment = 1
+		// a log from before segments existed becomes the first one
+		if _, err := os.Stat(base); err == nil {
+			if err := os.Rename(base, l.segmentPath(1)); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		l.segment = segments[len(segments)-1]
+	}
+	if err := l.openSegment(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) openSegment() error {
+	f, err := os.OpenFile(l.segmentPath(l.segment), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.writer = bufio.NewWriter(f)
+	l.size = info.Size()
+	return nil
+}
+
+// Sequence numbers of the files next to the log with the given suffix, in increasing order
+func (l *Log) list(suffix string) ([]uint64, error) {
+	paths, err := filepath.Glob(l.base + ".*" + suffix)
+	if err != nil {
+		return nil, err
+	}
+	seqs := make([]uint64, 0, len(paths))
+	for _, path := range paths {
+		middle := strings.TrimSuffix(strings.TrimPrefix(path, l.base+"."), suffix)
+		if seq, err := strconv.ParseUint(middle, 10, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func checksum(recType uint8, payload []byte) uint32 {
+	crc := crc32.Update(0, crc32.IEEETable, []byte{recType})
+	return crc32.Update(crc, crc32.IEEETable, payload)
+}
+
+func writeRecord(w io.Writer, recType uint8, payload []byte) error {
+	var h [HEADER_SIZE]byte
+	h[0] = recType
+	binary.LittleEndian.PutUint32(h[1:5], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(h[5:9], checksum(recType, payload))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Buffers a record; it is only on disk after Sync
+func (l *Log) Append(recType uint8, payload []byte) error {
+	if err := writeRecord(l.writer, recType, payload); err != nil {
+		return err
+	}
+	l.size += int64(HEADER_SIZE + len(payload))
+	return nil
+}
+
+// Flushes buffered records and fsyncs the file
+func (l *Log) Sync() error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Calls apply for every complete record in segment from and the ones after it, in order.
+// A torn or corrupt record at the tail of the newest segment (a crash in the middle of
+// a write) ends the replay and is cut off the file, so that new records are appended
+// after the last good one. Older segments were synced before the log moved past them,
+// so damage there is an error.
+func (l *Log) Replay(from uint64, apply func(recType uint8, payload []byte) error) error {
+	segments, err := l.list(".log")
+	if err != nil {
+		return err
+	}
+	for _, seq := range segments {
+		if seq < from || seq >= l.segment {
+			continue
+		}
+		f, err := os.Open(l.segmentPath(seq))
+		if err != nil {
+			return err
+		}
+		_, err = replayFile(f, apply)
+		f.Close()
+		if err == ErrCorrupt {
+			return fmt.Errorf("%w in segment %d", ErrCorrupt, seq)
+		} else if err != nil {
+			return err
+		}
+	}
+	if l.segment < from {
+		return nil
+	}
+
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	good, err := replayFile(l.file, apply)
+	if err == ErrCorrupt {
+		// torn tail: drop everything after the last good record
+		if err := l.file.Truncate(good); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	l.size = good
+	_, err = l.file.Seek(good, io.SeekStart)
+	return err
+}
+
+// Applies records from f until its end or a bad record, returns the offset after the last good one
+func replayFile(f *os.File, apply func(recType uint8, payload []byte) error) (int64, error) {
+	reader := bufio.NewReader(f)
+	good := int64(0)
+	for {
+		recType, payload, err := readRecord(reader, MAX_RECORD_SIZE)
+		if err == io.EOF {
+			return good, nil
+		}
+		if err != nil {
+			return good, err
+		}
+		if err := apply(recType, payload); err != nil {
+			return good, err
+		}
+		good += int64(HEADER_SIZE + len(payload))
+	}
+}
+
+func readRecord(reader *bufio.Reader, maxSize uint32) (uint8, []byte, error) {
+	var h [HEADER_SIZE]byte
+	if n, err := io.ReadFull(reader, h[:]); err != nil {
+		if n == 0 && err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, ErrCorrupt
+	}
+	length := binary.LittleEndian.Uint32(h[1:5])
+	if length > maxSize {
+		return 0, nil, ErrCorrupt
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, ErrCorrupt
+	}
+	if checksum(h[0], payload) != binary.LittleEndian.Uint32(h[5:9]) {
+		return 0, nil, ErrCorrupt
+	}
+	return h[0], payload, nil
+}
+
+// Size of the current segment in bytes, including buffered records
+func (l *Log) Size() int64 {
+	return l.size
+}
+
+// Number of the segment records are appended to
+func (l *Log) Segment() uint64 {
+	return l.segment
+}
+
+// Syncs the current segment and starts appending to a new one, returning its number.
+// Everything appended before the call is in older segments.
+func (l *Log) Rotate() (uint64, error) {
+	if err := l.Sync(); err != nil {
+		return 0, err
+	}
+	if err := l.file.Close(); err != nil {
+		return 0, err
+	}
+	l.segment++
+	if err := l.openSegment(); err != nil {
+		return 0, err
+	}
+	return l.segment, syncDir(l.base)
+}
+
+// Atomically writes a snapshot standing in for every segment numbered below seq:
+// the snapshot goes to a temporary file that is synced and then renamed into place.
+// Once the snapshot is durable the segments and snapshots it supersedes are deleted.
+func (l *Log) WriteSnapshot(seq uint64, payload []byte) error {
+	tmp := l.snapshotPath(seq) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(f)
+	if err := writeRecord(writer, SNAPSHOT_RECORD, payload); err != nil {
+		f.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.snapshotPath(seq)); err != nil {
+		return err
+	}
+	if err := syncDir(l.base); err != nil {
+		return err
+	}
+
+	return l.removeBefore(seq)
+}
+
+// Deletes segments and snapshots numbered below seq
+func (l *Log) removeBefore(seq uint64) error {
+	segments, err := l.list(".log")
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s < seq {
+			if err := os.Remove(l.segmentPath(s)); err != nil {
+				return err
+			}
+		}
+	}
+	snapshots, err := l.list(".snap")
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		if s < seq {
+			if err := os.Remove(l.snapshotPath(s)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the newest snapshot and the segment replay continues from.
+// Without a snapshot the payload is nil and replay starts from the first segment.
+func (l *Log) LoadSnapshot() (uint64, []byte, error) {
+	snapshots, err := l.list(".snap")
+	if err != nil || len(snapshots) == 0 {
+		return 0, nil, err
+	}
+	// the segments before it are gone, so there is nothing to fall back on
+	seq := snapshots[len(snapshots)-1]
+	f, err := os.Open(l.snapshotPath(seq))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	recType, payload, err := readRecord(bufio.NewReader(f), MAX_SNAPSHOT_SIZE)
+	if err != nil || recType != SNAPSHOT_RECORD {
+		return 0, nil, fmt.Errorf("%w in snapshot %d", ErrCorrupt, seq)
+	}
+	return seq, payload, nil
+}
+
+// Makes renames and newly created files in the log's directory durable
+func syncDir(base string) error {
+	dir, err := os.Open(filepath.Dir(base))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (l *Log) Close() error {
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	return l.file.Close()
+}
+
+// Closes the file without flushing, dropping the records buffered since the last Sync
+// the way a crash of the process would
+func (l *Log) Abandon() error {
+	return l.file.Close()
+}
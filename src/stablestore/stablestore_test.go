@@ -0,0 +1,236 @@
+package stablestore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type record struct {
+	recType uint8
+	payload string
+}
+
+func replay(t *testing.T, l *Log, from uint64) []record {
+	t.Helper()
+	var got []record
+	if err := l.Replay(from, func(recType uint8, payload []byte) error {
+		got = append(got, record{recType, string(payload)})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func appendAll(t *testing.T, l *Log, records ...record) {
+	t.Helper()
+	for _, r := range records {
+		if err := l.Append(r.recType, []byte(r.payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "replica0")
+	l, err := Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []record{{1, "ballot"}, {2, ""}, {3, "data"}}
+	appendAll(t, l, want...)
+	if err := l.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// buffered but never synced, as if the process died
+	appendAll(t, l, record{4, "lost"})
+	l.Abandon()
+
+	l, err = Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := replay(t, l, 0); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+}
+
+// A record torn or damaged by a crash is cut off, and new records go after the last good one
+func TestReplayTornTail(t *testing.T) {
+	for _, damage := range []func([]byte) []byte{
+		func(data []byte) []byte { return data[:len(data)-2] },
+		func(data []byte) []byte { data[len(data)-1] ^= 1; return data },
+	} {
+		base := filepath.Join(t.TempDir(), "replica0")
+		l, err := Open(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appendAll(t, l, record{1, "first"}, record{1, "second"})
+		l.Close()
+
+		path := l.segmentPath(l.Segment())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, damage(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		l, err = Open(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := replay(t, l, 0); !reflect.DeepEqual(got, []record{{1, "first"}}) {
+			t.Fatalf("replayed %v, want only the first record", got)
+		}
+		appendAll(t, l, record{2, "third"})
+		l.Close()
+
+		l, err = Open(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := replay(t, l, 0); !reflect.DeepEqual(got, []record{{1, "first"}, {2, "third"}}) {
+			t.Errorf("replayed %v after appending to a cut log", got)
+		}
+		if l.Size() != int64(2*HEADER_SIZE+len("first")+len("third")) {
+			t.Errorf("size %d after replaying a cut log", l.Size())
+		}
+		l.Close()
+	}
+}
+
+// Damage in a segment the log already moved past is not a torn tail
+func TestReplayCorruptOldSegment(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "replica0")
+	l, err := Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendAll(t, l, record{1, "old"})
+	old := l.Segment()
+	if _, err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := l.segmentPath(old)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = l.Replay(0, func(uint8, []byte) error { return nil })
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("replaying a corrupt older segment: %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "replica0")
+	l, err := Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq, payload, err := l.LoadSnapshot(); err != nil || payload != nil || seq != 0 {
+		t.Fatalf("LoadSnapshot of a new log = %d, %q, %v", seq, payload, err)
+	}
+
+	appendAll(t, l, record{1, "before"})
+	seq, err := l.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, l, record{1, "after"})
+	if err := l.WriteSnapshot(seq, []byte("state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(l.segmentPath(seq - 1)); !os.IsNotExist(err) {
+		t.Errorf("the segment the snapshot replaces is still there: %v", err)
+	}
+	if err := l.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l, err = Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got, payload, err := l.LoadSnapshot()
+	if err != nil || got != seq || string(payload) != "state" {
+		t.Fatalf("LoadSnapshot = %d, %q, %v; want %d, \"state\"", got, payload, err, seq)
+	}
+	if records := replay(t, l, got); !reflect.DeepEqual(records, []record{{1, "after"}}) {
+		t.Errorf("replayed %v after the snapshot, want only the record after it", records)
+	}
+
+	// a later snapshot supersedes the earlier one
+	next, err := l.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WriteSnapshot(next, []byte(fmt.Sprint("state ", next))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(l.snapshotPath(seq)); !os.IsNotExist(err) {
+		t.Errorf("the older snapshot is still there: %v", err)
+	}
+}
+
+func TestCorruptSnapshot(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "replica0")
+	l, err := Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	seq, err := l.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WriteSnapshot(seq, []byte("state")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(l.snapshotPath(seq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	if err := os.WriteFile(l.snapshotPath(seq), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.LoadSnapshot(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("LoadSnapshot of a corrupt snapshot: %v", err)
+	}
+}
+
+// A log written before segments existed is picked up as the first segment
+func TestOpenUnsegmented(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "replica0")
+	var old bytes.Buffer
+	writeRecord(&old, 1, []byte("ballot"))
+	if err := os.WriteFile(base, old.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := replay(t, l, 0); l.Segment() != 1 || !reflect.DeepEqual(got, []record{{1, "ballot"}}) {
+		t.Errorf("replayed %v from segment %d", got, l.Segment())
+	}
+}
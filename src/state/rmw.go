@@ -0,0 +1,75 @@
+package state
+
+// Computes the new value of a key from its current value and the RMW command. written is
+// false while the key was never written, and so holds NIL.
+type RMWFunc func(current Value, written bool, cmd *Command) Value
+
+var rmwTable = map[Operation]RMWFunc{
+	// legacy RMW: increment by one
+	RMW: func(current Value, written bool, cmd *Command) Value {
+		return current + 1
+	},
+	FETCH_ADD: func(current Value, written bool, cmd *Command) Value {
+		return current + cmd.V
+	},
+	COMPARE_SWAP: func(current Value, written bool, cmd *Command) Value {
+		if current == cmd.E {
+			return cmd.V
+		}
+		return current
+	},
+	SWAP: func(current Value, written bool, cmd *Command) Value {
+		return cmd.V
+	},
+	FETCH_MAX: func(current Value, written bool, cmd *Command) Value {
+		if cmd.V > current {
+			return cmd.V
+		}
+		return current
+	},
+	FETCH_MIN: func(current Value, written bool, cmd *Command) Value {
+		if cmd.V < current {
+			return cmd.V
+		}
+		return current
+	},
+	COND_SET: func(current Value, written bool, cmd *Command) Value {
+		if !written {
+			return cmd.V
+		}
+		return current
+	},
+}
+
+// Registers (or replaces) the modify function used for an RMW operation.
+// Must be called before any replica starts handling proposals.
+func RegisterRMW(op Operation, f RMWFunc) {
+	rmwTable[op] = f
+}
+
+// Returns true if the operation is a registered RMW
+func IsRMW(op Operation) bool {
+	_, present := rmwTable[op]
+	return present
+}
+
+// Applies an RMW command to the current value of its key, returning the new value.
+// ok is false if the command's operation is not a registered RMW.
+func (c *Command) Modify(current Value, written bool) (newValue Value, ok bool) {
+	f, present := rmwTable[c.Op]
+	if !present {
+		return current, false
+	}
+	return f(current, written, c), true
+}
+
+// Reports whether the RMW command, applied to previous, can have given result. A reply
+// does not say whether the key was written before, and one that never was holds NIL, so
+// both are tried for NIL.
+func (c *Command) Yields(previous Value, result Value) bool {
+	if v, ok := c.Modify(previous, true); !ok || v == result {
+		return ok
+	}
+	v, _ := c.Modify(previous, false)
+	return previous == NIL && v == result
+}
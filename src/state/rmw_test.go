@@ -0,0 +1,76 @@
+package state
+
+import "testing"
+
+func TestModify(t *testing.T) {
+	tests := []struct {
+		cmd     Command
+		current Value
+		written bool
+		want    Value
+	}{
+		{Command{Op: RMW}, 4, true, 5},
+		{Command{Op: FETCH_ADD, V: 3}, 4, true, 7},
+		{Command{Op: COMPARE_SWAP, E: 4, V: 9}, 4, true, 9},
+		{Command{Op: COMPARE_SWAP, E: 5, V: 9}, 4, true, 4},
+		{Command{Op: SWAP, V: 9}, 4, true, 9},
+		{Command{Op: FETCH_MAX, V: 9}, 4, true, 9},
+		{Command{Op: FETCH_MAX, V: 2}, 4, true, 4},
+		{Command{Op: FETCH_MIN, V: 2}, 4, true, 2},
+		{Command{Op: FETCH_MIN, V: 9}, 4, true, 4},
+		{Command{Op: COND_SET, V: 7}, NIL, false, 7},
+		// a key that was written, even with NIL, holds a value
+		{Command{Op: COND_SET, V: 7}, NIL, true, NIL},
+		{Command{Op: COND_SET, V: 7}, 4, true, 4},
+	}
+	for _, test := range tests {
+		got, ok := test.cmd.Modify(test.current, test.written)
+		if !ok || got != test.want {
+			t.Errorf("op %d (V %d, E %d) on %d (written %v) = %d, %v; want %d, true",
+				test.cmd.Op, test.cmd.V, test.cmd.E, test.current, test.written, got, ok, test.want)
+		}
+	}
+}
+
+func TestModifyNotRMW(t *testing.T) {
+	for _, op := range []Operation{NONE, PUT, GET} {
+		cmd := Command{Op: op, V: 3}
+		if v, ok := cmd.Modify(4, true); ok || v != 4 {
+			t.Errorf("op %d = %d, %v; want 4, false", op, v, ok)
+		}
+	}
+}
+
+func TestYields(t *testing.T) {
+	condSet := Command{Op: COND_SET, V: 7}
+	if !condSet.Yields(NIL, 7) || !condSet.Yields(NIL, NIL) {
+		t.Error("COND_SET on NIL may or may not set, depending on whether the key was written")
+	}
+	if condSet.Yields(4, 7) {
+		t.Error("COND_SET set a key holding 4")
+	}
+	add := Command{Op: FETCH_ADD, V: 1}
+	if !add.Yields(4, 5) || add.Yields(4, 6) {
+		t.Error("FETCH_ADD(1) of 4 must give 5 and only 5")
+	}
+	put := Command{Op: PUT, V: 1}
+	if put.Yields(4, 1) {
+		t.Error("a PUT is not an RMW")
+	}
+}
+
+func TestRegisterRMW(t *testing.T) {
+	const DOUBLE Operation = 200
+	RegisterRMW(DOUBLE, func(current Value, written bool, cmd *Command) Value {
+		return 2 * current
+	})
+	defer delete(rmwTable, DOUBLE)
+
+	if !IsRMW(DOUBLE) {
+		t.Fatal("registered operation is not an RMW")
+	}
+	cmd := Command{Op: DOUBLE}
+	if v, ok := cmd.Modify(21, true); !ok || v != 42 {
+		t.Errorf("DOUBLE of 21 = %d, %v; want 42, true", v, ok)
+	}
+}
@@ -18,6 +18,12 @@ const (
 	DELETE
 	RLOCK
 	WLOCK
+	FETCH_ADD    // add V to the current value
+	COMPARE_SWAP // set V if the current value equals E
+	SWAP         // set V unconditionally, returning the previous value
+	FETCH_MAX    // keep the larger of the current value and V
+	FETCH_MIN    // keep the smaller of the current value and V
+	COND_SET     // set V only if the key does not hold a value yet
 )
 
 type Value int64
@@ -30,6 +36,7 @@ type Command struct {
 	Op Operation
 	K  Key
 	V  Value
+	E  Value // expected value, used by conditional RMWs
 }
 
 type State struct {
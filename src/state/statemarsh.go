@@ -16,6 +16,8 @@ func (t *Command) Marshal(w io.Writer) {
 	w.Write(bs)
 	binary.LittleEndian.PutUint64(bs, uint64(t.V))
 	w.Write(bs)
+	binary.LittleEndian.PutUint64(bs, uint64(t.E))
+	w.Write(bs)
 }
 
 func (t *Command) Unmarshal(r io.Reader) error {
@@ -35,6 +37,10 @@ func (t *Command) Unmarshal(r io.Reader) error {
 		return err
 	}
 	t.V = Value(binary.LittleEndian.Uint64(bs))
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return err
+	}
+	t.E = Value(binary.LittleEndian.Uint64(bs))
 	return nil
 }
 
@@ -0,0 +1,240 @@
+package main
+
+// Floods replica client connections with thousands of concurrent requests and checks
+// that every CommandId gets exactly one well-formed reply. Mixing ABD operations with
+// RMWs interleaves replies that finish in different phases on the same connection.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pineapple/src/config"
+	"pineapple/src/genericsmr"
+	"pineapple/src/genericsmrproto"
+	"pineapple/src/state"
+)
+
+var serverAddr *string = flag.String("saddr", "127.0.0.1", "Server address. Replicas other than the leader answer RMWs with NOT_LEADER.")
+var serverPort *int = flag.Int("sport", 7070, "Server port.")
+var transport = flag.String("transport", "tcp", "How to reach the replica: tcp or unix, as given to the server.")
+var sockDir = flag.String("sockdir", os.TempDir(), "Directory of the replicas' Unix-domain sockets.")
+var conns = flag.Int("conns", 4, "Client connections, each with its own requests in flight.")
+var inFlight = flag.Int("inflight", 5000, "Requests in flight per connection.")
+var requests = flag.Int("n", 50000, "Requests per connection.")
+var percentWrites = flag.Float64("writes", 0.4, "Fraction of requests that are writes.")
+var percentRMWs = flag.Float64("rmws", 0.2, "Fraction of requests that are RMWs (fetch-and-add). The rest are reads.")
+var percentReadMsgs = flag.Float64("readmsgs", 0, "Fraction of reads sent as READ messages instead of GET proposals.")
+var percentProposeAndRead = flag.Float64("par", 0, "Fraction of writes and RMWs sent as PROPOSE_AND_READ, which only the leader takes.")
+var crc = flag.Bool("crc", false, "Send requests with a CRC32C checksum.")
+var keys = flag.Int("keys", 1000, "Number of distinct keys.")
+var timeout = flag.Int("timeout", 60, "Seconds to wait for all replies.")
+var configFile = flag.String("config", "", "Cluster config file. Replaces -saddr and -sport, and sets -transport and -sockdir unless they are given.")
+var replicaID = flag.Int("replica", -1, "Replica of the -config file to stress. Defaults to the preferred leader.")
+
+// Takes the address of the replica to stress and how to reach it from the config file
+func applyConfig() {
+	cluster, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *replicaID < 0 {
+		*replicaID = cluster.Leaders[0]
+	}
+	if *replicaID >= len(cluster.Replicas) {
+		log.Fatalf("-replica must be a replica id from %s, 0 to %d\n", *configFile, len(cluster.Replicas)-1)
+	}
+	*serverAddr, *serverPort, _ = config.SplitAddr(cluster.Replicas[*replicaID].Client)
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["transport"] {
+		*transport = cluster.Options.Transport
+	}
+	if !set["sockdir"] {
+		*sockDir = cluster.Options.SockDir
+	}
+	if !set["crc"] {
+		*crc = cluster.Options.Crc
+	}
+}
+
+// What every connection sends
+type workload struct {
+	inFlight       int
+	requests       int
+	writes         float64
+	rmws           float64
+	readMsgs       float64
+	proposeAndRead float64
+	keys           int
+	crc            bool
+	timeout        time.Duration
+}
+
+func flagWorkload() workload {
+	return workload{*inFlight, *requests, *percentWrites, *percentRMWs, *percentReadMsgs, *percentProposeAndRead,
+		*keys, *crc, time.Duration(*timeout) * time.Second}
+}
+
+// Result of one connection
+type stats struct {
+	replies    int
+	failed     int // replies that were not OK
+	redirected int // NOT_LEADER replies
+	problems   int // unknown, duplicate or malformed replies
+	missing    int
+}
+
+func (s *stats) add(o stats) {
+	s.replies += o.replies
+	s.failed += o.failed
+	s.redirected += o.redirected
+	s.problems += o.problems
+	s.missing += o.missing
+}
+
+func main() {
+	flag.Parse()
+	if *configFile != "" {
+		applyConfig()
+	}
+
+	link, err := genericsmr.NewTransport(*transport, *sockDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := flagWorkload()
+	results := make(chan stats, *conns)
+	start := time.Now()
+	for i := 0; i < *conns; i++ {
+		server, err := link.Dial(net.JoinHostPort(*serverAddr, strconv.Itoa(*serverPort)))
+		if err != nil {
+			log.Fatalf("Error connecting to replica %s:%d\n", *serverAddr, *serverPort)
+		}
+		go func(i int) {
+			results <- runConnection(i, server, w)
+		}(i)
+	}
+
+	var total stats
+	for i := 0; i < *conns; i++ {
+		total.add(<-results)
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("%d connections, %d replies (%d failed, %d redirected) in %v, %.0f replies/s; %d bad replies, %d missing\n",
+		*conns, total.replies, total.failed, total.redirected, elapsed, float64(total.replies)/elapsed.Seconds(), total.problems, total.missing)
+	if total.problems > 0 || total.missing > 0 {
+		os.Exit(1)
+	}
+}
+
+// Sends the workload on a connection to a replica and checks the replies, then closes it
+func runConnection(conn int, server net.Conn, w workload) stats {
+	defer server.Close()
+	var result stats
+	reader := bufio.NewReader(server)
+	if _, err := genericsmrproto.Handshake(server, reader, genericsmrproto.NewHello(genericsmrproto.ROLE_CLIENT, -1)); err != nil {
+		log.Printf("Connection %d: the replica refused the connection: %v\n", conn, err)
+		result.problems++
+		return result
+	}
+
+	var lock sync.Mutex
+	outstanding := make(map[int32]state.Command, w.inFlight)
+	slots := make(chan bool, w.inFlight)
+	done := make(chan bool)
+	var received int32
+
+	go func() {
+		for atomic.LoadInt32(&received) < int32(w.requests) {
+			replyType, reply, notLeader, err := genericsmrproto.ReadClientReplyOrRedirect(reader)
+			if err != nil {
+				log.Printf("Connection %d: error during unmarshaling: %v\n", conn, err)
+				result.problems++
+				break
+			}
+			lock.Lock()
+			cmd, ok := outstanding[reply.CommandId]
+			delete(outstanding, reply.CommandId)
+			lock.Unlock()
+
+			if !ok {
+				log.Printf("Connection %d: unexpected or duplicate reply for command %d\n", conn, reply.CommandId)
+				result.problems++
+				continue
+			}
+			if notLeader != nil {
+				result.redirected++
+			} else if reply.OK != genericsmrproto.REPLY_OK {
+				result.failed++
+			} else if cmd.Op == state.PUT && replyType == genericsmrproto.PROPOSE_REPLY && reply.Value != cmd.V {
+				log.Printf("Connection %d: write %d returned value %d instead of %d\n", conn, reply.CommandId, reply.Value, cmd.V)
+				result.problems++
+			}
+			result.replies++
+			atomic.AddInt32(&received, 1)
+			<-slots
+		}
+		close(done)
+	}()
+
+	writer := bufio.NewWriter(server)
+	opRand := rand.New(rand.NewSource(int64(conn)))
+	args := genericsmrproto.Propose{}
+	for id := int32(0); id < int32(w.requests); id++ {
+		args.CommandId = id
+		args.Command = state.Command{Op: state.GET, K: state.Key(opRand.Intn(w.keys))}
+		if x := opRand.Float64(); x < w.writes {
+			args.Command.Op = state.PUT
+			args.Command.V = state.Value(int64(conn)<<32 | int64(id))
+		} else if x < w.writes+w.rmws {
+			args.Command.Op = state.FETCH_ADD
+			args.Command.V = 1
+		}
+
+		lock.Lock()
+		outstanding[id] = args.Command
+		lock.Unlock()
+
+		select {
+		case slots <- true:
+		default:
+			// window full: push out what is buffered, then wait for a reply
+			writer.Flush()
+			slots <- true
+		}
+		if args.Command.Op == state.GET && opRand.Float64() < w.readMsgs {
+			read := genericsmrproto.Read{CommandId: id, Key: args.Command.K}
+			genericsmrproto.WriteFrame(writer, genericsmrproto.READ, &read, w.crc)
+		} else if args.Command.Op != state.GET && opRand.Float64() < w.proposeAndRead {
+			pr := genericsmrproto.ProposeAndRead{CommandId: id, Command: args.Command, Key: args.Command.K + 1}
+			genericsmrproto.WriteFrame(writer, genericsmrproto.PROPOSE_AND_READ, &pr, w.crc)
+		} else {
+			genericsmrproto.WriteFrame(writer, genericsmrproto.PROPOSE, &args, w.crc)
+		}
+	}
+	writer.Flush()
+
+	select {
+	case <-done:
+	case <-time.After(w.timeout):
+		log.Printf("Connection %d: timed out\n", conn)
+		server.Close() // stops the reader
+		<-done
+	}
+
+	lock.Lock()
+	result.missing = len(outstanding)
+	lock.Unlock()
+	return result
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"pineapple/src/genericsmr"
+	"pineapple/src/pineapple"
+)
+
+// Dials addr until the replica there listens, which it does once its Run loop started
+func dialMem(t *testing.T, transport *genericsmr.MemTransport, addr string) net.Conn {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		server, err := transport.Dial(addr)
+		if err == nil {
+			return server
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cannot connect to %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Thousands of requests in flight on every connection of every replica of a cluster on
+// MemTransport. Each CommandId must get exactly one OK reply, except RMWs sent to
+// followers, which must be redirected to the leader.
+func TestStressMemCluster(t *testing.T) {
+	const replicas = 3
+	const connsPerReplica = 4
+	w := workload{inFlight: 2000, requests: 5000, writes: 0.4, rmws: 0.2, readMsgs: 0.2, proposeAndRead: 0.1,
+		keys: 100, crc: true, timeout: 60 * time.Second}
+	if testing.Short() {
+		w.inFlight, w.requests = 500, 1000
+	}
+
+	transport := genericsmr.NewMemTransport()
+	var addrs []string
+	for i := 0; i < replicas; i++ {
+		addrs = append(addrs, fmt.Sprintf("replica%d", i))
+	}
+	for i := 0; i < replicas; i++ {
+		pineapple.NewReplica(i, addrs, nil, true, true, false, 100*time.Millisecond, 5, 0, true, true, transport)
+	}
+
+	type result struct {
+		replica int
+		stats
+	}
+	results := make(chan result, replicas*connsPerReplica)
+	for r := 0; r < replicas; r++ {
+		for c := 0; c < connsPerReplica; c++ {
+			server := dialMem(t, transport, addrs[r])
+			go func(r int, conn int) {
+				results <- result{r, runConnection(conn, server, w)}
+			}(r, r*connsPerReplica+c)
+		}
+	}
+
+	var total stats
+	for i := 0; i < replicas*connsPerReplica; i++ {
+		res := <-results
+		if res.replica == 0 && res.redirected > 0 {
+			t.Errorf("the leader redirected %d requests", res.redirected)
+		}
+		total.add(res.stats)
+	}
+	t.Logf("%d replies, %d redirected", total.replies, total.redirected)
+	if total.problems > 0 || total.missing > 0 || total.failed > 0 {
+		t.Fatalf("%d bad replies, %d missing, %d failed", total.problems, total.missing, total.failed)
+	}
+	if want := replicas * connsPerReplica * w.requests; total.replies != want {
+		t.Fatalf("%d replies to %d requests", total.replies, want)
+	}
+}
@@ -49,11 +49,11 @@ else
   done
 
   if [ "$1" = "master" ]; then
-    bin/master -maddr "10.10.1.1" -N 5 &
+    bin/master -config cluster.json &
     sleep 0.5
   fi
 
-  bin/server -maddr "10.10.1.1" -mport 7087 -addr "$IP" -port $PORT &
+  bin/server -config cluster.json -id $ID &
   sleep 1.5
   . test.sh $IP $PORT $ID &
 fi
\ No newline at end of file